@@ -0,0 +1,431 @@
+/*
+   Copyright (c) 2022 Cyber Home Lab authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	core "cyberhomelab.com/core/core"
+	logging "cyberhomelab.com/core/logging"
+	storage "cyberhomelab.com/core/storage"
+)
+
+var log = logging.NewLogger()
+
+// MetadataSuffix is added to the archive path to get the metadata record
+const MetadataSuffix = ".json"
+
+type Job struct {
+	// Name is the first part of the archive names, "backup" when empty
+	Name string
+	// Node selects the Backup list from Nodes, the hostname is used when it
+	// is empty. Config is core.CoreConfig when it is nil
+	Node   string
+	Config *core.Config
+	// Paths are backed up together with the ones from the config, globs
+	// are expanded for both
+	Paths []string
+	// Destination is the directory of the archives and of their metadata
+	Destination string
+	// Options are used for the archive, the format is gzip compressed tar
+	// by default and the filters of the config are added for each path. The
+	// keys of the config are used when there is no Encryption
+	Options core.ArchiveOptions
+	// Catalog is updated with each backup, it is DefaultCatalogPath when
+	// empty
+	Catalog string
+	// Hooks run after the hooks of the job from the config
+	Hooks core.BackupHooks
+	// Targets receive a copy of each backup after the BackupTargets of the
+	// node, a target which fails is a warning
+	Targets []storage.Storage
+	// Retention prunes the older backups of the job from Destination and
+	// from the targets after a successful run when it isn't nil
+	Retention *RetentionPolicy
+}
+
+// Result is returned by Run and is written next to the archive as its
+// metadata record
+type Result struct {
+	Name         string             `json:"name"`
+	Node         string             `json:"node"`
+	Paths        []string           `json:"paths"`
+	Archive      string             `json:"archive"`
+	Files        []string           `json:"files"`
+	Format       core.ArchiveFormat `json:"format"`
+	Entries      int                `json:"entries"`
+	Bytes        int64              `json:"bytes"`
+	ArchiveBytes int64              `json:"archive_bytes"`
+	SHA256       string             `json:"sha256"`
+	Encrypted    bool               `json:"encrypted"`
+	Verified     bool               `json:"verified"`
+	Level        int                `json:"level"`
+	StartTime    time.Time          `json:"start_time"`
+	Duration     time.Duration      `json:"duration"`
+	Warnings     []string           `json:"warnings"`
+	// Pruned are the backups removed by the retention policy
+	Pruned []string `json:"pruned,omitempty"`
+}
+
+// MetadataPath returns the path of the metadata record of an archive
+func MetadataPath(archivePath string) string {
+	return archivePath + MetadataSuffix
+}
+
+func ReadMetadata(metadataPath string) (Result, error) {
+	var result Result
+	content, err := ioutil.ReadFile(metadataPath)
+	if err != nil {
+		return Result{}, fmt.Errorf("couldn't read metadata %s -> %s", metadataPath, err)
+	}
+	err = json.Unmarshal(content, &result)
+	if err != nil {
+		return Result{}, fmt.Errorf("couldn't decode metadata %s -> %s", metadataPath, err)
+	}
+	return result, nil
+}
+
+func writeMetadata(metadataPath string, result Result) error {
+	content, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return fmt.Errorf("couldn't encode the metadata -> %s", err)
+	}
+	return core.WriteFileAtomically(metadataPath, content, 0644)
+}
+
+// source is a path to back up and the entry of the Backup list it comes from,
+// the exclude patterns of the config belong to the entry
+type source struct {
+	path  string
+	entry string
+}
+
+// resolvePaths returns the paths of Common.Backup, of the node and of the
+// job with the globs expanded, the entries matching nothing are warnings
+func resolvePaths(config *core.Config, host core.Host, jobPaths []string) ([]source, []string, error) {
+	var sources []source
+	var warnings []string
+	seen := make(map[string]bool)
+	var entries []string
+	entries = append(entries, config.Common.Backup...)
+	entries = append(entries, host.Backup...)
+	entries = append(entries, jobPaths...)
+	for _, entry := range entries {
+		matches, err := filepath.Glob(entry)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid backup path %s -> %s", entry, err)
+		}
+		if len(matches) == 0 {
+			warnings = append(warnings, fmt.Sprintf("backup path %s doesn't match anything", entry))
+			continue
+		}
+		sort.Strings(matches)
+		for _, match := range matches {
+			match = filepath.Clean(match)
+			if seen[match] {
+				continue
+			}
+			seen[match] = true
+			sources = append(sources, source{path: match, entry: entry})
+		}
+	}
+	return sources, warnings, nil
+}
+
+// removeArchive deletes what was written for an archive which failed
+func removeArchive(archivePath string) {
+	volumePaths, _ := filepath.Glob(archivePath + ".[0-9][0-9][0-9]")
+	for _, filePath := range append(volumePaths, archivePath, core.VolumeIndexPath(archivePath)) {
+		os.Remove(filePath)
+	}
+}
+
+// encryptionOptions returns encryption when it is set and the keys of the
+// config otherwise
+func encryptionOptions(config *core.Config, encryption *core.EncryptionOptions) (*core.EncryptionOptions, error) {
+	if encryption != nil {
+		return encryption, nil
+	}
+	if config == nil {
+		config = &core.CoreConfig
+	}
+	return config.BackupEncryptionOptions()
+}
+
+// Run creates a timestamped archive of the Backup lists in the destination,
+// verifies it and writes its metadata record next to it
+func Run(ctx context.Context, job Job) (Result, error) {
+	startTime := time.Now().UTC()
+	config := job.Config
+	if config == nil {
+		config = &core.CoreConfig
+	}
+	if job.Name == "" {
+		job.Name = "backup"
+	}
+	if job.Node == "" {
+		job.Node = core.Hostname
+	}
+	if job.Catalog == "" {
+		job.Catalog = DefaultCatalogPath
+	}
+	if job.Options.Format == core.ArchiveFormatAuto {
+		job.Options.Format = core.ArchiveFormatTarGz
+	}
+	result := Result{Name: job.Name, Node: job.Node, Format: job.Options.Format, StartTime: startTime, Warnings: []string{}}
+	var err error
+	job.Options.Encryption, err = encryptionOptions(config, job.Options.Encryption)
+	if err != nil {
+		return result, err
+	}
+
+	// Paths
+	host, err := config.GetNode(job.Node)
+	if err != nil {
+		return result, err
+	}
+
+	// The pre hooks, then the backup, then the post hooks
+	hooks := mergeHooks(host.BackupHooks[job.Name], job.Hooks)
+	err = runHooks(ctx, "pre", hooks.Pre, hookEnvironment(job, result, nil), true)
+	if err == nil {
+		err = createBackup(ctx, job, config, host, &result)
+	}
+	if err == nil {
+		hookErr := runHooks(ctx, "post", hooks.Post, hookEnvironment(job, result, nil), false)
+		if hookErr != nil {
+			result.Warnings = append(result.Warnings, hookErr.Error())
+		}
+	}
+	// The always hooks clean up, they run even when ctx is done
+	hookErr := runHooks(context.Background(), "always", hooks.Always, hookEnvironment(job, result, err), false)
+	if hookErr != nil {
+		result.Warnings = append(result.Warnings, hookErr.Error())
+	}
+	return result, err
+}
+
+// mergeHooks returns the hooks of the config followed by the ones of the
+// job, in new slices so the config is never changed
+func mergeHooks(configHooks core.BackupHooks, jobHooks core.BackupHooks) core.BackupHooks {
+	return core.BackupHooks{
+		Pre:    append(append([]core.BackupHook{}, configHooks.Pre...), jobHooks.Pre...),
+		Post:   append(append([]core.BackupHook{}, configHooks.Post...), jobHooks.Post...),
+		Always: append(append([]core.BackupHook{}, configHooks.Always...), jobHooks.Always...),
+	}
+}
+
+// createBackup creates, verifies and records the archive of a job
+func createBackup(ctx context.Context, job Job, config *core.Config, host core.Host, result *Result) error {
+	sources, warnings, err := resolvePaths(config, host, job.Paths)
+	if err != nil {
+		return err
+	}
+	result.Warnings = append(result.Warnings, warnings...)
+	if len(sources) == 0 {
+		return fmt.Errorf("there is nothing to back up for node %s", job.Node)
+	}
+
+	// Filters from the config, the filters given in the options win
+	pathFilters := make(map[string]*core.Filter)
+	for path, filter := range job.Options.PathFilters {
+		pathFilters[path] = filter
+	}
+	for _, source := range sources {
+		result.Paths = append(result.Paths, source.path)
+		if _, found := pathFilters[source.path]; found || job.Options.Filter != nil {
+			continue
+		}
+		filter, err := core.NewFilter(config.BackupFilterOptions(host, source.entry))
+		if err != nil {
+			return fmt.Errorf("couldn't create the filter of %s -> %s", source.entry, err)
+		}
+		pathFilters[source.path] = filter
+	}
+	job.Options.PathFilters = pathFilters
+
+	// Archive
+	err = os.MkdirAll(job.Destination, core.DefaultMode)
+	if err != nil {
+		return fmt.Errorf("couldn't create directory %s -> %s", job.Destination, err)
+	}
+	archiveName := fmt.Sprintf("%s-%s-%s.%s", job.Name, strings.ToLower(job.Node), result.StartTime.Format("20060102T150405Z"), job.Options.Format)
+	if job.Options.Encryption != nil {
+		archiveName += core.EncryptedArchiveExtension
+		result.Encrypted = true
+	}
+	result.Archive = filepath.Join(job.Destination, archiveName)
+	log.Infof("Creating backup %s of %s", result.Archive, strings.Join(result.Paths, ", "))
+	job.Options.DeferSnapshot = true
+	archiveResult, err := core.CreateArchiveWithContext(ctx, result.Archive, result.Paths, job.Options)
+	if err != nil {
+		removeArchive(result.Archive)
+		return err
+	}
+	result.Files = archiveResult.Files
+	result.Entries = archiveResult.Entries
+	result.Bytes = archiveResult.Bytes
+	result.ArchiveBytes = archiveResult.ArchiveBytes
+	result.SHA256 = archiveResult.SHA256
+	result.Level = archiveResult.Level
+	result.Warnings = append(result.Warnings, archiveResult.Warnings...)
+
+	// Verify, an archive encrypted only for recipients can't be read here
+	encryption := job.Options.Encryption
+	if encryption != nil && len(encryption.Identities) == 0 && encryption.Passphrase == "" {
+		result.Warnings = append(result.Warnings, "the archive is encrypted without an identity, it wasn't verified")
+	} else {
+		_, err = core.VerifyArchiveWithOptions(result.Archive, core.InspectOptions{Encryption: encryption})
+		if err != nil {
+			return fmt.Errorf("couldn't verify backup %s -> %s", result.Archive, err)
+		}
+		result.Verified = true
+	}
+
+	// The next incremental backup starts from this one only once it is
+	// verified
+	if archiveResult.Snapshot != nil {
+		err = core.WriteSnapshot(job.Options.Snapshot, archiveResult.Snapshot)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Metadata
+	result.Duration = time.Since(result.StartTime)
+	err = writeMetadata(MetadataPath(result.Archive), *result)
+	if err != nil {
+		return err
+	}
+	for _, warning := range result.Warnings {
+		log.Warningf("Backup %s -> %s", result.Archive, warning)
+	}
+	log.Infof("Backup %s was created with %d entries (%s) in %s", result.Archive, result.Entries, core.FormatBytes(result.ArchiveBytes), result.Duration)
+
+	// Targets, catalog and retention
+	entry := newCatalogEntry(*result)
+	nodeTargets := openTargets(config, host, result)
+	defer closeTargets(nodeTargets)
+	targets := copyToTargets(ctx, job, append(nodeTargets, job.Targets...), entry, result)
+	for _, target := range targets {
+		entry.Locations = append(entry.Locations, locationOf(target))
+	}
+	err = updateCatalog(job.Catalog, func(catalog *Catalog) error {
+		catalog.add(entry)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if job.Retention != nil {
+		return prune(ctx, job, append([]storage.Storage{storage.NewLocal(job.Destination)}, targets...), result)
+	}
+	return nil
+}
+
+// openTargets builds the backup targets of the node, the ones which can't be
+// used are warnings
+func openTargets(config *core.Config, host core.Host, result *Result) []storage.Storage {
+	var targets []storage.Storage
+	for _, name := range host.BackupTargets {
+		target, err := storage.FromConfig(config, host, name)
+		if err != nil {
+			addWarning(result, fmt.Sprintf("couldn't use backup target %s -> %s", name, err))
+			continue
+		}
+		targets = append(targets, target)
+	}
+	return targets
+}
+
+// copyToTargets copies the files of a backup to the targets and returns the
+// ones which have the whole backup, the failures are warnings
+func copyToTargets(ctx context.Context, job Job, targets []storage.Storage, entry CatalogEntry, result *Result) []storage.Storage {
+	var copied []storage.Storage
+	for _, target := range targets {
+		var err error
+		for _, fileName := range entry.Files {
+			err = storage.PutFile(ctx, target, filepath.Join(job.Destination, fileName), fileName)
+			if err != nil {
+				break
+			}
+		}
+		if err != nil {
+			addWarning(result, fmt.Sprintf("couldn't copy the backup to %s -> %s", storage.String(target), err))
+			continue
+		}
+		copied = append(copied, target)
+	}
+	return copied
+}
+
+// closeTargets ends the connections opened for the targets
+func closeTargets(targets []storage.Storage) {
+	for _, target := range targets {
+		if closer, ok := target.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+}
+
+// prune applies the retention policy to each storage of a job, the first one
+// is Destination and its failure is an error, the others are warnings
+func prune(ctx context.Context, job Job, targets []storage.Storage, result *Result) error {
+	pruned := make(map[string]bool)
+	for k, target := range targets {
+		report, err := PruneStorage(ctx, target, job.Name, job.Node, *job.Retention, false)
+		if err != nil && k == 0 {
+			return err
+		}
+		if err != nil {
+			addWarning(result, err.Error())
+			continue
+		}
+		location := locationOf(target)
+		err = updateCatalog(job.Catalog, func(catalog *Catalog) error {
+			for _, backup := range report.Pruned() {
+				catalog.removeLocation(backup.Name, location)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, backup := range report.Pruned() {
+			if !pruned[backup.Name] {
+				pruned[backup.Name] = true
+				result.Pruned = append(result.Pruned, backup.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// addWarning is for the warnings found after the metadata was written
+func addWarning(result *Result, warning string) {
+	log.Warningf("Backup %s -> %s", result.Archive, warning)
+	result.Warnings = append(result.Warnings, warning)
+}
@@ -0,0 +1,194 @@
+/*
+   Copyright (c) 2022 Cyber Home Lab authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package backup
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	core "cyberhomelab.com/core/core"
+	storage "cyberhomelab.com/core/storage"
+
+	"gotest.tools/assert"
+)
+
+// createTestConfig returns a config backing up two directories under
+// directoryPath for all the nodes and one for Mars
+func createTestConfig(t *testing.T, directoryPath string) *core.Config {
+	for _, relativePath := range []string{"common1/a.txt", "common2/b.txt", "mars/c.txt", "mars/d.tmp"} {
+		filePath := filepath.Join(directoryPath, relativePath)
+		assert.NilError(t, os.MkdirAll(filepath.Dir(filePath), core.DefaultMode))
+		assert.NilError(t, core.WriteToFile(filePath, relativePath))
+	}
+	config := &core.Config{}
+	config.Common.Backup = []string{filepath.Join(directoryPath, "common*")}
+	marsPath := filepath.Join(directoryPath, "mars")
+	config.Nodes.Mars.Backup = []string{marsPath}
+	config.Nodes.Mars.BackupExclude = map[string][]string{marsPath: {"*.tmp"}}
+	return config
+}
+
+func TestRunHappyFlow(t *testing.T) {
+	directoryPath := filepath.Join(os.TempDir(), "TestBackupRunHappyFlow")
+	destinationPath := filepath.Join(os.TempDir(), "TestBackupRunHappyFlow_destination")
+	config := createTestConfig(t, directoryPath)
+
+	job := Job{
+		Node:        "Mars",
+		Config:      config,
+		Paths:       []string{filepath.Join(directoryPath, "missing*")},
+		Destination: destinationPath,
+		Catalog:     filepath.Join(destinationPath, CatalogFileName),
+	}
+	result, err := Run(context.Background(), job)
+	assert.NilError(t, err)
+	assert.Equal(t, len(result.Paths), 3)
+	assert.DeepEqual(t, result.Warnings, []string{"backup path " + job.Paths[0] + " doesn't match anything"})
+	assert.Assert(t, strings.HasPrefix(filepath.Base(result.Archive), "backup-mars-"))
+	assert.Assert(t, strings.HasSuffix(result.Archive, ".tar.gz"))
+	assert.Equal(t, result.Verified, true)
+	assert.Equal(t, result.Entries, 6)
+
+	// The exclude patterns of the config are used
+	entries, err := core.ListArchive(result.Archive)
+	assert.NilError(t, err)
+	for _, entry := range entries {
+		assert.Assert(t, !strings.HasSuffix(entry.Path, ".tmp"))
+	}
+
+	// Metadata
+	metadata, err := ReadMetadata(MetadataPath(result.Archive))
+	assert.NilError(t, err)
+	assert.Equal(t, metadata.SHA256, result.SHA256)
+	assert.DeepEqual(t, metadata.Files, []string{result.Archive})
+
+	// Cleanup
+	assert.NilError(t, core.Remove(directoryPath))
+	assert.NilError(t, core.Remove(destinationPath))
+}
+
+func TestRunEncrypted(t *testing.T) {
+	directoryPath := filepath.Join(os.TempDir(), "TestBackupRunEncrypted")
+	destinationPath := filepath.Join(os.TempDir(), "TestBackupRunEncrypted_destination")
+	config := createTestConfig(t, directoryPath)
+	_, recipient, err := core.GenerateEncryptionKey()
+	assert.NilError(t, err)
+
+	job := Job{Name: "encrypted", Node: "phobos", Config: config, Destination: destinationPath, Catalog: filepath.Join(destinationPath, CatalogFileName)}
+	job.Options.Encryption = &core.EncryptionOptions{Recipients: []string{recipient}}
+	result, err := Run(context.Background(), job)
+	assert.NilError(t, err)
+	assert.Assert(t, strings.HasSuffix(result.Archive, ".tar.gz"+core.EncryptedArchiveExtension))
+	assert.Equal(t, result.Encrypted, true)
+	assert.Equal(t, result.Verified, false)
+	assert.Equal(t, len(result.Warnings), 1)
+
+	// Cleanup
+	assert.NilError(t, core.Remove(directoryPath))
+	assert.NilError(t, core.Remove(destinationPath))
+}
+
+func TestRunNegativeFlow(t *testing.T) {
+	destinationPath := filepath.Join(os.TempDir(), "TestBackupRunNegativeFlow_destination")
+	config := &core.Config{}
+
+	_, err := Run(context.Background(), Job{Node: "Deimos", Config: config, Destination: destinationPath})
+	assert.ErrorContains(t, err, "node Deimos is not in the config")
+	_, err = Run(context.Background(), Job{Node: "Mars", Config: config, Destination: destinationPath})
+	assert.ErrorContains(t, err, "there is nothing to back up for node Mars")
+
+	// A cancelled backup doesn't leave an archive behind
+	directoryPath := filepath.Join(os.TempDir(), "TestBackupRunNegativeFlow")
+	config = createTestConfig(t, directoryPath)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = Run(ctx, Job{Node: "Mars", Config: config, Destination: destinationPath})
+	assert.ErrorContains(t, err, "context canceled")
+	files, err := os.ReadDir(destinationPath)
+	assert.NilError(t, err)
+	assert.Equal(t, len(files), 0)
+
+	// Cleanup
+	assert.NilError(t, core.Remove(directoryPath))
+	assert.NilError(t, core.Remove(destinationPath))
+}
+
+func TestRunWithTargets(t *testing.T) {
+	directoryPath := filepath.Join(os.TempDir(), "TestBackupRunWithTargets")
+	destinationPath := filepath.Join(os.TempDir(), "TestBackupRunWithTargets_destination")
+	usbPath := filepath.Join(os.TempDir(), "TestBackupRunWithTargets_usb")
+	otherPath := filepath.Join(os.TempDir(), "TestBackupRunWithTargets_other")
+	restorePath := filepath.Join(os.TempDir(), "TestBackupRunWithTargets_restore")
+	config := createTestConfig(t, directoryPath)
+	config.Nodes.Mars.BackupTargets = []string{usbPath, "usb"}
+	job := Job{
+		Node:        "Mars",
+		Config:      config,
+		Destination: destinationPath,
+		Catalog:     filepath.Join(directoryPath, CatalogFileName),
+		Targets:     []storage.Storage{storage.NewLocal(otherPath)},
+		Retention:   &RetentionPolicy{KeepLast: 1},
+	}
+
+	// The backup is copied to the targets which work
+	first, err := Run(context.Background(), job)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, first.Warnings, []string{"couldn't use backup target usb -> unknown backup target usb"})
+	catalog, err := ReadCatalog(job.Catalog)
+	assert.NilError(t, err)
+	assert.Equal(t, len(catalog.Backups), 1)
+	assert.DeepEqual(t, catalog.Backups[0].Locations, []Location{
+		{Storage: LocalStorage, Path: destinationPath},
+		{Storage: LocalStorage, Path: usbPath},
+		{Storage: LocalStorage, Path: otherPath},
+	})
+	backups, err := ListLocalBackups(usbPath, "backup", "Mars")
+	assert.NilError(t, err)
+	assert.Equal(t, len(backups), 1)
+	assert.Equal(t, len(backups[0].Files), 2)
+	assert.Equal(t, backups[0].Verified, true)
+
+	// The retention is applied to every target
+	time.Sleep(time.Second)
+	second, err := Run(context.Background(), job)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, second.Pruned, []string{backupID(first.Archive)})
+	for _, path := range []string{destinationPath, usbPath, otherPath} {
+		backups, err := ListLocalBackups(path, "backup", "Mars")
+		assert.NilError(t, err)
+		assert.Equal(t, len(backups), 1)
+		assert.Equal(t, backups[0].Name, backupID(second.Archive))
+	}
+	catalog, err = ReadCatalog(job.Catalog)
+	assert.NilError(t, err)
+	assert.Equal(t, len(catalog.Backups), 1)
+
+	// A copy is restored when the destination is gone
+	assert.NilError(t, core.Remove(destinationPath))
+	result, err := RestoreWithOptions(context.Background(), backupID(second.Archive), nil, restorePath, RestoreOptions{Catalog: job.Catalog})
+	assert.NilError(t, err)
+	assert.Equal(t, result.Restored, 3)
+
+	// Cleanup
+	for _, path := range []string{directoryPath, usbPath, otherPath, restorePath} {
+		assert.NilError(t, core.Remove(path))
+	}
+}
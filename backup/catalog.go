@@ -0,0 +1,319 @@
+/*
+   Copyright (c) 2022 Cyber Home Lab authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	core "cyberhomelab.com/core/core"
+	nextcloud "cyberhomelab.com/core/nextcloud"
+	storage "cyberhomelab.com/core/storage"
+)
+
+const CatalogFileName = "catalog.json"
+
+// DefaultCatalogPath is the catalog updated by the jobs which don't set one
+var DefaultCatalogPath = filepath.Join(core.ProjectPath, CatalogFileName)
+
+type StorageType string
+
+const (
+	LocalStorage     StorageType = storage.LocalType
+	NextcloudStorage StorageType = storage.NextcloudType
+	SFTPStorage      StorageType = storage.SFTPType
+)
+
+// Location is a directory holding the files of a backup, a local path, a
+// directory relative to the files of the Nextcloud user or user@host:path
+// for SFTP
+type Location struct {
+	Storage StorageType `json:"storage"`
+	Path    string      `json:"path"`
+}
+
+// locationOf returns the location of the backups stored at the root of
+// target
+func locationOf(target storage.Storage) Location {
+	return Location{Storage: StorageType(target.Type()), Path: target.Path()}
+}
+
+// CatalogEntry describes a backup, Archive and Files are names in each of
+// the locations
+type CatalogEntry struct {
+	ID           string             `json:"id"`
+	Name         string             `json:"name"`
+	Node         string             `json:"node"`
+	Paths        []string           `json:"paths"`
+	Archive      string             `json:"archive"`
+	Files        []string           `json:"files"`
+	Format       core.ArchiveFormat `json:"format"`
+	Level        int                `json:"level"`
+	Bytes        int64              `json:"bytes"`
+	ArchiveBytes int64              `json:"archive_bytes"`
+	SHA256       string             `json:"sha256"`
+	Encrypted    bool               `json:"encrypted"`
+	Verified     bool               `json:"verified"`
+	Time         time.Time          `json:"time"`
+	Locations    []Location         `json:"locations"`
+	// LastRestoreCheck is the result of the last CheckRestore of the backup
+	LastRestoreCheck *RestoreCheck `json:"last_restore_check,omitempty"`
+}
+
+// Catalog is the index of the backups, sorted from the oldest to the newest
+type Catalog struct {
+	Backups []CatalogEntry `json:"backups"`
+}
+
+// catalogMutex serialises the updates of the catalogs from this process
+var catalogMutex sync.Mutex
+
+// backupID returns the name shared by the files of a backup
+func backupID(archivePath string) string {
+	match := backupNamePattern.FindStringSubmatch(filepath.Base(archivePath))
+	if match == nil {
+		return filepath.Base(archivePath)
+	}
+	return match[1] + "-" + match[2]
+}
+
+// newCatalogEntry returns the entry of a backup created by Run
+func newCatalogEntry(result Result) CatalogEntry {
+	directoryPath, err := filepath.Abs(filepath.Dir(result.Archive))
+	if err != nil {
+		directoryPath = filepath.Dir(result.Archive)
+	}
+	entry := CatalogEntry{
+		ID:           backupID(result.Archive),
+		Name:         result.Name,
+		Node:         result.Node,
+		Paths:        result.Paths,
+		Archive:      filepath.Base(result.Archive),
+		Format:       result.Format,
+		Level:        result.Level,
+		Bytes:        result.Bytes,
+		ArchiveBytes: result.ArchiveBytes,
+		SHA256:       result.SHA256,
+		Encrypted:    result.Encrypted,
+		Verified:     result.Verified,
+		Time:         result.StartTime,
+		Locations:    []Location{{Storage: LocalStorage, Path: directoryPath}},
+	}
+	for _, filePath := range append(result.Files, MetadataPath(result.Archive)) {
+		entry.Files = append(entry.Files, filepath.Base(filePath))
+	}
+	return entry
+}
+
+// ReadCatalog returns an empty catalog when the file doesn't exist yet
+func ReadCatalog(catalogPath string) (*Catalog, error) {
+	catalog := &Catalog{}
+	content, err := ioutil.ReadFile(catalogPath)
+	if os.IsNotExist(err) {
+		return catalog, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read catalog %s -> %s", catalogPath, err)
+	}
+	err = json.Unmarshal(content, catalog)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't decode catalog %s -> %s", catalogPath, err)
+	}
+	return catalog, nil
+}
+
+func (c *Catalog) write(catalogPath string) error {
+	content, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return fmt.Errorf("couldn't encode the catalog -> %s", err)
+	}
+	err = os.MkdirAll(filepath.Dir(catalogPath), core.DefaultMode)
+	if err != nil {
+		return fmt.Errorf("couldn't create directory %s -> %s", filepath.Dir(catalogPath), err)
+	}
+	return core.WriteFileAtomically(catalogPath, content, 0644)
+}
+
+// updateCatalog reads the catalog, changes it with update and writes it back
+func updateCatalog(catalogPath string, update func(catalog *Catalog) error) error {
+	catalogMutex.Lock()
+	defer catalogMutex.Unlock()
+	catalog, err := ReadCatalog(catalogPath)
+	if err != nil {
+		return err
+	}
+	err = update(catalog)
+	if err != nil {
+		return err
+	}
+	return catalog.write(catalogPath)
+}
+
+func (c *Catalog) Find(id string) (CatalogEntry, bool) {
+	for _, entry := range c.Backups {
+		if entry.ID == id {
+			return entry, true
+		}
+	}
+	return CatalogEntry{}, false
+}
+
+// List returns the backups of a node containing path, newest first. An
+// empty node or path matches everything and a path matches the backups of
+// its parents and of its children
+func (c *Catalog) List(node string, path string) []CatalogEntry {
+	var entries []CatalogEntry
+	for _, entry := range c.Backups {
+		if node != "" && !strings.EqualFold(entry.Node, node) {
+			continue
+		}
+		if path != "" && !containsPath(entry.Paths, path) {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Time.After(entries[j].Time) })
+	return entries
+}
+
+func containsPath(paths []string, path string) bool {
+	path = filepath.Clean(path)
+	for _, backupPath := range paths {
+		backupPath = filepath.Clean(backupPath)
+		if path == backupPath || strings.HasPrefix(path, backupPath+string(filepath.Separator)) || strings.HasPrefix(backupPath, path+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// chain returns the backups needed to restore entry, from the full backup to
+// entry itself
+func (c *Catalog) chain(entry CatalogEntry) ([]CatalogEntry, error) {
+	chain := []CatalogEntry{entry}
+	level := entry.Level
+	for _, previous := range c.List(entry.Node, "") {
+		if level == 0 {
+			break
+		}
+		if previous.Name != entry.Name || !previous.Time.Before(entry.Time) || previous.Level >= level {
+			continue
+		}
+		chain = append([]CatalogEntry{previous}, chain...)
+		level = previous.Level
+	}
+	if level != 0 {
+		return nil, fmt.Errorf("the full backup of %s is not in the catalog", entry.ID)
+	}
+	return chain, nil
+}
+
+func (c *Catalog) add(entry CatalogEntry) {
+	c.remove(entry.ID)
+	c.Backups = append(c.Backups, entry)
+	sort.SliceStable(c.Backups, func(i, j int) bool { return c.Backups[i].Time.Before(c.Backups[j].Time) })
+}
+
+func (c *Catalog) remove(id string) {
+	var backups []CatalogEntry
+	for _, entry := range c.Backups {
+		if entry.ID != id {
+			backups = append(backups, entry)
+		}
+	}
+	c.Backups = backups
+}
+
+func (c *Catalog) addLocation(id string, location Location) {
+	for k := range c.Backups {
+		if c.Backups[k].ID != id {
+			continue
+		}
+		for _, current := range c.Backups[k].Locations {
+			if current == location {
+				return
+			}
+		}
+		c.Backups[k].Locations = append(c.Backups[k].Locations, location)
+	}
+}
+
+// removeLocation forgets a location of a backup, the backup is removed when
+// it was the last one
+func (c *Catalog) removeLocation(id string, location Location) {
+	for k := range c.Backups {
+		if c.Backups[k].ID != id {
+			continue
+		}
+		var locations []Location
+		for _, current := range c.Backups[k].Locations {
+			if current != location {
+				locations = append(locations, current)
+			}
+		}
+		c.Backups[k].Locations = locations
+		if len(locations) == 0 {
+			c.remove(id)
+		}
+		return
+	}
+}
+
+// CopyBackup copies the files of a backup from its local location to the
+// root of target and adds the location to the catalog
+func CopyBackup(ctx context.Context, target storage.Storage, catalogPath string, id string) error {
+	catalog, err := ReadCatalog(catalogPath)
+	if err != nil {
+		return err
+	}
+	entry, found := catalog.Find(id)
+	if !found {
+		return fmt.Errorf("backup %s is not in the catalog", id)
+	}
+	var localPath string
+	for _, location := range entry.Locations {
+		if location.Storage == LocalStorage {
+			localPath = location.Path
+		}
+	}
+	if localPath == "" {
+		return fmt.Errorf("backup %s isn't stored locally", id)
+	}
+	for _, fileName := range entry.Files {
+		err := storage.PutFile(ctx, target, filepath.Join(localPath, fileName), fileName)
+		if err != nil {
+			return fmt.Errorf("couldn't copy %s -> %s", fileName, err)
+		}
+	}
+	return updateCatalog(catalogPath, func(catalog *Catalog) error {
+		catalog.addLocation(id, locationOf(target))
+		return nil
+	})
+}
+
+// UploadBackup is CopyBackup for the upload directory of client
+func UploadBackup(ctx context.Context, client *nextcloud.Client, catalogPath string, id string) error {
+	return CopyBackup(ctx, storage.NewWebDAV(client), catalogPath, id)
+}
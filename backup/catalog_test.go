@@ -0,0 +1,106 @@
+/*
+   Copyright (c) 2022 Cyber Home Lab authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package backup
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	core "cyberhomelab.com/core/core"
+
+	"gotest.tools/assert"
+)
+
+func TestCatalogHappyFlow(t *testing.T) {
+	directoryPath := filepath.Join(os.TempDir(), "TestCatalogHappyFlow")
+	destinationPath := filepath.Join(os.TempDir(), "TestCatalogHappyFlow_destination")
+	catalogPath := filepath.Join(destinationPath, CatalogFileName)
+	config := createTestConfig(t, directoryPath)
+
+	// Each run adds its backup
+	job := Job{Name: "catalog", Node: "Mars", Config: config, Destination: destinationPath, Catalog: catalogPath}
+	job.Options.Snapshot = filepath.Join(destinationPath, "catalog.snapshot")
+	full, err := Run(context.Background(), job)
+	assert.NilError(t, err)
+	time.Sleep(time.Second)
+	incremental, err := Run(context.Background(), job)
+	assert.NilError(t, err)
+	catalog, err := ReadCatalog(catalogPath)
+	assert.NilError(t, err)
+	assert.Equal(t, len(catalog.Backups), 2)
+
+	entry, found := catalog.Find(backupID(incremental.Archive))
+	assert.Assert(t, found)
+	assert.Equal(t, entry.Level, 1)
+	assert.Equal(t, entry.SHA256, incremental.SHA256)
+	assert.DeepEqual(t, entry.Files, []string{filepath.Base(incremental.Archive), filepath.Base(MetadataPath(incremental.Archive))})
+	assert.DeepEqual(t, entry.Locations, []Location{{Storage: LocalStorage, Path: destinationPath}})
+
+	// Listing by node and path
+	assert.Equal(t, len(catalog.List("mars", "")), 2)
+	assert.Equal(t, catalog.List("mars", "")[0].ID, entry.ID)
+	assert.Equal(t, len(catalog.List("Mars", filepath.Join(directoryPath, "mars", "c.txt"))), 2)
+	assert.Equal(t, len(catalog.List("Mars", directoryPath)), 2)
+	assert.Equal(t, len(catalog.List("Mars", "/nothing")), 0)
+	assert.Equal(t, len(catalog.List("Phobos", "")), 0)
+
+	// The chain of the incremental backup starts with the full one
+	chain, err := catalog.chain(entry)
+	assert.NilError(t, err)
+	assert.Equal(t, len(chain), 2)
+	assert.Equal(t, chain[0].ID, backupID(full.Archive))
+
+	// Retention forgets the pruned backups
+	job.Options.Snapshot = ""
+	job.Retention = &RetentionPolicy{KeepLast: 1}
+	time.Sleep(time.Second)
+	last, err := Run(context.Background(), job)
+	assert.NilError(t, err)
+	assert.Equal(t, len(last.Pruned), 2)
+	catalog, err = ReadCatalog(catalogPath)
+	assert.NilError(t, err)
+	assert.Equal(t, len(catalog.Backups), 1)
+	assert.Equal(t, catalog.Backups[0].ID, backupID(last.Archive))
+
+	// Cleanup
+	assert.NilError(t, core.Remove(directoryPath))
+	assert.NilError(t, core.Remove(destinationPath))
+}
+
+func TestCatalogNegativeFlow(t *testing.T) {
+	catalogPath := filepath.Join(os.TempDir(), "TestCatalogNegativeFlow.json")
+
+	// A missing catalog is empty
+	catalog, err := ReadCatalog(catalogPath)
+	assert.NilError(t, err)
+	assert.Equal(t, len(catalog.Backups), 0)
+
+	// An incremental backup without its full backup can't be restored
+	catalog.add(CatalogEntry{ID: "incremental", Name: "job", Node: "mars", Level: 1, Time: time.Now()})
+	_, err = catalog.chain(catalog.Backups[0])
+	assert.ErrorContains(t, err, "the full backup of incremental is not in the catalog")
+
+	assert.NilError(t, core.WriteToFile(catalogPath, "{"))
+	_, err = ReadCatalog(catalogPath)
+	assert.ErrorContains(t, err, "couldn't decode catalog")
+
+	// Cleanup
+	assert.NilError(t, core.Remove(catalogPath))
+}
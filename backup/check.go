@@ -0,0 +1,413 @@
+/*
+   Copyright (c) 2022 Cyber Home Lab authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package backup
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	core "cyberhomelab.com/core/core"
+	nextcloud "cyberhomelab.com/core/nextcloud"
+	storage "cyberhomelab.com/core/storage"
+	telegram "cyberhomelab.com/core/telegram"
+)
+
+// DefaultRecentBackups is the number of newest backups a restore check picks
+// from
+const DefaultRecentBackups = 5
+
+// Notifier sends a message to the administrators, telegram.SendMessage is
+// one
+type Notifier func(message string) error
+
+type CheckOptions struct {
+	// Catalog is DefaultCatalogPath when it is empty
+	Catalog string
+	// Node and Name select the backups, all of them match when empty
+	Node string
+	Name string
+	// Recent is the number of newest backups to pick from, the one which
+	// wasn't checked for the longest time is picked
+	Recent int
+	// Paths restricts the restore to these names in the archive
+	Paths      []string
+	Nextcloud  *nextcloud.Client
+	Targets    []storage.Storage
+	Encryption *core.EncryptionOptions
+	// Config has the keys used when Encryption is nil, it is
+	// core.CoreConfig when it is nil
+	Config *core.Config
+	// WorkDirectory is where the backup is restored, os.TempDir() when empty
+	WorkDirectory string
+	// IgnoreOwnership keeps the owner of the user who runs the check
+	IgnoreOwnership bool
+	// CompareSource also compares the restored files with the live source,
+	// SourceFilters are applied to the source paths and the filters of the
+	// config of the node, like in Run, to the others
+	CompareSource bool
+	SourceFilters map[string]*core.Filter
+	// Notifier is told about the failures and the differences, it is
+	// telegram.SendMessage when nil
+	Notifier Notifier
+}
+
+// RestoreCheck is the result of a restore test, the last one of a backup is
+// kept in the catalog
+type RestoreCheck struct {
+	BackupId string        `json:"backup_id"`
+	Time     time.Time     `json:"time"`
+	Duration time.Duration `json:"duration"`
+	Success  bool          `json:"success"`
+	Error    string        `json:"error,omitempty"`
+	Files    int           `json:"files"`
+	// Differences with the live source, the source changes after the backup
+	// so they don't make the check fail
+	Differences []string `json:"differences,omitempty"`
+}
+
+// pickBackup returns the backup of the catalog which should be checked next
+func pickBackup(catalog *Catalog, options CheckOptions) (CatalogEntry, error) {
+	var candidates []CatalogEntry
+	for _, entry := range catalog.List(options.Node, "") {
+		if options.Name == "" || entry.Name == options.Name {
+			candidates = append(candidates, entry)
+		}
+	}
+	if len(candidates) == 0 {
+		return CatalogEntry{}, fmt.Errorf("there are no backups to check in the catalog")
+	}
+	if len(candidates) > options.Recent {
+		candidates = candidates[:options.Recent]
+	}
+	picked := candidates[0]
+	for _, candidate := range candidates {
+		if candidate.LastRestoreCheck == nil {
+			return candidate, nil
+		}
+		if candidate.LastRestoreCheck.Time.Before(picked.LastRestoreCheck.Time) {
+			picked = candidate
+		}
+	}
+	return picked, nil
+}
+
+// CheckRestore restores a recent backup to a temporary directory, compares
+// the files with the manifests of the archives and records the result in
+// the catalog
+func CheckRestore(ctx context.Context, options CheckOptions) (RestoreCheck, error) {
+	startTime := time.Now()
+	check := RestoreCheck{Time: startTime.UTC()}
+	if options.Catalog == "" {
+		options.Catalog = DefaultCatalogPath
+	}
+	if options.WorkDirectory == "" {
+		options.WorkDirectory = os.TempDir()
+	}
+	if options.Recent == 0 {
+		options.Recent = DefaultRecentBackups
+	}
+	if options.Notifier == nil {
+		options.Notifier = telegram.SendMessage
+	}
+	encryption, err := encryptionOptions(options.Config, options.Encryption)
+	if err != nil {
+		return check, reportCheckFailure(options, err)
+	}
+	options.Encryption = encryption
+	catalog, err := ReadCatalog(options.Catalog)
+	if err != nil {
+		return check, reportCheckFailure(options, err)
+	}
+	entry, err := pickBackup(catalog, options)
+	if err != nil {
+		return check, reportCheckFailure(options, err)
+	}
+	check.BackupId = entry.ID
+
+	// Restore and compare
+	log.Infof("Checking the restore of backup %s", entry.ID)
+	err = checkRestore(ctx, catalog, entry, options, &check)
+	check.Duration = time.Since(startTime)
+	check.Success = err == nil
+	if err != nil {
+		check.Error = err.Error()
+	}
+	if ctx.Err() != nil {
+		return check, ctx.Err()
+	}
+
+	// Record and report
+	recordErr := updateCatalog(options.Catalog, func(catalog *Catalog) error {
+		for k := range catalog.Backups {
+			if catalog.Backups[k].ID == entry.ID {
+				catalog.Backups[k].LastRestoreCheck = &check
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		err = fmt.Errorf("the restore check of backup %s failed -> %s", entry.ID, err)
+		if recordErr != nil {
+			err = fmt.Errorf("%s, and it couldn't be recorded -> %s", err, recordErr)
+		}
+		return check, reportCheckFailure(options, err)
+	}
+	if len(check.Differences) > 0 {
+		log.Warningf("Backup %s differs from the source in %d places", entry.ID, len(check.Differences))
+		notify(options.Notifier, fmt.Sprintf("Backup %s on %s differs from the source:\n%s", entry.ID, core.Hostname, strings.Join(check.Differences, "\n")))
+	}
+	if recordErr != nil {
+		return check, recordErr
+	}
+	log.Infof("The restore check of backup %s passed with %d files in %s", entry.ID, check.Files, check.Duration)
+	return check, nil
+}
+
+// reportCheckFailure logs and notifies err and returns it
+func reportCheckFailure(options CheckOptions, err error) error {
+	log.Errorf("Restore check -> %s", err)
+	notify(options.Notifier, fmt.Sprintf("Restore check on %s -> %s", core.Hostname, err))
+	return err
+}
+
+func notify(notifier Notifier, message string) {
+	if notifier == nil {
+		return
+	}
+	err := notifier(message)
+	if err != nil {
+		log.Errorf("Couldn't send the notification -> %s", err)
+	}
+}
+
+func checkRestore(ctx context.Context, catalog *Catalog, entry CatalogEntry, options CheckOptions, check *RestoreCheck) error {
+	workPath, err := os.MkdirTemp(options.WorkDirectory, "restore-check-")
+	if err != nil {
+		return fmt.Errorf("couldn't create the work directory -> %s", err)
+	}
+	defer os.RemoveAll(workPath)
+	restoreOptions := RestoreOptions{Nextcloud: options.Nextcloud, Targets: options.Targets, Encryption: options.Encryption}
+	_, archivePaths, err := fetchChain(ctx, catalog, entry.ID, workPath, restoreOptions)
+	if err != nil {
+		return err
+	}
+	restorePath := filepath.Join(workPath, "restore")
+	extractResult, err := core.ExtractArchiveChain(archivePaths, restorePath, core.ExtractOptions{Paths: options.Paths, Encryption: options.Encryption, IgnoreOwnership: options.IgnoreOwnership})
+	if err != nil {
+		return err
+	}
+	for _, warning := range extractResult.Warnings {
+		log.Warningf("Backup %s -> %s", entry.ID, warning)
+	}
+
+	// The manifests, the newest hash of a name wins
+	hashes := make(map[string]string)
+	var lastManifest map[string]string
+	for _, archivePath := range archivePaths {
+		manifest, err := core.ReadManifest(archivePath, core.InspectOptions{Encryption: options.Encryption})
+		if err != nil {
+			return err
+		}
+		if manifest == nil {
+			return fmt.Errorf("archive %s has no manifest", filepath.Base(archivePath))
+		}
+		for name, hash := range manifest {
+			hashes[name] = hash
+		}
+		lastManifest = manifest
+	}
+	err = filepath.WalkDir(restorePath, func(path string, dirEntry fs.DirEntry, err error) error {
+		if err != nil || !dirEntry.Type().IsRegular() {
+			return err
+		}
+		check.Files++
+		relativePath, _ := filepath.Rel(restorePath, path)
+		name := filepath.ToSlash(relativePath)
+		// Hardlinks are not in the manifest
+		manifestHash, found := hashes[name]
+		if !found {
+			return nil
+		}
+		hash, err := core.GetHash(path)
+		if err != nil {
+			return err
+		}
+		if hash != manifestHash {
+			return fmt.Errorf("hash missmatch for restored file %s", name)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for name := range lastManifest {
+		if !core.IsSelected(name, options.Paths) {
+			continue
+		}
+		_, err := os.Lstat(filepath.Join(restorePath, filepath.FromSlash(name)))
+		if err != nil {
+			return fmt.Errorf("%s wasn't restored", name)
+		}
+	}
+
+	// The live source
+	if !options.CompareSource {
+		return nil
+	}
+	filters, err := sourceFilters(entry, options)
+	if err != nil {
+		return err
+	}
+	for _, sourcePath := range entry.Paths {
+		differences, err := compareSource(sourcePath, filepath.Join(restorePath, filepath.Base(sourcePath)), filters[sourcePath])
+		if err != nil {
+			return err
+		}
+		check.Differences = append(check.Differences, differences...)
+	}
+	return nil
+}
+
+// sourceFilters returns the filters of the paths of a backup, they come
+// from the options or from the config of its node like in Run
+func sourceFilters(entry CatalogEntry, options CheckOptions) (map[string]*core.Filter, error) {
+	config := options.Config
+	if config == nil {
+		config = &core.CoreConfig
+	}
+	host, err := config.GetNode(entry.Node)
+	if err != nil {
+		return nil, err
+	}
+	sources, _, err := resolvePaths(config, host, nil)
+	if err != nil {
+		return nil, err
+	}
+	entries := make(map[string]string)
+	for _, source := range sources {
+		entries[source.path] = source.entry
+	}
+	filters := make(map[string]*core.Filter)
+	for _, sourcePath := range entry.Paths {
+		if filter, found := options.SourceFilters[sourcePath]; found {
+			filters[sourcePath] = filter
+			continue
+		}
+		// The paths of the job are their own entries
+		backupPath, found := entries[sourcePath]
+		if !found {
+			backupPath = sourcePath
+		}
+		filter, err := core.NewFilter(config.BackupFilterOptions(host, backupPath))
+		if err != nil {
+			return nil, fmt.Errorf("couldn't create the filter of %s -> %s", backupPath, err)
+		}
+		filters[sourcePath] = filter
+	}
+	return filters, nil
+}
+
+// compareSource returns the actions which would make the restored copy look
+// like the live source, nothing is compared when the path wasn't restored
+func compareSource(sourcePath string, restoredPath string, filter *core.Filter) ([]string, error) {
+	restoredInfo, err := os.Lstat(restoredPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	sourceInfo, err := os.Lstat(sourcePath)
+	if os.IsNotExist(err) {
+		return []string{fmt.Sprintf("%s was removed from the source", sourcePath)}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// A single file
+	if !sourceInfo.IsDir() || !restoredInfo.IsDir() {
+		if !sourceInfo.Mode().IsRegular() || !restoredInfo.Mode().IsRegular() {
+			return nil, nil
+		}
+		sourceHash, err := core.GetHash(sourcePath)
+		if err != nil {
+			return nil, err
+		}
+		restoredHash, err := core.GetHash(restoredPath)
+		if err != nil {
+			return nil, err
+		}
+		if sourceHash != restoredHash {
+			return []string{fmt.Sprintf("%s changed", sourcePath)}, nil
+		}
+		return nil, nil
+	}
+
+	// A directory
+	sourceTree, err := core.ScanTreeWithFilter(sourcePath, filter)
+	if err != nil {
+		return nil, err
+	}
+	restoredTree, err := core.ScanTree(restoredPath)
+	if err != nil {
+		return nil, err
+	}
+	// The archives keep the modification times to the second, so the
+	// content is compared instead
+	contentDiffers := func(relativePath string) (bool, error) {
+		sourceHash, err := core.GetHash(filepath.Join(sourcePath, filepath.FromSlash(relativePath)))
+		if err != nil {
+			return false, err
+		}
+		restoredHash, err := core.GetHash(filepath.Join(restoredPath, filepath.FromSlash(relativePath)))
+		return sourceHash != restoredHash, err
+	}
+	plan, err := core.DiffTrees(sourcePath, sourceTree, restoredPath, restoredTree, core.SyncOptions{Delete: true, Checksum: true}, contentDiffers)
+	if err != nil {
+		return nil, err
+	}
+	var differences []string
+	for _, action := range plan.Actions {
+		differences = append(differences, action.String())
+	}
+	return differences, nil
+}
+
+// CheckRestoreEvery runs CheckRestore at each interval until ctx is done,
+// the failures are logged and notified by CheckRestore. A passed check which
+// couldn't be recorded is only returned by CheckRestore, it is logged here
+func CheckRestoreEvery(ctx context.Context, interval time.Duration, options CheckOptions) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		check, err := CheckRestore(ctx, options)
+		if err != nil && check.Success && ctx.Err() == nil {
+			log.Errorf("Restore check of backup %s -> %s", check.BackupId, err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
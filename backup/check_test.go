@@ -0,0 +1,115 @@
+/*
+   Copyright (c) 2022 Cyber Home Lab authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package backup
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	core "cyberhomelab.com/core/core"
+
+	"gotest.tools/assert"
+)
+
+func TestCheckRestoreHappyFlow(t *testing.T) {
+	directoryPath := filepath.Join(os.TempDir(), "TestCheckRestoreHappyFlow")
+	destinationPath := filepath.Join(os.TempDir(), "TestCheckRestoreHappyFlow_destination")
+	config := createTestConfig(t, directoryPath)
+	job := Job{Name: "check", Node: "Mars", Config: config, Destination: destinationPath, Catalog: filepath.Join(destinationPath, CatalogFileName)}
+	older := runTestBackup(t, job)
+	time.Sleep(time.Second)
+	newer := runTestBackup(t, job)
+
+	var messages []string
+	marsPath := filepath.Join(directoryPath, "mars")
+	options := CheckOptions{
+		Catalog:       job.Catalog,
+		Config:        config,
+		CompareSource: true,
+		Notifier: func(message string) error {
+			messages = append(messages, message)
+			return nil
+		},
+	}
+
+	// The newest backup first, then the one which wasn't checked
+	check, err := CheckRestore(context.Background(), options)
+	assert.NilError(t, err)
+	assert.Equal(t, check.BackupId, newer)
+	assert.Equal(t, check.Success, true)
+	assert.Equal(t, check.Files, 3)
+	assert.DeepEqual(t, check.Differences, []string(nil))
+	check, err = CheckRestore(context.Background(), options)
+	assert.NilError(t, err)
+	assert.Equal(t, check.BackupId, older)
+	assert.Equal(t, len(messages), 0)
+
+	catalog, err := ReadCatalog(job.Catalog)
+	assert.NilError(t, err)
+	entry, _ := catalog.Find(older)
+	assert.Equal(t, entry.LastRestoreCheck.Success, true)
+
+	// The changes of the source are reported
+	assert.NilError(t, core.WriteToFile(filepath.Join(marsPath, "c.txt"), "changed"))
+	check, err = CheckRestore(context.Background(), options)
+	assert.NilError(t, err)
+	assert.Equal(t, check.BackupId, newer)
+	assert.Equal(t, len(check.Differences), 1)
+	assert.Equal(t, len(messages), 1)
+
+	// Cleanup
+	assert.NilError(t, core.Remove(directoryPath))
+	assert.NilError(t, core.Remove(destinationPath))
+}
+
+func TestCheckRestoreNegativeFlow(t *testing.T) {
+	directoryPath := filepath.Join(os.TempDir(), "TestCheckRestoreNegativeFlow")
+	destinationPath := filepath.Join(os.TempDir(), "TestCheckRestoreNegativeFlow_destination")
+	config := createTestConfig(t, directoryPath)
+	job := Job{Name: "check", Node: "Mars", Config: config, Destination: destinationPath, Catalog: filepath.Join(destinationPath, CatalogFileName)}
+
+	var messages []string
+	options := CheckOptions{
+		Catalog: job.Catalog,
+		Notifier: func(message string) error {
+			messages = append(messages, message)
+			return nil
+		},
+	}
+	_, err := CheckRestore(context.Background(), options)
+	assert.ErrorContains(t, err, "there are no backups to check in the catalog")
+	assert.Equal(t, len(messages), 1)
+
+	// A corrupted archive fails the check and the failure is recorded
+	backupId := runTestBackup(t, job)
+	assert.NilError(t, core.WriteToFile(filepath.Join(destinationPath, backupId+".tar.gz"), "corrupted"))
+	check, err := CheckRestore(context.Background(), options)
+	assert.ErrorContains(t, err, "hash missmatch")
+	assert.Equal(t, check.Success, false)
+	assert.Equal(t, len(messages), 2)
+	catalog, err := ReadCatalog(job.Catalog)
+	assert.NilError(t, err)
+	entry, _ := catalog.Find(backupId)
+	assert.Equal(t, entry.LastRestoreCheck.Success, false)
+
+	// Cleanup
+	assert.NilError(t, core.Remove(directoryPath))
+	assert.NilError(t, core.Remove(destinationPath))
+}
@@ -0,0 +1,88 @@
+/*
+   Copyright (c) 2022 Cyber Home Lab authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package backup
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	core "cyberhomelab.com/core/core"
+	host "cyberhomelab.com/core/host"
+)
+
+// DefaultHookTimeout is the timeout in seconds of the hooks without one
+const DefaultHookTimeout = 300
+
+// hookEnvironment describes the job to the hooks, the status is "running"
+// for the pre hooks
+func hookEnvironment(job Job, result Result, err error) []string {
+	status := "running"
+	if result.Archive != "" && err == nil {
+		status = "success"
+	}
+	if err != nil {
+		status = "failure"
+	}
+	env := []string{
+		"BACKUP_JOB=" + job.Name,
+		"BACKUP_NODE=" + job.Node,
+		"BACKUP_DESTINATION=" + job.Destination,
+		"BACKUP_ARCHIVE=" + result.Archive,
+		"BACKUP_STATUS=" + status,
+	}
+	if err != nil {
+		env = append(env, "BACKUP_ERROR="+err.Error())
+	}
+	return env
+}
+
+// runHooks runs the hooks in order, the first failure stops them when
+// stopOnError is set and otherwise all of them run and the failures are
+// returned together
+func runHooks(ctx context.Context, kind string, hooks []core.BackupHook, env []string, stopOnError bool) error {
+	var errs []string
+	for _, hook := range hooks {
+		if len(hook.Command) == 0 {
+			continue
+		}
+		err := ctx.Err()
+		if err != nil && stopOnError {
+			return err
+		}
+		timeout := hook.Timeout
+		if timeout == 0 {
+			timeout = DefaultHookTimeout
+		}
+		output, err := host.RunCommandWithEnv(ctx, timeout, env, hook.Command[0], hook.Command[1:]...)
+		if output != "" {
+			log.Infof("The %s hook %s printed -> %s", kind, hook.Command[0], strings.TrimSpace(output))
+		}
+		if err != nil {
+			err = fmt.Errorf("the %s hook %s failed -> %s", kind, strings.Join(hook.Command, " "), err)
+			log.Error(err)
+			if stopOnError {
+				return err
+			}
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+/*
+   Copyright (c) 2022 Cyber Home Lab authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package backup
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	core "cyberhomelab.com/core/core"
+
+	"gotest.tools/assert"
+)
+
+// shellHook returns a hook running script with sh
+func shellHook(script string) core.BackupHook {
+	return core.BackupHook{Command: []string{"sh", "-c", script}, Timeout: 5}
+}
+
+func TestRunHooksHappyFlow(t *testing.T) {
+	directoryPath := filepath.Join(os.TempDir(), "TestRunHooksHappyFlow")
+	destinationPath := filepath.Join(os.TempDir(), "TestRunHooksHappyFlow_destination")
+	config := createTestConfig(t, directoryPath)
+	logPath := filepath.Join(directoryPath, "hooks.log")
+	configPre := make([]core.BackupHook, 1, 2)
+	configPre[0] = shellHook("echo pre $BACKUP_JOB $BACKUP_NODE $BACKUP_STATUS >> " + logPath)
+	config.Nodes.Mars.BackupHooks = map[string]core.BackupHooks{"hooks": {Pre: configPre}}
+
+	// The hooks of the job run after the ones from the config and a pre hook
+	// can add files to the backup
+	job := Job{Name: "hooks", Node: "Mars", Config: config, Destination: destinationPath, Catalog: filepath.Join(destinationPath, CatalogFileName)}
+	job.Hooks.Pre = []core.BackupHook{shellHook("echo dump > " + filepath.Join(directoryPath, "mars", "dump.sql"))}
+	job.Hooks.Post = []core.BackupHook{shellHook("echo post $BACKUP_STATUS $(basename $BACKUP_ARCHIVE) >> " + logPath)}
+	job.Hooks.Always = []core.BackupHook{shellHook("echo always $BACKUP_STATUS >> " + logPath)}
+	result, err := Run(context.Background(), job)
+	assert.NilError(t, err)
+	assert.Equal(t, len(result.Warnings), 0)
+	content, err := core.ReadFile(logPath)
+	assert.NilError(t, err)
+	assert.Equal(t, content, "pre hooks Mars running\npost success "+filepath.Base(result.Archive)+"\nalways success\n")
+	assert.Equal(t, len(configPre[:2][1].Command), 0)
+	entries, err := core.ListArchive(result.Archive)
+	assert.NilError(t, err)
+	found := false
+	for _, entry := range entries {
+		found = found || entry.Path == "mars/dump.sql"
+	}
+	assert.Assert(t, found)
+
+	// Cleanup
+	assert.NilError(t, core.Remove(directoryPath))
+	assert.NilError(t, core.Remove(destinationPath))
+}
+
+func TestRunHooksNegativeFlow(t *testing.T) {
+	directoryPath := filepath.Join(os.TempDir(), "TestRunHooksNegativeFlow")
+	destinationPath := filepath.Join(os.TempDir(), "TestRunHooksNegativeFlow_destination")
+	config := createTestConfig(t, directoryPath)
+	logPath := filepath.Join(directoryPath, "hooks.log")
+	job := Job{Name: "hooks", Node: "Mars", Config: config, Destination: destinationPath, Catalog: filepath.Join(destinationPath, CatalogFileName)}
+	job.Hooks.Always = []core.BackupHook{
+		shellHook("exit 1"),
+		shellHook("echo always $BACKUP_STATUS $BACKUP_ERROR >> " + logPath),
+	}
+
+	// A failed pre hook stops the backup, the always hooks still run
+	job.Hooks.Pre = []core.BackupHook{shellHook("exit 3"), shellHook("echo never >> " + logPath)}
+	job.Hooks.Post = []core.BackupHook{shellHook("echo never >> " + logPath)}
+	result, err := Run(context.Background(), job)
+	assert.ErrorContains(t, err, "the pre hook sh -c exit 3 failed")
+	assert.Equal(t, result.Archive, "")
+	content, err := core.ReadFile(logPath)
+	assert.NilError(t, err)
+	assert.Assert(t, strings.HasPrefix(content, "always failure the pre hook sh -c exit 3 failed"))
+	assert.Equal(t, len(result.Warnings), 1)
+	_, err = os.Stat(destinationPath)
+	assert.Assert(t, os.IsNotExist(err))
+
+	// A failed post hook is a warning
+	job.Hooks.Pre = nil
+	job.Hooks.Post = []core.BackupHook{shellHook("exit 2")}
+	result, err = Run(context.Background(), job)
+	assert.NilError(t, err)
+	assert.Equal(t, len(result.Warnings), 2)
+	assert.Assert(t, strings.Contains(result.Warnings[0], "the post hook sh -c exit 2 failed"))
+
+	// Cleanup
+	assert.NilError(t, core.Remove(directoryPath))
+	assert.NilError(t, core.Remove(destinationPath))
+}
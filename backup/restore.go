@@ -0,0 +1,373 @@
+/*
+   Copyright (c) 2022 Cyber Home Lab authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package backup
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	core "cyberhomelab.com/core/core"
+	nextcloud "cyberhomelab.com/core/nextcloud"
+	storage "cyberhomelab.com/core/storage"
+)
+
+// ConflictPolicy decides what happens to the files of the destination which
+// are also restored
+type ConflictPolicy int
+
+const (
+	// ConflictFail stops the restore before anything is changed
+	ConflictFail ConflictPolicy = iota
+	ConflictSkip
+	ConflictOverwrite
+	// ConflictKeepBoth writes the restored file next to the existing one
+	// with RestoredSuffix, followed by a number when that name is taken
+	ConflictKeepBoth
+)
+
+const RestoredSuffix = ".restored"
+
+type RestoreOptions struct {
+	// Catalog is DefaultCatalogPath when it is empty
+	Catalog string
+	// Nextcloud is used for the backups which are only stored there
+	Nextcloud *nextcloud.Client
+	// Targets are the other storages the backups can be fetched from, a
+	// target is used for the locations of its type and path
+	Targets []storage.Storage
+	// Encryption has the identities or the passphrase of encrypted backups,
+	// the keys of Config are used when it is nil. Config is core.CoreConfig
+	// when it is nil
+	Encryption *core.EncryptionOptions
+	Config     *core.Config
+	Conflict   ConflictPolicy
+	// IgnoreOwnership keeps the owner of the user who restores, instead of
+	// the owner stored in the archive
+	IgnoreOwnership bool
+	// WorkDirectory keeps the downloaded archives during the restore, it
+	// is os.TempDir() when empty
+	WorkDirectory string
+}
+
+type RestoreResult struct {
+	// Backups are the IDs of the restored chain, from the full backup
+	Backups  []string
+	Entries  int
+	Bytes    int64
+	Restored int
+	Skipped  int
+	Renamed  int
+	// Warnings are the owners and the extended attributes which couldn't
+	// be restored
+	Warnings []string
+}
+
+// Restore extracts paths from a backup of the catalog into destination, the
+// paths are names in the archive and everything is restored when there are
+// none
+func Restore(ctx context.Context, backupId string, paths []string, destinationPath string) (RestoreResult, error) {
+	return RestoreWithOptions(ctx, backupId, paths, destinationPath, RestoreOptions{})
+}
+
+func RestoreWithOptions(ctx context.Context, backupId string, paths []string, destinationPath string, options RestoreOptions) (RestoreResult, error) {
+	var err error
+	result := RestoreResult{}
+	if options.Catalog == "" {
+		options.Catalog = DefaultCatalogPath
+	}
+	if options.WorkDirectory == "" {
+		options.WorkDirectory = os.TempDir()
+	}
+	options.Encryption, err = encryptionOptions(options.Config, options.Encryption)
+	if err != nil {
+		return result, err
+	}
+	catalog, err := ReadCatalog(options.Catalog)
+	if err != nil {
+		return result, err
+	}
+	workPath, err := os.MkdirTemp(options.WorkDirectory, "restore-")
+	if err != nil {
+		return result, fmt.Errorf("couldn't create the work directory -> %s", err)
+	}
+	defer os.RemoveAll(workPath)
+	chain, archivePaths, err := fetchChain(ctx, catalog, backupId, workPath, options)
+	if err != nil {
+		return result, err
+	}
+	for _, chainEntry := range chain {
+		result.Backups = append(result.Backups, chainEntry.ID)
+	}
+
+	// Extract into a staging directory in the destination, so the files can
+	// be renamed into place
+	err = os.MkdirAll(destinationPath, core.DefaultMode)
+	if err != nil {
+		return result, fmt.Errorf("couldn't create directory %s -> %s", destinationPath, err)
+	}
+	stagingPath, err := os.MkdirTemp(destinationPath, ".restore-")
+	if err != nil {
+		return result, fmt.Errorf("couldn't create the staging directory -> %s", err)
+	}
+	defer os.RemoveAll(stagingPath)
+	log.Infof("Restoring backup %s to %s", backupId, destinationPath)
+	extractResult, err := core.ExtractArchiveChain(archivePaths, stagingPath, core.ExtractOptions{Paths: paths, Encryption: options.Encryption, IgnoreOwnership: options.IgnoreOwnership})
+	result.Entries = extractResult.Entries
+	result.Bytes = extractResult.Bytes
+	result.Warnings = extractResult.Warnings
+	for _, warning := range result.Warnings {
+		log.Warningf("Backup %s -> %s", backupId, warning)
+	}
+	if err != nil {
+		return result, err
+	}
+	err = ctx.Err()
+	if err != nil {
+		return result, err
+	}
+	err = mergeRestored(stagingPath, destinationPath, options.Conflict, &result)
+	if err != nil {
+		return result, err
+	}
+	log.Infof("Backup %s was restored to %s with %d files (%d skipped, %d renamed)", backupId, destinationPath, result.Restored, result.Skipped, result.Renamed)
+	return result, nil
+}
+
+// fetchChain fetches and verifies the archives needed to restore a backup,
+// from the full backup to the backup itself
+func fetchChain(ctx context.Context, catalog *Catalog, backupId string, workPath string, options RestoreOptions) ([]CatalogEntry, []string, error) {
+	entry, found := catalog.Find(backupId)
+	if !found {
+		return nil, nil, fmt.Errorf("backup %s is not in the catalog", backupId)
+	}
+	chain, err := catalog.chain(entry)
+	if err != nil {
+		return nil, nil, err
+	}
+	var archivePaths []string
+	for _, chainEntry := range chain {
+		archivePath, err := fetchBackup(ctx, chainEntry, workPath, options)
+		if err != nil {
+			return nil, nil, err
+		}
+		err = verifyBackup(chainEntry, archivePath, options.Encryption)
+		if err != nil {
+			return nil, nil, err
+		}
+		archivePaths = append(archivePaths, archivePath)
+	}
+	return chain, archivePaths, nil
+}
+
+// fetchBackup returns the path of the archive of entry, the files are
+// downloaded into workPath when the backup isn't stored locally
+func fetchBackup(ctx context.Context, entry CatalogEntry, workPath string, options RestoreOptions) (string, error) {
+	var errs []string
+	for _, location := range entry.Locations {
+		switch location.Storage {
+		case LocalStorage:
+			archivePath := filepath.Join(location.Path, entry.Archive)
+			_, err := os.Stat(archivePath)
+			if err == nil {
+				return archivePath, nil
+			}
+			_, err = os.Stat(core.VolumeIndexPath(archivePath))
+			if err == nil {
+				return archivePath, nil
+			}
+			errs = append(errs, fmt.Sprintf("%s isn't in %s", entry.Archive, location.Path))
+		default:
+			target := locationStorage(location, options)
+			if target == nil {
+				errs = append(errs, fmt.Sprintf("there is no storage for %s:%s", location.Storage, location.Path))
+				continue
+			}
+			err := downloadBackup(ctx, target, entry, workPath)
+			if err == nil {
+				return filepath.Join(workPath, entry.Archive), nil
+			}
+			errs = append(errs, err.Error())
+		}
+	}
+	return "", fmt.Errorf("couldn't fetch backup %s -> %s", entry.ID, strings.Join(errs, ", "))
+}
+
+// locationStorage returns the target of the options for location, the
+// Nextcloud client is used for the Nextcloud locations when no target
+// matches
+func locationStorage(location Location, options RestoreOptions) storage.Storage {
+	for _, target := range options.Targets {
+		if locationOf(target) == location {
+			return target
+		}
+	}
+	if location.Storage == NextcloudStorage && options.Nextcloud != nil {
+		client := *options.Nextcloud
+		client.Directory = location.Path
+		return storage.NewWebDAV(&client)
+	}
+	return nil
+}
+
+func downloadBackup(ctx context.Context, target storage.Storage, entry CatalogEntry, workPath string) error {
+	log.Infof("Downloading backup %s from %s", entry.ID, storage.String(target))
+	for _, fileName := range entry.Files {
+		err := storage.GetFile(ctx, target, fileName, filepath.Join(workPath, fileName))
+		if err != nil {
+			return fmt.Errorf("couldn't download %s -> %s", fileName, err)
+		}
+	}
+	return nil
+}
+
+// verifyBackup compares the archive with the hash of the catalog, the
+// volumes are checked against their index while they are read, and reads
+// all the entries
+func verifyBackup(entry CatalogEntry, archivePath string, encryption *core.EncryptionOptions) error {
+	if _, err := os.Stat(archivePath); err == nil && entry.SHA256 != "" {
+		hash, err := core.GetHash(archivePath)
+		if err != nil {
+			return fmt.Errorf("couldn't verify backup %s -> %s", entry.ID, err)
+		}
+		if hash != entry.SHA256 {
+			return fmt.Errorf("couldn't verify backup %s -> hash missmatch", entry.ID)
+		}
+	}
+	_, err := core.VerifyArchiveWithOptions(archivePath, core.InspectOptions{Encryption: encryption})
+	if err != nil {
+		return fmt.Errorf("couldn't verify backup %s -> %s", entry.ID, err)
+	}
+	return nil
+}
+
+// mergeRestored moves the files of the staging directory into destination,
+// the conflicts are all found before anything is moved
+func mergeRestored(stagingPath string, destinationPath string, policy ConflictPolicy, result *RestoreResult) error {
+	if policy == ConflictFail {
+		var conflicts []string
+		err := filepath.WalkDir(stagingPath, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			relativePath, _ := filepath.Rel(stagingPath, path)
+			info, err := os.Lstat(filepath.Join(destinationPath, relativePath))
+			if os.IsNotExist(err) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if !entry.IsDir() || !info.IsDir() {
+				conflicts = append(conflicts, relativePath)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if len(conflicts) > 0 {
+			return fmt.Errorf("the restore would overwrite %s", strings.Join(conflicts, ", "))
+		}
+	}
+
+	return filepath.WalkDir(stagingPath, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || path == stagingPath {
+			return err
+		}
+		relativePath, _ := filepath.Rel(stagingPath, path)
+		targetPath := filepath.Join(destinationPath, relativePath)
+		info, err := os.Lstat(targetPath)
+		if os.IsNotExist(err) {
+			// A new directory is moved with everything under it
+			result.Restored += countFiles(path)
+			err = os.Rename(path, targetPath)
+			if err != nil {
+				return fmt.Errorf("couldn't restore %s -> %s", relativePath, err)
+			}
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() && info.IsDir() {
+			return nil
+		}
+		switch policy {
+		case ConflictSkip:
+			result.Skipped += countFiles(path)
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		case ConflictKeepBoth:
+			targetPath, err = freeRestoredPath(targetPath)
+			if err != nil {
+				return fmt.Errorf("couldn't restore %s -> %s", relativePath, err)
+			}
+			result.Renamed += countFiles(path)
+		default:
+			result.Restored += countFiles(path)
+		}
+		err = os.RemoveAll(targetPath)
+		if err != nil {
+			return fmt.Errorf("couldn't replace %s -> %s", relativePath, err)
+		}
+		err = os.Rename(path, targetPath)
+		if err != nil {
+			return fmt.Errorf("couldn't restore %s -> %s", relativePath, err)
+		}
+		if entry.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+}
+
+// freeRestoredPath returns the first name of RestoredSuffix, .restored.1,
+// .restored.2, ... which doesn't exist next to targetPath
+func freeRestoredPath(targetPath string) (string, error) {
+	restoredPath := targetPath + RestoredSuffix
+	for k := 1; ; k++ {
+		_, err := os.Lstat(restoredPath)
+		if os.IsNotExist(err) {
+			return restoredPath, nil
+		}
+		if err != nil {
+			return "", fmt.Errorf("couldn't run os.Lstat() -> %s", err)
+		}
+		restoredPath = fmt.Sprintf("%s%s.%d", targetPath, RestoredSuffix, k)
+	}
+}
+
+// countFiles returns the number of files which aren't directories at path
+func countFiles(path string) int {
+	count := 0
+	filepath.WalkDir(path, func(_ string, entry fs.DirEntry, err error) error {
+		if err == nil && !entry.IsDir() {
+			count++
+		}
+		return nil
+	})
+	return count
+}
@@ -0,0 +1,185 @@
+/*
+   Copyright (c) 2022 Cyber Home Lab authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package backup
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	core "cyberhomelab.com/core/core"
+	nextcloud "cyberhomelab.com/core/nextcloud"
+
+	"golang.org/x/net/webdav"
+	"gotest.tools/assert"
+)
+
+// runTestBackup backs up the Mars paths of the test config and returns the
+// ID of the backup
+func runTestBackup(t *testing.T, job Job) string {
+	result, err := Run(context.Background(), job)
+	assert.NilError(t, err)
+	return backupID(result.Archive)
+}
+
+func TestRestoreHappyFlow(t *testing.T) {
+	directoryPath := filepath.Join(os.TempDir(), "TestRestoreHappyFlow")
+	destinationPath := filepath.Join(os.TempDir(), "TestRestoreHappyFlow_destination")
+	restorePath := filepath.Join(os.TempDir(), "TestRestoreHappyFlow_restore")
+	config := createTestConfig(t, directoryPath)
+	job := Job{Name: "restore", Node: "Mars", Config: config, Destination: destinationPath, Catalog: filepath.Join(destinationPath, CatalogFileName)}
+	job.Options.Snapshot = filepath.Join(destinationPath, "restore.snapshot")
+	options := RestoreOptions{Catalog: job.Catalog}
+
+	// An incremental backup is restored with its full backup
+	runTestBackup(t, job)
+	assert.NilError(t, core.WriteToFile(filepath.Join(directoryPath, "mars", "c.txt"), "changed"))
+	time.Sleep(time.Second)
+	backupId := runTestBackup(t, job)
+	result, err := RestoreWithOptions(context.Background(), backupId, nil, restorePath, options)
+	assert.NilError(t, err)
+	assert.Equal(t, len(result.Backups), 2)
+	assert.Equal(t, result.Restored, 3)
+	content, err := core.ReadFile(filepath.Join(restorePath, "mars", "c.txt"))
+	assert.NilError(t, err)
+	assert.Equal(t, content, "changed")
+
+	// Only some paths
+	assert.NilError(t, core.Remove(restorePath))
+	result, err = RestoreWithOptions(context.Background(), backupId, []string{"common1"}, restorePath, options)
+	assert.NilError(t, err)
+	assert.Equal(t, result.Restored, 1)
+	files, err := os.ReadDir(restorePath)
+	assert.NilError(t, err)
+	assert.Equal(t, len(files), 1)
+
+	// Conflicts
+	assert.NilError(t, core.WriteToFile(filepath.Join(restorePath, "common1", "a.txt"), "local"))
+	_, err = RestoreWithOptions(context.Background(), backupId, []string{"common1"}, restorePath, options)
+	assert.ErrorContains(t, err, "the restore would overwrite common1/a.txt")
+	options.Conflict = ConflictSkip
+	result, err = RestoreWithOptions(context.Background(), backupId, []string{"common1"}, restorePath, options)
+	assert.NilError(t, err)
+	assert.Equal(t, result.Skipped, 1)
+	options.Conflict = ConflictKeepBoth
+	result, err = RestoreWithOptions(context.Background(), backupId, []string{"common1"}, restorePath, options)
+	assert.NilError(t, err)
+	assert.Equal(t, result.Renamed, 1)
+	content, err = core.ReadFile(filepath.Join(restorePath, "common1", "a.txt"+RestoredSuffix))
+	assert.NilError(t, err)
+	assert.Equal(t, content, "common1/a.txt")
+	assert.NilError(t, core.WriteToFile(filepath.Join(restorePath, "common1", "a.txt"+RestoredSuffix), "kept"))
+	result, err = RestoreWithOptions(context.Background(), backupId, []string{"common1"}, restorePath, options)
+	assert.NilError(t, err)
+	assert.Equal(t, result.Renamed, 1)
+	content, err = core.ReadFile(filepath.Join(restorePath, "common1", "a.txt"+RestoredSuffix))
+	assert.NilError(t, err)
+	assert.Equal(t, content, "kept")
+	content, err = core.ReadFile(filepath.Join(restorePath, "common1", "a.txt"+RestoredSuffix+".1"))
+	assert.NilError(t, err)
+	assert.Equal(t, content, "common1/a.txt")
+	options.Conflict = ConflictOverwrite
+	result, err = RestoreWithOptions(context.Background(), backupId, []string{"common1"}, restorePath, options)
+	assert.NilError(t, err)
+	assert.Equal(t, result.Restored, 1)
+	content, err = core.ReadFile(filepath.Join(restorePath, "common1", "a.txt"))
+	assert.NilError(t, err)
+	assert.Equal(t, content, "common1/a.txt")
+
+	// Cleanup
+	assert.NilError(t, core.Remove(directoryPath))
+	assert.NilError(t, core.Remove(destinationPath))
+	assert.NilError(t, core.Remove(restorePath))
+}
+
+func TestRestoreFromNextcloud(t *testing.T) {
+	directoryPath := filepath.Join(os.TempDir(), "TestRestoreFromNextcloud")
+	destinationPath := filepath.Join(os.TempDir(), "TestRestoreFromNextcloud_destination")
+	remotePath := filepath.Join(os.TempDir(), "TestRestoreFromNextcloud_remote")
+	restorePath := filepath.Join(os.TempDir(), "TestRestoreFromNextcloud_restore")
+	config := createTestConfig(t, directoryPath)
+	job := Job{Name: "remote", Node: "Mars", Config: config, Destination: destinationPath, Catalog: filepath.Join(directoryPath, CatalogFileName)}
+	backupId := runTestBackup(t, job)
+
+	assert.NilError(t, os.MkdirAll(filepath.Join(remotePath, "backups"), core.DefaultMode))
+	handler := &webdav.Handler{Prefix: "/remote.php/dav/files/user", FileSystem: webdav.Dir(remotePath), LockSystem: webdav.NewMemLS()}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	client := &nextcloud.Client{BaseURL: server.URL, Directory: "backups", User: "user", Password: "password"}
+	assert.NilError(t, UploadBackup(context.Background(), client, job.Catalog, backupId))
+
+	// The local copy is gone, the archive is downloaded
+	assert.NilError(t, core.Remove(destinationPath))
+	options := RestoreOptions{Catalog: job.Catalog}
+	_, err := RestoreWithOptions(context.Background(), backupId, nil, restorePath, options)
+	assert.ErrorContains(t, err, "there is no storage for nextcloud:backups")
+	options.Nextcloud = &nextcloud.Client{BaseURL: server.URL, User: "user", Password: "password"}
+	result, err := RestoreWithOptions(context.Background(), backupId, nil, restorePath, options)
+	assert.NilError(t, err)
+	assert.Equal(t, result.Restored, 3)
+
+	// A corrupted archive isn't restored
+	archiveName := backupId + ".tar.gz"
+	assert.NilError(t, core.WriteToFile(filepath.Join(remotePath, "backups", archiveName), "corrupted"))
+	_, err = RestoreWithOptions(context.Background(), backupId, nil, restorePath, options)
+	assert.ErrorContains(t, err, "hash missmatch")
+
+	_, err = RestoreWithOptions(context.Background(), "missing", nil, restorePath, options)
+	assert.ErrorContains(t, err, "backup missing is not in the catalog")
+
+	// Cleanup
+	assert.NilError(t, core.Remove(directoryPath))
+	assert.NilError(t, core.Remove(remotePath))
+	assert.NilError(t, core.Remove(restorePath))
+}
+
+func TestRestoreEncryptedFromConfig(t *testing.T) {
+	directoryPath := filepath.Join(os.TempDir(), "TestRestoreEncryptedFromConfig")
+	destinationPath := filepath.Join(os.TempDir(), "TestRestoreEncryptedFromConfig_destination")
+	restorePath := filepath.Join(os.TempDir(), "TestRestoreEncryptedFromConfig_restore")
+	config := createTestConfig(t, directoryPath)
+	identity, recipient, err := core.GenerateEncryptionKey()
+	assert.NilError(t, err)
+	config.Common.BackupRecipients = []string{recipient}
+	config.Common.BackupIdentities = []string{identity}
+
+	// The keys of the config are used without any option
+	job := Job{Node: "Mars", Config: config, Destination: destinationPath, Catalog: filepath.Join(directoryPath, CatalogFileName)}
+	result, err := Run(context.Background(), job)
+	assert.NilError(t, err)
+	assert.Assert(t, strings.HasSuffix(result.Archive, ".tar.gz"+core.EncryptedArchiveExtension))
+	assert.Equal(t, result.Encrypted, true)
+	assert.Equal(t, result.Verified, true)
+	_, err = core.ListArchive(result.Archive)
+	assert.Assert(t, err != nil)
+
+	restored, err := RestoreWithOptions(context.Background(), backupID(result.Archive), nil, restorePath, RestoreOptions{Catalog: job.Catalog, Config: config})
+	assert.NilError(t, err)
+	assert.Equal(t, restored.Restored, 3)
+	check, err := CheckRestore(context.Background(), CheckOptions{Catalog: job.Catalog, Config: config})
+	assert.NilError(t, err)
+	assert.Equal(t, check.Success, true)
+
+	// Cleanup
+	for _, path := range []string{directoryPath, destinationPath, restorePath} {
+		assert.NilError(t, core.Remove(path))
+	}
+}
@@ -0,0 +1,363 @@
+/*
+   Copyright (c) 2022 Cyber Home Lab authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	core "cyberhomelab.com/core/core"
+	nextcloud "cyberhomelab.com/core/nextcloud"
+	storage "cyberhomelab.com/core/storage"
+)
+
+// RetentionPolicy decides which backups of a job are kept, a backup is kept
+// when at least one of the rules keeps it. The daily, weekly, monthly and
+// yearly rules keep the newest backup of each period for the given number
+// of periods
+type RetentionPolicy struct {
+	KeepLast    int
+	KeepDaily   int
+	KeepWeekly  int
+	KeepMonthly int
+	KeepYearly  int
+	// MinimumAge keeps all the backups younger than it
+	MinimumAge time.Duration
+}
+
+// BackupInfo is a backup found in a local or remote listing, Files are all
+// the files of the backup (archive, volumes, index and metadata). Level is
+// the incremental level from the metadata, 0 for a full backup
+type BackupInfo struct {
+	Name     string
+	Time     time.Time
+	Level    int
+	Verified bool
+	Files    []string
+}
+
+type RetentionDecision struct {
+	Backup BackupInfo
+	Keep   bool
+	// Reasons are the rules keeping the backup
+	Reasons []string
+}
+
+type RetentionReport []RetentionDecision
+
+func (r RetentionReport) String() string {
+	var lines []string
+	for _, decision := range r {
+		if decision.Keep {
+			lines = append(lines, fmt.Sprintf("keep  %s (%s)", decision.Backup.Name, strings.Join(decision.Reasons, ", ")))
+		} else {
+			lines = append(lines, fmt.Sprintf("prune %s", decision.Backup.Name))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Pruned returns the backups which are not kept
+func (r RetentionReport) Pruned() []BackupInfo {
+	var backups []BackupInfo
+	for _, decision := range r {
+		if !decision.Keep {
+			backups = append(backups, decision.Backup)
+		}
+	}
+	return backups
+}
+
+func (p RetentionPolicy) isEmpty() bool {
+	return p.KeepLast == 0 && p.KeepDaily == 0 && p.KeepWeekly == 0 && p.KeepMonthly == 0 && p.KeepYearly == 0 && p.MinimumAge == 0
+}
+
+// ApplyRetention returns a decision for each backup, newest first. The
+// newest verified backup is always kept when no other verified backup is
+func ApplyRetention(backups []BackupInfo, policy RetentionPolicy, now time.Time) (RetentionReport, error) {
+	if policy.isEmpty() {
+		return nil, fmt.Errorf("the retention policy doesn't keep anything")
+	}
+	report := make(RetentionReport, len(backups))
+	for k, backup := range backups {
+		report[k] = RetentionDecision{Backup: backup}
+	}
+	sort.SliceStable(report, func(i, j int) bool { return report[i].Backup.Time.After(report[j].Backup.Time) })
+	keep := func(k int, reason string) {
+		report[k].Keep = true
+		report[k].Reasons = append(report[k].Reasons, reason)
+	}
+
+	// Last and minimum age
+	for k := range report {
+		if k < policy.KeepLast {
+			keep(k, "last")
+		}
+		if policy.MinimumAge > 0 && now.Sub(report[k].Backup.Time) < policy.MinimumAge {
+			keep(k, "minimum age")
+		}
+	}
+
+	// The newest backup of each period, the periods start at now
+	periods := []struct {
+		reason string
+		since  time.Time
+		bucket func(t time.Time) string
+	}{
+		{"daily", now.AddDate(0, 0, -policy.KeepDaily), func(t time.Time) string { return t.Format("2006-01-02") }},
+		{"weekly", now.AddDate(0, 0, -7*policy.KeepWeekly), func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-%d", year, week)
+		}},
+		{"monthly", now.AddDate(0, -policy.KeepMonthly, 0), func(t time.Time) string { return t.Format("2006-01") }},
+		{"yearly", now.AddDate(-policy.KeepYearly, 0, 0), func(t time.Time) string { return t.Format("2006") }},
+	}
+	for _, period := range periods {
+		seen := make(map[string]bool)
+		for k := range report {
+			backupTime := report[k].Backup.Time.In(now.Location())
+			if !backupTime.After(period.since) {
+				continue
+			}
+			bucket := period.bucket(backupTime)
+			if !seen[bucket] {
+				seen[bucket] = true
+				keep(k, period.reason)
+			}
+		}
+	}
+
+	// Never delete the only verified backup
+	newestVerified := -1
+	verifiedKept := false
+	for k := range report {
+		if report[k].Backup.Verified {
+			verifiedKept = verifiedKept || report[k].Keep
+			if newestVerified == -1 {
+				newestVerified = k
+			}
+		}
+	}
+	if newestVerified != -1 && !verifiedKept {
+		keep(newestVerified, "only verified backup")
+	}
+
+	// An incremental backup needs the backups down to the full one, after
+	// all the other rules so every kept backup can be restored
+	for k := range report {
+		if !report[k].Keep || report[k].Backup.Level == 0 {
+			continue
+		}
+		for j := k + 1; j < len(report); j++ {
+			if !report[j].Keep {
+				keep(j, "base of "+report[k].Backup.Name)
+			}
+			if report[j].Backup.Level == 0 {
+				break
+			}
+		}
+	}
+
+	return report, nil
+}
+
+// backupNamePattern matches the names created by Run, the prefix is the job
+// and the node and the files of a backup share the prefix and the time
+var backupNamePattern = regexp.MustCompile(`^(.+)-(\d{8}T\d{6}Z)\.`)
+
+// groupBackups groups the files by backup, the files which don't belong to
+// a backup of prefix are ignored
+func groupBackups(fileNames []string, prefix string) map[string]*BackupInfo {
+	backups := make(map[string]*BackupInfo)
+	for _, fileName := range fileNames {
+		match := backupNamePattern.FindStringSubmatch(fileName)
+		if match == nil || match[1] != prefix {
+			continue
+		}
+		backupTime, err := time.Parse("20060102T150405Z", match[2])
+		if err != nil {
+			continue
+		}
+		key := match[1] + "-" + match[2]
+		backup, found := backups[key]
+		if !found {
+			backup = &BackupInfo{Name: key, Time: backupTime}
+			backups[key] = backup
+		}
+		backup.Files = append(backup.Files, fileName)
+	}
+	return backups
+}
+
+func sortedBackups(backups map[string]*BackupInfo) []BackupInfo {
+	var sorted []BackupInfo
+	for _, backup := range backups {
+		sort.Strings(backup.Files)
+		sorted = append(sorted, *backup)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Time.After(sorted[j].Time) })
+	return sorted
+}
+
+// jobPrefix is the beginning of the names of the archives of a job
+func jobPrefix(name string, node string) string {
+	return fmt.Sprintf("%s-%s", name, strings.ToLower(node))
+}
+
+// ListBackups returns the backups of a job from the root of a storage, the
+// metadata is read to know if they are verified
+func ListBackups(ctx context.Context, target storage.Storage, name string, node string) ([]BackupInfo, error) {
+	files, err := target.List(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	var fileNames []string
+	for _, file := range files {
+		if !file.IsDirectory {
+			fileNames = append(fileNames, file.Name)
+		}
+	}
+	backups := groupBackups(fileNames, jobPrefix(name, node))
+	for _, backup := range backups {
+		for _, fileName := range backup.Files {
+			if !strings.HasSuffix(fileName, MetadataSuffix) {
+				continue
+			}
+			metadata, err := readStoredMetadata(ctx, target, fileName)
+			if err != nil {
+				return nil, err
+			}
+			backup.Verified = metadata.Verified
+			backup.Level = metadata.Level
+		}
+	}
+	return sortedBackups(backups), nil
+}
+
+// readStoredMetadata returns an empty result when the metadata can't be
+// decoded, the backup is then seen as not verified and a warning is logged
+func readStoredMetadata(ctx context.Context, target storage.Storage, fileName string) (Result, error) {
+	reader, err := target.Get(ctx, fileName)
+	if err != nil {
+		return Result{}, fmt.Errorf("couldn't read metadata %s from %s -> %s", fileName, storage.String(target), err)
+	}
+	defer reader.Close()
+	var metadata Result
+	content, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return Result{}, fmt.Errorf("couldn't read metadata %s from %s -> %s", fileName, storage.String(target), err)
+	}
+	err = json.Unmarshal(content, &metadata)
+	if err != nil {
+		log.Warningf("Couldn't decode metadata %s from %s, the backup is seen as not verified -> %s", fileName, storage.String(target), err)
+	}
+	return metadata, nil
+}
+
+// ListLocalBackups is ListBackups for a directory, the files are paths
+func ListLocalBackups(directoryPath string, name string, node string) ([]BackupInfo, error) {
+	backups, err := ListBackups(context.Background(), storage.NewLocal(directoryPath), name, node)
+	if err != nil {
+		return nil, err
+	}
+	for _, backup := range backups {
+		for k, fileName := range backup.Files {
+			backup.Files[k] = filepath.Join(directoryPath, fileName)
+		}
+	}
+	return backups, nil
+}
+
+// ListRemoteBackups is ListBackups for the upload directory of client
+func ListRemoteBackups(ctx context.Context, client *nextcloud.Client, name string, node string) ([]BackupInfo, error) {
+	return ListBackups(ctx, storage.NewWebDAV(client), name, node)
+}
+
+// PruneStorage deletes the backups of a job which are not kept by the
+// policy from a storage, nothing is deleted for a dry run
+func PruneStorage(ctx context.Context, target storage.Storage, name string, node string, policy RetentionPolicy, dryRun bool) (RetentionReport, error) {
+	backups, err := ListBackups(ctx, target, name, node)
+	if err != nil {
+		return nil, err
+	}
+	report, err := ApplyRetention(backups, policy, time.Now())
+	if err != nil || dryRun {
+		return report, err
+	}
+	for _, backup := range report.Pruned() {
+		log.Infof("Pruning backup %s from %s", backup.Name, storage.String(target))
+		for _, fileName := range backup.Files {
+			err := target.Delete(ctx, fileName)
+			if err != nil {
+				return report, fmt.Errorf("couldn't prune backup %s from %s -> %s", backup.Name, storage.String(target), err)
+			}
+		}
+	}
+	return report, nil
+}
+
+// PruneLocal is PruneStorage for a directory
+func PruneLocal(directoryPath string, name string, node string, policy RetentionPolicy, dryRun bool) (RetentionReport, error) {
+	return PruneStorage(context.Background(), storage.NewLocal(directoryPath), name, node, policy, dryRun)
+}
+
+// PruneRemote is PruneStorage for the upload directory of client
+func PruneRemote(ctx context.Context, client *nextcloud.Client, name string, node string, policy RetentionPolicy, dryRun bool) (RetentionReport, error) {
+	return PruneStorage(ctx, storage.NewWebDAV(client), name, node, policy, dryRun)
+}
+
+// PruneRepository forgets the snapshots of a host which are not kept by the
+// policy and collects their chunks, the snapshots of the other hosts are
+// left alone
+func PruneRepository(ctx context.Context, repository *core.Repository, host string, policy RetentionPolicy, dryRun bool) (RetentionReport, error) {
+	snapshots, err := repository.Snapshots()
+	if err != nil {
+		return nil, err
+	}
+	var backups []BackupInfo
+	for _, snapshot := range snapshots {
+		if strings.EqualFold(snapshot.Host, host) {
+			// The chunks are checked against their hash when they are stored
+			backups = append(backups, BackupInfo{Name: snapshot.Id, Time: snapshot.Time, Verified: true})
+		}
+	}
+	report, err := ApplyRetention(backups, policy, time.Now())
+	if err != nil || dryRun {
+		return report, err
+	}
+	var ids []string
+	for _, backup := range report.Pruned() {
+		ids = append(ids, backup.Name)
+	}
+	if len(ids) == 0 {
+		return report, nil
+	}
+	log.Infof("Pruning snapshots %s from repository %s", strings.Join(ids, ", "), repository.Path())
+	err = repository.ForgetSnapshots(ids...)
+	if err != nil {
+		return report, err
+	}
+	_, err = repository.GarbageCollect(ctx)
+	return report, err
+}
@@ -0,0 +1,204 @@
+/*
+   Copyright (c) 2022 Cyber Home Lab authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	core "cyberhomelab.com/core/core"
+	nextcloud "cyberhomelab.com/core/nextcloud"
+
+	"golang.org/x/net/webdav"
+	"gotest.tools/assert"
+)
+
+// keptNames returns the names of the kept backups, newest first
+func keptNames(report RetentionReport) []string {
+	var names []string
+	for _, decision := range report {
+		if decision.Keep {
+			names = append(names, decision.Backup.Name)
+		}
+	}
+	return names
+}
+
+func TestApplyRetentionHappyFlow(t *testing.T) {
+	now := time.Date(2022, 6, 15, 12, 0, 0, 0, time.UTC)
+	// One backup a day for 400 days
+	var backups []BackupInfo
+	for day := 0; day < 400; day++ {
+		backupTime := now.AddDate(0, 0, -day)
+		backups = append(backups, BackupInfo{Name: backupTime.Format("2006-01-02"), Time: backupTime, Verified: true})
+	}
+
+	report, err := ApplyRetention(backups, RetentionPolicy{KeepLast: 2}, now)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, keptNames(report), []string{"2022-06-15", "2022-06-14"})
+	assert.Equal(t, len(report.Pruned()), 398)
+
+	report, err = ApplyRetention(backups, RetentionPolicy{KeepDaily: 3, KeepMonthly: 3}, now)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, keptNames(report), []string{"2022-06-15", "2022-06-14", "2022-06-13", "2022-05-31", "2022-04-30", "2022-03-31"})
+	assert.DeepEqual(t, report[0].Reasons, []string{"daily", "monthly"})
+
+	report, err = ApplyRetention(backups, RetentionPolicy{KeepWeekly: 2, KeepYearly: 2}, now)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, keptNames(report), []string{"2022-06-15", "2022-06-12", "2022-06-05", "2021-12-31"})
+
+	report, err = ApplyRetention(backups, RetentionPolicy{MinimumAge: 36 * time.Hour}, now)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, keptNames(report), []string{"2022-06-15", "2022-06-14"})
+	assert.Assert(t, strings.Contains(report.String(), "keep  2022-06-14 (minimum age)\nprune 2022-06-13"))
+}
+
+func TestApplyRetentionProtection(t *testing.T) {
+	now := time.Date(2022, 6, 15, 12, 0, 0, 0, time.UTC)
+	backups := []BackupInfo{
+		{Name: "incremental2", Time: now.Add(-1 * time.Hour), Level: 2},
+		{Name: "incremental1", Time: now.Add(-2 * time.Hour), Level: 1},
+		{Name: "full", Time: now.Add(-3 * time.Hour), Level: 0},
+		{Name: "verified", Time: now.Add(-4 * time.Hour), Verified: true},
+		{Name: "old", Time: now.Add(-5 * time.Hour), Verified: true},
+	}
+
+	// The base of an incremental backup is kept and so is the newest
+	// verified backup when no other one is
+	report, err := ApplyRetention(backups, RetentionPolicy{KeepLast: 1}, now)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, keptNames(report), []string{"incremental2", "incremental1", "full", "verified"})
+	assert.DeepEqual(t, report[2].Reasons, []string{"base of incremental2"})
+	assert.DeepEqual(t, report[3].Reasons, []string{"only verified backup"})
+
+	// The bases of the verified backup kept by the protection are kept too
+	backups = []BackupInfo{
+		{Name: "new", Time: now.Add(-1 * time.Hour)},
+		{Name: "verified2", Time: now.Add(-2 * time.Hour), Level: 2, Verified: true},
+		{Name: "verified1", Time: now.Add(-3 * time.Hour), Level: 1, Verified: true},
+		{Name: "verified0", Time: now.Add(-4 * time.Hour), Level: 0, Verified: true},
+		{Name: "older", Time: now.Add(-5 * time.Hour), Verified: true},
+	}
+	report, err = ApplyRetention(backups, RetentionPolicy{KeepLast: 1}, now)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, keptNames(report), []string{"new", "verified2", "verified1", "verified0"})
+	assert.DeepEqual(t, report[3].Reasons, []string{"base of verified2"})
+
+	_, err = ApplyRetention(backups, RetentionPolicy{}, now)
+	assert.ErrorContains(t, err, "the retention policy doesn't keep anything")
+}
+
+// writeTestBackups creates the files of three backups of a job in
+// directoryPath, the oldest one is verified
+func writeTestBackups(t *testing.T, directoryPath string) {
+	assert.NilError(t, os.MkdirAll(directoryPath, core.DefaultMode))
+	for k, timestamp := range []string{"20220101T000000Z", "20220102T000000Z", "20220103T000000Z"} {
+		archiveName := "job-mars-" + timestamp + ".tar.gz"
+		assert.NilError(t, core.WriteToFile(filepath.Join(directoryPath, archiveName), archiveName))
+		content, err := json.Marshal(Result{Archive: archiveName, Verified: k == 0})
+		assert.NilError(t, err)
+		assert.NilError(t, core.WriteToFile(filepath.Join(directoryPath, MetadataPath(archiveName)), string(content)))
+	}
+	// Another job is never pruned
+	assert.NilError(t, core.WriteToFile(filepath.Join(directoryPath, "other-mars-20220101T000000Z.tar.gz"), "other"))
+}
+
+func TestPruneLocal(t *testing.T) {
+	directoryPath := filepath.Join(os.TempDir(), "TestPruneLocal")
+	writeTestBackups(t, directoryPath)
+
+	backups, err := ListLocalBackups(directoryPath, "job", "Mars")
+	assert.NilError(t, err)
+	assert.Equal(t, len(backups), 3)
+	assert.Equal(t, backups[0].Name, "job-mars-20220103T000000Z")
+	assert.DeepEqual(t, backups[2].Files, []string{
+		filepath.Join(directoryPath, "job-mars-20220101T000000Z.tar.gz"),
+		filepath.Join(directoryPath, "job-mars-20220101T000000Z.tar.gz.json"),
+	})
+	assert.Equal(t, backups[2].Verified, true)
+
+	// A dry run doesn't delete anything
+	report, err := PruneLocal(directoryPath, "job", "Mars", RetentionPolicy{KeepLast: 1}, true)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, keptNames(report), []string{"job-mars-20220103T000000Z", "job-mars-20220101T000000Z"})
+	files, err := os.ReadDir(directoryPath)
+	assert.NilError(t, err)
+	assert.Equal(t, len(files), 7)
+
+	_, err = PruneLocal(directoryPath, "job", "Mars", RetentionPolicy{KeepLast: 1}, false)
+	assert.NilError(t, err)
+	files, err = os.ReadDir(directoryPath)
+	assert.NilError(t, err)
+	assert.Equal(t, len(files), 5)
+	_, err = os.Stat(filepath.Join(directoryPath, "job-mars-20220102T000000Z.tar.gz"))
+	assert.Assert(t, os.IsNotExist(err))
+
+	// Cleanup
+	assert.NilError(t, core.Remove(directoryPath))
+}
+
+func TestPruneRemote(t *testing.T) {
+	directoryPath := filepath.Join(os.TempDir(), "TestPruneRemote")
+	writeTestBackups(t, filepath.Join(directoryPath, "backups"))
+	handler := &webdav.Handler{Prefix: "/remote.php/dav/files/user", FileSystem: webdav.Dir(directoryPath), LockSystem: webdav.NewMemLS()}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	client := &nextcloud.Client{BaseURL: server.URL, Directory: "backups", User: "user", Password: "password"}
+
+	report, err := PruneRemote(context.Background(), client, "job", "Mars", RetentionPolicy{KeepLast: 1}, false)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, keptNames(report), []string{"job-mars-20220103T000000Z", "job-mars-20220101T000000Z"})
+	backups, err := ListRemoteBackups(context.Background(), client, "job", "Mars")
+	assert.NilError(t, err)
+	assert.Equal(t, len(backups), 2)
+	assert.Equal(t, backups[1].Verified, true)
+
+	// Cleanup
+	assert.NilError(t, core.Remove(directoryPath))
+}
+
+func TestPruneRepository(t *testing.T) {
+	directoryPath := filepath.Join(os.TempDir(), "TestPruneRepository")
+	repositoryPath := filepath.Join(os.TempDir(), "TestPruneRepository_repository")
+	createTestConfig(t, directoryPath)
+	repository, err := core.InitRepository(repositoryPath, core.RepositoryOptions{})
+	assert.NilError(t, err)
+	for _, host := range []string{"mars", "mars", "phobos"} {
+		_, err := repository.CreateSnapshot(context.Background(), []string{directoryPath}, core.SnapshotOptions{Host: host})
+		assert.NilError(t, err)
+	}
+
+	report, err := PruneRepository(context.Background(), repository, "Mars", RetentionPolicy{KeepLast: 1}, true)
+	assert.NilError(t, err)
+	assert.Equal(t, len(report.Pruned()), 1)
+	_, err = PruneRepository(context.Background(), repository, "Mars", RetentionPolicy{KeepLast: 1}, false)
+	assert.NilError(t, err)
+	snapshots, err := repository.Snapshots()
+	assert.NilError(t, err)
+	assert.Equal(t, len(snapshots), 2)
+	assert.Equal(t, snapshots[0].Id, report[0].Backup.Name)
+
+	// Cleanup
+	assert.NilError(t, core.Remove(directoryPath))
+	assert.NilError(t, core.Remove(repositoryPath))
+}
@@ -18,88 +18,636 @@ package core
 
 import (
 	"archive/tar"
-	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 )
 
-func addToArchive(tarWriter *tar.Writer, filePath string) error {
-	// Open the file
-	file, err := os.Open(filePath)
+type ArchiveOptions struct {
+	// Format is detected from the extension of the archive when it is empty
+	Format ArchiveFormat
+	// CompressionLevel uses the default of the format when it is 0
+	CompressionLevel int
+	// Limiter throttles the reading of the files added to the archive
+	Limiter    *RateLimiter
+	IOPriority *IOPriority
+	// Preflight checks the free space for the archive, the size of the
+	// files is used as the estimation because the compression ratio is unknown
+	Preflight *PreflightOptions
+	// Reproducible creates the same bytes for the same data: the sources are
+	// sorted, the modification times are clamped to SourceDateEpoch (or the
+	// SOURCE_DATE_EPOCH environment variable) and the compression headers
+	// don't contain any timestamp
+	Reproducible    bool
+	SourceDateEpoch *time.Time
+	// StripOwnership stores all the entries as owned by 0:0 without names
+	StripOwnership bool
+	// Tee receives a copy of the archive stream, for example a hash or an
+	// upload running in parallel
+	Tee io.Writer
+	// StripPrefix is removed from the paths of the files to get the names
+	// stored in the archive, by default the names start with the base name
+	// of each source. ArchiveRoot is added in front of all the names
+	StripPrefix string
+	ArchiveRoot string
+	// Filter selects the files added to the archive, PathFilters replaces
+	// it for some of the sources
+	Filter      *Filter
+	PathFilters map[string]*Filter
+	// Encryption encrypts the archive stream for its recipients or with a
+	// passphrase, the encryption is never reproducible
+	Encryption *EncryptionOptions
+	// VolumeSize splits the archive created by CreateArchive into volumes
+	// of this size with an index next to them, see VolumeIndex
+	VolumeSize int64
+	// Snapshot makes the archive incremental, only the files changed since
+	// the archive which wrote the snapshot are stored together with the
+	// deleted names. Without the snapshot file a full archive is created.
+	// Differential keeps the snapshot as it is, so every archive is
+	// compared with the full one
+	Snapshot     string
+	Differential bool
+	// DeferSnapshot leaves the snapshot file as it is, the caller writes
+	// the Snapshot of the result with WriteSnapshot once the archive is
+	// verified
+	DeferSnapshot bool
+	// Concurrency compresses gzip and zstd archives with this many
+	// goroutines, the blocks of CompressionBlockSize bytes are compressed
+	// independently so the archive is a bit bigger. The archive is
+	// compressed by a single goroutine when it is 0 or 1
+	Concurrency          int
+	CompressionBlockSize int
+}
+
+// getSourceDateEpoch returns the time used to clamp the modification times,
+// nil means the times are kept
+func getSourceDateEpoch(options ArchiveOptions) (*time.Time, error) {
+	if !options.Reproducible || options.SourceDateEpoch != nil {
+		return options.SourceDateEpoch, nil
+	}
+	epoch, found := os.LookupEnv("SOURCE_DATE_EPOCH")
+	if !found || StringIsEmpty(epoch) {
+		return nil, nil
+	}
+	seconds, err := strconv.ParseInt(strings.TrimSpace(epoch), 10, 64)
 	if err != nil {
-		return fmt.Errorf("couldn't open file %s -> %s", filePath, err)
+		return nil, fmt.Errorf("SOURCE_DATE_EPOCH %s is not a valid timestamp -> %s", epoch, err)
 	}
-	defer file.Close()
+	sourceDateEpoch := time.Unix(seconds, 0).UTC()
+	return &sourceDateEpoch, nil
+}
+
+func normalizeHeader(header *tar.Header, options ArchiveOptions, sourceDateEpoch *time.Time) {
+	if options.StripOwnership {
+		header.Uid = 0
+		header.Gid = 0
+		header.Uname = ""
+		header.Gname = ""
+	}
+	if options.Reproducible {
+		header.AccessTime = time.Time{}
+		header.ChangeTime = time.Time{}
+		header.ModTime = header.ModTime.Truncate(time.Second)
+	}
+	if sourceDateEpoch != nil && header.ModTime.After(*sourceDateEpoch) {
+		header.ModTime = *sourceDateEpoch
+	}
+}
+
+// paxXattrPrefix is the PAX record prefix used by GNU tar and star for the
+// extended attributes
+const paxXattrPrefix = "SCHILY.xattr."
 
-	// ...
-	info, err := os.Stat(filePath)
+type fileId struct {
+	device uint64
+	inode  uint64
+}
+
+// archiver adds the files to an archive, it remembers the hardlinks
+// already stored so the next ones are stored as links
+type archiver struct {
+	ctx             context.Context
+	writer          archiveWriter
+	options         ArchiveOptions
+	sourceDateEpoch *time.Time
+	hardlinks       map[fileId]string
+	result          ArchiveResult
+	// previous is the snapshot of the incremental archives, snapshot is the
+	// one of the current run
+	previous *Snapshot
+	snapshot *Snapshot
+	// manifest has the hash of each regular file in the order they were
+	// written, latestModTime is used as the time of the manifest entry
+	manifest      []manifestEntry
+	latestModTime time.Time
+}
+
+func newArchiver(ctx context.Context, writer archiveWriter, options ArchiveOptions) (*archiver, error) {
+	sourceDateEpoch, err := getSourceDateEpoch(options)
 	if err != nil {
+		return nil, err
+	}
+	a := &archiver{
+		ctx:             ctx,
+		writer:          writer,
+		options:         options,
+		sourceDateEpoch: sourceDateEpoch,
+		hardlinks:       make(map[fileId]string),
+	}
+
+	// Incremental archives
+	if options.Snapshot != "" {
+		a.previous, err = ReadSnapshot(options.Snapshot)
+		if err != nil {
+			return nil, err
+		}
+		a.snapshot = &Snapshot{Time: time.Now().UTC(), Entries: make(map[string]SnapshotEntry)}
+		if a.previous != nil {
+			a.snapshot.Level = a.previous.Level + 1
+		}
+		a.result.Level = a.snapshot.Level
+	}
+	return a, nil
+}
+
+// entryName returns the name stored in the archive for path, sourcePath is
+// the file or directory given by the caller
+func (a *archiver) entryName(sourcePath string, path string) (string, error) {
+	var name string
+	if a.options.StripPrefix != "" {
+		relativePath, err := filepath.Rel(filepath.Clean(a.options.StripPrefix), path)
+		if err != nil {
+			return "", err
+		}
+		if relativePath == ".." || strings.HasPrefix(relativePath, "../") {
+			return "", fmt.Errorf("%s is not under the prefix %s", path, a.options.StripPrefix)
+		}
+		name = relativePath
+	} else {
+		relativePath, err := filepath.Rel(sourcePath, path)
+		if err != nil {
+			return "", err
+		}
+		name = filepath.Join(filepath.Base(sourcePath), relativePath)
+	}
+	name = filepath.ToSlash(filepath.Join(a.options.ArchiveRoot, name))
+	return strings.TrimPrefix(name, "/"), nil
+}
+
+func (a *archiver) addToArchive(sourcePath string) error {
+	sourcePath = filepath.Clean(sourcePath)
+
+	// The source itself is not followed if it is a symlink
+	_, err := os.Lstat(sourcePath)
+	if err != nil {
+		return fmt.Errorf("couldn't run os.Lstat() -> %s", err)
+	}
+
+	// Go through each file, the walk doesn't follow the symlinks
+	filter := a.options.Filter
+	if pathFilter, found := a.options.PathFilters[sourcePath]; found {
+		filter = pathFilter
+	}
+	return filter.Walk(sourcePath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name, err := a.entryName(sourcePath, path)
+		if err != nil {
+			return err
+		}
+		if name == "" || name == "." {
+			return nil
+		}
+		return a.addEntry(path, name, info)
+	})
+}
+
+func (a *archiver) addEntry(path string, name string, info os.FileInfo) error {
+	err := a.ctx.Err()
+	if err != nil {
+		return err
+	}
+
+	// Sockets can't be restored
+	if info.Mode()&os.ModeSocket != 0 {
+		return nil
+	}
+
+	// Zip archives only have directories, regular files and symlinks
+	if a.options.Format == ArchiveFormatZip && !info.IsDir() && !info.Mode().IsRegular() && info.Mode()&os.ModeSymlink == 0 {
+		a.result.Warnings = append(a.result.Warnings, fmt.Sprintf("skipped special file %s, zip archives can't store it", path))
 		return nil
 	}
-	var baseDir string
+
+	// Symlinks
+	var linkTarget string
+	if info.Mode()&os.ModeSymlink != 0 {
+		var err error
+		linkTarget, err = os.Readlink(path)
+		if err != nil {
+			return fmt.Errorf("couldn't read symlink %s -> %s", path, err)
+		}
+	}
+
+	// Header, it contains the names of the owners as well
+	header, err := tar.FileInfoHeader(info, linkTarget)
+	if err != nil {
+		return fmt.Errorf("couldn't create the header for %s -> %s", path, err)
+	}
+	header.Name = name
 	if info.IsDir() {
-		baseDir = filepath.Base(filePath)
+		header.Name += "/"
+	}
+	if name == ManifestName || name == DeletionsName {
+		return fmt.Errorf("%s can't be archived, its name is reserved", path)
+	}
+	if a.unchanged(name, info) {
+		return nil
 	}
 
-	// Go through each file
-	return filepath.Walk(filePath,
-		func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
-			header, err := tar.FileInfoHeader(info, info.Name())
-			if err != nil {
-				return err
-			}
+	// Hardlinks, zip archives don't support them so the content is stored again
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if ok && info.Mode().IsRegular() && stat.Nlink > 1 && a.options.Format != ArchiveFormatZip {
+		id := fileId{device: uint64(stat.Dev), inode: uint64(stat.Ino)}
+		if firstName, found := a.hardlinks[id]; found {
+			header.Typeflag = tar.TypeLink
+			header.Linkname = firstName
+			header.Size = 0
+		} else {
+			a.hardlinks[id] = header.Name
+		}
+	}
 
-			if baseDir != "" {
-				header.Name = filepath.Join(baseDir, strings.TrimPrefix(path, filePath))
-			}
+	// Extended attributes, stored as PAX records
+	xattrs, err := getXattrs(path)
+	if err != nil {
+		return fmt.Errorf("couldn't read the extended attributes of %s -> %s", path, err)
+	}
+	if len(xattrs) > 0 {
+		header.PAXRecords = make(map[string]string)
+		for name, value := range xattrs {
+			header.PAXRecords[paxXattrPrefix+name] = value
+		}
+		header.Format = tar.FormatPAX
+	}
 
-			if err := tarWriter.WriteHeader(header); err != nil {
-				return err
-			}
+	// Write the header
+	normalizeHeader(header, a.options, a.sourceDateEpoch)
+	err = a.writer.WriteHeader(header)
+	if err != nil {
+		return err
+	}
+	a.result.Entries++
+	if header.ModTime.After(a.latestModTime) {
+		a.latestModTime = header.ModTime
+	}
+	if header.Typeflag != tar.TypeReg {
+		return nil
+	}
+	a.result.Bytes += header.Size
 
-			if info.IsDir() {
-				return nil
-			}
+	// Write the content, exactly the size from the header even if the file
+	// changes in the meantime
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader := a.options.Limiter.Reader(a.ctx, &contextReader{ctx: a.ctx, reader: file})
+	hash := sha256.New()
+	_, err = io.CopyN(io.MultiWriter(a.writer, hash), reader, header.Size)
+	if err == io.EOF {
+		return fmt.Errorf("file %s was truncated while it was archived", path)
+	}
+	if err != nil {
+		return err
+	}
+	a.manifest = append(a.manifest, manifestEntry{name: header.Name, hash: hex.EncodeToString(hash.Sum(nil))})
+	return nil
+}
 
-			file, err := os.Open(path)
+// writeManifest adds the manifest as the last entry, it isn't counted in
+// the result because it isn't one of the files
+func (a *archiver) writeManifest() error {
+	content := formatManifest(a.manifest)
+	modTime := a.latestModTime
+	if modTime.IsZero() {
+		modTime = time.Unix(0, 0).UTC()
+	}
+	header := &tar.Header{
+		Name:     ManifestName,
+		Mode:     0644,
+		ModTime:  modTime,
+		Typeflag: tar.TypeReg,
+		Size:     int64(len(content)),
+	}
+	err := a.writer.WriteHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = a.writer.Write(content)
+	return err
+}
+
+func CreateArchive(archivePath string, filePaths []string) error {
+	_, err := CreateArchiveWithOptions(archivePath, filePaths, ArchiveOptions{})
+	return err
+}
+
+func CreateArchiveWithOptions(archivePath string, filePaths []string, options ArchiveOptions) (ArchiveResult, error) {
+	return CreateArchiveWithContext(context.Background(), archivePath, filePaths, options)
+}
+
+// CreateArchiveWithContext stops as soon as ctx is done, the archive is
+// incomplete in that case
+func CreateArchiveWithContext(ctx context.Context, archivePath string, filePaths []string, options ArchiveOptions) (ArchiveResult, error) {
+	var result ArchiveResult
+	err := withIOPriority(options.IOPriority, func() error {
+		var err error
+		result, err = createArchive(ctx, archivePath, filePaths, options)
+		return err
+	})
+	return result, err
+}
+
+// validateArchiveOptions checks the options which don't depend on the files,
+// before anything is written
+func validateArchiveOptions(options ArchiveOptions) error {
+	_, err := getSourceDateEpoch(options)
+	if err != nil {
+		return err
+	}
+	if options.Encryption != nil {
+		_, err = parseRecipients(options.Encryption)
+	}
+	return err
+}
+
+func createArchive(ctx context.Context, archivePath string, filePaths []string, options ArchiveOptions) (ArchiveResult, error) {
+	err := validateArchiveOptions(options)
+	if err != nil {
+		return ArchiveResult{}, fmt.Errorf("couldn't create archive %s -> %s", archivePath, err)
+	}
+
+	// Free space
+	if options.Preflight != nil {
+		var size int64
+		for _, filePath := range filePaths {
+			pathSize, err := GetDirectorySizeWithFilter(filePath, options.Filter)
 			if err != nil {
-				return err
+				return ArchiveResult{}, fmt.Errorf("couldn't estimate the size of archive %s -> %s", archivePath, err)
 			}
-			defer file.Close()
-			_, err = io.Copy(tarWriter, file)
-			return err
-		},
-	)
+			size += pathSize
+		}
+		err = CheckFreeSpace(filepath.Dir(archivePath), size, 1, *options.Preflight)
+		if err != nil {
+			return ArchiveResult{}, err
+		}
+	}
+
+	// Format, gzip compressed tar is kept as the default for unknown extensions
+	if options.Format == ArchiveFormatAuto {
+		format, err := DetectArchiveFormat(archivePath)
+		if err != nil {
+			format = ArchiveFormatTarGz
+		}
+		options.Format = format
+	}
+
+	// Volumes
+	if options.VolumeSize > 0 {
+		writer := newVolumeWriter(archivePath, options.VolumeSize)
+		result, err := writeArchive(ctx, writer, filePaths, options)
+		if err != nil {
+			writer.finishVolume()
+			return result, fmt.Errorf("couldn't create archive %s -> %s", archivePath, err)
+		}
+		result.Files, err = writer.Close(result.ArchiveBytes, result.SHA256)
+		if err != nil {
+			return result, fmt.Errorf("couldn't finish the volumes of archive %s -> %s", archivePath, err)
+		}
+		return result, finishSnapshot(result, options)
+	}
+
+	// The archive is written next to its final name and renamed once it is
+	// complete, a failure never leaves a partial archive or replaces an
+	// older one
+	outFile, err := os.CreateTemp(filepath.Dir(archivePath), "."+filepath.Base(archivePath)+".tmp-")
+	if err != nil {
+		return ArchiveResult{}, fmt.Errorf("couldn't create archive %s -> %s", archivePath, err)
+	}
+	temporaryPath := outFile.Name()
+
+	// Write the archive
+	result, err := writeArchive(ctx, outFile, filePaths, options)
+	closeErr := outFile.Close()
+	if err != nil {
+		os.Remove(temporaryPath)
+		return result, fmt.Errorf("couldn't create archive %s -> %s", archivePath, err)
+	}
+	if closeErr == nil {
+		closeErr = os.Chmod(temporaryPath, 0644)
+	}
+	if closeErr == nil {
+		closeErr = os.Rename(temporaryPath, archivePath)
+	}
+	if closeErr != nil {
+		os.Remove(temporaryPath)
+		return result, fmt.Errorf("couldn't close archive %s -> %s", archivePath, closeErr)
+	}
+	result.Files = []string{archivePath}
+	return result, finishSnapshot(result, options)
 }
 
-func CreateArchive(archivePath string, filePaths []string) error {
-	// Create an empty file that will be used by tar
-	outFile, err := os.Create(archivePath)
+// finishSnapshot writes the snapshot of a complete archive unless the
+// caller does it
+func finishSnapshot(result ArchiveResult, options ArchiveOptions) error {
+	if result.Snapshot == nil || options.DeferSnapshot {
+		return nil
+	}
+	return WriteSnapshot(options.Snapshot, result.Snapshot)
+}
+
+type ArchiveResult struct {
+	// Entries and Bytes describe the files added to the archive
+	Entries int
+	Bytes   int64
+	// ArchiveBytes and SHA256 describe the archive stream
+	ArchiveBytes int64
+	SHA256       string
+	Duration     time.Duration
+	// Files are the paths created by CreateArchive, the archive or its
+	// volumes followed by their index
+	Files []string
+	// Level is 0 for a full archive and is increased by each incremental
+	// archive, Deleted is the number of names deleted since the previous one
+	Level   int
+	Deleted int
+	// CompressionRatio is ArchiveBytes divided by Bytes and Throughput is
+	// the number of bytes of the files archived per second
+	CompressionRatio float64
+	Throughput       float64
+	// Snapshot is the new snapshot of an incremental archive, it is nil
+	// when the snapshot file is kept as it is
+	Snapshot *Snapshot
+	// Warnings are the special files zip archives can't store, they are
+	// skipped
+	Warnings []string
+}
+
+type countingWriter struct {
+	count int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.count += int64(len(p))
+	return len(p), nil
+}
+
+// contextReader stops reading as soon as the context is done
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	err := r.ctx.Err()
 	if err != nil {
-		return fmt.Errorf("couldn't create archive %s -> %s", archivePath, err)
+		return 0, err
 	}
-	defer outFile.Close()
+	return r.reader.Read(p)
+}
 
-	// Creating the gzip writer
-	gzipWriter := gzip.NewWriter(outFile)
-	defer gzipWriter.Close()
+// NewContextReader returns a reader which fails with the error of ctx once it
+// is done
+func NewContextReader(ctx context.Context, reader io.Reader) io.Reader {
+	return &contextReader{ctx: ctx, reader: reader}
+}
+
+// WriteArchive streams the archive to writer, the format has to be given in
+// the options, otherwise gzip compressed tar is used. The stream is hashed
+// while it is written and it is copied to options.Tee as well
+func WriteArchive(ctx context.Context, writer io.Writer, filePaths []string, options ArchiveOptions) (ArchiveResult, error) {
+	var result ArchiveResult
+	err := withIOPriority(options.IOPriority, func() error {
+		var err error
+		result, err = writeArchive(ctx, writer, filePaths, options)
+		return err
+	})
+	if err != nil {
+		return result, err
+	}
+	return result, finishSnapshot(result, options)
+}
+
+func writeArchive(ctx context.Context, writer io.Writer, filePaths []string, options ArchiveOptions) (ArchiveResult, error) {
+	start := time.Now()
+	if options.Format == ArchiveFormatAuto {
+		options.Format = ArchiveFormatTarGz
+	}
+
+	// Reproducible archives
+	if options.Reproducible {
+		filePaths = append([]string{}, filePaths...)
+		sort.Strings(filePaths)
+	}
+
+	// The stream goes to the writer, the hash and the tee
+	hash := sha256.New()
+	counter := &countingWriter{}
+	writers := []io.Writer{writer, hash, counter}
+	if options.Tee != nil {
+		writers = append(writers, options.Tee)
+	}
+
+	output := io.MultiWriter(writers...)
+
+	// The encryption is the last layer, the hash is of the encrypted stream
+	var encryptingWriter io.WriteCloser
+	if options.Encryption != nil {
+		var err error
+		encryptingWriter, err = newEncryptingWriter(output, options.Encryption)
+		if err != nil {
+			return ArchiveResult{}, err
+		}
+		output = encryptingWriter
+	}
 
-	// Creating the tar writer
-	tarWriter := tar.NewWriter(gzipWriter)
-	defer tarWriter.Close()
+	// Creating the archive writer
+	var archiveWriter archiveWriter
+	var err error
+	if options.Concurrency > 1 {
+		archiveWriter, err = newParallelArchiveWriter(output, options.Format, options.CompressionLevel, options.Concurrency, options.CompressionBlockSize)
+	} else {
+		archiveWriter, err = newArchiveWriter(output, options.Format, options.CompressionLevel)
+	}
+	if err != nil {
+		return ArchiveResult{}, err
+	}
+	archiver, err := newArchiver(ctx, archiveWriter, options)
+	if err != nil {
+		archiveWriter.Close()
+		return ArchiveResult{}, err
+	}
 
 	// Adding all the files to the archive
 	for _, filePath := range filePaths {
-		err := addToArchive(tarWriter, filePath)
+		err := archiver.addToArchive(filePath)
 		if err != nil {
-			return fmt.Errorf("couldn't add file %s to archive %s -> %s", filePath, archivePath, err)
+			archiveWriter.Close()
+			return archiver.result, fmt.Errorf("couldn't add file %s -> %s", filePath, err)
 		}
 	}
-	return nil
+
+	// The deletions of the incremental archives and the manifest are always
+	// the last entries
+	err = archiver.writeDeletions()
+	if err != nil {
+		archiveWriter.Close()
+		return archiver.result, fmt.Errorf("couldn't add the deletions -> %s", err)
+	}
+	err = archiver.writeManifest()
+	if err != nil {
+		archiveWriter.Close()
+		return archiver.result, fmt.Errorf("couldn't add the manifest -> %s", err)
+	}
+
+	// Flush everything, an error here means the archive is incomplete
+	err = archiveWriter.Close()
+	if err != nil {
+		return archiver.result, fmt.Errorf("couldn't finish the archive -> %s", err)
+	}
+	if encryptingWriter != nil {
+		err = encryptingWriter.Close()
+		if err != nil {
+			return archiver.result, fmt.Errorf("couldn't finish the encryption -> %s", err)
+		}
+	}
+
+	// Result, the snapshot is written by the caller once the archive is
+	// complete
+	result := archiver.result
+	if archiver.snapshot != nil && (!options.Differential || archiver.previous == nil) {
+		result.Snapshot = archiver.snapshot
+	}
+	result.ArchiveBytes = counter.count
+	result.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	result.Duration = time.Since(start)
+	if result.Bytes > 0 {
+		result.CompressionRatio = float64(result.ArchiveBytes) / float64(result.Bytes)
+	}
+	if result.Duration > 0 {
+		result.Throughput = float64(result.Bytes) / result.Duration.Seconds()
+	}
+	return result, nil
 }
@@ -16,8 +16,14 @@
 package core
 
 import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"gotest.tools/assert"
 )
@@ -49,3 +55,135 @@ func TestCreateArchive(t *testing.T) {
 	// End
 	t.Logf("CreateArchive() function works as expected.")
 }
+
+func TestCreateArchiveReproducible(t *testing.T) {
+	sourceDirectoryPath := filepath.Join(os.TempDir(), "TestCreateArchiveReproducible_source")
+	sourceDateEpoch := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	createTestTree(t, sourceDirectoryPath, testTreeOptions{})
+
+	for _, extension := range []string{".tar.gz", ".tar.zst", ".tar.xz", ".zip"} {
+		archivePath1 := filepath.Join(os.TempDir(), "TestCreateArchiveReproducible_1"+extension)
+		archivePath2 := filepath.Join(os.TempDir(), "TestCreateArchiveReproducible_2"+extension)
+		options := ArchiveOptions{Reproducible: true, SourceDateEpoch: &sourceDateEpoch, StripOwnership: true}
+
+		// Two runs over the same data with different modification times
+		_, err := CreateArchiveWithOptions(archivePath1, []string{sourceDirectoryPath}, options)
+		assert.NilError(t, err)
+		now := time.Now()
+		assert.NilError(t, os.Chtimes(filepath.Join(sourceDirectoryPath, "a.txt"), now, now))
+		_, err = CreateArchiveWithOptions(archivePath2, []string{sourceDirectoryPath}, options)
+		assert.NilError(t, err)
+
+		// Checks
+		assert.NilError(t, CheckHash(archivePath1, archivePath2))
+
+		// Cleanup
+		for _, archivePath := range []string{archivePath1, archivePath2} {
+			assert.NilError(t, Remove(archivePath))
+		}
+	}
+
+	// Cleanup
+	assert.NilError(t, Remove(sourceDirectoryPath))
+}
+
+func TestCreateArchiveReproducibleNegativeFlow(t *testing.T) {
+	archivePath := filepath.Join(os.TempDir(), "TestCreateArchiveReproducibleNegativeFlow.tar.gz")
+	t.Cleanup(func() { os.Remove(archivePath) })
+	assert.NilError(t, WriteToFile(archivePath, "previous archive"))
+	os.Setenv("SOURCE_DATE_EPOCH", "yesterday")
+	defer os.Unsetenv("SOURCE_DATE_EPOCH")
+
+	// The options are checked before the previous archive is replaced
+	_, err := CreateArchiveWithOptions(archivePath, []string{}, ArchiveOptions{Reproducible: true})
+	assert.ErrorContains(t, err, "SOURCE_DATE_EPOCH yesterday is not a valid timestamp")
+	content, err := ReadFile(archivePath)
+	assert.NilError(t, err)
+	assert.Equal(t, content, "previous archive")
+
+	// A failed archive leaves nothing behind
+	os.Unsetenv("SOURCE_DATE_EPOCH")
+	_, err = CreateArchiveWithOptions(archivePath, []string{filepath.Join(os.TempDir(), "TestCreateArchiveReproducibleNegativeFlow_missing")}, ArchiveOptions{})
+	assert.Assert(t, err != nil)
+	content, err = ReadFile(archivePath)
+	assert.NilError(t, err)
+	assert.Equal(t, content, "previous archive")
+	temporaryPaths, err := filepath.Glob(filepath.Join(os.TempDir(), ".TestCreateArchiveReproducibleNegativeFlow.tar.gz.tmp-*"))
+	assert.NilError(t, err)
+	assert.Equal(t, len(temporaryPaths), 0)
+}
+
+func readTestArchiveHeaders(t *testing.T, archivePath string) map[string]*tar.Header {
+	headers := make(map[string]*tar.Header)
+	file, err := os.Open(archivePath)
+	assert.NilError(t, err)
+	defer file.Close()
+	gzipReader, err := gzip.NewReader(file)
+	assert.NilError(t, err)
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.NilError(t, err)
+		headers[header.Name] = header
+	}
+	return headers
+}
+
+func TestCreateArchiveFidelity(t *testing.T) {
+	sourceDirectoryPath := filepath.Join(os.TempDir(), "TestCreateArchiveFidelity_source")
+	destinationDirectoryPath := filepath.Join(os.TempDir(), "TestCreateArchiveFidelity_destination")
+	archivePath := filepath.Join(os.TempDir(), "TestCreateArchiveFidelity.tar.gz")
+	longName := strings.Repeat("long", 40)
+	createTestTree(t, sourceDirectoryPath, testTreeOptions{Links: true})
+	assert.NilError(t, WriteToFile(filepath.Join(sourceDirectoryPath, longName), "long"))
+	xattrsSupported := setXattrs(filepath.Join(sourceDirectoryPath, "b.log"), map[string]string{"user.backup": "yes"}) == nil
+
+	// Create with a custom prefix
+	options := ArchiveOptions{StripPrefix: sourceDirectoryPath, ArchiveRoot: "root"}
+	_, err := CreateArchiveWithOptions(archivePath, []string{sourceDirectoryPath}, options)
+	assert.NilError(t, err)
+
+	// Headers
+	headers := readTestArchiveHeaders(t, archivePath)
+	assert.Equal(t, headers["root/link"].Typeflag, byte(tar.TypeSymlink))
+	assert.Equal(t, headers["root/link"].Linkname, "a.txt")
+	assert.Equal(t, headers["root/hardlink"].Typeflag, byte(tar.TypeLink))
+	assert.Equal(t, headers["root/hardlink"].Linkname, "root/data")
+	assert.Assert(t, headers["root/"+longName] != nil)
+	assert.Assert(t, headers["root/src/sub/"] != nil)
+	assert.Assert(t, headers["root/a.txt"].Uname != "")
+	if xattrsSupported {
+		assert.Equal(t, headers["root/b.log"].PAXRecords[paxXattrPrefix+"user.backup"], "yes")
+	}
+
+	// Round trip
+	_, err = ExtractArchive(archivePath, destinationDirectoryPath, ExtractOptions{})
+	assert.NilError(t, err)
+	extractedDirectoryPath := filepath.Join(destinationDirectoryPath, "root")
+	linkName, err := os.Readlink(filepath.Join(extractedDirectoryPath, "link"))
+	assert.NilError(t, err)
+	assert.Equal(t, linkName, "a.txt")
+	fileStat, err := os.Stat(filepath.Join(extractedDirectoryPath, "data"))
+	assert.NilError(t, err)
+	hardlinkStat, err := os.Stat(filepath.Join(extractedDirectoryPath, "hardlink"))
+	assert.NilError(t, err)
+	assert.Assert(t, os.SameFile(fileStat, hardlinkStat))
+	assert.NilError(t, CheckHash(filepath.Join(sourceDirectoryPath, longName), filepath.Join(extractedDirectoryPath, longName)))
+	if xattrsSupported {
+		xattrs, err := getXattrs(filepath.Join(extractedDirectoryPath, "b.log"))
+		assert.NilError(t, err)
+		assert.Equal(t, xattrs["user.backup"], "yes")
+	}
+
+	// Paths outside of the prefix
+	_, err = CreateArchiveWithOptions(archivePath, []string{os.TempDir()}, ArchiveOptions{StripPrefix: sourceDirectoryPath})
+	assert.ErrorContains(t, err, "is not under the prefix")
+
+	// Cleanup
+	for _, path := range []string{sourceDirectoryPath, destinationDirectoryPath, archivePath} {
+		assert.NilError(t, Remove(path))
+	}
+}
@@ -0,0 +1,156 @@
+/*
+   Copyright (c) 2022 Cyber Home Lab authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package core
+
+import (
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+const (
+	DefaultChunkMinSize     = 512 * 1024
+	DefaultChunkAverageSize = 1024 * 1024
+	DefaultChunkMaxSize     = 8 * 1024 * 1024
+)
+
+// ChunkerOptions are the sizes of the chunks, a chunk ends where the rolling
+// hash of the last bytes matches, so an insertion only changes the chunks
+// around it. The defaults are used for the sizes which are 0
+type ChunkerOptions struct {
+	MinSize     int `json:"min_size"`
+	AverageSize int `json:"average_size"`
+	MaxSize     int `json:"max_size"`
+}
+
+func (o ChunkerOptions) withDefaults() ChunkerOptions {
+	if o.MinSize == 0 {
+		o.MinSize = DefaultChunkMinSize
+	}
+	if o.AverageSize == 0 {
+		o.AverageSize = DefaultChunkAverageSize
+	}
+	if o.MaxSize == 0 {
+		o.MaxSize = DefaultChunkMaxSize
+	}
+	return o
+}
+
+func (o ChunkerOptions) check() error {
+	if o.MinSize <= 0 || o.MinSize >= o.AverageSize || o.AverageSize > o.MaxSize {
+		return fmt.Errorf("the chunk sizes must be 0 < min (%d) < average (%d) <= max (%d)", o.MinSize, o.AverageSize, o.MaxSize)
+	}
+	return nil
+}
+
+// gearTable has a random value for each byte, it is generated from a fixed
+// seed because the chunks of a repository depend on it
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	state := uint64(0x6379626572686f6d)
+	for k := range table {
+		// splitmix64
+		state += 0x9e3779b97f4a7c15
+		value := state
+		value = (value ^ (value >> 30)) * 0xbf58476d1ce4e5b9
+		value = (value ^ (value >> 27)) * 0x94d049bb133111eb
+		table[k] = value ^ (value >> 31)
+	}
+	return table
+}()
+
+// chunker splits a stream with a gear rolling hash
+type chunker struct {
+	reader  io.Reader
+	options ChunkerOptions
+	mask    uint64
+	buffer  []byte
+	start   int
+	end     int
+	eof     bool
+}
+
+func newChunker(reader io.Reader, options ChunkerOptions) (*chunker, error) {
+	options = options.withDefaults()
+	err := options.check()
+	if err != nil {
+		return nil, err
+	}
+	// The hash matches every 2^maskBits bytes after the minimum size, the
+	// high bits of the hash depend on the last 64 bytes
+	maskBits := bits.Len(uint(options.AverageSize-options.MinSize)) - 1
+	return &chunker{
+		reader:  reader,
+		options: options,
+		mask:    ^uint64(0) << (64 - maskBits),
+		buffer:  make([]byte, options.MaxSize),
+	}, nil
+}
+
+// fill moves the data left to the beginning of the buffer and reads until
+// the buffer is full or the stream ends
+func (c *chunker) fill() error {
+	copy(c.buffer, c.buffer[c.start:c.end])
+	c.end -= c.start
+	c.start = 0
+	for c.end < len(c.buffer) && !c.eof {
+		n, err := c.reader.Read(c.buffer[c.end:])
+		c.end += n
+		if err == io.EOF {
+			c.eof = true
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cut returns the length of the chunk at the beginning of data
+func (c *chunker) cut(data []byte) int {
+	if len(data) <= c.options.MinSize {
+		return len(data)
+	}
+	if len(data) > c.options.MaxSize {
+		data = data[:c.options.MaxSize]
+	}
+	var hash uint64
+	for k := c.options.MinSize; k < len(data); k++ {
+		hash = (hash << 1) + gearTable[data[k]]
+		if hash&c.mask == 0 {
+			return k + 1
+		}
+	}
+	return len(data)
+}
+
+// Next returns the next chunk or io.EOF, the chunk is only valid until the
+// next call
+func (c *chunker) Next() ([]byte, error) {
+	if c.end-c.start < c.options.MaxSize && !c.eof {
+		err := c.fill()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+	length := c.cut(c.buffer[c.start:c.end])
+	chunk := c.buffer[c.start : c.start+length]
+	c.start += length
+	return chunk, nil
+}
@@ -0,0 +1,82 @@
+/*
+   Copyright (c) 2022 Cyber Home Lab authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package core
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+var testChunkerOptions = ChunkerOptions{MinSize: 1024, AverageSize: 4096, MaxSize: 16384}
+
+// splitTestData returns the chunks of data
+func splitTestData(t *testing.T, data []byte) [][]byte {
+	chunker, err := newChunker(bytes.NewReader(data), testChunkerOptions)
+	assert.NilError(t, err)
+	var chunks [][]byte
+	for {
+		chunk, err := chunker.Next()
+		if err == io.EOF {
+			return chunks
+		}
+		assert.NilError(t, err)
+		chunks = append(chunks, append([]byte(nil), chunk...))
+	}
+}
+
+func TestChunkerHappyFlow(t *testing.T) {
+	data := make([]byte, 1024*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	// The chunks respect the sizes and put together give the data back
+	chunks := splitTestData(t, data)
+	assert.Assert(t, len(chunks) > 100 && len(chunks) < 600, len(chunks))
+	for k, chunk := range chunks {
+		assert.Assert(t, len(chunk) <= testChunkerOptions.MaxSize)
+		if k < len(chunks)-1 {
+			assert.Assert(t, len(chunk) >= testChunkerOptions.MinSize)
+		}
+	}
+	assert.DeepEqual(t, bytes.Join(chunks, nil), data)
+
+	// An insertion only changes the chunks around it
+	changed := append(append(append([]byte(nil), data[:500000]...), []byte("inserted")...), data[500000:]...)
+	changedChunks := splitTestData(t, changed)
+	known := make(map[string]bool)
+	for _, chunk := range chunks {
+		known[string(chunk)] = true
+	}
+	different := 0
+	for _, chunk := range changedChunks {
+		if !known[string(chunk)] {
+			different++
+		}
+	}
+	assert.Assert(t, different <= 2, different)
+
+	// Empty streams have no chunks
+	assert.Equal(t, len(splitTestData(t, nil)), 0)
+}
+
+func TestChunkerNegativeFlow(t *testing.T) {
+	_, err := newChunker(bytes.NewReader(nil), ChunkerOptions{MinSize: 4096, AverageSize: 1024, MaxSize: 16384})
+	assert.ErrorContains(t, err, "the chunk sizes must be 0 < min (4096) < average (1024) <= max (16384)")
+}
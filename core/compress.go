@@ -0,0 +1,187 @@
+/*
+   Copyright (c) 2022 Cyber Home Lab authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package core
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// DefaultCompressionBlockSize is the size of the blocks compressed in
+// parallel, each block is an independent gzip member or zstd frame
+const DefaultCompressionBlockSize = 1024 * 1024
+
+type compressedBlock struct {
+	data []byte
+	err  error
+}
+
+// parallelCompressor compresses blocks of blockSize bytes in parallel and
+// writes them in order, the concatenated blocks are a valid stream because
+// gzip and zstd decoders read multiple members or frames
+type parallelCompressor struct {
+	writer    io.Writer
+	compress  func(block []byte) ([]byte, error)
+	blockSize int
+	buffer    []byte
+	queue     chan chan compressedBlock
+	done      chan struct{}
+	mutex     sync.Mutex
+	err       error
+}
+
+func newParallelCompressor(writer io.Writer, compress func(block []byte) ([]byte, error), concurrency int, blockSize int) *parallelCompressor {
+	c := &parallelCompressor{
+		writer:    writer,
+		compress:  compress,
+		blockSize: blockSize,
+		buffer:    make([]byte, 0, blockSize),
+		queue:     make(chan chan compressedBlock, concurrency),
+		done:      make(chan struct{}),
+	}
+	go c.writeBlocks()
+	return c
+}
+
+// writeBlocks writes the compressed blocks in the order they were queued,
+// after an error the remaining blocks are only drained
+func (c *parallelCompressor) writeBlocks() {
+	defer close(c.done)
+	for result := range c.queue {
+		block := <-result
+		if c.getErr() != nil {
+			continue
+		}
+		err := block.err
+		if err == nil {
+			_, err = c.writer.Write(block.data)
+		}
+		if err != nil {
+			c.mutex.Lock()
+			c.err = err
+			c.mutex.Unlock()
+		}
+	}
+}
+
+func (c *parallelCompressor) getErr() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.err
+}
+
+func (c *parallelCompressor) flush() {
+	block := c.buffer
+	c.buffer = make([]byte, 0, c.blockSize)
+	result := make(chan compressedBlock, 1)
+	go func() {
+		data, err := c.compress(block)
+		result <- compressedBlock{data: data, err: err}
+	}()
+	c.queue <- result
+}
+
+func (c *parallelCompressor) Write(p []byte) (int, error) {
+	err := c.getErr()
+	if err != nil {
+		return 0, err
+	}
+	total := 0
+	for len(p) > 0 {
+		n := c.blockSize - len(c.buffer)
+		if n > len(p) {
+			n = len(p)
+		}
+		c.buffer = append(c.buffer, p[:n]...)
+		total += n
+		p = p[n:]
+		if len(c.buffer) == c.blockSize {
+			c.flush()
+		}
+	}
+	return total, nil
+}
+
+// Close compresses the last block and waits for all the blocks to be
+// written
+func (c *parallelCompressor) Close() error {
+	if len(c.buffer) > 0 {
+		c.flush()
+	}
+	close(c.queue)
+	<-c.done
+	return c.getErr()
+}
+
+func gzipBlock(level int) func(block []byte) ([]byte, error) {
+	return func(block []byte) ([]byte, error) {
+		var buffer bytes.Buffer
+		gzipWriter, err := gzip.NewWriterLevel(&buffer, level)
+		if err != nil {
+			return nil, err
+		}
+		gzipWriter.Header = gzip.Header{OS: 255}
+		_, err = gzipWriter.Write(block)
+		if err != nil {
+			return nil, err
+		}
+		err = gzipWriter.Close()
+		return buffer.Bytes(), err
+	}
+}
+
+// newParallelArchiveWriter returns a writer compressing with concurrency
+// goroutines, the formats which can't be compressed in blocks use
+// newArchiveWriter
+func newParallelArchiveWriter(writer io.Writer, format ArchiveFormat, level int, concurrency int, blockSize int) (archiveWriter, error) {
+	if blockSize <= 0 {
+		blockSize = DefaultCompressionBlockSize
+	}
+	var compress func(block []byte) ([]byte, error)
+	switch format {
+	case ArchiveFormatTarGz:
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		if level < gzip.HuffmanOnly || level > gzip.BestCompression {
+			return nil, fmt.Errorf("gzip compression level %d is not between %d and %d", level, gzip.HuffmanOnly, gzip.BestCompression)
+		}
+		compress = gzipBlock(level)
+	case ArchiveFormatTarZst:
+		zstdOptions := []zstd.EOption{zstd.WithEncoderConcurrency(concurrency)}
+		if level != 0 {
+			zstdOptions = append(zstdOptions, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		}
+		encoder, err := zstd.NewWriter(nil, zstdOptions...)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't create the %s compressor -> %s", format, err)
+		}
+		compress = func(block []byte) ([]byte, error) {
+			return encoder.EncodeAll(block, nil), nil
+		}
+	default:
+		return newArchiveWriter(writer, format, level)
+	}
+	compressor := newParallelCompressor(writer, compress, concurrency, blockSize)
+	return &tarArchiveWriter{Writer: tar.NewWriter(compressor), compressor: compressor}, nil
+}
@@ -0,0 +1,88 @@
+/*
+   Copyright (c) 2022 Cyber Home Lab authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package core
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestParallelCompressorOrder(t *testing.T) {
+	data := make([]byte, 100000)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	// The blocks are written in order even if they finish in another order
+	var output bytes.Buffer
+	compressor := newParallelCompressor(&output, func(block []byte) ([]byte, error) {
+		return append([]byte{}, block...), nil
+	}, 8, 777)
+	for k := 0; k < len(data); k += 1000 {
+		_, err := compressor.Write(data[k : k+1000])
+		assert.NilError(t, err)
+	}
+	assert.NilError(t, compressor.Close())
+	assert.DeepEqual(t, output.Bytes(), data)
+
+	// The first error is returned
+	compressor = newParallelCompressor(io.Discard, func(block []byte) ([]byte, error) {
+		return nil, io.ErrUnexpectedEOF
+	}, 2, 10)
+	_, err := compressor.Write(data[:100])
+	assert.NilError(t, err)
+	assert.Equal(t, compressor.Close(), io.ErrUnexpectedEOF)
+}
+
+func TestParallelCompression(t *testing.T) {
+	sourceDirectoryPath := filepath.Join(os.TempDir(), "TestParallelCompression_source")
+	destinationDirectoryPath := filepath.Join(os.TempDir(), "TestParallelCompression_destination")
+	createTestTree(t, sourceDirectoryPath, testTreeOptions{})
+
+	for _, format := range []ArchiveFormat{ArchiveFormatTarGz, ArchiveFormatTarZst} {
+		options := ArchiveOptions{Format: format, Concurrency: 4, CompressionBlockSize: 16 * 1024, Reproducible: true}
+
+		// Blocks give the same bytes every time
+		var first, second bytes.Buffer
+		result, err := WriteArchive(context.Background(), &first, []string{sourceDirectoryPath}, options)
+		assert.NilError(t, err)
+		_, err = WriteArchive(context.Background(), &second, []string{sourceDirectoryPath}, options)
+		assert.NilError(t, err)
+		assert.Assert(t, bytes.Equal(first.Bytes(), second.Bytes()))
+		assert.Assert(t, result.CompressionRatio > 0.5 && result.CompressionRatio < 1)
+		assert.Assert(t, result.Throughput > 0)
+
+		// The stream is read by the standard decoders
+		_, err = ReadArchive(context.Background(), &first, destinationDirectoryPath, ExtractOptions{})
+		assert.NilError(t, err, format)
+		extractedDirectoryPath := filepath.Join(destinationDirectoryPath, filepath.Base(sourceDirectoryPath))
+		assert.NilError(t, CheckIfDirectoriesMatch(sourceDirectoryPath, extractedDirectoryPath))
+		assert.NilError(t, Remove(destinationDirectoryPath))
+	}
+
+	// Invalid level
+	_, err := WriteArchive(context.Background(), io.Discard, []string{sourceDirectoryPath}, ArchiveOptions{Format: ArchiveFormatTarGz, Concurrency: 2, CompressionLevel: 42})
+	assert.ErrorContains(t, err, "gzip compression level 42 is not between")
+
+	// Cleanup
+	assert.NilError(t, Remove(sourceDirectoryPath))
+}
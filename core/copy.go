@@ -17,60 +17,126 @@
 package core
 
 import (
+	"context"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 	"syscall"
 )
 
+type CopyStrategy string
+
+const (
+	CopyStrategyAuto          CopyStrategy = ""
+	CopyStrategyReflink       CopyStrategy = "reflink"
+	CopyStrategyCopyFileRange CopyStrategy = "copy_file_range"
+	CopyStrategySparse        CopyStrategy = "sparse"
+	CopyStrategyStream        CopyStrategy = "stream"
+)
+
+type CopyOptions struct {
+	// Strategy forces a specific copy strategy, the default (CopyStrategyAuto)
+	// tries reflink, sparse, copy_file_range and stream in this order
+	Strategy CopyStrategy
+	// Resume writes to a partial file with a journal next to it, an
+	// interrupted copy continues from the last verified block
+	Resume bool
+	// BlockSize is the journal granularity used by Resume
+	BlockSize int64
+	// Limiter throttles the copy, a throttled copy always streams the data
+	Limiter *RateLimiter
+	// IOPriority is applied to the thread doing the copy
+	IOPriority *IOPriority
+	// Preflight checks the free space in the destination before writing
+	Preflight *PreflightOptions
+	// Filter selects the files copied by CopyDirectory
+	Filter *Filter
+	// KeepMetadata gives the directories created by a plan the mode and the
+	// owner of the source and the copied files its modification time, Sync
+	// always sets it
+	KeepMetadata bool
+}
+
+type CopyResult struct {
+	Bytes    int64
+	Strategy CopyStrategy
+	// ResumedBytes is the verified prefix reused from a previous run
+	ResumedBytes int64
+}
+
 func CopyFile(sourceFilePath string, destinationPath string) (int64, error) {
+	result, err := CopyFileWithOptions(sourceFilePath, destinationPath, CopyOptions{})
+	if err != nil {
+		return 0, err
+	}
+	return result.Bytes, nil
+}
+
+func CopyFileWithOptions(sourceFilePath string, destinationPath string, options CopyOptions) (CopyResult, error) {
+	var result CopyResult
+	err := withIOPriority(options.IOPriority, func() error {
+		var err error
+		result, err = copyFileWithOptions(sourceFilePath, destinationPath, options)
+		return err
+	})
+	return result, err
+}
+
+func copyFileWithOptions(sourceFilePath string, destinationPath string, options CopyOptions) (CopyResult, error) {
 	// Checks
 	sourceFileStat, err := os.Stat(sourceFilePath)
 	if err != nil {
-		return 0, fmt.Errorf("couldn't run os.Stat() -> %s", err)
+		return CopyResult{}, fmt.Errorf("couldn't run os.Stat() -> %s", err)
 	}
 	if sourceFileStat.IsDir() {
-		return 0, fmt.Errorf("%s is a directory, not a file", sourceFilePath)
+		return CopyResult{}, fmt.Errorf("%s is a directory, not a file", sourceFilePath)
 	}
 	if !sourceFileStat.Mode().IsRegular() {
-		return 0, fmt.Errorf("%s is not a regular file", sourceFileStat)
+		return CopyResult{}, fmt.Errorf("%s is not a regular file", sourceFileStat)
 	}
 
 	// Open the file
 	source, err := os.Open(sourceFilePath)
 	if err != nil {
-		return 0, fmt.Errorf("couldn't run os.Open() -> %s", err)
+		return CopyResult{}, fmt.Errorf("couldn't run os.Open() -> %s", err)
 	}
 	defer source.Close()
 
 	// Preparing the destination
 	destinationStat, err := os.Stat(destinationPath)
 	if err != nil && !os.IsNotExist(err) {
-		return 0, fmt.Errorf("couldn't run os.Stat() -> %s", err)
+		return CopyResult{}, fmt.Errorf("couldn't run os.Stat() -> %s", err)
 	}
 	if !os.IsNotExist(err) {
 		if destinationStat.IsDir() {
 			destinationPath = filepath.Join(destinationPath, sourceFileStat.Name())
 		}
 	}
-	destination, err := os.Create(destinationPath)
-	if err != nil {
-		return 0, fmt.Errorf("couldn't run os.Create() -> %s", err)
+
+	// Free space
+	if options.Preflight != nil {
+		err = CheckFreeSpace(destinationPath, sourceFileStat.Size(), 1, *options.Preflight)
+		if err != nil {
+			return CopyResult{}, err
+		}
 	}
-	defer destination.Close()
 
 	// Coping file to the destination
-	nrOfBytes, err := io.Copy(destination, source)
+	var result CopyResult
+	if options.Resume {
+		result, err = copyFileResumable(source, sourceFileStat, destinationPath, options)
+	} else {
+		result, err = copyFile(source, sourceFileStat, destinationPath, options)
+	}
 	if err != nil {
-		return 0, fmt.Errorf("couldn't copy file to destination -> %s", err)
+		return CopyResult{}, fmt.Errorf("couldn't copy file to destination -> %s", err)
 	}
 
 	// Preserving the permissions
 	err = os.Chmod(destinationPath, sourceFileStat.Mode())
 	if err != nil {
-		return 0, fmt.Errorf(
+		return CopyResult{}, fmt.Errorf(
 			"couldn't preserve the permissions in the destination location %s -> %s",
 			destinationPath, err)
 	}
@@ -79,76 +145,60 @@ func CopyFile(sourceFilePath string, destinationPath string) (int64, error) {
 	sourceFileStatSys := sourceFileStat.Sys().(*syscall.Stat_t)
 	err = os.Chown(destinationPath, int(sourceFileStatSys.Uid), int(sourceFileStatSys.Gid))
 	if err != nil {
-		return 0, fmt.Errorf(
+		return CopyResult{}, fmt.Errorf(
 			"couldn't preserve the ownership in the destination location %s -> %s",
 			destinationPath, err)
 	}
 
 	// Finish
-	return nrOfBytes, nil
+	return result, nil
 }
 
-func CopyDirectory(sourceDirectoryPath string, destinationDirectoryPath string) error {
-	// Cleanup
-	sourceDirectoryPath = filepath.Clean(sourceDirectoryPath)
-	destinationDirectoryPath = filepath.Clean(destinationDirectoryPath)
-
-	// Checks
-	sourceStat, err := os.Stat(sourceDirectoryPath)
+func copyFile(source *os.File, sourceFileStat os.FileInfo, destinationPath string, options CopyOptions) (CopyResult, error) {
+	destination, err := os.Create(destinationPath)
 	if err != nil {
-		return fmt.Errorf("couldn't run os.Stat() -> %s", err)
-	}
-	if !sourceStat.IsDir() {
-		return fmt.Errorf("%s is not a directory", sourceDirectoryPath)
-	}
-	_, err = os.Stat(destinationDirectoryPath)
-	if err != nil && !os.IsNotExist(err) {
-		return fmt.Errorf("couldn't run os.Stat() -> %s", err)
-	}
-	if err == nil {
-		return fmt.Errorf(
-			"destination directory %s already exists, please delete it or use a different path",
-			destinationDirectoryPath)
+		return CopyResult{}, fmt.Errorf("couldn't run os.Create() -> %s", err)
 	}
+	defer destination.Close()
 
-	// Create the destination directory
-	err = os.MkdirAll(destinationDirectoryPath, sourceStat.Mode())
+	if options.Limiter != nil {
+		nrOfBytes, err := streamCopy(destination, options.Limiter.Reader(context.Background(), source))
+		if err != nil {
+			return CopyResult{}, err
+		}
+		return CopyResult{Bytes: nrOfBytes, Strategy: CopyStrategyStream}, nil
+	}
+	nrOfBytes, strategy, err := copyFileContent(destination, source, sourceFileStat.Size(), options.Strategy)
 	if err != nil {
-		return fmt.Errorf("couldn't create a directory under the following path %s -> %s", destinationDirectoryPath, err)
+		return CopyResult{}, err
 	}
+	return CopyResult{Bytes: nrOfBytes, Strategy: strategy}, nil
+}
 
-	// Get all the files in source directory
-	entries, err := ioutil.ReadDir(sourceDirectoryPath)
+// streamCopy hides the ReadFrom/WriteTo methods of *os.File, otherwise
+// io.Copy would silently switch to copy_file_range or sendfile
+func streamCopy(destination io.Writer, source io.Reader) (int64, error) {
+	return io.Copy(struct{ io.Writer }{destination}, struct{ io.Reader }{source})
+}
+
+func CopyDirectory(sourceDirectoryPath string, destinationDirectoryPath string) error {
+	return CopyDirectoryWithOptions(sourceDirectoryPath, destinationDirectoryPath, CopyOptions{})
+}
+
+func CopyDirectoryWithOptions(sourceDirectoryPath string, destinationDirectoryPath string, options CopyOptions) error {
+	priority := options.IOPriority
+	options.IOPriority = nil
+	return withIOPriority(priority, func() error {
+		return copyDirectory(sourceDirectoryPath, destinationDirectoryPath, options)
+	})
+}
+
+func copyDirectory(sourceDirectoryPath string, destinationDirectoryPath string, options CopyOptions) error {
+	plan, err := PlanCopyDirectoryWithFilter(sourceDirectoryPath, destinationDirectoryPath, options.Filter)
 	if err != nil {
-		return fmt.Errorf("couldn't get all the files under the following path %s -> %s", sourceDirectoryPath, err)
-	}
-
-	// Copy files
-	for _, entry := range entries {
-		currentSourcePath := filepath.Join(sourceDirectoryPath, entry.Name())
-		currentDestinationPath := filepath.Join(destinationDirectoryPath, entry.Name())
-
-		if entry.IsDir() {
-			err = CopyDirectory(currentSourcePath, currentDestinationPath)
-			if err != nil {
-				return fmt.Errorf("couldn't run CopyDirectory() -> %s", err)
-			}
-		} else {
-			// Skip symlinks
-			// TODO: Copy symlinks
-			if entry.Mode()&os.ModeSymlink != 0 {
-				continue
-			}
-
-			_, err = CopyFile(currentSourcePath, currentDestinationPath)
-			if err != nil {
-				return fmt.Errorf("couldn't run CopyFile() -> %s", err)
-			}
-		}
+		return err
 	}
-
-	// Finish
-	return nil
+	return plan.execute(options)
 }
 
 func Copy(sourcePath string, destinationPath string) error {
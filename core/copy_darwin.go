@@ -0,0 +1,30 @@
+/*
+   Copyright (c) 2022 Cyber Home Lab authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package core
+
+import (
+	"fmt"
+	"os"
+)
+
+func copyFileContent(destination *os.File, source *os.File, _ int64, strategy CopyStrategy) (int64, CopyStrategy, error) {
+	if strategy != CopyStrategyAuto && strategy != CopyStrategyStream {
+		return 0, strategy, fmt.Errorf("copy strategy %s is not supported on this platform", strategy)
+	}
+	nrOfBytes, err := streamCopy(destination, source)
+	return nrOfBytes, CopyStrategyStream, err
+}
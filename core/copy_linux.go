@@ -0,0 +1,191 @@
+/*
+   Copyright (c) 2022 Cyber Home Lab authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package core
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+type dataSegment struct {
+	offset int64
+	length int64
+}
+
+func copyFileContent(destination *os.File, source *os.File, size int64, strategy CopyStrategy) (int64, CopyStrategy, error) {
+	switch strategy {
+	case CopyStrategyReflink:
+		err := unix.IoctlFileClone(int(destination.Fd()), int(source.Fd()))
+		if err != nil {
+			return 0, strategy, fmt.Errorf("couldn't clone the file -> %s", err)
+		}
+		return size, strategy, nil
+	case CopyStrategySparse:
+		segments, err := getDataSegments(source, size)
+		if err != nil {
+			return 0, strategy, fmt.Errorf("couldn't detect the holes in the file -> %s", err)
+		}
+		nrOfBytes, err := copySparse(destination, source, segments, size)
+		return nrOfBytes, strategy, err
+	case CopyStrategyCopyFileRange:
+		nrOfBytes, err := copyRange(destination, source, 0, -1, false)
+		return nrOfBytes, strategy, err
+	case CopyStrategyStream:
+		nrOfBytes, err := streamCopy(destination, source)
+		return nrOfBytes, strategy, err
+	case CopyStrategyAuto:
+	default:
+		return 0, strategy, fmt.Errorf("unknown copy strategy %s", strategy)
+	}
+
+	// Reflink (btrfs, xfs, ...)
+	err := unix.IoctlFileClone(int(destination.Fd()), int(source.Fd()))
+	if err == nil {
+		return size, CopyStrategyReflink, nil
+	}
+
+	// Sparse files, only the data segments are copied
+	segments, err := getDataSegments(source, size)
+	if err == nil && isSparse(segments, size) {
+		nrOfBytes, err := copySparse(destination, source, segments, size)
+		return nrOfBytes, CopyStrategySparse, err
+	}
+
+	// In-kernel copy
+	nrOfBytes, err := copyRange(destination, source, 0, -1, false)
+	if err == nil {
+		return nrOfBytes, CopyStrategyCopyFileRange, nil
+	}
+	if !errors.Is(err, errCopyRangeUnsupported) {
+		return 0, CopyStrategyCopyFileRange, err
+	}
+
+	// Fallback
+	nrOfBytes, err = streamCopy(destination, source)
+	return nrOfBytes, CopyStrategyStream, err
+}
+
+var errCopyRangeUnsupported = errors.New("copy_file_range is not supported")
+
+// copyRange copies length bytes (or everything until EOF when length is -1)
+// starting with offset, the same offset is used in the destination. When
+// fallback is true, the data is streamed if copy_file_range is not supported
+func copyRange(destination *os.File, source *os.File, offset int64, length int64, fallback bool) (int64, error) {
+	var copied int64
+	sourceOffset := offset
+	destinationOffset := offset
+	for length < 0 || copied < length {
+		chunk := 1 << 30
+		if length >= 0 && length-copied < int64(chunk) {
+			chunk = int(length - copied)
+		}
+		n, err := unix.CopyFileRange(int(source.Fd()), &sourceOffset, int(destination.Fd()), &destinationOffset, chunk, 0)
+		if err != nil {
+			if copied == 0 && isCopyRangeUnsupported(err) {
+				if !fallback {
+					return 0, errCopyRangeUnsupported
+				}
+				return streamRange(destination, source, offset, length)
+			}
+			return copied, fmt.Errorf("couldn't run copy_file_range() -> %s", err)
+		}
+		if n == 0 {
+			break
+		}
+		copied += int64(n)
+	}
+	return copied, nil
+}
+
+func streamRange(destination *os.File, source *os.File, offset int64, length int64) (int64, error) {
+	var reader io.Reader = io.NewSectionReader(source, offset, 1<<62)
+	if length >= 0 {
+		reader = io.NewSectionReader(source, offset, length)
+	}
+	_, err := destination.Seek(offset, io.SeekStart)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't seek in the destination -> %s", err)
+	}
+	return streamCopy(destination, reader)
+}
+
+func isCopyRangeUnsupported(err error) bool {
+	return errors.Is(err, unix.ENOSYS) || errors.Is(err, unix.EXDEV) ||
+		errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.EINVAL) ||
+		errors.Is(err, unix.EBADF)
+}
+
+// getDataSegments returns the parts of the file which contain data, using
+// SEEK_DATA and SEEK_HOLE
+func getDataSegments(file *os.File, size int64) ([]dataSegment, error) {
+	var segments []dataSegment
+	fd := int(file.Fd())
+	var offset int64
+	for offset < size {
+		dataOffset, err := unix.Seek(fd, offset, unix.SEEK_DATA)
+		if errors.Is(err, unix.ENXIO) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		holeOffset, err := unix.Seek(fd, dataOffset, unix.SEEK_HOLE)
+		if err != nil {
+			return nil, err
+		}
+		if holeOffset > size {
+			holeOffset = size
+		}
+		segments = append(segments, dataSegment{offset: dataOffset, length: holeOffset - dataOffset})
+		offset = holeOffset
+	}
+	_, err := unix.Seek(fd, 0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	return segments, nil
+}
+
+func isSparse(segments []dataSegment, size int64) bool {
+	if size == 0 {
+		return false
+	}
+	if len(segments) != 1 {
+		return true
+	}
+	return segments[0].offset != 0 || segments[0].length != size
+}
+
+func copySparse(destination *os.File, source *os.File, segments []dataSegment, size int64) (int64, error) {
+	for _, segment := range segments {
+		_, err := copyRange(destination, source, segment.offset, segment.length, true)
+		if err != nil {
+			return 0, fmt.Errorf("couldn't copy the data at offset %d -> %s", segment.offset, err)
+		}
+	}
+
+	// The trailing hole
+	err := destination.Truncate(size)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't truncate the destination -> %s", err)
+	}
+	return size, nil
+}
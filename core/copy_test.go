@@ -18,7 +18,9 @@ package core
 
 import (
 	"fmt"
+	"os"
 	"path/filepath"
+	"syscall"
 	"testing"
 
 	"gotest.tools/assert"
@@ -106,3 +108,69 @@ func TestCopy(t *testing.T) {
 	// End
 	t.Logf("Copy() function works as expected.")
 }
+
+func TestCopyFileWithOptionsSparse(t *testing.T) {
+	sourceFilePath := filepath.Join(os.TempDir(), "TestCopyFileWithOptionsSparse_source")
+	destinationFilePath := filepath.Join(os.TempDir(), "TestCopyFileWithOptionsSparse_destination")
+	size := int64(16 * 1024 * 1024)
+
+	// Create a sparse source with data at the beginning and in the middle
+	assert.NilError(t, CreateFileWithMessage(sourceFilePath, "Hello Sparse World!", DefaultMode, DefaultUserId, DefaultGroupId))
+	source, err := os.OpenFile(sourceFilePath, os.O_WRONLY, 0)
+	assert.NilError(t, err)
+	_, err = source.WriteAt([]byte("Hello from the middle!"), size/2)
+	assert.NilError(t, err)
+	assert.NilError(t, source.Truncate(size))
+	assert.NilError(t, source.Close())
+
+	// Copy
+	result, err := CopyFileWithOptions(sourceFilePath, destinationFilePath, CopyOptions{Strategy: CopyStrategySparse})
+	assert.NilError(t, err)
+	assert.Equal(t, result.Strategy, CopyStrategySparse)
+	assert.Equal(t, result.Bytes, size)
+
+	// Checks
+	filesMatch, err := CheckIfFilesMatch(sourceFilePath, destinationFilePath)
+	assert.NilError(t, err)
+	assert.Assert(t, filesMatch)
+	destinationStat, err := os.Stat(destinationFilePath)
+	assert.NilError(t, err)
+	allocated := destinationStat.Sys().(*syscall.Stat_t).Blocks * 512
+	assert.Assert(t, allocated < size, "%d bytes allocated for a sparse file of %d bytes", allocated, size)
+
+	// Cleanup
+	for _, filePath := range []string{sourceFilePath, destinationFilePath} {
+		assert.NilError(t, Remove(filePath))
+	}
+}
+
+func TestCopyFileWithOptionsStrategies(t *testing.T) {
+	sourceFilePath := filepath.Join(os.TempDir(), "TestCopyFileWithOptionsStrategies_source")
+	destinationFilePath := filepath.Join(os.TempDir(), "TestCopyFileWithOptionsStrategies_destination")
+	message := "Hello World!"
+
+	// Create source
+	assert.NilError(t, CreateFileWithMessage(sourceFilePath, message, DefaultMode, DefaultUserId, DefaultGroupId))
+
+	// The automatic strategy always reports what was used
+	result, err := CopyFileWithOptions(sourceFilePath, destinationFilePath, CopyOptions{})
+	assert.NilError(t, err)
+	assert.Assert(t, result.Strategy != CopyStrategyAuto)
+	assert.NilError(t, CheckHash(sourceFilePath, destinationFilePath))
+
+	// Streaming copy
+	result, err = CopyFileWithOptions(sourceFilePath, destinationFilePath, CopyOptions{Strategy: CopyStrategyStream})
+	assert.NilError(t, err)
+	assert.Equal(t, result.Strategy, CopyStrategyStream)
+	assert.Equal(t, result.Bytes, int64(len(message)))
+	assert.NilError(t, CheckHash(sourceFilePath, destinationFilePath))
+
+	// Unknown strategy
+	_, err = CopyFileWithOptions(sourceFilePath, destinationFilePath, CopyOptions{Strategy: "unknown"})
+	assert.ErrorContains(t, err, "unknown copy strategy")
+
+	// Cleanup
+	for _, filePath := range []string{sourceFilePath, destinationFilePath} {
+		assert.NilError(t, Remove(filePath))
+	}
+}
@@ -17,6 +17,7 @@ package core
 
 import (
 	"fmt"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -41,6 +42,34 @@ type Host struct {
 	NetworkInterface string
 	FirewallRules    []string
 	Backup           []string
+	// BackupExclude has the exclude patterns of each Backup entry
+	BackupExclude map[string][]string
+	// BackupHooks has the hooks of each backup job by its name
+	BackupHooks map[string]BackupHooks
+	// BackupTargets receive a copy of each backup, a target is a local
+	// directory, "nextcloud" or sftp://node/directory for another node
+	BackupTargets []string
+	// Address is how the other nodes reach this one over SSH, the node name
+	// in lowercase when empty. SSHUser is the user they log in as, the
+	// current user when empty
+	Address string
+	SSHUser string
+}
+
+// BackupHook is a command run around a backup, Command is the program
+// followed by its arguments and Timeout is in seconds
+type BackupHook struct {
+	Command []string
+	Timeout int
+}
+
+// BackupHooks of a job, Pre runs before the backup and a failure stops it,
+// Post runs after a successful backup and Always runs after Post or after
+// the failure, so the services stopped by Pre are started again
+type BackupHooks struct {
+	Pre    []BackupHook
+	Post   []BackupHook
+	Always []BackupHook
 }
 
 type Config struct {
@@ -55,6 +84,13 @@ type Config struct {
 		NextcloudHostname     string
 		NextcloudDirectory    string
 		Backup                []string
+		BackupExclude         map[string][]string
+		// The keys of the backups can be secret references like
+		// "env:NAME" or "file:PATH", see ResolveSecret. Without recipients
+		// and passphrase the backups are encrypted for the identities
+		BackupRecipients []string
+		BackupIdentities []string
+		BackupPassphrase string
 	}
 	Nodes struct {
 		Mars   Host
@@ -111,6 +147,13 @@ func (c *Config) CheckConfig() error {
 	if ListIsEmpty(c.Common.Backup) {
 		return fmt.Errorf("list Common.Backup is empty")
 	}
+	err := checkBackupExclude("Common", c.Common.Backup, c.Common.BackupExclude)
+	if err != nil {
+		return err
+	}
+	if !ListIsEmpty(c.Common.BackupRecipients) && !StringIsEmpty(c.Common.BackupPassphrase) {
+		return fmt.Errorf("Common.BackupRecipients and Common.BackupPassphrase can't be used together")
+	}
 
 	// Test Nodes
 	nodesList := []string{"ServiceDirectory", "UserSSHKey", "RootSSHKey", "LogDirectory", "NetworkInterface"}
@@ -128,6 +171,18 @@ func (c *Config) CheckConfig() error {
 	if ListIsEmpty(c.Nodes.Mars.Backup) {
 		return fmt.Errorf("list Nodes.Mars.Backup is empty")
 	}
+	err = checkBackupExclude("Nodes.Mars", c.Nodes.Mars.Backup, c.Nodes.Mars.BackupExclude)
+	if err != nil {
+		return err
+	}
+	err = checkBackupHooks("Nodes.Mars", c.Nodes.Mars.BackupHooks)
+	if err != nil {
+		return err
+	}
+	err = checkBackupTargets("Nodes.Mars", c.Nodes.Mars.BackupTargets)
+	if err != nil {
+		return err
+	}
 
 	// Test Nodes.Phobos
 	nodesPhobosValue := reflect.ValueOf(c.Nodes.Phobos)
@@ -142,11 +197,144 @@ func (c *Config) CheckConfig() error {
 	if ListIsEmpty(c.Nodes.Phobos.Backup) {
 		return fmt.Errorf("list Nodes.Phobos.Backup is empty")
 	}
+	err = checkBackupExclude("Nodes.Phobos", c.Nodes.Phobos.Backup, c.Nodes.Phobos.BackupExclude)
+	if err != nil {
+		return err
+	}
+	err = checkBackupHooks("Nodes.Phobos", c.Nodes.Phobos.BackupHooks)
+	if err != nil {
+		return err
+	}
+	err = checkBackupTargets("Nodes.Phobos", c.Nodes.Phobos.BackupTargets)
+	if err != nil {
+		return err
+	}
 
 	// Default
 	return nil
 }
 
+// checkBackupExclude checks that the patterns are valid and belong to one
+// of the Backup entries
+func checkBackupExclude(section string, backup []string, backupExclude map[string][]string) error {
+	for backupPath, patterns := range backupExclude {
+		found := false
+		for _, path := range backup {
+			found = found || path == backupPath
+		}
+		if !found {
+			return fmt.Errorf("%s.BackupExclude has patterns for %s which is not in %s.Backup", section, backupPath, section)
+		}
+		_, err := NewFilter(FilterOptions{Exclude: patterns})
+		if err != nil {
+			return fmt.Errorf("%s.BackupExclude for %s is not valid -> %s", section, backupPath, err)
+		}
+	}
+	return nil
+}
+
+// checkBackupHooks checks that every hook has a command and a valid timeout
+func checkBackupHooks(section string, backupHooks map[string]BackupHooks) error {
+	for job, hooks := range backupHooks {
+		for kind, list := range map[string][]BackupHook{"Pre": hooks.Pre, "Post": hooks.Post, "Always": hooks.Always} {
+			for k, hook := range list {
+				if ListIsEmpty(hook.Command) || StringIsEmpty(hook.Command[0]) {
+					return fmt.Errorf("%s.BackupHooks.%s.%s[%d] has no command", section, job, kind, k)
+				}
+				if hook.Timeout < 0 {
+					return fmt.Errorf("%s.BackupHooks.%s.%s[%d] has a negative timeout", section, job, kind, k)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// checkBackupTargets checks that every target is an absolute path,
+// "nextcloud" or an sftp URL with a host and a directory
+func checkBackupTargets(section string, targets []string) error {
+	for k, target := range targets {
+		switch {
+		case target == "nextcloud", filepath.IsAbs(target):
+		case strings.HasPrefix(target, "sftp://"):
+			targetURL, err := url.Parse(target)
+			if err != nil {
+				return fmt.Errorf("%s.BackupTargets[%d] is not valid -> %s", section, k, err)
+			}
+			if targetURL.Hostname() == "" || strings.Trim(targetURL.Path, "/") == "" {
+				return fmt.Errorf("%s.BackupTargets[%d] needs a host and a directory", section, k)
+			}
+		default:
+			return fmt.Errorf("%s.BackupTargets[%d] is not a directory, nextcloud or an sftp URL", section, k)
+		}
+	}
+	return nil
+}
+
+// GetNode returns the host from Nodes with the given name, the case of the
+// name doesn't matter so the hostname can be used
+func (c *Config) GetNode(name string) (Host, error) {
+	nodesValue := reflect.ValueOf(c.Nodes)
+	for k := 0; k < nodesValue.NumField(); k++ {
+		if strings.EqualFold(nodesValue.Type().Field(k).Name, name) {
+			return nodesValue.Field(k).Interface().(Host), nil
+		}
+	}
+	return Host{}, fmt.Errorf("node %s is not in the config", name)
+}
+
+// BackupFilterOptions returns the filter of a Backup entry of host, the
+// patterns from Common and from the host are merged and the .backupignore
+// files of the tree are used as well
+func (c *Config) BackupFilterOptions(host Host, backupPath string) FilterOptions {
+	var exclude []string
+	exclude = append(exclude, c.Common.BackupExclude[backupPath]...)
+	exclude = append(exclude, host.BackupExclude[backupPath]...)
+	return FilterOptions{Exclude: exclude, IgnoreFileName: BackupIgnoreFileName}
+}
+
+// BackupEncryptionOptions resolves the keys of the backups, nil means the
+// backups are not encrypted
+func (c *Config) BackupEncryptionOptions() (*EncryptionOptions, error) {
+	if ListIsEmpty(c.Common.BackupRecipients) && ListIsEmpty(c.Common.BackupIdentities) && StringIsEmpty(c.Common.BackupPassphrase) {
+		return nil, nil
+	}
+	options := &EncryptionOptions{}
+	for _, reference := range c.Common.BackupRecipients {
+		recipient, err := ResolveSecret(reference)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't resolve Common.BackupRecipients -> %s", err)
+		}
+		options.Recipients = append(options.Recipients, recipient)
+	}
+	for _, reference := range c.Common.BackupIdentities {
+		identity, err := ResolveSecret(reference)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't resolve Common.BackupIdentities -> %s", err)
+		}
+		options.Identities = append(options.Identities, identity)
+	}
+	if !StringIsEmpty(c.Common.BackupPassphrase) {
+		passphrase, err := ResolveSecret(c.Common.BackupPassphrase)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't resolve Common.BackupPassphrase -> %s", err)
+		}
+		options.Passphrase = passphrase
+	}
+
+	// The backups of a config with identities only are encrypted for them
+	if len(options.Recipients) == 0 && options.Passphrase == "" {
+		for _, identity := range options.Identities {
+			recipient, err := identityRecipient(identity)
+			if err != nil {
+				return nil, fmt.Errorf("couldn't parse Common.BackupIdentities -> %s", err)
+			}
+			options.Recipients = append(options.Recipients, recipient)
+		}
+	}
+	return options, nil
+}
+
 func init() {
 	var err error
 
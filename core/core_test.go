@@ -20,6 +20,7 @@ import (
 	"path/filepath"
 	"testing"
 
+	toml "github.com/pelletier/go-toml"
 	"gotest.tools/assert"
 )
 
@@ -76,3 +77,40 @@ func TestCheckConfigNegativeFlow(t *testing.T) {
 	assert.NilError(t, err)
 	assert.ErrorContains(t, config.CheckConfig(), "integer Common.TelegramChatID is empty")
 }
+
+func TestGetNode(t *testing.T) {
+	var config Config
+	config.Nodes.Phobos.ServiceDirectory = "/srv"
+	host, err := config.GetNode("phobos")
+	assert.NilError(t, err)
+	assert.Equal(t, host.ServiceDirectory, "/srv")
+	_, err = config.GetNode("Deimos")
+	assert.ErrorContains(t, err, "node Deimos is not in the config")
+}
+
+func TestCheckBackupHooks(t *testing.T) {
+	var config Config
+	content := `
+[Nodes.Mars.BackupHooks.database]
+Pre = [{ Command = ["systemctl", "stop", "database"], Timeout = 60 }]
+Always = [{ Command = ["systemctl", "start", "database"] }]
+`
+	assert.NilError(t, toml.Unmarshal([]byte(content), &config))
+	hooks := config.Nodes.Mars.BackupHooks["database"]
+	assert.DeepEqual(t, hooks.Pre, []BackupHook{{Command: []string{"systemctl", "stop", "database"}, Timeout: 60}})
+	assert.Equal(t, len(hooks.Always), 1)
+	assert.NilError(t, checkBackupHooks("Nodes.Mars", config.Nodes.Mars.BackupHooks))
+
+	err := checkBackupHooks("Nodes.Mars", map[string]BackupHooks{"database": {Post: []BackupHook{{}}}})
+	assert.ErrorContains(t, err, "Nodes.Mars.BackupHooks.database.Post[0] has no command")
+	err = checkBackupHooks("Nodes.Mars", map[string]BackupHooks{"database": {Pre: []BackupHook{{Command: []string{"true"}, Timeout: -1}}}})
+	assert.ErrorContains(t, err, "Nodes.Mars.BackupHooks.database.Pre[0] has a negative timeout")
+}
+
+func TestCheckBackupTargets(t *testing.T) {
+	assert.NilError(t, checkBackupTargets("Nodes.Mars", []string{"/mnt/usb/backups", "nextcloud", "sftp://phobos/srv/backups"}))
+	err := checkBackupTargets("Nodes.Mars", []string{"backups"})
+	assert.ErrorContains(t, err, "Nodes.Mars.BackupTargets[0] is not a directory, nextcloud or an sftp URL")
+	err = checkBackupTargets("Nodes.Mars", []string{"nextcloud", "sftp://phobos"})
+	assert.ErrorContains(t, err, "Nodes.Mars.BackupTargets[1] needs a host and a directory")
+}
@@ -0,0 +1,162 @@
+/*
+   Copyright (c) 2022 Cyber Home Lab authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+)
+
+// EncryptedArchiveExtension is added after the extension of the format,
+// for example backup.tar.gz.age
+const EncryptedArchiveExtension = ".age"
+
+// ageMagic is the first line of the age format, it is used to recognise the
+// encrypted archives
+var ageMagic = []byte("age-encryption.org/v1\n")
+
+type EncryptionOptions struct {
+	// Recipients are age X25519 public keys (age1...), any of the matching
+	// identities can decrypt the archive
+	Recipients []string
+	// Identities are age X25519 private keys (AGE-SECRET-KEY-1...), they
+	// are only used for decryption
+	Identities []string
+	// Passphrase is used with scrypt instead of the keys, it can't be
+	// combined with Recipients
+	Passphrase string
+}
+
+// ResolveSecret returns the value of a secret reference, "env:NAME" reads
+// an environment variable, "file:PATH" reads a file and anything else is the
+// secret itself
+func ResolveSecret(reference string) (string, error) {
+	switch {
+	case strings.HasPrefix(reference, "env:"):
+		name := strings.TrimPrefix(reference, "env:")
+		value, found := os.LookupEnv(name)
+		if !found || StringIsEmpty(value) {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return value, nil
+	case strings.HasPrefix(reference, "file:"):
+		filePath := strings.TrimPrefix(reference, "file:")
+		content, err := ioutil.ReadFile(filePath)
+		if err != nil {
+			return "", fmt.Errorf("couldn't read secret file %s -> %s", filePath, err)
+		}
+		return strings.TrimSpace(string(content)), nil
+	}
+	return reference, nil
+}
+
+// GenerateEncryptionKey returns a new identity and its recipient
+func GenerateEncryptionKey() (string, string, error) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		return "", "", fmt.Errorf("couldn't generate the key -> %s", err)
+	}
+	return identity.String(), identity.Recipient().String(), nil
+}
+
+// identityRecipient returns the recipient of an identity, to encrypt for it
+func identityRecipient(key string) (string, error) {
+	identity, err := age.ParseX25519Identity(strings.TrimSpace(key))
+	if err != nil {
+		return "", err
+	}
+	return identity.Recipient().String(), nil
+}
+
+func isEncrypted(header []byte) bool {
+	return bytes.HasPrefix(header, ageMagic)
+}
+
+// parseRecipients returns the age recipients of the encryption options
+func parseRecipients(options *EncryptionOptions) ([]age.Recipient, error) {
+	var recipients []age.Recipient
+	if options.Passphrase != "" {
+		if len(options.Recipients) > 0 {
+			return nil, fmt.Errorf("a passphrase can't be combined with recipients")
+		}
+		recipient, err := age.NewScryptRecipient(options.Passphrase)
+		if err != nil {
+			return nil, err
+		}
+		recipients = append(recipients, recipient)
+	}
+	for _, key := range options.Recipients {
+		recipient, err := age.ParseX25519Recipient(strings.TrimSpace(key))
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse recipient %s -> %s", key, err)
+		}
+		recipients = append(recipients, recipient)
+	}
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("a recipient or a passphrase is needed for the encryption")
+	}
+	return recipients, nil
+}
+
+// newEncryptingWriter encrypts everything written to it, the last chunk is
+// written to writer by Close
+func newEncryptingWriter(writer io.Writer, options *EncryptionOptions) (io.WriteCloser, error) {
+	recipients, err := parseRecipients(options)
+	if err != nil {
+		return nil, err
+	}
+	encryptingWriter, err := age.Encrypt(writer, recipients...)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't start the encryption -> %s", err)
+	}
+	return encryptingWriter, nil
+}
+
+func newDecryptingReader(reader io.Reader, options *EncryptionOptions) (io.Reader, error) {
+	if options == nil {
+		return nil, fmt.Errorf("the archive is encrypted, an identity or a passphrase is needed")
+	}
+	var identities []age.Identity
+	if options.Passphrase != "" {
+		identity, err := age.NewScryptIdentity(options.Passphrase)
+		if err != nil {
+			return nil, err
+		}
+		identities = append(identities, identity)
+	}
+	for _, key := range options.Identities {
+		identity, err := age.ParseX25519Identity(strings.TrimSpace(key))
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse an identity -> %s", err)
+		}
+		identities = append(identities, identity)
+	}
+	if len(identities) == 0 {
+		return nil, fmt.Errorf("the archive is encrypted, an identity or a passphrase is needed")
+	}
+	decryptingReader, err := age.Decrypt(reader, identities...)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't decrypt the archive -> %s", err)
+	}
+	return decryptingReader, nil
+}
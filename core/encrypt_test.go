@@ -0,0 +1,150 @@
+/*
+   Copyright (c) 2022 Cyber Home Lab authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package core
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestEncryptedArchiveHappyFlow(t *testing.T) {
+	sourceDirectoryPath := filepath.Join(os.TempDir(), "TestEncryptedArchiveHappyFlow_source")
+	destinationDirectoryPath := filepath.Join(os.TempDir(), "TestEncryptedArchiveHappyFlow_destination")
+	createTestTree(t, sourceDirectoryPath, testTreeOptions{})
+	identity, recipient, err := GenerateEncryptionKey()
+	assert.NilError(t, err)
+
+	testCases := []struct {
+		extension  string
+		encryption EncryptionOptions
+		decryption EncryptionOptions
+	}{
+		{".tar.gz.age", EncryptionOptions{Recipients: []string{recipient}}, EncryptionOptions{Identities: []string{identity}}},
+		{".zip.age", EncryptionOptions{Recipients: []string{recipient}}, EncryptionOptions{Identities: []string{identity}}},
+		{".tar.zst.age", EncryptionOptions{Passphrase: "secret"}, EncryptionOptions{Passphrase: "secret"}},
+	}
+	for _, testCase := range testCases {
+		archivePath := filepath.Join(os.TempDir(), "TestEncryptedArchiveHappyFlow"+testCase.extension)
+		encryption, decryption := testCase.encryption, testCase.decryption
+		_, err := CreateArchiveWithOptions(archivePath, []string{sourceDirectoryPath}, ArchiveOptions{Encryption: &encryption})
+		assert.NilError(t, err)
+
+		// The archive is recognised as encrypted
+		_, err = ListArchive(archivePath)
+		assert.ErrorContains(t, err, "the archive is encrypted, an identity or a passphrase is needed")
+
+		// Decryption
+		result, err := VerifyArchiveWithOptions(archivePath, InspectOptions{Encryption: &decryption})
+		assert.NilError(t, err, testCase.extension)
+		assert.Equal(t, result.Manifest, true)
+		_, err = ExtractArchive(archivePath, destinationDirectoryPath, ExtractOptions{Encryption: &decryption})
+		assert.NilError(t, err)
+		extractedDirectoryPath := filepath.Join(destinationDirectoryPath, filepath.Base(sourceDirectoryPath))
+		assert.NilError(t, CheckIfDirectoriesMatch(sourceDirectoryPath, extractedDirectoryPath))
+		assert.NilError(t, Remove(destinationDirectoryPath))
+		assert.NilError(t, Remove(archivePath))
+	}
+
+	// Cleanup
+	assert.NilError(t, Remove(sourceDirectoryPath))
+}
+
+func TestEncryptedArchiveNegativeFlow(t *testing.T) {
+	sourceDirectoryPath := filepath.Join(os.TempDir(), "TestEncryptedArchiveNegativeFlow_source")
+	archivePath := filepath.Join(os.TempDir(), "TestEncryptedArchiveNegativeFlow.tar.gz.age")
+	createTestTree(t, sourceDirectoryPath, testTreeOptions{})
+	_, recipient, err := GenerateEncryptionKey()
+	assert.NilError(t, err)
+	otherIdentity, _, err := GenerateEncryptionKey()
+	assert.NilError(t, err)
+
+	// Encryption
+	_, err = CreateArchiveWithOptions(archivePath, []string{sourceDirectoryPath}, ArchiveOptions{Encryption: &EncryptionOptions{}})
+	assert.ErrorContains(t, err, "a recipient or a passphrase is needed")
+	_, err = CreateArchiveWithOptions(archivePath, []string{sourceDirectoryPath}, ArchiveOptions{Encryption: &EncryptionOptions{Recipients: []string{recipient}, Passphrase: "secret"}})
+	assert.ErrorContains(t, err, "a passphrase can't be combined with recipients")
+	_, err = CreateArchiveWithOptions(archivePath, []string{sourceDirectoryPath}, ArchiveOptions{Encryption: &EncryptionOptions{Recipients: []string{"age1invalid"}}})
+	assert.ErrorContains(t, err, "couldn't parse recipient age1invalid")
+
+	// Decryption with the wrong key
+	_, err = CreateArchiveWithOptions(archivePath, []string{sourceDirectoryPath}, ArchiveOptions{Encryption: &EncryptionOptions{Recipients: []string{recipient}}})
+	assert.NilError(t, err)
+	_, err = VerifyArchiveWithOptions(archivePath, InspectOptions{Encryption: &EncryptionOptions{Identities: []string{otherIdentity}}})
+	assert.ErrorContains(t, err, "couldn't decrypt the archive")
+
+	// Cleanup
+	assert.NilError(t, Remove(sourceDirectoryPath))
+	assert.NilError(t, Remove(archivePath))
+}
+
+func TestResolveSecret(t *testing.T) {
+	secretFilePath := filepath.Join(os.TempDir(), "TestResolveSecret.txt")
+	assert.NilError(t, WriteToFile(secretFilePath, "from file\n"))
+	os.Setenv("TEST_RESOLVE_SECRET", "from env")
+	defer os.Unsetenv("TEST_RESOLVE_SECRET")
+
+	for reference, expected := range map[string]string{
+		"plain":                   "plain",
+		"env:TEST_RESOLVE_SECRET": "from env",
+		"file:" + secretFilePath:  "from file",
+	} {
+		secret, err := ResolveSecret(reference)
+		assert.NilError(t, err)
+		assert.Equal(t, secret, expected)
+	}
+	_, err := ResolveSecret("env:TEST_RESOLVE_SECRET_NOT_FOUND")
+	assert.ErrorContains(t, err, "environment variable TEST_RESOLVE_SECRET_NOT_FOUND is not set")
+	_, err = ResolveSecret("file:" + TestFileNotFound)
+	assert.ErrorContains(t, err, "couldn't read secret file")
+
+	// From the config
+	var config Config
+	options, err := config.BackupEncryptionOptions()
+	assert.NilError(t, err)
+	assert.Assert(t, options == nil)
+	config.Common.BackupPassphrase = "env:TEST_RESOLVE_SECRET"
+	options, err = config.BackupEncryptionOptions()
+	assert.NilError(t, err)
+	assert.Equal(t, options.Passphrase, "from env")
+
+	// The recipient of an identity without recipients encrypts the backups
+	identity, recipient, err := GenerateEncryptionKey()
+	assert.NilError(t, err)
+	config = Config{}
+	config.Common.BackupIdentities = []string{identity}
+	options, err = config.BackupEncryptionOptions()
+	assert.NilError(t, err)
+	assert.DeepEqual(t, options.Recipients, []string{recipient})
+	_, err = newEncryptingWriter(io.Discard, options)
+	assert.NilError(t, err)
+	config.Common.BackupIdentities = []string{"AGE-SECRET-KEY-INVALID"}
+	_, err = config.BackupEncryptionOptions()
+	assert.ErrorContains(t, err, "couldn't parse Common.BackupIdentities")
+
+	// Cleanup
+	assert.NilError(t, Remove(secretFilePath))
+}
+
+func TestDetectArchiveFormatEncrypted(t *testing.T) {
+	format, err := DetectArchiveFormat("/tmp/backup.tar.zst" + EncryptedArchiveExtension)
+	assert.NilError(t, err)
+	assert.Equal(t, format, ArchiveFormatTarZst)
+}
@@ -0,0 +1,456 @@
+/*
+   Copyright (c) 2022 Cyber Home Lab authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package core
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	DefaultExtractMaxEntries   = 1000000
+	DefaultExtractMaxTotalSize = 1024 * 1024 * 1024 * 1024
+)
+
+type ExtractOptions struct {
+	// Format is detected from the content of the archive when it is empty
+	Format ArchiveFormat
+	// Paths restricts the extraction to these entries, a directory selects
+	// everything under it
+	Paths []string
+	// MaxEntries and MaxTotalSize protect against archive bombs, the
+	// defaults are used when they are 0 and the limits are disabled when
+	// they are negative
+	MaxEntries   int
+	MaxTotalSize int64
+	// IgnoreOwnership keeps the current user as the owner of the files
+	IgnoreOwnership bool
+	// Encryption has the identities or the passphrase of encrypted archives,
+	// they are recognised from their content
+	Encryption *EncryptionOptions
+}
+
+type ExtractResult struct {
+	Entries int
+	Bytes   int64
+	// Deleted is the number of names removed by incremental archives
+	Deleted int
+	// Warnings are the owners and the extended attributes which couldn't
+	// be restored, because the filesystem doesn't support them or because
+	// the user isn't allowed to set them, and the directories replaced by a
+	// later entry
+	Warnings []string
+}
+
+type extractor struct {
+	destinationPath string
+	options         ExtractOptions
+	result          ExtractResult
+	directories     []*tar.Header
+}
+
+func ExtractArchive(archivePath string, destinationPath string, options ExtractOptions) (ExtractResult, error) {
+	// Open the archive, or its volumes
+	file, err := openArchiveFile(archivePath)
+	if err != nil {
+		return ExtractResult{}, fmt.Errorf("couldn't open archive %s -> %s", archivePath, err)
+	}
+	defer file.Close()
+
+	// Extract
+	name := strings.TrimSuffix(archivePath, VolumeIndexSuffix)
+	result, err := readArchive(context.Background(), file, name, destinationPath, options)
+	if err != nil {
+		return result, fmt.Errorf("couldn't extract archive %s to %s -> %s", archivePath, destinationPath, err)
+	}
+	return result, nil
+}
+
+// ReadArchive extracts an archive streamed from reader, the format is
+// detected from the content when it is not given in the options
+func ReadArchive(ctx context.Context, reader io.Reader, destinationPath string, options ExtractOptions) (ExtractResult, error) {
+	return readArchive(ctx, reader, "", destinationPath, options)
+}
+
+func readArchive(ctx context.Context, reader io.Reader, name string, destinationPath string, options ExtractOptions) (ExtractResult, error) {
+	// Creating the archive reader
+	archiveReader, err := openArchiveReader(reader, options.Format, name, options.Encryption)
+	if err != nil {
+		return ExtractResult{}, fmt.Errorf("couldn't read the archive -> %s", err)
+	}
+	defer archiveReader.Close()
+
+	return extractEntries(ctx, archiveReader, destinationPath, options)
+}
+
+func extractEntries(ctx context.Context, reader archiveReader, destinationPath string, options ExtractOptions) (ExtractResult, error) {
+	e, err := newExtractor(destinationPath, options)
+	if err != nil {
+		return ExtractResult{}, err
+	}
+
+	// Go through each entry
+	for {
+		err := ctx.Err()
+		if err != nil {
+			return e.result, err
+		}
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return e.result, fmt.Errorf("couldn't read the next entry -> %s", err)
+		}
+		if isManifest(header) {
+			continue
+		}
+		if isDeletions(header) {
+			err = e.applyDeletions(&contextReader{ctx: ctx, reader: reader})
+			if err != nil {
+				return e.result, err
+			}
+			continue
+		}
+		err = e.extractEntry(header, &contextReader{ctx: ctx, reader: reader})
+		if err != nil {
+			return e.result, fmt.Errorf("couldn't extract %s -> %s", header.Name, err)
+		}
+	}
+
+	// Writing into a directory changes its modification time
+	err = e.finishDirectories()
+	if err != nil {
+		return e.result, err
+	}
+	return e.result, nil
+}
+
+// newExtractor creates the destination and fills in the default limits
+func newExtractor(destinationPath string, options ExtractOptions) (*extractor, error) {
+	// Defaults
+	if options.MaxEntries == 0 {
+		options.MaxEntries = DefaultExtractMaxEntries
+	}
+	if options.MaxTotalSize == 0 {
+		options.MaxTotalSize = DefaultExtractMaxTotalSize
+	}
+
+	// The destination
+	destinationPath, err := filepath.Abs(destinationPath)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(destinationPath, DefaultMode)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create directory %s -> %s", destinationPath, err)
+	}
+	return &extractor{destinationPath: destinationPath, options: options}, nil
+}
+
+// sanitizeEntryName returns a clean relative name and rejects the names which
+// could escape the destination
+func sanitizeEntryName(name string) (string, error) {
+	if filepath.IsAbs(name) || strings.HasPrefix(name, "/") {
+		return "", fmt.Errorf("absolute path %s is not allowed", name)
+	}
+	for _, component := range strings.Split(filepath.ToSlash(name), "/") {
+		if component == ".." {
+			return "", fmt.Errorf("path %s contains '..'", name)
+		}
+	}
+	cleanName := filepath.Clean(name)
+	if cleanName == "." {
+		return "", nil
+	}
+	return cleanName, nil
+}
+
+// IsSelected tells if the archive entry name is one of paths or under one
+// of them, every name is selected when paths is empty
+func IsSelected(name string, paths []string) bool {
+	if len(paths) == 0 {
+		return true
+	}
+	for _, path := range paths {
+		path = filepath.Clean(strings.TrimPrefix(path, "/"))
+		if name == path || strings.HasPrefix(name, path+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// securePath returns the location of name in the destination after checking
+// that none of its parents is a symlink, so nothing can be written outside
+// of the destination through a symlink extracted before
+func (e *extractor) securePath(name string) (string, error) {
+	currentPath := e.destinationPath
+	components := strings.Split(name, string(filepath.Separator))
+	for _, component := range components[:len(components)-1] {
+		currentPath = filepath.Join(currentPath, component)
+		info, err := os.Lstat(currentPath)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("parent %s is a symlink", currentPath)
+		}
+		if !info.IsDir() {
+			return "", fmt.Errorf("parent %s is not a directory", currentPath)
+		}
+	}
+	return filepath.Join(e.destinationPath, name), nil
+}
+
+func (e *extractor) checkLimits(header *tar.Header) error {
+	e.result.Entries++
+	if e.options.MaxEntries > 0 && e.result.Entries > e.options.MaxEntries {
+		return fmt.Errorf("the archive has more than %d entries", e.options.MaxEntries)
+	}
+	if header.Typeflag == tar.TypeReg || header.Typeflag == tar.TypeRegA {
+		e.result.Bytes += header.Size
+	}
+	if e.options.MaxTotalSize > 0 && e.result.Bytes > e.options.MaxTotalSize {
+		return fmt.Errorf("the archive has more than %s of data", FormatBytes(e.options.MaxTotalSize))
+	}
+	return nil
+}
+
+// removeExisting deletes a file or an empty directory in the way of the
+// entry, symlinks are removed instead of being followed
+func removeExisting(path string, keepDirectory bool) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.IsDir() && keepDirectory {
+		return nil
+	}
+	return os.Remove(path)
+}
+
+func (e *extractor) extractEntry(header *tar.Header, reader io.Reader) error {
+	name, err := sanitizeEntryName(header.Name)
+	if err != nil {
+		return err
+	}
+	if name == "" || !IsSelected(name, e.options.Paths) {
+		return nil
+	}
+	err = e.checkLimits(header)
+	if err != nil {
+		return err
+	}
+	targetPath, err := e.securePath(name)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(targetPath), DefaultMode)
+	if err != nil {
+		return err
+	}
+
+	switch header.Typeflag {
+	case tar.TypeDir:
+		err = removeExisting(targetPath, true)
+		if err != nil {
+			return err
+		}
+		err = os.MkdirAll(targetPath, DefaultMode)
+		if err != nil {
+			return err
+		}
+		e.directories = append(e.directories, header)
+		return nil
+	case tar.TypeReg, tar.TypeRegA:
+		err = removeExisting(targetPath, false)
+		if err != nil {
+			return err
+		}
+		file, err := os.OpenFile(targetPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(file, reader)
+		closeErr := file.Close()
+		if err != nil {
+			return err
+		}
+		if closeErr != nil {
+			return closeErr
+		}
+	case tar.TypeSymlink:
+		err = removeExisting(targetPath, false)
+		if err != nil {
+			return err
+		}
+		err = os.Symlink(header.Linkname, targetPath)
+		if err != nil {
+			return err
+		}
+		return e.lchown(targetPath, header)
+	case tar.TypeLink:
+		linkName, err := sanitizeEntryName(header.Linkname)
+		if err != nil {
+			return fmt.Errorf("hardlink target -> %s", err)
+		}
+		linkPath, err := e.securePath(linkName)
+		if err != nil {
+			return fmt.Errorf("hardlink target -> %s", err)
+		}
+		linkInfo, err := os.Lstat(linkPath)
+		if err != nil {
+			return fmt.Errorf("hardlink target %s wasn't extracted -> %s", header.Linkname, err)
+		}
+		if !linkInfo.Mode().IsRegular() {
+			return fmt.Errorf("hardlink target %s is not a regular file", header.Linkname)
+		}
+		err = removeExisting(targetPath, false)
+		if err != nil {
+			return err
+		}
+		return os.Link(linkPath, targetPath)
+	case tar.TypeXGlobalHeader:
+		return nil
+	default:
+		return fmt.Errorf("unsupported entry type %c", header.Typeflag)
+	}
+
+	return e.applyMetadata(targetPath, header)
+}
+
+// applyMetadata restores the owner, the mode, the extended attributes and the
+// times of an entry, it is opened without following symlinks so they never
+// apply outside of the destination
+func (e *extractor) applyMetadata(targetPath string, header *tar.Header) error {
+	flags := os.O_RDONLY | syscall.O_NOFOLLOW
+	if header.Typeflag == tar.TypeDir {
+		flags |= syscall.O_DIRECTORY
+	}
+	file, err := os.OpenFile(targetPath, flags, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// The owner first, chown() clears the setuid and setgid bits
+	if !e.options.IgnoreOwnership {
+		err = e.ownerError(header, file.Chown(header.Uid, header.Gid))
+		if err != nil {
+			return err
+		}
+	}
+	err = file.Chmod(header.FileInfo().Mode())
+	if err != nil {
+		return err
+	}
+
+	// Extended attributes, tmpfs and NFS may not have them and only root
+	// can set the security and trusted ones
+	var names []string
+	for key := range header.PAXRecords {
+		if strings.HasPrefix(key, paxXattrPrefix) {
+			names = append(names, strings.TrimPrefix(key, paxXattrPrefix))
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		err = setXattrs(targetPath, map[string]string{name: header.PAXRecords[paxXattrPrefix+name]})
+		if errors.Is(err, syscall.ENOTSUP) || errors.Is(err, syscall.EOPNOTSUPP) || errors.Is(err, syscall.EPERM) {
+			e.warn("couldn't restore the extended attribute %s of %s -> %s", name, header.Name, err)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("couldn't restore the extended attribute %s -> %s", name, err)
+		}
+	}
+
+	accessTime := header.AccessTime
+	if accessTime.IsZero() {
+		accessTime = time.Now()
+	}
+	times := []unix.Timespec{unix.NsecToTimespec(accessTime.UnixNano()), unix.NsecToTimespec(header.ModTime.UnixNano())}
+	return unix.UtimesNanoAt(unix.AT_FDCWD, targetPath, times, unix.AT_SYMLINK_NOFOLLOW)
+}
+
+// lchown restores the owner of a symlink
+func (e *extractor) lchown(targetPath string, header *tar.Header) error {
+	if e.options.IgnoreOwnership {
+		return nil
+	}
+	return e.ownerError(header, os.Lchown(targetPath, header.Uid, header.Gid))
+}
+
+// ownerError turns EPERM into a warning for the users other than root, only
+// root can give the files to another user
+func (e *extractor) ownerError(header *tar.Header, err error) error {
+	if errors.Is(err, syscall.EPERM) && os.Geteuid() != 0 {
+		e.warn("couldn't restore the owner of %s -> %s", header.Name, err)
+		return nil
+	}
+	return err
+}
+
+func (e *extractor) warn(format string, args ...interface{}) {
+	e.result.Warnings = append(e.result.Warnings, fmt.Sprintf(format, args...))
+}
+
+// finishDirectories restores the metadata of the directories once their
+// content is written, a later entry may have replaced one of them with a
+// symlink or a file which is skipped
+func (e *extractor) finishDirectories() error {
+	for k := len(e.directories) - 1; k >= 0; k-- {
+		header := e.directories[k]
+		name, _ := sanitizeEntryName(header.Name)
+		targetPath, err := e.securePath(name)
+		if err != nil {
+			e.warn("couldn't restore the metadata of %s -> %s", header.Name, err)
+			continue
+		}
+		info, err := os.Lstat(targetPath)
+		if err != nil {
+			return fmt.Errorf("couldn't restore the metadata of %s -> %s", header.Name, err)
+		}
+		if !info.IsDir() {
+			e.warn("couldn't restore the metadata of %s -> it was replaced by a later entry", header.Name)
+			continue
+		}
+		err = e.applyMetadata(targetPath, header)
+		if err != nil {
+			return fmt.Errorf("couldn't restore the metadata of %s -> %s", header.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+/*
+   Copyright (c) 2022 Cyber Home Lab authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package core
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+type testArchiveEntry struct {
+	header  tar.Header
+	content string
+}
+
+func createTestArchive(t *testing.T, archivePath string, entries []testArchiveEntry) {
+	file, err := os.Create(archivePath)
+	assert.NilError(t, err)
+	gzipWriter := gzip.NewWriter(file)
+	tarWriter := tar.NewWriter(gzipWriter)
+	for _, entry := range entries {
+		header := entry.header
+		header.Size = int64(len(entry.content))
+		if header.Mode == 0 {
+			header.Mode = 0600
+		}
+		assert.NilError(t, tarWriter.WriteHeader(&header))
+		_, err = tarWriter.Write([]byte(entry.content))
+		assert.NilError(t, err)
+	}
+	assert.NilError(t, tarWriter.Close())
+	assert.NilError(t, gzipWriter.Close())
+	assert.NilError(t, file.Close())
+}
+
+func TestExtractArchiveHappyFlow(t *testing.T) {
+	sourceDirectoryPath := filepath.Join(os.TempDir(), "TestExtractArchiveHappyFlow_source")
+	destinationDirectoryPath := filepath.Join(os.TempDir(), "TestExtractArchiveHappyFlow_destination")
+	archivePath := filepath.Join(os.TempDir(), "TestExtractArchiveHappyFlow.tar.gz")
+	createTestTree(t, sourceDirectoryPath, testTreeOptions{})
+
+	// Round trip
+	assert.NilError(t, CreateArchive(archivePath, []string{sourceDirectoryPath}))
+	result, err := ExtractArchive(archivePath, destinationDirectoryPath, ExtractOptions{})
+	assert.NilError(t, err)
+	assert.Equal(t, result.Entries, 1+testTreeDirectories+testTreeFiles)
+	extractedDirectoryPath := filepath.Join(destinationDirectoryPath, filepath.Base(sourceDirectoryPath))
+	assert.NilError(t, CheckIfDirectoriesMatch(sourceDirectoryPath, extractedDirectoryPath))
+	filesMatch, err := CheckIfFilesMatch(filepath.Join(sourceDirectoryPath, "a.txt"), filepath.Join(extractedDirectoryPath, "a.txt"))
+	assert.NilError(t, err)
+	assert.Assert(t, filesMatch)
+	assert.NilError(t, CheckPermissions(filepath.Join(sourceDirectoryPath, "a.txt"), filepath.Join(extractedDirectoryPath, "a.txt")))
+
+	// Only selected paths
+	assert.NilError(t, Remove(destinationDirectoryPath))
+	selectedPath := filepath.Join(filepath.Base(sourceDirectoryPath), "src")
+	result, err = ExtractArchive(archivePath, destinationDirectoryPath, ExtractOptions{Paths: []string{selectedPath}})
+	assert.NilError(t, err)
+	assert.Equal(t, result.Entries, 6)
+	_, err = os.Stat(filepath.Join(extractedDirectoryPath, "a.txt"))
+	assert.Assert(t, os.IsNotExist(err))
+
+	// Cleanup
+	for _, path := range []string{sourceDirectoryPath, destinationDirectoryPath, archivePath} {
+		assert.NilError(t, Remove(path))
+	}
+}
+
+func TestExtractArchiveLinks(t *testing.T) {
+	destinationDirectoryPath := filepath.Join(os.TempDir(), "TestExtractArchiveLinks_destination")
+	archivePath := filepath.Join(os.TempDir(), "TestExtractArchiveLinks.tar.gz")
+	createTestArchive(t, archivePath, []testArchiveEntry{
+		{header: tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0750}},
+		{header: tar.Header{Name: "dir/file", Typeflag: tar.TypeReg, Mode: 0640}, content: "Hello World!"},
+		{header: tar.Header{Name: "dir/symlink", Typeflag: tar.TypeSymlink, Linkname: "file"}},
+		{header: tar.Header{Name: "hardlink", Typeflag: tar.TypeLink, Linkname: "dir/file"}},
+	})
+
+	// Extract
+	_, err := ExtractArchive(archivePath, destinationDirectoryPath, ExtractOptions{IgnoreOwnership: true})
+	assert.NilError(t, err)
+
+	// Checks
+	linkName, err := os.Readlink(filepath.Join(destinationDirectoryPath, "dir", "symlink"))
+	assert.NilError(t, err)
+	assert.Equal(t, linkName, "file")
+	fileStat, err := os.Stat(filepath.Join(destinationDirectoryPath, "dir", "file"))
+	assert.NilError(t, err)
+	assert.Equal(t, fileStat.Mode(), os.FileMode(0640))
+	hardlinkStat, err := os.Stat(filepath.Join(destinationDirectoryPath, "hardlink"))
+	assert.NilError(t, err)
+	assert.Assert(t, os.SameFile(fileStat, hardlinkStat))
+	directoryStat, err := os.Stat(filepath.Join(destinationDirectoryPath, "dir"))
+	assert.NilError(t, err)
+	assert.Equal(t, directoryStat.Mode().Perm(), os.FileMode(0750))
+
+	// Cleanup
+	for _, path := range []string{destinationDirectoryPath, archivePath} {
+		assert.NilError(t, Remove(path))
+	}
+}
+
+func TestExtractArchiveDirectoryReplacedBySymlink(t *testing.T) {
+	destinationDirectoryPath := filepath.Join(os.TempDir(), "TestExtractArchiveDirectoryReplacedBySymlink_destination")
+	outsideDirectoryPath := filepath.Join(os.TempDir(), "TestExtractArchiveDirectoryReplacedBySymlink_outside")
+	archivePath := filepath.Join(os.TempDir(), "TestExtractArchiveDirectoryReplacedBySymlink.tar.gz")
+	assert.NilError(t, os.Mkdir(outsideDirectoryPath, 0700))
+	createTestArchive(t, archivePath, []testArchiveEntry{
+		{header: tar.Header{Name: "a/", Typeflag: tar.TypeDir, Mode: 0777, ModTime: time.Unix(1000, 0)}},
+		{header: tar.Header{Name: "a", Typeflag: tar.TypeSymlink, Linkname: outsideDirectoryPath}},
+	})
+
+	// The metadata of the directory isn't applied through the symlink
+	result, err := ExtractArchive(archivePath, destinationDirectoryPath, ExtractOptions{IgnoreOwnership: true})
+	assert.NilError(t, err)
+	assert.Equal(t, len(result.Warnings), 1)
+	assert.Assert(t, strings.Contains(result.Warnings[0], "it was replaced by a later entry"))
+	outsideStat, err := os.Stat(outsideDirectoryPath)
+	assert.NilError(t, err)
+	assert.Equal(t, outsideStat.Mode().Perm(), os.FileMode(0700))
+	assert.Assert(t, outsideStat.ModTime().Unix() != 1000)
+
+	// Cleanup
+	for _, path := range []string{destinationDirectoryPath, outsideDirectoryPath, archivePath} {
+		assert.NilError(t, Remove(path))
+	}
+}
+
+func TestExtractArchiveMetadataWarnings(t *testing.T) {
+	destinationDirectoryPath := filepath.Join(os.TempDir(), "TestExtractArchiveMetadataWarnings_destination")
+	archivePath := filepath.Join(os.TempDir(), "TestExtractArchiveMetadataWarnings.tar.gz")
+	createTestArchive(t, archivePath, []testArchiveEntry{
+		{header: tar.Header{Name: "file", Typeflag: tar.TypeReg, Uid: os.Getuid(), Gid: os.Getgid(), PAXRecords: map[string]string{
+			paxXattrPrefix + "unknown.namespace": "yes",
+		}}, content: "Hello World!"},
+	})
+
+	// An extended attribute which the filesystem refuses doesn't stop the extraction
+	result, err := ExtractArchive(archivePath, destinationDirectoryPath, ExtractOptions{})
+	assert.NilError(t, err)
+	assert.Equal(t, result.Entries, 1)
+	if runtime.GOOS == "linux" {
+		assert.Equal(t, len(result.Warnings), 1)
+		assert.Assert(t, strings.Contains(result.Warnings[0], "unknown.namespace"))
+	}
+	content, err := ReadFile(filepath.Join(destinationDirectoryPath, "file"))
+	assert.NilError(t, err)
+	assert.Equal(t, content, "Hello World!")
+
+	// Cleanup
+	for _, path := range []string{destinationDirectoryPath, archivePath} {
+		assert.NilError(t, Remove(path))
+	}
+}
+
+func TestExtractArchiveNegativeFlow(t *testing.T) {
+	destinationDirectoryPath := filepath.Join(os.TempDir(), "TestExtractArchiveNegativeFlow_destination")
+	archivePath := filepath.Join(os.TempDir(), "TestExtractArchiveNegativeFlow.tar.gz")
+	testCases := []struct {
+		entries  []testArchiveEntry
+		options  ExtractOptions
+		expected string
+	}{
+		{
+			entries:  []testArchiveEntry{{header: tar.Header{Name: "../evil", Typeflag: tar.TypeReg}, content: "evil"}},
+			expected: "contains '..'",
+		},
+		{
+			entries:  []testArchiveEntry{{header: tar.Header{Name: "/tmp/evil", Typeflag: tar.TypeReg}, content: "evil"}},
+			expected: "absolute path",
+		},
+		{
+			entries: []testArchiveEntry{
+				{header: tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: os.TempDir()}},
+				{header: tar.Header{Name: "link/evil", Typeflag: tar.TypeReg}, content: "evil"},
+			},
+			expected: "is a symlink",
+		},
+		{
+			entries:  []testArchiveEntry{{header: tar.Header{Name: "hardlink", Typeflag: tar.TypeLink, Linkname: "../../etc/passwd"}}},
+			expected: "hardlink target",
+		},
+		{
+			entries: []testArchiveEntry{
+				{header: tar.Header{Name: "1", Typeflag: tar.TypeReg}, content: "1"},
+				{header: tar.Header{Name: "2", Typeflag: tar.TypeReg}, content: "2"},
+			},
+			options:  ExtractOptions{MaxEntries: 1},
+			expected: "more than 1 entries",
+		},
+		{
+			entries:  []testArchiveEntry{{header: tar.Header{Name: "big", Typeflag: tar.TypeReg}, content: "Hello World!"}},
+			options:  ExtractOptions{MaxTotalSize: 5},
+			expected: "more than 5 B of data",
+		},
+	}
+
+	for _, testCase := range testCases {
+		createTestArchive(t, archivePath, testCase.entries)
+		_, err := ExtractArchive(archivePath, destinationDirectoryPath, testCase.options)
+		assert.ErrorContains(t, err, testCase.expected)
+		assert.NilError(t, Remove(destinationDirectoryPath))
+	}
+	_, err := os.Stat(filepath.Join(os.TempDir(), "evil"))
+	assert.Assert(t, os.IsNotExist(err))
+
+	// Cleanup
+	assert.NilError(t, Remove(archivePath))
+}
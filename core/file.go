@@ -18,6 +18,7 @@ package core
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"fmt"
 	"io"
@@ -27,7 +28,26 @@ import (
 	"path/filepath"
 )
 
+type HashOptions struct {
+	Limiter    *RateLimiter
+	IOPriority *IOPriority
+}
+
 func GetHash(filePath string) (string, error) {
+	return GetHashWithOptions(filePath, HashOptions{})
+}
+
+func GetHashWithOptions(filePath string, options HashOptions) (string, error) {
+	var hash string
+	err := withIOPriority(options.IOPriority, func() error {
+		var err error
+		hash, err = getHash(filePath, options.Limiter)
+		return err
+	})
+	return hash, err
+}
+
+func getHash(filePath string, limiter *RateLimiter) (string, error) {
 	file, err := os.Open(filePath)
 	if err != nil {
 		return "", fmt.Errorf("couldn't read the file -> %s", err)
@@ -35,7 +55,7 @@ func GetHash(filePath string) (string, error) {
 	defer file.Close()
 
 	hash := sha256.New()
-	if _, err := io.Copy(hash, file); err != nil {
+	if _, err := io.Copy(hash, limiter.Reader(context.Background(), file)); err != nil {
 		return "", fmt.Errorf("couldn't calculate the hash -> %s", err)
 	}
 
@@ -83,6 +103,36 @@ func WriteToFile(filePath string, content string) error {
 	return ioutil.WriteFile(filePath, []byte(content), 0644)
 }
 
+// WriteFileAtomically replaces a file with content, it is written to a
+// temporary file next to it which is renamed. A crash leaves the old file in
+// place
+func WriteFileAtomically(filePath string, content []byte, perm fs.FileMode) error {
+	file, err := os.CreateTemp(filepath.Dir(filePath), "."+filepath.Base(filePath)+".tmp-")
+	if err != nil {
+		return fmt.Errorf("couldn't write %s -> %s", filePath, err)
+	}
+	temporaryPath := file.Name()
+	_, err = file.Write(content)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(temporaryPath, perm)
+	}
+	if err == nil {
+		err = os.Rename(temporaryPath, filePath)
+	}
+	if err != nil {
+		os.Remove(temporaryPath)
+		return fmt.Errorf("couldn't write %s -> %s", filePath, err)
+	}
+	return nil
+}
+
 func Remove(fileOrDirPath string) error {
 	fileOrDirStat, err := os.Stat(fileOrDirPath)
 	if err != nil {
@@ -163,8 +213,12 @@ func GetNumberOfFiles(directoryPath string) (int, error) {
 }
 
 func GetDirectorySize(directoryPath string) (int64, error) {
+	return GetDirectorySizeWithFilter(directoryPath, nil)
+}
+
+func GetDirectorySizeWithFilter(directoryPath string, filter *Filter) (int64, error) {
 	var size int64
-	err := filepath.Walk(directoryPath, func(_ string, info os.FileInfo, err error) error {
+	err := filter.Walk(directoryPath, func(_ string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
@@ -17,6 +17,9 @@
 package core
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
@@ -87,3 +90,29 @@ func TestReadFileNegativeFlow(t *testing.T) {
 	_, err := ReadFile(TestFileNotFound)
 	assert.ErrorContains(t, err, "no such file or directory")
 }
+
+func TestWriteFileAtomically(t *testing.T) {
+	directoryPath := filepath.Join(os.TempDir(), "TestWriteFileAtomically")
+	assert.NilError(t, os.MkdirAll(directoryPath, DefaultMode))
+	filePath := filepath.Join(directoryPath, "file.json")
+
+	// The file is replaced and nothing else is left
+	assert.NilError(t, WriteFileAtomically(filePath, []byte("old"), 0600))
+	assert.NilError(t, WriteFileAtomically(filePath, []byte("new"), 0644))
+	content, err := ReadFile(filePath)
+	assert.NilError(t, err)
+	assert.Equal(t, content, "new")
+	fileStat, err := os.Stat(filePath)
+	assert.NilError(t, err)
+	assert.Equal(t, fileStat.Mode().Perm(), os.FileMode(0644))
+	files, err := ioutil.ReadDir(directoryPath)
+	assert.NilError(t, err)
+	assert.Equal(t, len(files), 1)
+
+	// A missing directory
+	err = WriteFileAtomically(filepath.Join(directoryPath, "missing", "file.json"), []byte("new"), 0644)
+	assert.ErrorContains(t, err, "couldn't write")
+
+	// Cleanup
+	assert.NilError(t, Remove(directoryPath))
+}
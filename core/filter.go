@@ -0,0 +1,383 @@
+/*
+   Copyright (c) 2022 Cyber Home Lab authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package core
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// BackupIgnoreFileName is read in every directory when it is given as the
+// IgnoreFileName of a filter, it has the same format as .gitignore
+const BackupIgnoreFileName = ".backupignore"
+
+type FilterOptions struct {
+	// Include keeps only the files matching one of the patterns (or under a
+	// directory matching one), the directories are always kept so the files
+	// have their parents. Exclude drops the matching files and directories,
+	// nothing under an excluded directory is visited. Both use the format of
+	// .gitignore and are relative to the root of the walk
+	Include []string
+	Exclude []string
+	// IgnoreFileName is read in every directory, its patterns are added to
+	// Exclude and are relative to the directory of the file
+	IgnoreFileName string
+	// MinSize and MaxSize limit the size of the regular files, 0 disables
+	// the limit
+	MinSize int64
+	MaxSize int64
+	// MinAge skips the files modified recently (still being written for
+	// example) and MaxAge skips the old ones, 0 disables the limit
+	MinAge time.Duration
+	MaxAge time.Duration
+}
+
+// filterRule is a single .gitignore pattern, the segments of a pattern which
+// isn't anchored start with "**" so they match at any depth
+type filterRule struct {
+	negate        bool
+	directoryOnly bool
+	segments      []string
+}
+
+func parseFilterRule(pattern string) (filterRule, bool, error) {
+	var rule filterRule
+	pattern = strings.TrimRight(pattern, " \t\r")
+	if pattern == "" || strings.HasPrefix(pattern, "#") {
+		return rule, false, nil
+	}
+	if strings.HasPrefix(pattern, "!") {
+		rule.negate = true
+		pattern = pattern[1:]
+	}
+	if strings.HasSuffix(pattern, "/") {
+		rule.directoryOnly = true
+		pattern = strings.TrimRight(pattern, "/")
+	}
+	if pattern == "" {
+		return rule, false, fmt.Errorf("pattern %q is empty", pattern)
+	}
+	anchored := strings.Contains(pattern, "/")
+	rule.segments = strings.Split(strings.TrimPrefix(pattern, "/"), "/")
+	if !anchored {
+		rule.segments = append([]string{"**"}, rule.segments...)
+	}
+	for _, segment := range rule.segments {
+		_, err := path.Match(segment, "")
+		if err != nil {
+			return rule, false, fmt.Errorf("invalid pattern %q -> %s", pattern, err)
+		}
+	}
+	return rule, true, nil
+}
+
+func parseFilterRules(patterns []string) ([]filterRule, error) {
+	var rules []filterRule
+	for _, pattern := range patterns {
+		rule, ok, err := parseFilterRule(pattern)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			rules = append(rules, rule)
+		}
+	}
+	return rules, nil
+}
+
+func matchSegments(patternSegments []string, pathSegments []string) bool {
+	if len(patternSegments) == 0 {
+		return len(pathSegments) == 0
+	}
+	if patternSegments[0] == "**" {
+		for k := 0; k <= len(pathSegments); k++ {
+			if matchSegments(patternSegments[1:], pathSegments[k:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(pathSegments) == 0 {
+		return false
+	}
+	matched, _ := path.Match(patternSegments[0], pathSegments[0])
+	return matched && matchSegments(patternSegments[1:], pathSegments[1:])
+}
+
+// match checks a slash separated path relative to the base of the rule
+func (r filterRule) match(relativePath string, isDirectory bool) bool {
+	if r.directoryOnly && !isDirectory {
+		return false
+	}
+	return matchSegments(r.segments, strings.Split(relativePath, "/"))
+}
+
+// Filter selects the files visited by the archive, copy, sync and size
+// functions, a nil filter selects everything
+type Filter struct {
+	options FilterOptions
+	include []filterRule
+	exclude []filterRule
+}
+
+func NewFilter(options FilterOptions) (*Filter, error) {
+	include, err := parseFilterRules(options.Include)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse the include patterns -> %s", err)
+	}
+	exclude, err := parseFilterRules(options.Exclude)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse the exclude patterns -> %s", err)
+	}
+	return &Filter{options: options, include: include, exclude: exclude}, nil
+}
+
+// ignoreFile has the rules read from an ignore file, they are relative to
+// the directory of the file
+type ignoreFile struct {
+	directory string
+	rules     []filterRule
+}
+
+func readIgnoreFile(filePath string) ([]filterRule, error) {
+	file, err := os.Open(filePath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var patterns []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		patterns = append(patterns, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	rules, err := parseFilterRules(patterns)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse %s -> %s", filePath, err)
+	}
+	return rules, nil
+}
+
+// filterWalk is the state of a single walk, the ignore files are read when
+// their directory is visited. They are read from ignoreRoot, which is the
+// root of the walk unless the rules of another tree are applied
+type filterWalk struct {
+	filter      *Filter
+	root        string
+	ignoreRoot  string
+	now         time.Time
+	ignoreFiles []ignoreFile
+}
+
+func (w *filterWalk) loadIgnoreFile(directoryPath string) error {
+	if w.filter.options.IgnoreFileName == "" {
+		return nil
+	}
+	relativePath, err := filepath.Rel(w.root, directoryPath)
+	if err != nil {
+		return err
+	}
+	ignoreFilePath := filepath.Join(w.ignoreRoot, relativePath, w.filter.options.IgnoreFileName)
+	rules, err := readIgnoreFile(ignoreFilePath)
+	if err != nil {
+		return err
+	}
+	if len(rules) > 0 {
+		w.ignoreFiles = append(w.ignoreFiles, ignoreFile{directory: directoryPath, rules: rules})
+	}
+	return nil
+}
+
+func (w *filterWalk) excluded(filePath string, relativePath string, info os.FileInfo) bool {
+	// Sockets can't be copied or restored
+	if info.Mode()&os.ModeSocket != 0 {
+		return true
+	}
+
+	// Patterns, the last matching one wins like in .gitignore
+	isDirectory := info.IsDir()
+	excluded := false
+	for _, rule := range w.filter.exclude {
+		if rule.match(relativePath, isDirectory) {
+			excluded = !rule.negate
+		}
+	}
+	for _, ignoreFile := range w.ignoreFiles {
+		if !isChildPath(filepath.ToSlash(ignoreFile.directory), filepath.ToSlash(filePath)) {
+			continue
+		}
+		ignoreRelativePath, err := filepath.Rel(ignoreFile.directory, filePath)
+		if err != nil {
+			continue
+		}
+		for _, rule := range ignoreFile.rules {
+			if rule.match(filepath.ToSlash(ignoreRelativePath), isDirectory) {
+				excluded = !rule.negate
+			}
+		}
+	}
+	if excluded || isDirectory {
+		return excluded
+	}
+
+	// Include, the file or one of its parents has to match
+	if len(w.filter.include) > 0 && !w.included(relativePath) {
+		return true
+	}
+
+	// Size and age of the regular files
+	if !info.Mode().IsRegular() {
+		return false
+	}
+	options := w.filter.options
+	if options.MinSize > 0 && info.Size() < options.MinSize {
+		return true
+	}
+	if options.MaxSize > 0 && info.Size() > options.MaxSize {
+		return true
+	}
+	age := w.now.Sub(info.ModTime())
+	if options.MinAge > 0 && age < options.MinAge {
+		return true
+	}
+	if options.MaxAge > 0 && age > options.MaxAge {
+		return true
+	}
+	return false
+}
+
+func (w *filterWalk) included(relativePath string) bool {
+	segments := strings.Split(relativePath, "/")
+	for k := len(segments); k > 0; k-- {
+		candidate := strings.Join(segments[:k], "/")
+		isDirectory := k < len(segments)
+		included := false
+		for _, rule := range w.filter.include {
+			if rule.match(candidate, isDirectory) {
+				included = !rule.negate
+			}
+		}
+		if included {
+			return true
+		}
+	}
+	return false
+}
+
+// Walk is filepath.Walk without the files rejected by the filter, the root
+// itself is always visited
+func (f *Filter) Walk(root string, walkFn filepath.WalkFunc) error {
+	return f.walk(root, root, walkFn)
+}
+
+// walk reads the ignore files from ignoreRoot instead of root, a sync
+// applies the ignore files of the source to the destination
+func (f *Filter) walk(root string, ignoreRoot string, walkFn filepath.WalkFunc) error {
+	if f == nil {
+		return filepath.Walk(root, walkFn)
+	}
+	w := &filterWalk{filter: f, root: filepath.Clean(root), ignoreRoot: filepath.Clean(ignoreRoot), now: time.Now()}
+	return filepath.Walk(w.root, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return walkFn(filePath, info, err)
+		}
+		if filePath != w.root {
+			relativePath, err := filepath.Rel(w.root, filePath)
+			if err != nil {
+				return err
+			}
+			if w.excluded(filePath, filepath.ToSlash(relativePath), info) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+		}
+		if info.IsDir() {
+			err := w.loadIgnoreFile(filePath)
+			if err != nil {
+				return fmt.Errorf("couldn't read the ignore file of %s -> %s", filePath, err)
+			}
+		}
+		return walkFn(filePath, info, nil)
+	})
+}
+
+// treeEntryInfo is the os.FileInfo of a TreeEntry, for the trees which are
+// not local
+type treeEntryInfo struct {
+	entry TreeEntry
+}
+
+func (i treeEntryInfo) Name() string       { return path.Base(i.entry.Path) }
+func (i treeEntryInfo) Size() int64        { return i.entry.Size }
+func (i treeEntryInfo) Mode() os.FileMode  { return i.entry.Mode }
+func (i treeEntryInfo) ModTime() time.Time { return i.entry.ModTime }
+func (i treeEntryInfo) IsDir() bool        { return i.entry.Mode.IsDir() }
+func (i treeEntryInfo) Sys() interface{}   { return nil }
+
+// FilterTree returns the entries of a tree which are selected by filter, for
+// a tree which wasn't scanned locally. The ignore files are read from
+// ignoreRoot, the local tree the other one is compared with
+func FilterTree(tree map[string]TreeEntry, ignoreRoot string, filter *Filter) (map[string]TreeEntry, error) {
+	if filter == nil {
+		return tree, nil
+	}
+	w := &filterWalk{filter: filter, root: filepath.Clean(ignoreRoot), ignoreRoot: filepath.Clean(ignoreRoot), now: time.Now()}
+	err := w.loadIgnoreFile(w.root)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read the ignore file of %s -> %s", w.root, err)
+	}
+	filtered := make(map[string]TreeEntry)
+	var excludedDirectories []string
+	for _, relativePath := range sortedTreePaths(tree) {
+		entry := tree[relativePath]
+		skipped := false
+		for _, directory := range excludedDirectories {
+			skipped = skipped || isChildPath(directory, relativePath)
+		}
+		if skipped {
+			continue
+		}
+		filePath := filepath.Join(w.root, filepath.FromSlash(relativePath))
+		if w.excluded(filePath, relativePath, treeEntryInfo{entry: entry}) {
+			if entry.Mode.IsDir() {
+				excludedDirectories = append(excludedDirectories, relativePath)
+			}
+			continue
+		}
+		if entry.Mode.IsDir() {
+			err := w.loadIgnoreFile(filePath)
+			if err != nil {
+				return nil, fmt.Errorf("couldn't read the ignore file of %s -> %s", filePath, err)
+			}
+		}
+		filtered[relativePath] = entry
+	}
+	return filtered, nil
+}
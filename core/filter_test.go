@@ -0,0 +1,189 @@
+/*
+   Copyright (c) 2022 Cyber Home Lab authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+// walkWithFilter returns the relative paths visited by the filter
+func walkWithFilter(t *testing.T, filter *Filter, root string) []string {
+	var paths []string
+	err := filter.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relativePath, err := filepath.Rel(root, path)
+		assert.NilError(t, err)
+		paths = append(paths, filepath.ToSlash(relativePath))
+		return nil
+	})
+	assert.NilError(t, err)
+	sort.Strings(paths)
+	return paths
+}
+
+func TestFilterPatterns(t *testing.T) {
+	directoryPath := filepath.Join(os.TempDir(), "TestFilterPatterns")
+	createTestTree(t, directoryPath, testTreeOptions{})
+
+	testCases := []struct {
+		options  FilterOptions
+		expected []string
+	}{
+		{
+			options:  FilterOptions{Exclude: []string{"*.log", "node_modules/"}},
+			expected: []string{".", "a.txt", "cache", "cache/c.txt", "data", "empty", "src", "src/d.go", "src/sub"},
+		},
+		{
+			options:  FilterOptions{Exclude: []string{"/cache", "src/**/*.log", "# comment", ""}},
+			expected: []string{".", "a.txt", "b.log", "data", "empty", "src", "src/d.go", "src/node_modules", "src/node_modules/e.js", "src/sub"},
+		},
+		{
+			options:  FilterOptions{Exclude: []string{"*.txt", "!a.txt", "src"}},
+			expected: []string{".", "a.txt", "b.log", "cache", "data", "empty"},
+		},
+		{
+			options:  FilterOptions{Include: []string{"src/"}, Exclude: []string{"*.log"}},
+			expected: []string{".", "cache", "src", "src/d.go", "src/node_modules", "src/node_modules/e.js", "src/sub"},
+		},
+		{
+			options:  FilterOptions{MinSize: 6, MaxSize: 11},
+			expected: []string{".", "cache", "cache/c.txt", "src", "src/d.go", "src/node_modules", "src/sub"},
+		},
+	}
+	for _, testCase := range testCases {
+		filter, err := NewFilter(testCase.options)
+		assert.NilError(t, err)
+		assert.DeepEqual(t, walkWithFilter(t, filter, directoryPath), testCase.expected)
+	}
+
+	// A nil filter visits everything
+	assert.Equal(t, len(walkWithFilter(t, nil, directoryPath)), 1+testTreeDirectories+testTreeFiles)
+
+	// Invalid patterns
+	_, err := NewFilter(FilterOptions{Exclude: []string{"[a-"}})
+	assert.ErrorContains(t, err, "invalid pattern")
+
+	// Cleanup
+	assert.NilError(t, Remove(directoryPath))
+}
+
+func TestFilterAge(t *testing.T) {
+	directoryPath := filepath.Join(os.TempDir(), "TestFilterAge")
+	createTestTree(t, directoryPath, testTreeOptions{})
+	old := time.Now().Add(-48 * time.Hour)
+	assert.NilError(t, os.Chtimes(filepath.Join(directoryPath, "a.txt"), old, old))
+
+	filter, err := NewFilter(FilterOptions{MaxAge: 24 * time.Hour, Exclude: []string{"src/"}})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, walkWithFilter(t, filter, directoryPath), []string{".", "b.log", "cache", "cache/c.txt", "data", "empty"})
+	filter, err = NewFilter(FilterOptions{MinAge: 24 * time.Hour})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, walkWithFilter(t, filter, directoryPath), []string{".", "a.txt", "cache", "src", "src/node_modules", "src/sub"})
+
+	// Cleanup
+	assert.NilError(t, Remove(directoryPath))
+}
+
+func TestFilterIgnoreFile(t *testing.T) {
+	directoryPath := filepath.Join(os.TempDir(), "TestFilterIgnoreFile")
+	createTestTree(t, directoryPath, testTreeOptions{})
+	assert.NilError(t, WriteToFile(filepath.Join(directoryPath, BackupIgnoreFileName), "cache/\n"))
+	assert.NilError(t, WriteToFile(filepath.Join(directoryPath, "src", BackupIgnoreFileName), "/node_modules\n*.log\n"))
+
+	filter, err := NewFilter(FilterOptions{IgnoreFileName: BackupIgnoreFileName})
+	assert.NilError(t, err)
+	expected := []string{".", BackupIgnoreFileName, "a.txt", "b.log", "data", "empty", "src", "src/" + BackupIgnoreFileName, "src/d.go", "src/sub"}
+	assert.DeepEqual(t, walkWithFilter(t, filter, directoryPath), expected)
+
+	// The size, copy, sync and archive functions use the same files
+	size, err := GetDirectorySizeWithFilter(directoryPath, filter)
+	assert.NilError(t, err)
+	assert.Equal(t, size, int64(7+5+5+20+8+testTreeDataSize))
+
+	copyPath := filepath.Join(os.TempDir(), "TestFilterIgnoreFile_copy")
+	assert.NilError(t, CopyDirectoryWithOptions(directoryPath, copyPath, CopyOptions{Filter: filter}))
+	assert.DeepEqual(t, walkWithFilter(t, nil, copyPath), expected)
+
+	syncPath := filepath.Join(os.TempDir(), "TestFilterIgnoreFile_sync")
+	assert.NilError(t, os.MkdirAll(filepath.Join(syncPath, "cache"), DefaultMode))
+	assert.NilError(t, WriteToFile(filepath.Join(syncPath, "cache", "kept.txt"), "kept"))
+	_, err = Sync(directoryPath, syncPath, SyncOptions{Delete: true, Filter: filter}, CopyOptions{})
+	assert.NilError(t, err)
+	_, err = os.Stat(filepath.Join(syncPath, "cache", "kept.txt"))
+	assert.NilError(t, err)
+	_, err = os.Stat(filepath.Join(syncPath, "src", "node_modules"))
+	assert.Assert(t, os.IsNotExist(err))
+
+	archivePath := filepath.Join(os.TempDir(), "TestFilterIgnoreFile.tar.gz")
+	result, err := CreateArchiveWithOptions(archivePath, []string{directoryPath}, ArchiveOptions{Filter: filter})
+	assert.NilError(t, err)
+	assert.Equal(t, result.Entries, len(expected))
+
+	// Cleanup
+	for _, path := range []string{directoryPath, copyPath, syncPath, archivePath} {
+		assert.NilError(t, Remove(path))
+	}
+}
+
+func TestBackupFilterOptions(t *testing.T) {
+	var config Config
+	config.Common.Backup = []string{"/data"}
+	config.Common.BackupExclude = map[string][]string{"/data": {"*.tmp"}}
+	host := Host{Backup: []string{"/data"}, BackupExclude: map[string][]string{"/data": {"cache/"}}}
+
+	options := config.BackupFilterOptions(host, "/data")
+	assert.DeepEqual(t, options.Exclude, []string{"*.tmp", "cache/"})
+	assert.Equal(t, options.IgnoreFileName, BackupIgnoreFileName)
+	assert.NilError(t, checkBackupExclude("Common", config.Common.Backup, config.Common.BackupExclude))
+
+	// Negative flow
+	err := checkBackupExclude("Common", config.Common.Backup, map[string][]string{"/other": {"*.tmp"}})
+	assert.ErrorContains(t, err, "Common.BackupExclude has patterns for /other which is not in Common.Backup")
+	err = checkBackupExclude("Common", config.Common.Backup, map[string][]string{"/data": {"[a-"}})
+	assert.ErrorContains(t, err, "Common.BackupExclude for /data is not valid")
+}
+
+func TestFilterTree(t *testing.T) {
+	directoryPath := filepath.Join(os.TempDir(), "TestFilterTree")
+	createTestTree(t, directoryPath, testTreeOptions{})
+	assert.NilError(t, WriteToFile(filepath.Join(directoryPath, BackupIgnoreFileName), "cache/\n"))
+	assert.NilError(t, WriteToFile(filepath.Join(directoryPath, "src", BackupIgnoreFileName), "/node_modules\n*.log\n"))
+	tree, err := ScanTree(directoryPath)
+	assert.NilError(t, err)
+
+	// The same files as a walk with the filter
+	filter, err := NewFilter(FilterOptions{Exclude: []string{"a.txt"}, IgnoreFileName: BackupIgnoreFileName})
+	assert.NilError(t, err)
+	filtered, err := FilterTree(tree, directoryPath, filter)
+	assert.NilError(t, err)
+	expected := walkWithFilter(t, filter, directoryPath)[1:]
+	assert.DeepEqual(t, sortedTreePaths(filtered), expected)
+	filtered, err = FilterTree(tree, directoryPath, nil)
+	assert.NilError(t, err)
+	assert.Equal(t, len(filtered), len(tree))
+
+	// Cleanup
+	assert.NilError(t, Remove(directoryPath))
+}
@@ -0,0 +1,78 @@
+/*
+   Copyright (c) 2022 Cyber Home Lab authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package core
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+// The test tree without the variants has testTreeFiles regular files of
+// testTreeBytes in testTreeDirectories directories besides its root. Its
+// data file spans several chunks, volumes and compression blocks
+const (
+	testTreeDataSize    = 256 * 1024
+	testTreeFiles       = 8
+	testTreeDirectories = 4
+	testTreeBytes       = testTreeDataSize + 63
+)
+
+// testTreeOptions adds the variants of the test tree
+type testTreeOptions struct {
+	// Links adds the symlink link to a.txt and the hardlink hardlink to data
+	Links bool
+	// Deletions adds gone/file and src/deleted.txt for the tests which
+	// delete them
+	Deletions bool
+	// Copy adds cache/copy with the content of data, which the
+	// repositories deduplicate
+	Copy bool
+}
+
+// createTestTree creates the tree shared by the tests and returns the content
+// of data. The small files contain their relative path and a.txt has the
+// mode 0600, data is half random and half zeros so it compresses to about
+// half of its size
+func createTestTree(t *testing.T, directoryPath string, options testTreeOptions) []byte {
+	files := []string{"a.txt", "b.log", "cache/c.txt", "src/d.go", "src/node_modules/e.js", "src/sub/f.log"}
+	if options.Deletions {
+		files = append(files, "gone/file", "src/deleted.txt")
+	}
+	for _, relativePath := range files {
+		filePath := filepath.Join(directoryPath, filepath.FromSlash(relativePath))
+		assert.NilError(t, os.MkdirAll(filepath.Dir(filePath), DefaultMode))
+		assert.NilError(t, WriteToFile(filePath, relativePath))
+	}
+	assert.NilError(t, os.Chmod(filepath.Join(directoryPath, "a.txt"), 0600))
+	assert.NilError(t, WriteToFile(filepath.Join(directoryPath, "empty"), ""))
+
+	data := make([]byte, testTreeDataSize)
+	rand.New(rand.NewSource(1)).Read(data[:testTreeDataSize/2])
+	assert.NilError(t, os.WriteFile(filepath.Join(directoryPath, "data"), data, 0644))
+	if options.Copy {
+		assert.NilError(t, os.WriteFile(filepath.Join(directoryPath, "cache", "copy"), data, 0644))
+	}
+	if options.Links {
+		assert.NilError(t, os.Symlink("a.txt", filepath.Join(directoryPath, "link")))
+		assert.NilError(t, os.Link(filepath.Join(directoryPath, "data"), filepath.Join(directoryPath, "hardlink")))
+	}
+	return data
+}
@@ -0,0 +1,413 @@
+/*
+   Copyright (c) 2022 Cyber Home Lab authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package core
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+type ArchiveFormat string
+
+const (
+	ArchiveFormatAuto   ArchiveFormat = ""
+	ArchiveFormatTar    ArchiveFormat = "tar"
+	ArchiveFormatTarGz  ArchiveFormat = "tar.gz"
+	ArchiveFormatTarZst ArchiveFormat = "tar.zst"
+	ArchiveFormatTarXz  ArchiveFormat = "tar.xz"
+	ArchiveFormatZip    ArchiveFormat = "zip"
+)
+
+var archiveExtensions = []struct {
+	extension string
+	format    ArchiveFormat
+}{
+	{".tar.gz", ArchiveFormatTarGz},
+	{".tgz", ArchiveFormatTarGz},
+	{".tar.zst", ArchiveFormatTarZst},
+	{".tzst", ArchiveFormatTarZst},
+	{".tar.xz", ArchiveFormatTarXz},
+	{".txz", ArchiveFormatTarXz},
+	{".tar", ArchiveFormatTar},
+	{".zip", ArchiveFormatZip},
+}
+
+// DetectArchiveFormat returns the format based on the extension of the file,
+// the extension of the encryption is ignored
+func DetectArchiveFormat(archivePath string) (ArchiveFormat, error) {
+	lowerPath := strings.TrimSuffix(strings.ToLower(archivePath), EncryptedArchiveExtension)
+	for _, archiveExtension := range archiveExtensions {
+		if strings.HasSuffix(lowerPath, archiveExtension.extension) {
+			return archiveExtension.format, nil
+		}
+	}
+	return ArchiveFormatAuto, fmt.Errorf("couldn't detect the archive format of %s", archivePath)
+}
+
+// detectArchiveFormatFromContent checks the magic bytes at the beginning of
+// the stream
+func detectArchiveFormatFromContent(header []byte) ArchiveFormat {
+	switch {
+	case bytes.HasPrefix(header, []byte{0x1f, 0x8b}):
+		return ArchiveFormatTarGz
+	case bytes.HasPrefix(header, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return ArchiveFormatTarZst
+	case bytes.HasPrefix(header, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}):
+		return ArchiveFormatTarXz
+	case bytes.HasPrefix(header, []byte{'P', 'K', 0x03, 0x04}), bytes.HasPrefix(header, []byte{'P', 'K', 0x05, 0x06}):
+		return ArchiveFormatZip
+	case len(header) >= 262 && string(header[257:262]) == "ustar":
+		return ArchiveFormatTar
+	}
+	return ArchiveFormatAuto
+}
+
+// archiveWriter hides the differences between tar and zip, the entries are
+// always described with tar headers
+type archiveWriter interface {
+	WriteHeader(header *tar.Header) error
+	Write(p []byte) (int, error)
+	Close() error
+}
+
+type tarArchiveWriter struct {
+	*tar.Writer
+	compressor io.WriteCloser
+}
+
+func (w *tarArchiveWriter) Close() error {
+	// The compressor is always closed so its goroutines stop
+	err := w.Writer.Close()
+	if w.compressor != nil {
+		compressorErr := w.compressor.Close()
+		if err == nil {
+			err = compressorErr
+		}
+	}
+	return err
+}
+
+type zipArchiveWriter struct {
+	writer  *zip.Writer
+	current io.Writer
+}
+
+func (w *zipArchiveWriter) WriteHeader(header *tar.Header) error {
+	fileHeader, err := zip.FileInfoHeader(header.FileInfo())
+	if err != nil {
+		return err
+	}
+	fileHeader.Name = strings.TrimSuffix(header.Name, "/")
+	fileHeader.Modified = header.ModTime
+	switch header.Typeflag {
+	case tar.TypeDir:
+		fileHeader.Name += "/"
+		fileHeader.Method = zip.Store
+	case tar.TypeSymlink:
+		// The target of a symlink is stored as its content
+		fileHeader.Method = zip.Store
+	case tar.TypeReg, tar.TypeRegA:
+		fileHeader.Method = zip.Deflate
+	default:
+		return fmt.Errorf("entry type %c of %s is not supported by zip", header.Typeflag, header.Name)
+	}
+	w.current, err = w.writer.CreateHeader(fileHeader)
+	if err != nil {
+		return err
+	}
+	if header.Typeflag == tar.TypeSymlink {
+		_, err = w.current.Write([]byte(header.Linkname))
+	}
+	return err
+}
+
+func (w *zipArchiveWriter) Write(p []byte) (int, error) {
+	if w.current == nil {
+		return 0, fmt.Errorf("zip entry header is missing")
+	}
+	return w.current.Write(p)
+}
+
+func (w *zipArchiveWriter) Close() error {
+	return w.writer.Close()
+}
+
+// xzDictionarySizes are the dictionaries used by the xz presets from 0 to 9
+var xzDictionarySizes = []int{256 << 10, 1 << 20, 2 << 20, 4 << 20, 4 << 20, 8 << 20, 8 << 20, 16 << 20, 32 << 20, 64 << 20}
+
+// newArchiveWriter returns a writer for format, level 0 means the default
+// compression level of the format
+func newArchiveWriter(writer io.Writer, format ArchiveFormat, level int) (archiveWriter, error) {
+	var compressor io.WriteCloser
+	var err error
+	switch format {
+	case ArchiveFormatTar:
+	case ArchiveFormatTarGz:
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		var gzipWriter *gzip.Writer
+		gzipWriter, err = gzip.NewWriterLevel(writer, level)
+		if err == nil {
+			// No name and no timestamp in the header, the same data
+			// always gives the same bytes
+			gzipWriter.Header = gzip.Header{OS: 255}
+			compressor = gzipWriter
+		}
+	case ArchiveFormatTarZst:
+		zstdOptions := []zstd.EOption{}
+		if level != 0 {
+			zstdOptions = append(zstdOptions, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		}
+		compressor, err = zstd.NewWriter(writer, zstdOptions...)
+	case ArchiveFormatTarXz:
+		config := xz.WriterConfig{}
+		if level != 0 {
+			if level < 0 || level >= len(xzDictionarySizes) {
+				return nil, fmt.Errorf("xz compression level %d is not between 0 and 9", level)
+			}
+			config.DictCap = xzDictionarySizes[level]
+		}
+		compressor, err = config.NewWriter(writer)
+	case ArchiveFormatZip:
+		zipWriter := zip.NewWriter(writer)
+		if level != 0 {
+			if level < flate.HuffmanOnly || level > flate.BestCompression {
+				return nil, fmt.Errorf("zip compression level %d is not between %d and %d", level, flate.HuffmanOnly, flate.BestCompression)
+			}
+			zipWriter.RegisterCompressor(zip.Deflate, func(w io.Writer) (io.WriteCloser, error) {
+				return flate.NewWriter(w, level)
+			})
+		}
+		return &zipArchiveWriter{writer: zipWriter}, nil
+	default:
+		return nil, fmt.Errorf("unknown archive format %s", format)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create the %s compressor -> %s", format, err)
+	}
+	if compressor == nil {
+		return &tarArchiveWriter{Writer: tar.NewWriter(writer)}, nil
+	}
+	return &tarArchiveWriter{Writer: tar.NewWriter(compressor), compressor: compressor}, nil
+}
+
+// archiveReader is the reading counterpart of archiveWriter
+type archiveReader interface {
+	Next() (*tar.Header, error)
+	Read(p []byte) (int, error)
+	Close() error
+}
+
+type tarArchiveReader struct {
+	*tar.Reader
+	// stream is the decompressed tar stream, it is read until the end after
+	// the last entry so the checksum of the compression is verified
+	stream       io.Reader
+	decompressor io.Closer
+}
+
+func (r *tarArchiveReader) Next() (*tar.Header, error) {
+	header, err := r.Reader.Next()
+	if err == io.EOF {
+		_, drainErr := io.Copy(ioutil.Discard, r.stream)
+		if drainErr != nil {
+			return nil, fmt.Errorf("the archive is incomplete -> %s", drainErr)
+		}
+	}
+	return header, err
+}
+
+func (r *tarArchiveReader) Close() error {
+	if r.decompressor != nil {
+		return r.decompressor.Close()
+	}
+	return nil
+}
+
+type zipArchiveReader struct {
+	files   []*zip.File
+	index   int
+	current io.ReadCloser
+}
+
+func (r *zipArchiveReader) Next() (*tar.Header, error) {
+	if r.current != nil {
+		r.current.Close()
+		r.current = nil
+	}
+	if r.index >= len(r.files) {
+		return nil, io.EOF
+	}
+	file := r.files[r.index]
+	r.index++
+
+	info := file.FileInfo()
+	header := &tar.Header{
+		Name:     file.Name,
+		Mode:     int64(info.Mode().Perm()),
+		ModTime:  file.Modified,
+		Typeflag: tar.TypeReg,
+		Size:     int64(file.UncompressedSize64),
+	}
+	content, err := file.Open()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open zip entry %s -> %s", file.Name, err)
+	}
+	switch {
+	case info.IsDir():
+		header.Typeflag = tar.TypeDir
+		header.Size = 0
+	case info.Mode()&os.ModeSymlink != 0:
+		linkName, err := ioutil.ReadAll(io.LimitReader(content, 4096))
+		content.Close()
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read the target of symlink %s -> %s", file.Name, err)
+		}
+		header.Typeflag = tar.TypeSymlink
+		header.Linkname = string(linkName)
+		header.Size = 0
+		return header, nil
+	}
+	r.current = content
+	return header, nil
+}
+
+func (r *zipArchiveReader) Read(p []byte) (int, error) {
+	if r.current == nil {
+		return 0, io.EOF
+	}
+	return r.current.Read(p)
+}
+
+func (r *zipArchiveReader) Close() error {
+	if r.current != nil {
+		return r.current.Close()
+	}
+	return nil
+}
+
+// temporaryFileCloser removes the temporary copy of a streamed zip archive
+type temporaryFileCloser struct {
+	archiveReader
+	file *os.File
+}
+
+func (c *temporaryFileCloser) Close() error {
+	err := c.archiveReader.Close()
+	c.file.Close()
+	os.Remove(c.file.Name())
+	return err
+}
+
+// openArchiveReader reads the archive from reader, the format is detected
+// from the content when it is not given and from the extension of name when
+// the content is not enough. Encrypted archives are always recognised and
+// decrypted with encryption
+func openArchiveReader(reader io.Reader, format ArchiveFormat, name string, encryption *EncryptionOptions) (archiveReader, error) {
+	bufferedReader := bufio.NewReaderSize(reader, 64*1024)
+	header, err := bufferedReader.Peek(512)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if isEncrypted(header) {
+		decryptingReader, err := newDecryptingReader(bufferedReader, encryption)
+		if err != nil {
+			return nil, err
+		}
+		return openArchiveReader(decryptingReader, format, name, nil)
+	}
+	if format == ArchiveFormatAuto {
+		format = detectArchiveFormatFromContent(header)
+		if format == ArchiveFormatAuto {
+			format, err = DetectArchiveFormat(name)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	switch format {
+	case ArchiveFormatZip:
+		// zip needs random access, a stream is copied to a temporary file
+		if file, ok := reader.(*os.File); ok {
+			return newZipArchiveReader(file)
+		}
+		file, err := ioutil.TempFile("", "archive-*.zip")
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.Copy(file, bufferedReader)
+		if err != nil {
+			file.Close()
+			os.Remove(file.Name())
+			return nil, fmt.Errorf("couldn't buffer the zip archive -> %s", err)
+		}
+		zipReader, err := newZipArchiveReader(file)
+		if err != nil {
+			file.Close()
+			os.Remove(file.Name())
+			return nil, err
+		}
+		return &temporaryFileCloser{archiveReader: zipReader, file: file}, nil
+	case ArchiveFormatTar:
+		return &tarArchiveReader{Reader: tar.NewReader(bufferedReader), stream: bufferedReader}, nil
+	case ArchiveFormatTarGz:
+		gzipReader, err := gzip.NewReader(bufferedReader)
+		if err != nil {
+			return nil, err
+		}
+		return &tarArchiveReader{Reader: tar.NewReader(gzipReader), stream: gzipReader, decompressor: gzipReader}, nil
+	case ArchiveFormatTarZst:
+		zstdReader, err := zstd.NewReader(bufferedReader)
+		if err != nil {
+			return nil, err
+		}
+		return &tarArchiveReader{Reader: tar.NewReader(zstdReader), stream: zstdReader, decompressor: zstdReader.IOReadCloser()}, nil
+	case ArchiveFormatTarXz:
+		xzReader, err := xz.NewReader(bufferedReader)
+		if err != nil {
+			return nil, err
+		}
+		return &tarArchiveReader{Reader: tar.NewReader(xzReader), stream: xzReader}, nil
+	}
+	return nil, fmt.Errorf("unknown archive format %s", format)
+}
+
+func newZipArchiveReader(file *os.File) (archiveReader, error) {
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	zipReader, err := zip.NewReader(file, stat.Size())
+	if err != nil {
+		return nil, err
+	}
+	return &zipArchiveReader{files: zipReader.File}, nil
+}
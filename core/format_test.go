@@ -0,0 +1,109 @@
+/*
+   Copyright (c) 2022 Cyber Home Lab authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestDetectArchiveFormat(t *testing.T) {
+	for archivePath, expected := range map[string]ArchiveFormat{
+		"backup.tar":     ArchiveFormatTar,
+		"backup.tar.gz":  ArchiveFormatTarGz,
+		"backup.TGZ":     ArchiveFormatTarGz,
+		"backup.tar.zst": ArchiveFormatTarZst,
+		"backup.tar.xz":  ArchiveFormatTarXz,
+		"backup.zip":     ArchiveFormatZip,
+	} {
+		format, err := DetectArchiveFormat(archivePath)
+		assert.NilError(t, err)
+		assert.Equal(t, format, expected)
+	}
+	_, err := DetectArchiveFormat("backup.rar")
+	assert.ErrorContains(t, err, "couldn't detect the archive format")
+}
+
+func TestArchiveFormats(t *testing.T) {
+	sourceDirectoryPath := filepath.Join(os.TempDir(), "TestArchiveFormats_source")
+	createTestTree(t, sourceDirectoryPath, testTreeOptions{Links: true})
+
+	testCases := []struct {
+		extension string
+		options   ArchiveOptions
+	}{
+		{extension: ".tar"},
+		{extension: ".tar.gz", options: ArchiveOptions{CompressionLevel: 9}},
+		{extension: ".tar.zst", options: ArchiveOptions{CompressionLevel: 3}},
+		{extension: ".tar.xz", options: ArchiveOptions{CompressionLevel: 1}},
+		{extension: ".zip"},
+		{extension: ".backup", options: ArchiveOptions{Format: ArchiveFormatTarZst}},
+	}
+	for _, testCase := range testCases {
+		archivePath := filepath.Join(os.TempDir(), "TestArchiveFormats"+testCase.extension)
+		destinationDirectoryPath := filepath.Join(os.TempDir(), "TestArchiveFormats_destination")
+
+		// Round trip, the format is detected from the content when extracting
+		_, err := CreateArchiveWithOptions(archivePath, []string{sourceDirectoryPath}, testCase.options)
+		assert.NilError(t, err)
+		_, err = ExtractArchive(archivePath, destinationDirectoryPath, ExtractOptions{})
+		assert.NilError(t, err, testCase.extension)
+		extractedDirectoryPath := filepath.Join(destinationDirectoryPath, filepath.Base(sourceDirectoryPath))
+		assert.NilError(t, CheckHash(filepath.Join(sourceDirectoryPath, "data"), filepath.Join(extractedDirectoryPath, "data")))
+		assert.NilError(t, CheckHash(filepath.Join(sourceDirectoryPath, "empty"), filepath.Join(extractedDirectoryPath, "empty")))
+		assert.NilError(t, CheckPermissions(filepath.Join(sourceDirectoryPath, "a.txt"), filepath.Join(extractedDirectoryPath, "a.txt")))
+		linkName, err := os.Readlink(filepath.Join(extractedDirectoryPath, "link"))
+		assert.NilError(t, err)
+		assert.Equal(t, linkName, "a.txt")
+
+		// Cleanup
+		for _, path := range []string{archivePath, destinationDirectoryPath} {
+			assert.NilError(t, Remove(path))
+		}
+	}
+
+	// Cleanup
+	assert.NilError(t, Remove(sourceDirectoryPath))
+}
+
+func TestArchiveFormatsZipSpecialFiles(t *testing.T) {
+	sourceDirectoryPath := filepath.Join(os.TempDir(), "TestArchiveFormatsZipSpecialFiles_source")
+	destinationDirectoryPath := filepath.Join(os.TempDir(), "TestArchiveFormatsZipSpecialFiles_destination")
+	archivePath := filepath.Join(os.TempDir(), "TestArchiveFormatsZipSpecialFiles.zip")
+	assert.NilError(t, os.MkdirAll(sourceDirectoryPath, DefaultMode))
+	assert.NilError(t, WriteToFile(filepath.Join(sourceDirectoryPath, "file"), "file"))
+	assert.NilError(t, syscall.Mkfifo(filepath.Join(sourceDirectoryPath, "fifo"), 0600))
+
+	// The FIFO is skipped with a warning instead of failing the archive
+	result, err := CreateArchiveWithOptions(archivePath, []string{sourceDirectoryPath}, ArchiveOptions{})
+	assert.NilError(t, err)
+	assert.Equal(t, len(result.Warnings), 1)
+	assert.Assert(t, strings.Contains(result.Warnings[0], "fifo"))
+	extractResult, err := ExtractArchive(archivePath, destinationDirectoryPath, ExtractOptions{})
+	assert.NilError(t, err)
+	assert.Equal(t, extractResult.Entries, 2)
+
+	// Cleanup
+	for _, path := range []string{sourceDirectoryPath, destinationDirectoryPath, archivePath} {
+		assert.NilError(t, Remove(path))
+	}
+}
@@ -0,0 +1,202 @@
+/*
+   Copyright (c) 2022 Cyber Home Lab authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package core
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+)
+
+// DeletionsName is the entry of the incremental archives with the names
+// deleted since the previous archive, it is written before the manifest
+const DeletionsName = "DELETIONS.json"
+
+// SnapshotEntry is what is compared to decide if a file changed since the
+// previous archive, like the listed-incremental mode of GNU tar
+type SnapshotEntry struct {
+	Device  uint64      `json:"device"`
+	Inode   uint64      `json:"inode"`
+	ModTime int64       `json:"mod_time"`
+	Size    int64       `json:"size"`
+	Mode    os.FileMode `json:"mode"`
+	UserId  int         `json:"uid"`
+	GroupId int         `json:"gid"`
+}
+
+// Snapshot records everything stored in the chain of archives, the keys of
+// Entries are the names in the archives. Level is 0 for a full archive
+type Snapshot struct {
+	Time    time.Time                `json:"time"`
+	Level   int                      `json:"level"`
+	Entries map[string]SnapshotEntry `json:"entries"`
+}
+
+func newSnapshotEntry(info os.FileInfo) SnapshotEntry {
+	entry := SnapshotEntry{
+		ModTime: info.ModTime().UnixNano(),
+		Size:    info.Size(),
+		Mode:    info.Mode(),
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		entry.Device = uint64(stat.Dev)
+		entry.Inode = uint64(stat.Ino)
+		entry.UserId = int(stat.Uid)
+		entry.GroupId = int(stat.Gid)
+	}
+	if info.IsDir() {
+		entry.Size = 0
+	}
+	return entry
+}
+
+// ReadSnapshot returns nil without an error when the snapshot doesn't exist,
+// the next archive is a full one
+func ReadSnapshot(snapshotPath string) (*Snapshot, error) {
+	content, err := ioutil.ReadFile(snapshotPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read snapshot %s -> %s", snapshotPath, err)
+	}
+	snapshot := &Snapshot{}
+	err = json.Unmarshal(content, snapshot)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't decode snapshot %s -> %s", snapshotPath, err)
+	}
+	if snapshot.Entries == nil {
+		snapshot.Entries = make(map[string]SnapshotEntry)
+	}
+	return snapshot, nil
+}
+
+// WriteSnapshot replaces the snapshot file, see ArchiveOptions.DeferSnapshot
+func WriteSnapshot(snapshotPath string, snapshot *Snapshot) error {
+	content, err := json.Marshal(snapshot)
+	if err != nil {
+		return fmt.Errorf("couldn't encode the snapshot -> %s", err)
+	}
+	return WriteFileAtomically(snapshotPath, content, 0600)
+}
+
+func isDeletions(header *tar.Header) bool {
+	return header.Typeflag == tar.TypeReg && filepath.Clean(header.Name) == DeletionsName
+}
+
+// unchanged records the entry in the snapshot of the current run and checks
+// if it was already stored by one of the previous archives, the directories
+// are always stored so their metadata is restored
+func (a *archiver) unchanged(name string, info os.FileInfo) bool {
+	if a.snapshot == nil {
+		return false
+	}
+	entry := newSnapshotEntry(info)
+	a.snapshot.Entries[name] = entry
+	if a.previous == nil || info.IsDir() {
+		return false
+	}
+	previousEntry, found := a.previous.Entries[name]
+	return found && previousEntry == entry
+}
+
+// writeDeletions adds the names which were in the previous snapshot and are
+// not in the current one
+func (a *archiver) writeDeletions() error {
+	if a.previous == nil {
+		return nil
+	}
+	deletions := []string{}
+	for name := range a.previous.Entries {
+		if _, found := a.snapshot.Entries[name]; !found {
+			deletions = append(deletions, name)
+		}
+	}
+	sort.Strings(deletions)
+	a.result.Deleted = len(deletions)
+	content, err := json.Marshal(deletions)
+	if err != nil {
+		return err
+	}
+	header := &tar.Header{
+		Name:     DeletionsName,
+		Mode:     0644,
+		ModTime:  a.snapshot.Time.Truncate(time.Second),
+		Typeflag: tar.TypeReg,
+		Size:     int64(len(content)),
+	}
+	normalizeHeader(header, a.options, a.sourceDateEpoch)
+	err = a.writer.WriteHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = a.writer.Write(content)
+	return err
+}
+
+// applyDeletions removes the names deleted since the previous archive of
+// the chain, a name which doesn't exist anymore is ignored
+func (e *extractor) applyDeletions(reader io.Reader) error {
+	var deletions []string
+	err := json.NewDecoder(reader).Decode(&deletions)
+	if err != nil {
+		return fmt.Errorf("couldn't decode the deletions -> %s", err)
+	}
+	for _, deletion := range deletions {
+		name, err := sanitizeEntryName(deletion)
+		if err != nil {
+			return err
+		}
+		if name == "" || !IsSelected(name, e.options.Paths) {
+			continue
+		}
+		targetPath, err := e.securePath(name)
+		if err != nil {
+			return err
+		}
+		err = os.RemoveAll(targetPath)
+		if err != nil {
+			return fmt.Errorf("couldn't delete %s -> %s", deletion, err)
+		}
+		e.result.Deleted++
+	}
+	return nil
+}
+
+// ExtractArchiveChain extracts a full archive followed by its incremental
+// archives in order, the destination has the state of the last archive
+func ExtractArchiveChain(archivePaths []string, destinationPath string, options ExtractOptions) (ExtractResult, error) {
+	var result ExtractResult
+	for _, archivePath := range archivePaths {
+		archiveResult, err := ExtractArchive(archivePath, destinationPath, options)
+		result.Entries += archiveResult.Entries
+		result.Bytes += archiveResult.Bytes
+		result.Deleted += archiveResult.Deleted
+		result.Warnings = append(result.Warnings, archiveResult.Warnings...)
+		if err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
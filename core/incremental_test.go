@@ -0,0 +1,156 @@
+/*
+   Copyright (c) 2022 Cyber Home Lab authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestIncrementalArchives(t *testing.T) {
+	sourceDirectoryPath := filepath.Join(os.TempDir(), "TestIncrementalArchives_source")
+	destinationDirectoryPath := filepath.Join(os.TempDir(), "TestIncrementalArchives_destination")
+	snapshotPath := filepath.Join(os.TempDir(), "TestIncrementalArchives.snapshot")
+	archivePaths := []string{
+		filepath.Join(os.TempDir(), "TestIncrementalArchives.0.tar.gz"),
+		filepath.Join(os.TempDir(), "TestIncrementalArchives.1.tar.gz"),
+		filepath.Join(os.TempDir(), "TestIncrementalArchives.2.tar.gz"),
+	}
+	createTestTree(t, sourceDirectoryPath, testTreeOptions{Deletions: true})
+	options := ArchiveOptions{Snapshot: snapshotPath}
+
+	// Full
+	result, err := CreateArchiveWithOptions(archivePaths[0], []string{sourceDirectoryPath}, options)
+	assert.NilError(t, err)
+	assert.Equal(t, result.Level, 0)
+	assert.Equal(t, result.Entries, 16)
+	snapshot, err := ReadSnapshot(snapshotPath)
+	assert.NilError(t, err)
+	assert.Equal(t, len(snapshot.Entries), 16)
+
+	// A changed, a new and a deleted file and a deleted directory, the
+	// directories are always stored
+	assert.NilError(t, WriteToFile(filepath.Join(sourceDirectoryPath, "a.txt"), "Changed!"))
+	assert.NilError(t, WriteToFile(filepath.Join(sourceDirectoryPath, "src", "sub", "new"), "New!"))
+	assert.NilError(t, Remove(filepath.Join(sourceDirectoryPath, "src", "deleted.txt")))
+	assert.NilError(t, Remove(filepath.Join(sourceDirectoryPath, "gone")))
+	result, err = CreateArchiveWithOptions(archivePaths[1], []string{sourceDirectoryPath}, options)
+	assert.NilError(t, err)
+	assert.Equal(t, result.Level, 1)
+	assert.Equal(t, result.Entries, 1+testTreeDirectories+2)
+	assert.Equal(t, result.Deleted, 3)
+	_, err = VerifyArchive(archivePaths[1])
+	assert.NilError(t, err)
+
+	// Nothing changed
+	result, err = CreateArchiveWithOptions(archivePaths[2], []string{sourceDirectoryPath}, options)
+	assert.NilError(t, err)
+	assert.Equal(t, result.Level, 2)
+	assert.Equal(t, result.Entries, 1+testTreeDirectories)
+	assert.Equal(t, result.Deleted, 0)
+
+	// The chain has the final state
+	extractResult, err := ExtractArchiveChain(archivePaths, destinationDirectoryPath, ExtractOptions{})
+	assert.NilError(t, err)
+	assert.Equal(t, extractResult.Deleted, 3)
+	extractedDirectoryPath := filepath.Join(destinationDirectoryPath, filepath.Base(sourceDirectoryPath))
+	assert.NilError(t, CheckIfDirectoriesMatch(sourceDirectoryPath, extractedDirectoryPath))
+	content, err := ReadFile(filepath.Join(extractedDirectoryPath, "a.txt"))
+	assert.NilError(t, err)
+	assert.Equal(t, content, "Changed!")
+	for _, relativePath := range []string{filepath.Join("src", "deleted.txt"), "gone"} {
+		_, err = os.Stat(filepath.Join(extractedDirectoryPath, relativePath))
+		assert.Assert(t, os.IsNotExist(err), relativePath)
+	}
+
+	// Cleanup
+	for _, path := range append(archivePaths, sourceDirectoryPath, destinationDirectoryPath, snapshotPath) {
+		assert.NilError(t, Remove(path))
+	}
+}
+
+func TestDifferentialArchives(t *testing.T) {
+	sourceDirectoryPath := filepath.Join(os.TempDir(), "TestDifferentialArchives_source")
+	snapshotPath := filepath.Join(os.TempDir(), "TestDifferentialArchives.snapshot")
+	archivePath := filepath.Join(os.TempDir(), "TestDifferentialArchives.tar")
+	createTestTree(t, sourceDirectoryPath, testTreeOptions{Deletions: true})
+	options := ArchiveOptions{Snapshot: snapshotPath, Differential: true}
+
+	// The first archive is the full one, the next ones are compared with it
+	result, err := CreateArchiveWithOptions(archivePath, []string{sourceDirectoryPath}, options)
+	assert.NilError(t, err)
+	assert.Equal(t, result.Entries, 16)
+	for k, name := range []string{"a.txt", "b.log"} {
+		assert.NilError(t, WriteToFile(filepath.Join(sourceDirectoryPath, name), "Changed!"))
+		result, err = CreateArchiveWithOptions(archivePath, []string{sourceDirectoryPath}, options)
+		assert.NilError(t, err)
+		assert.Equal(t, result.Level, 1)
+		// The directories with gone and the files changed since the full one
+		assert.Equal(t, result.Entries, 2+testTreeDirectories+1+k)
+	}
+
+	// A snapshot which can't be read
+	assert.NilError(t, WriteToFile(snapshotPath, "invalid"))
+	_, err = CreateArchiveWithOptions(archivePath, []string{sourceDirectoryPath}, options)
+	assert.ErrorContains(t, err, "couldn't decode snapshot")
+
+	// Cleanup
+	for _, path := range []string{archivePath, sourceDirectoryPath, snapshotPath} {
+		assert.NilError(t, Remove(path))
+	}
+}
+
+func TestIncrementalSnapshotIsWrittenLast(t *testing.T) {
+	sourceDirectoryPath := filepath.Join(os.TempDir(), "TestIncrementalSnapshotIsWrittenLast_source")
+	snapshotPath := filepath.Join(os.TempDir(), "TestIncrementalSnapshotIsWrittenLast.snapshot")
+	archivePath := filepath.Join(os.TempDir(), "TestIncrementalSnapshotIsWrittenLast.tar.gz")
+	assert.NilError(t, os.MkdirAll(sourceDirectoryPath, DefaultMode))
+	assert.NilError(t, WriteToFile(filepath.Join(sourceDirectoryPath, "full"), "Full!"))
+	_, err := CreateArchiveWithOptions(archivePath, []string{sourceDirectoryPath}, ArchiveOptions{Snapshot: snapshotPath})
+	assert.NilError(t, err)
+	assert.NilError(t, WriteToFile(filepath.Join(sourceDirectoryPath, "incremental"), "Incremental!"))
+
+	// A failed archive keeps the previous snapshot
+	missingPath := filepath.Join(os.TempDir(), "TestIncrementalSnapshotIsWrittenLast_missing")
+	_, err = CreateArchiveWithOptions(archivePath, []string{sourceDirectoryPath, missingPath}, ArchiveOptions{Snapshot: snapshotPath})
+	assert.Assert(t, err != nil)
+	snapshot, err := ReadSnapshot(snapshotPath)
+	assert.NilError(t, err)
+	assert.Equal(t, snapshot.Level, 0)
+
+	// A deferred snapshot is only written by the caller
+	result, err := CreateArchiveWithOptions(archivePath, []string{sourceDirectoryPath}, ArchiveOptions{Snapshot: snapshotPath, DeferSnapshot: true})
+	assert.NilError(t, err)
+	assert.Equal(t, result.Snapshot.Level, 1)
+	snapshot, err = ReadSnapshot(snapshotPath)
+	assert.NilError(t, err)
+	assert.Equal(t, snapshot.Level, 0)
+	assert.NilError(t, WriteSnapshot(snapshotPath, result.Snapshot))
+	snapshot, err = ReadSnapshot(snapshotPath)
+	assert.NilError(t, err)
+	assert.Equal(t, snapshot.Level, 1)
+	_, found := snapshot.Entries[filepath.Base(sourceDirectoryPath)+"/incremental"]
+	assert.Assert(t, found)
+
+	// Cleanup
+	for _, path := range []string{sourceDirectoryPath, snapshotPath, archivePath} {
+		assert.NilError(t, Remove(path))
+	}
+}
@@ -0,0 +1,380 @@
+/*
+   Copyright (c) 2022 Cyber Home Lab authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package core
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ManifestName is the last entry of the archives, it contains the SHA-256
+// of every regular file in the format of sha256sum
+const ManifestName = "MANIFEST.sha256"
+
+type manifestEntry struct {
+	name string
+	hash string
+}
+
+func formatManifest(entries []manifestEntry) []byte {
+	var buffer bytes.Buffer
+	for _, entry := range entries {
+		fmt.Fprintf(&buffer, "%s  %s\n", entry.hash, entry.name)
+	}
+	return buffer.Bytes()
+}
+
+func parseManifest(reader io.Reader) (map[string]string, error) {
+	hashes := make(map[string]string)
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		// The hash has a fixed size, the name is everything after the
+		// separator which follows it
+		hashSize := sha256.Size * 2
+		if len(line) <= hashSize+2 || line[hashSize:hashSize+2] != "  " || strings.Contains(line[:hashSize], " ") {
+			return nil, fmt.Errorf("invalid manifest line %q", line)
+		}
+		hashes[line[hashSize+2:]] = line[:hashSize]
+	}
+	return hashes, scanner.Err()
+}
+
+func isManifest(header *tar.Header) bool {
+	return header.Typeflag == tar.TypeReg && filepath.Clean(header.Name) == ManifestName
+}
+
+type ArchiveEntryType string
+
+const (
+	ArchiveEntryFile      ArchiveEntryType = "file"
+	ArchiveEntryDirectory ArchiveEntryType = "directory"
+	ArchiveEntrySymlink   ArchiveEntryType = "symlink"
+	ArchiveEntryHardlink  ArchiveEntryType = "hardlink"
+	ArchiveEntryOther     ArchiveEntryType = "other"
+)
+
+type ArchiveEntry struct {
+	Path      string           `json:"path"`
+	Type      ArchiveEntryType `json:"type"`
+	Size      int64            `json:"size"`
+	Mode      os.FileMode      `json:"mode"`
+	UserId    int              `json:"uid"`
+	GroupId   int              `json:"gid"`
+	UserName  string           `json:"user,omitempty"`
+	GroupName string           `json:"group,omitempty"`
+	ModTime   time.Time        `json:"mod_time"`
+	// Linkname is the target of symlinks and hardlinks
+	Linkname string `json:"linkname,omitempty"`
+}
+
+func newArchiveEntry(header *tar.Header) ArchiveEntry {
+	entry := ArchiveEntry{
+		Path:      strings.TrimSuffix(header.Name, "/"),
+		Type:      ArchiveEntryOther,
+		Size:      header.Size,
+		Mode:      header.FileInfo().Mode(),
+		UserId:    header.Uid,
+		GroupId:   header.Gid,
+		UserName:  header.Uname,
+		GroupName: header.Gname,
+		ModTime:   header.ModTime,
+		Linkname:  header.Linkname,
+	}
+	switch header.Typeflag {
+	case tar.TypeReg:
+		entry.Type = ArchiveEntryFile
+	case tar.TypeDir:
+		entry.Type = ArchiveEntryDirectory
+	case tar.TypeSymlink:
+		entry.Type = ArchiveEntrySymlink
+	case tar.TypeLink:
+		entry.Type = ArchiveEntryHardlink
+	}
+	return entry
+}
+
+type InspectOptions struct {
+	// Format is detected from the content of the archive when it is empty
+	Format ArchiveFormat
+	// Encryption has the identities or the passphrase of encrypted archives
+	Encryption *EncryptionOptions
+}
+
+// archiveInspection is what is known about an archive after reading it,
+// hashes are only computed when the content is read
+type archiveInspection struct {
+	entries  []ArchiveEntry
+	bytes    int64
+	hashes   map[string]string
+	manifest map[string]string
+}
+
+func inspectArchive(archivePath string, options InspectOptions, readContent bool) (archiveInspection, error) {
+	inspection := archiveInspection{hashes: make(map[string]string)}
+
+	// Open the archive, or its volumes
+	file, err := openArchiveFile(archivePath)
+	if err != nil {
+		return inspection, fmt.Errorf("couldn't open archive %s -> %s", archivePath, err)
+	}
+	defer file.Close()
+	name := strings.TrimSuffix(archivePath, VolumeIndexSuffix)
+	reader, err := openArchiveReader(file, options.Format, name, options.Encryption)
+	if err != nil {
+		return inspection, fmt.Errorf("couldn't read archive %s -> %s", archivePath, err)
+	}
+	defer reader.Close()
+
+	// Go through each entry
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return inspection, fmt.Errorf("couldn't read the next entry of archive %s -> %s", archivePath, err)
+		}
+		if inspection.manifest != nil {
+			return inspection, fmt.Errorf("archive %s has entry %s after the manifest", archivePath, header.Name)
+		}
+
+		// The manifest
+		if isManifest(header) {
+			if !readContent {
+				inspection.manifest = make(map[string]string)
+				continue
+			}
+			inspection.manifest, err = parseManifest(reader)
+			if err != nil {
+				return inspection, fmt.Errorf("couldn't read the manifest of archive %s -> %s", archivePath, err)
+			}
+			continue
+		}
+
+		// The deletions of the incremental archives
+		if isDeletions(header) {
+			continue
+		}
+
+		// The entry
+		entry := newArchiveEntry(header)
+		inspection.entries = append(inspection.entries, entry)
+		if entry.Type != ArchiveEntryFile {
+			continue
+		}
+		inspection.bytes += entry.Size
+		if !readContent {
+			continue
+		}
+		hash := sha256.New()
+		_, err = io.Copy(hash, reader)
+		if err != nil {
+			return inspection, fmt.Errorf("couldn't read %s from archive %s -> %s", header.Name, archivePath, err)
+		}
+		inspection.hashes[header.Name] = hex.EncodeToString(hash.Sum(nil))
+	}
+	return inspection, nil
+}
+
+// ListArchive returns the entries of an archive without extracting them,
+// the manifest isn't one of them
+func ListArchive(archivePath string) ([]ArchiveEntry, error) {
+	return ListArchiveWithOptions(archivePath, InspectOptions{})
+}
+
+func ListArchiveWithOptions(archivePath string, options InspectOptions) ([]ArchiveEntry, error) {
+	inspection, err := inspectArchive(archivePath, options, false)
+	if err != nil {
+		return nil, err
+	}
+	return inspection.entries, nil
+}
+
+type VerifyResult struct {
+	Entries int
+	Bytes   int64
+	// Manifest is false for the archives created without a manifest, only
+	// the readability of the entries is verified for them
+	Manifest bool
+}
+
+// VerifyArchive reads the whole archive, so a truncated compression stream
+// or an unreadable entry is found, and compares the content of the files
+// with the manifest
+func VerifyArchive(archivePath string) (VerifyResult, error) {
+	return VerifyArchiveWithOptions(archivePath, InspectOptions{})
+}
+
+func VerifyArchiveWithOptions(archivePath string, options InspectOptions) (VerifyResult, error) {
+	inspection, err := inspectArchive(archivePath, options, true)
+	if err != nil {
+		return VerifyResult{}, err
+	}
+	result := VerifyResult{
+		Entries:  len(inspection.entries),
+		Bytes:    inspection.bytes,
+		Manifest: inspection.manifest != nil,
+	}
+	if !result.Manifest {
+		return result, nil
+	}
+
+	// Both ways, a file missing from the manifest is as bad as a file
+	// missing from the archive
+	for name, hash := range inspection.hashes {
+		manifestHash, found := inspection.manifest[name]
+		if !found {
+			return result, fmt.Errorf("%s from archive %s is not in the manifest", name, archivePath)
+		}
+		if manifestHash != hash {
+			return result, fmt.Errorf("hash missmatch for %s in archive %s (%s) and its manifest (%s)", name, archivePath, hash, manifestHash)
+		}
+	}
+	for name := range inspection.manifest {
+		if _, found := inspection.hashes[name]; !found {
+			return result, fmt.Errorf("%s from the manifest is missing from archive %s", name, archivePath)
+		}
+	}
+	return result, nil
+}
+
+// ReadManifest returns the hashes of the manifest of an archive by entry
+// name, it is nil for the archives created without a manifest
+func ReadManifest(archivePath string, options InspectOptions) (map[string]string, error) {
+	inspection, err := inspectArchive(archivePath, options, true)
+	if err != nil {
+		return nil, err
+	}
+	return inspection.manifest, nil
+}
+
+// CheckIfArchiveMatchesDirectory compares an archive created from directoryPath
+// with the directory, like CheckIfDirectoriesMatch the number of files and
+// the amount of data have to be the same and the content of every regular
+// file has to match
+func CheckIfArchiveMatchesDirectory(archivePath string, directoryPath string) error {
+	return CheckIfArchiveMatchesDirectoryWithOptions(archivePath, directoryPath, ArchiveOptions{})
+}
+
+// CheckIfArchiveMatchesDirectoryWithOptions takes the options the archive
+// was created with, so the names and the filter of the directory are the
+// same as in the archive. Incremental archives don't have all the files of
+// the directory and are refused
+func CheckIfArchiveMatchesDirectoryWithOptions(archivePath string, directoryPath string, options ArchiveOptions) error {
+	// Prechecks
+	if options.Snapshot != "" {
+		return fmt.Errorf("archive %s is incremental, it can't be compared with %s", archivePath, directoryPath)
+	}
+	directoryPath = filepath.Clean(directoryPath)
+	directoryStat, err := os.Stat(directoryPath)
+	if err != nil {
+		return fmt.Errorf("couldn't run os.Stat() -> %s", err)
+	}
+	if !directoryStat.IsDir() {
+		return fmt.Errorf("%s is not a directory", directoryPath)
+	}
+	inspection, err := inspectArchive(archivePath, InspectOptions{Format: options.Format, Encryption: options.Encryption}, true)
+	if err != nil {
+		return err
+	}
+
+	// The entries of the directory, the names are created like in the
+	// archive so the name of the directory itself is empty when it is the
+	// prefix which is stripped
+	namer := &archiver{options: options}
+	directoryName, err := namer.entryName(directoryPath, directoryPath)
+	if err != nil {
+		return err
+	}
+	archiveEntries := make(map[string]ArchiveEntry)
+	for _, entry := range inspection.entries {
+		if entry.Path == directoryName {
+			continue
+		}
+		if directoryName == "" || directoryName == "." || strings.HasPrefix(entry.Path, directoryName+"/") {
+			archiveEntries[entry.Path] = entry
+		}
+	}
+
+	// Nr. of files
+	filter := options.Filter
+	if pathFilter, found := options.PathFilters[directoryPath]; found {
+		filter = pathFilter
+	}
+	nrOfFilesInDirectory := 0
+	var directoryBytes, archiveBytes int64
+	err = filter.Walk(directoryPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == directoryPath || info.Mode()&os.ModeSocket != 0 {
+			return nil
+		}
+		name, err := namer.entryName(directoryPath, path)
+		if err != nil {
+			return err
+		}
+		nrOfFilesInDirectory++
+		entry, found := archiveEntries[name]
+		if !found {
+			return fmt.Errorf("%s is missing from archive %s", path, archivePath)
+		}
+
+		// Content
+		if !info.Mode().IsRegular() || entry.Type == ArchiveEntryHardlink {
+			return nil
+		}
+		directoryBytes += info.Size()
+		archiveBytes += entry.Size
+		hash, err := GetHash(path)
+		if err != nil {
+			return fmt.Errorf("couldn't get the hash for file %s -> %s", path, err)
+		}
+		archiveHash := inspection.hashes[entry.Path]
+		if hash != archiveHash {
+			return fmt.Errorf("hash missmatch between %s (%s) and %s in archive %s (%s)", path, hash, entry.Path, archivePath, archiveHash)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if nrOfFilesInDirectory != len(archiveEntries) {
+		return fmt.Errorf("the number of files differ between %s and %s", directoryPath, archivePath)
+	}
+
+	// Size
+	if directoryBytes != archiveBytes {
+		return fmt.Errorf("not the same amount of data are available in %s and %s", directoryPath, archivePath)
+	}
+
+	// End
+	return nil
+}
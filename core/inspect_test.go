@@ -0,0 +1,237 @@
+/*
+   Copyright (c) 2022 Cyber Home Lab authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package core
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestListArchive(t *testing.T) {
+	sourceDirectoryPath := filepath.Join(os.TempDir(), "TestListArchive_source")
+	archivePath := filepath.Join(os.TempDir(), "TestListArchive.tar.zst")
+	createTestTree(t, sourceDirectoryPath, testTreeOptions{Links: true})
+	assert.NilError(t, CreateArchive(archivePath, []string{sourceDirectoryPath}))
+
+	// The manifest isn't listed
+	entries, err := ListArchive(archivePath)
+	assert.NilError(t, err)
+	assert.Equal(t, len(entries), 1+testTreeDirectories+testTreeFiles+2)
+	assert.Equal(t, entries[0].Path, "TestListArchive_source")
+	assert.Equal(t, entries[0].Type, ArchiveEntryDirectory)
+	types := make(map[string]ArchiveEntryType)
+	for _, entry := range entries {
+		assert.Assert(t, entry.Path != ManifestName)
+		types[strings.TrimPrefix(entry.Path, "TestListArchive_source/")] = entry.Type
+		if entry.Type == ArchiveEntryFile {
+			info, err := os.Stat(filepath.Join(os.TempDir(), entry.Path))
+			assert.NilError(t, err)
+			assert.Equal(t, entry.Size, info.Size())
+			assert.Equal(t, entry.Mode, info.Mode())
+			assert.Equal(t, entry.UserId, DefaultUserId)
+		}
+	}
+
+	assert.Equal(t, types["src"], ArchiveEntryDirectory)
+	assert.Equal(t, types["empty"], ArchiveEntryFile)
+	assert.Equal(t, types["link"], ArchiveEntrySymlink)
+	assert.Equal(t, types["hardlink"], ArchiveEntryHardlink)
+
+	// Cleanup
+	assert.NilError(t, Remove(sourceDirectoryPath))
+	assert.NilError(t, Remove(archivePath))
+}
+
+func TestVerifyArchiveHappyFlow(t *testing.T) {
+	sourceDirectoryPath := filepath.Join(os.TempDir(), "TestVerifyArchiveHappyFlow_source")
+	createTestTree(t, sourceDirectoryPath, testTreeOptions{Links: true})
+
+	for _, extension := range []string{".tar", ".tar.gz", ".tar.zst", ".tar.xz", ".zip"} {
+		archivePath := filepath.Join(os.TempDir(), "TestVerifyArchiveHappyFlow"+extension)
+		assert.NilError(t, CreateArchive(archivePath, []string{sourceDirectoryPath}))
+		result, err := VerifyArchive(archivePath)
+		assert.NilError(t, err, extension)
+		assert.Equal(t, result.Entries, 1+testTreeDirectories+testTreeFiles+2)
+		assert.Equal(t, result.Manifest, true)
+		assert.NilError(t, CheckIfArchiveMatchesDirectory(archivePath, sourceDirectoryPath))
+		manifest, err := ReadManifest(archivePath, InspectOptions{})
+		assert.NilError(t, err)
+		// Zip archives store the hardlink as a file
+		expectedFiles := testTreeFiles
+		if extension == ".zip" {
+			expectedFiles++
+		}
+		assert.Equal(t, len(manifest), expectedFiles)
+		assert.NilError(t, Remove(archivePath))
+	}
+
+	// Archives without a manifest are only read
+	archivePath := filepath.Join(os.TempDir(), "TestVerifyArchiveHappyFlow_nomanifest.tar.gz")
+	createTestArchive(t, archivePath, []testArchiveEntry{
+		{header: tar.Header{Name: "file.txt", Typeflag: tar.TypeReg}, content: "content"},
+	})
+	result, err := VerifyArchive(archivePath)
+	assert.NilError(t, err)
+	assert.Equal(t, result.Manifest, false)
+	assert.Equal(t, result.Bytes, int64(7))
+	manifest, err := ReadManifest(archivePath, InspectOptions{})
+	assert.NilError(t, err)
+	assert.Assert(t, manifest == nil)
+
+	// Cleanup
+	assert.NilError(t, Remove(sourceDirectoryPath))
+	assert.NilError(t, Remove(archivePath))
+}
+
+func TestVerifyArchiveNegativeFlow(t *testing.T) {
+	archivePath := filepath.Join(os.TempDir(), "TestVerifyArchiveNegativeFlow.tar.gz")
+	validHash := "ed7002b439e9ac845f22357d822bac1444730fbdb6016d3ec9432297b9ec9f73"
+	emptyHash := "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+	testCases := []struct {
+		name    string
+		entries []testArchiveEntry
+		err     string
+	}{
+		{
+			name: "content differs",
+			entries: []testArchiveEntry{
+				{header: tar.Header{Name: "file.txt", Typeflag: tar.TypeReg}, content: "other"},
+				{header: tar.Header{Name: ManifestName, Typeflag: tar.TypeReg}, content: validHash + "  file.txt\n"},
+			},
+			err: "hash missmatch for file.txt",
+		},
+		{
+			name: "not in the manifest",
+			entries: []testArchiveEntry{
+				{header: tar.Header{Name: "file.txt", Typeflag: tar.TypeReg}, content: ""},
+				{header: tar.Header{Name: ManifestName, Typeflag: tar.TypeReg}, content: ""},
+			},
+			err: "file.txt from archive " + archivePath + " is not in the manifest",
+		},
+		{
+			name: "missing from the archive",
+			entries: []testArchiveEntry{
+				{header: tar.Header{Name: ManifestName, Typeflag: tar.TypeReg}, content: emptyHash + "  file.txt\n"},
+			},
+			err: "file.txt from the manifest is missing",
+		},
+		{
+			name: "entry after the manifest",
+			entries: []testArchiveEntry{
+				{header: tar.Header{Name: ManifestName, Typeflag: tar.TypeReg}, content: ""},
+				{header: tar.Header{Name: "file.txt", Typeflag: tar.TypeReg}, content: ""},
+			},
+			err: "has entry file.txt after the manifest",
+		},
+		{
+			name: "invalid manifest",
+			entries: []testArchiveEntry{
+				{header: tar.Header{Name: ManifestName, Typeflag: tar.TypeReg}, content: "file.txt\n"},
+			},
+			err: "invalid manifest line",
+		},
+	}
+	for _, testCase := range testCases {
+		createTestArchive(t, archivePath, testCase.entries)
+		_, err := VerifyArchive(archivePath)
+		assert.ErrorContains(t, err, testCase.err, testCase.name)
+	}
+
+	// Truncated compression stream
+	createTestArchive(t, archivePath, []testArchiveEntry{
+		{header: tar.Header{Name: "file.txt", Typeflag: tar.TypeReg}, content: "content"},
+	})
+	info, err := os.Stat(archivePath)
+	assert.NilError(t, err)
+	assert.NilError(t, os.Truncate(archivePath, info.Size()-4))
+	_, err = VerifyArchive(archivePath)
+	assert.ErrorContains(t, err, "unexpected EOF")
+
+	// Cleanup
+	assert.NilError(t, Remove(archivePath))
+}
+
+func TestCheckIfArchiveMatchesDirectoryNegativeFlow(t *testing.T) {
+	sourceDirectoryPath := filepath.Join(os.TempDir(), "TestCheckIfArchiveMatchesDirectoryNegativeFlow_source")
+	archivePath := filepath.Join(os.TempDir(), "TestCheckIfArchiveMatchesDirectoryNegativeFlow.tar.gz")
+	createTestTree(t, sourceDirectoryPath, testTreeOptions{Links: true})
+	assert.NilError(t, CreateArchive(archivePath, []string{sourceDirectoryPath}))
+
+	// Changed content
+	filePath := filepath.Join(sourceDirectoryPath, "a.txt")
+	content, err := ReadFile(filePath)
+	assert.NilError(t, err)
+	assert.NilError(t, WriteToFile(filePath, content+"x"))
+	assert.ErrorContains(t, CheckIfArchiveMatchesDirectory(archivePath, sourceDirectoryPath), "hash missmatch")
+
+	// New file
+	assert.NilError(t, WriteToFile(filePath, content))
+	assert.NilError(t, WriteToFile(filepath.Join(sourceDirectoryPath, "new.txt"), "new"))
+	assert.ErrorContains(t, CheckIfArchiveMatchesDirectory(archivePath, sourceDirectoryPath), "is missing from archive")
+
+	// Removed file
+	assert.NilError(t, Remove(filepath.Join(sourceDirectoryPath, "new.txt")))
+	assert.NilError(t, Remove(filePath))
+	assert.ErrorContains(t, CheckIfArchiveMatchesDirectory(archivePath, sourceDirectoryPath), "the number of files differ")
+
+	// Cleanup
+	assert.NilError(t, Remove(sourceDirectoryPath))
+	assert.NilError(t, Remove(archivePath))
+}
+
+func TestCheckIfArchiveMatchesDirectoryWithOptions(t *testing.T) {
+	sourceDirectoryPath := filepath.Join(os.TempDir(), "TestCheckIfArchiveMatchesDirectoryWithOptions_source")
+	archivePath := filepath.Join(os.TempDir(), "TestCheckIfArchiveMatchesDirectoryWithOptions.tar.gz")
+	createTestTree(t, sourceDirectoryPath, testTreeOptions{Links: true})
+	filter, err := NewFilter(FilterOptions{Exclude: []string{"*.log"}})
+	assert.NilError(t, err)
+	options := ArchiveOptions{StripPrefix: sourceDirectoryPath, ArchiveRoot: "root", Filter: filter}
+	_, err = CreateArchiveWithOptions(archivePath, []string{sourceDirectoryPath}, options)
+	assert.NilError(t, err)
+
+	// The names and the filter of the archive are used
+	assert.NilError(t, CheckIfArchiveMatchesDirectoryWithOptions(archivePath, sourceDirectoryPath, options))
+	assert.ErrorContains(t, CheckIfArchiveMatchesDirectory(archivePath, sourceDirectoryPath), "is missing from archive")
+	options.Filter = nil
+	assert.ErrorContains(t, CheckIfArchiveMatchesDirectoryWithOptions(archivePath, sourceDirectoryPath, options), "is missing from archive")
+
+	// Incremental archives are refused
+	options.Snapshot = filepath.Join(os.TempDir(), "TestCheckIfArchiveMatchesDirectoryWithOptions.snapshot")
+	assert.ErrorContains(t, CheckIfArchiveMatchesDirectoryWithOptions(archivePath, sourceDirectoryPath, options), "is incremental")
+
+	// Cleanup
+	assert.NilError(t, Remove(sourceDirectoryPath))
+	assert.NilError(t, Remove(archivePath))
+}
+
+func TestParseManifest(t *testing.T) {
+	hash := strings.Repeat("a", 64)
+	manifest, err := parseManifest(strings.NewReader(hash + "  two  spaces.txt\n" + hash + "   leading space.txt\n"))
+	assert.NilError(t, err)
+	assert.DeepEqual(t, manifest, map[string]string{"two  spaces.txt": hash, " leading space.txt": hash})
+
+	_, err = parseManifest(strings.NewReader(hash + " single.txt\n"))
+	assert.ErrorContains(t, err, "invalid manifest line")
+	_, err = parseManifest(strings.NewReader("abc  short.txt\n"))
+	assert.ErrorContains(t, err, "invalid manifest line")
+}
@@ -0,0 +1,33 @@
+/*
+   Copyright (c) 2022 Cyber Home Lab authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package core
+
+import (
+	"fmt"
+)
+
+func SetIOPriority(_ IOPriority) error {
+	return fmt.Errorf("IO priorities are not supported on this platform")
+}
+
+func runWithIOPriority(priority IOPriority, fn func() error) error {
+	err := SetIOPriority(priority)
+	if err != nil {
+		return err
+	}
+	return fn()
+}
@@ -0,0 +1,90 @@
+/*
+   Copyright (c) 2022 Cyber Home Lab authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package core
+
+import (
+	"fmt"
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	ioprioClassShift = 13
+	ioprioWhoProcess = 1
+)
+
+func ioprioGet() (int, error) {
+	// With IOPRIO_WHO_PROCESS and 0 the kernel uses the calling thread
+	priority, _, errno := unix.Syscall(unix.SYS_IOPRIO_GET, ioprioWhoProcess, 0, 0)
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(priority), nil
+}
+
+func ioprioSet(priority int) error {
+	_, _, errno := unix.Syscall(unix.SYS_IOPRIO_SET, ioprioWhoProcess, 0, uintptr(priority))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// SetIOPriority changes the IO priority of the current OS thread, the caller
+// has to run runtime.LockOSThread() before
+func SetIOPriority(priority IOPriority) error {
+	if priority.Class < IOPriorityClassNone || priority.Class > IOPriorityClassIdle {
+		return fmt.Errorf("unknown IO priority class %d", priority.Class)
+	}
+	if priority.Level < 0 || priority.Level > 7 {
+		return fmt.Errorf("IO priority level %d is not between 0 and 7", priority.Level)
+	}
+	err := ioprioSet(int(priority.Class)<<ioprioClassShift | priority.Level)
+	if err != nil {
+		return fmt.Errorf("couldn't run ioprio_set() -> %s", err)
+	}
+	return nil
+}
+
+// runWithIOPriority runs fn on a thread with the IO priority, the thread
+// stays locked to the goroutine when its priority can't be restored so Go
+// terminates it instead of reusing it
+func runWithIOPriority(priority IOPriority, fn func() error) error {
+	runtime.LockOSThread()
+	previousPriority, err := ioprioGet()
+	if err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("couldn't run ioprio_get() -> %s", err)
+	}
+	err = SetIOPriority(priority)
+	if err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+
+	err = fn()
+	restoreErr := ioprioSet(previousPriority)
+	if restoreErr != nil {
+		if err == nil {
+			err = fmt.Errorf("couldn't restore the IO priority -> %s", restoreErr)
+		}
+		return err
+	}
+	runtime.UnlockOSThread()
+	return err
+}
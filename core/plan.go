@@ -0,0 +1,341 @@
+/*
+   Copyright (c) 2022 Cyber Home Lab authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+type PlanActionType string
+
+const (
+	PlanActionCreateDirectory PlanActionType = "mkdir"
+	PlanActionCopyFile        PlanActionType = "copy"
+	PlanActionRemove          PlanActionType = "remove"
+	PlanActionChmod           PlanActionType = "chmod"
+	PlanActionChown           PlanActionType = "chown"
+)
+
+// PlanAction is a single step of a Plan. For copy actions the size and the
+// modification time of the source are recorded, the execution fails if the
+// source changed after the plan was created
+type PlanAction struct {
+	Type        PlanActionType `json:"type"`
+	Source      string         `json:"source,omitempty"`
+	Destination string         `json:"destination"`
+	Size        int64          `json:"size,omitempty"`
+	ModTime     time.Time      `json:"mod_time"`
+	Mode        fs.FileMode    `json:"mode,omitempty"`
+	UserId      int            `json:"uid"`
+	GroupId     int            `json:"gid"`
+}
+
+type Plan struct {
+	Actions []PlanAction `json:"actions"`
+}
+
+func (a PlanAction) String() string {
+	switch a.Type {
+	case PlanActionCreateDirectory:
+		return fmt.Sprintf("%-6s %s (%s %d:%d)", a.Type, a.Destination, a.Mode, a.UserId, a.GroupId)
+	case PlanActionCopyFile:
+		return fmt.Sprintf("%-6s %s -> %s (%d bytes, %s %d:%d)", a.Type, a.Source, a.Destination, a.Size, a.Mode, a.UserId, a.GroupId)
+	case PlanActionRemove:
+		return fmt.Sprintf("%-6s %s (%d bytes)", a.Type, a.Destination, a.Size)
+	case PlanActionChmod:
+		return fmt.Sprintf("%-6s %s (%s)", a.Type, a.Destination, a.Mode)
+	case PlanActionChown:
+		return fmt.Sprintf("%-6s %s (%d:%d)", a.Type, a.Destination, a.UserId, a.GroupId)
+	}
+	return fmt.Sprintf("%-6s %s", a.Type, a.Destination)
+}
+
+func (p Plan) String() string {
+	var builder strings.Builder
+	for _, action := range p.Actions {
+		builder.WriteString(action.String())
+		builder.WriteString("\n")
+	}
+	return builder.String()
+}
+
+// TotalBytes returns the number of bytes which will be copied
+func (p Plan) TotalBytes() int64 {
+	var size int64
+	for _, action := range p.Actions {
+		if action.Type == PlanActionCopyFile {
+			size += action.Size
+		}
+	}
+	return size
+}
+
+func SavePlan(filePath string, plan Plan) error {
+	content, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return fmt.Errorf("couldn't encode the plan -> %s", err)
+	}
+	return WriteToFile(filePath, string(content))
+}
+
+func LoadPlan(filePath string) (Plan, error) {
+	var plan Plan
+	content, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return Plan{}, fmt.Errorf("couldn't read the plan %s -> %s", filePath, err)
+	}
+	err = json.Unmarshal(content, &plan)
+	if err != nil {
+		return Plan{}, fmt.Errorf("couldn't decode the plan %s -> %s", filePath, err)
+	}
+	return plan, nil
+}
+
+func newPlanAction(actionType PlanActionType, sourcePath string, destinationPath string, info os.FileInfo) PlanAction {
+	action := PlanAction{
+		Type:        actionType,
+		Source:      sourcePath,
+		Destination: destinationPath,
+		Mode:        info.Mode(),
+		UserId:      DefaultUserId,
+		GroupId:     DefaultGroupId,
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		action.UserId = int(stat.Uid)
+		action.GroupId = int(stat.Gid)
+	}
+	if !info.IsDir() {
+		action.Size = info.Size()
+		action.ModTime = info.ModTime()
+	}
+	return action
+}
+
+func PlanCopyFile(sourceFilePath string, destinationPath string) (Plan, error) {
+	// Checks
+	sourceFileStat, err := os.Stat(sourceFilePath)
+	if err != nil {
+		return Plan{}, fmt.Errorf("couldn't run os.Stat() -> %s", err)
+	}
+	if sourceFileStat.IsDir() {
+		return Plan{}, fmt.Errorf("%s is a directory, not a file", sourceFilePath)
+	}
+	if !sourceFileStat.Mode().IsRegular() {
+		return Plan{}, fmt.Errorf("%s is not a regular file", sourceFilePath)
+	}
+
+	// The same rules as CopyFile() for the destination
+	destinationStat, err := os.Stat(destinationPath)
+	if err != nil && !os.IsNotExist(err) {
+		return Plan{}, fmt.Errorf("couldn't run os.Stat() -> %s", err)
+	}
+	if err == nil && destinationStat.IsDir() {
+		destinationPath = filepath.Join(destinationPath, sourceFileStat.Name())
+	}
+
+	return Plan{Actions: []PlanAction{newPlanAction(PlanActionCopyFile, sourceFilePath, destinationPath, sourceFileStat)}}, nil
+}
+
+// PlanCopyDirectory lists the directories and the regular files of the tree,
+// the symlinks are skipped so they are neither in the plan nor copied
+func PlanCopyDirectory(sourceDirectoryPath string, destinationDirectoryPath string) (Plan, error) {
+	return PlanCopyDirectoryWithFilter(sourceDirectoryPath, destinationDirectoryPath, nil)
+}
+
+// PlanCopyDirectoryWithFilter leaves out the files rejected by filter
+func PlanCopyDirectoryWithFilter(sourceDirectoryPath string, destinationDirectoryPath string, filter *Filter) (Plan, error) {
+	var plan Plan
+
+	// Cleanup
+	sourceDirectoryPath = filepath.Clean(sourceDirectoryPath)
+	destinationDirectoryPath = filepath.Clean(destinationDirectoryPath)
+
+	// Checks
+	sourceStat, err := os.Stat(sourceDirectoryPath)
+	if err != nil {
+		return Plan{}, fmt.Errorf("couldn't run os.Stat() -> %s", err)
+	}
+	if !sourceStat.IsDir() {
+		return Plan{}, fmt.Errorf("%s is not a directory", sourceDirectoryPath)
+	}
+	_, err = os.Stat(destinationDirectoryPath)
+	if err != nil && !os.IsNotExist(err) {
+		return Plan{}, fmt.Errorf("couldn't run os.Stat() -> %s", err)
+	}
+	if err == nil {
+		return Plan{}, fmt.Errorf(
+			"destination directory %s already exists, please delete it or use a different path",
+			destinationDirectoryPath)
+	}
+
+	// Go through each file, the directories are always before their content
+	err = filter.Walk(sourceDirectoryPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relativePath, err := filepath.Rel(sourceDirectoryPath, path)
+		if err != nil {
+			return err
+		}
+		currentDestinationPath := filepath.Join(destinationDirectoryPath, relativePath)
+
+		switch {
+		case info.IsDir():
+			plan.Actions = append(plan.Actions, newPlanAction(PlanActionCreateDirectory, path, currentDestinationPath, info))
+		case info.Mode()&os.ModeSymlink != 0:
+			// Skip symlinks, see PlanCopyDirectory()
+		case info.Mode().IsRegular():
+			plan.Actions = append(plan.Actions, newPlanAction(PlanActionCopyFile, path, currentDestinationPath, info))
+		default:
+			return fmt.Errorf("%s is not a regular file", path)
+		}
+		return nil
+	})
+	if err != nil {
+		return Plan{}, fmt.Errorf("couldn't get all the files under the following path %s -> %s", sourceDirectoryPath, err)
+	}
+	return plan, nil
+}
+
+func PlanCopy(sourcePath string, destinationPath string) (Plan, error) {
+	sourceStat, err := os.Stat(sourcePath)
+	if err != nil {
+		return Plan{}, fmt.Errorf("couldn't run os.Stat() -> %s", err)
+	}
+	if sourceStat.IsDir() {
+		return PlanCopyDirectory(sourcePath, destinationPath)
+	}
+	if sourceStat.Mode().IsRegular() {
+		return PlanCopyFile(sourcePath, destinationPath)
+	}
+	return Plan{}, fmt.Errorf("coudln't copy file %s because it has an unsuported type for the Copy() function", sourcePath)
+}
+
+// PlanRemove lists everything Remove() would delete, the content of a
+// directory is listed before the directory itself
+func PlanRemove(fileOrDirPath string) (Plan, error) {
+	var plan Plan
+	fileOrDirStat, err := os.Stat(fileOrDirPath)
+	if err != nil {
+		return Plan{}, fmt.Errorf("couldn't run os.Stat() -> %s", err)
+	}
+	if !fileOrDirStat.IsDir() && !fileOrDirStat.Mode().IsRegular() {
+		return Plan{}, fmt.Errorf("%s can't be deleted because it is not a regular file or a directory", fileOrDirPath)
+	}
+	err = filepath.Walk(fileOrDirPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		plan.Actions = append(plan.Actions, newPlanAction(PlanActionRemove, "", path, info))
+		return nil
+	})
+	if err != nil {
+		return Plan{}, fmt.Errorf("couldn't get all the files under the following path %s -> %s", fileOrDirPath, err)
+	}
+	reverseActions(plan.Actions)
+	return plan, nil
+}
+
+func reverseActions(actions []PlanAction) {
+	for i, j := 0, len(actions)-1; i < j; i, j = i+1, j-1 {
+		actions[i], actions[j] = actions[j], actions[i]
+	}
+}
+
+// Execute runs the actions in order and stops at the first error. With
+// options.KeepMetadata the copied files keep the modification time recorded
+// in the plan, otherwise they get the time of the copy
+func (p Plan) Execute(options CopyOptions) error {
+	priority := options.IOPriority
+	options.IOPriority = nil
+	return withIOPriority(priority, func() error {
+		return p.execute(options)
+	})
+}
+
+func (p Plan) execute(options CopyOptions) error {
+	if options.Preflight != nil {
+		err := p.CheckFreeSpace(*options.Preflight)
+		if err != nil {
+			return err
+		}
+		options.Preflight = nil
+	}
+	for _, action := range p.Actions {
+		err := action.execute(options)
+		if err != nil {
+			return fmt.Errorf("couldn't %s %s -> %s", action.Type, action.Destination, err)
+		}
+	}
+	return nil
+}
+
+func (a PlanAction) execute(options CopyOptions) error {
+	switch a.Type {
+	case PlanActionCreateDirectory:
+		err := os.MkdirAll(a.Destination, a.Mode.Perm())
+		if err != nil || !options.KeepMetadata {
+			return err
+		}
+		err = os.Chmod(a.Destination, a.Mode)
+		if err != nil {
+			return err
+		}
+		return os.Chown(a.Destination, a.UserId, a.GroupId)
+	case PlanActionCopyFile:
+		sourceStat, err := os.Stat(a.Source)
+		if err != nil {
+			return fmt.Errorf("couldn't run os.Stat() -> %s", err)
+		}
+		if sourceStat.Size() != a.Size || !sourceStat.ModTime().Equal(a.ModTime) {
+			return fmt.Errorf("source %s changed after the plan was created", a.Source)
+		}
+		_, err = copyFileWithOptions(a.Source, a.Destination, options)
+		if err != nil || !options.KeepMetadata {
+			return err
+		}
+		return os.Chtimes(a.Destination, time.Now(), a.ModTime)
+	case PlanActionRemove:
+		// Only what was reviewed is removed, the modification time of a
+		// directory changes when its content is removed
+		destinationStat, err := os.Lstat(a.Destination)
+		if err != nil {
+			return fmt.Errorf("couldn't run os.Lstat() -> %s", err)
+		}
+		changed := destinationStat.Mode().Type() != a.Mode.Type()
+		if !destinationStat.IsDir() {
+			changed = changed || destinationStat.Size() != a.Size || !destinationStat.ModTime().Equal(a.ModTime)
+		}
+		if changed {
+			return fmt.Errorf("%s changed after the plan was created", a.Destination)
+		}
+		return os.Remove(a.Destination)
+	case PlanActionChmod:
+		return os.Chmod(a.Destination, a.Mode)
+	case PlanActionChown:
+		return os.Lchown(a.Destination, a.UserId, a.GroupId)
+	}
+	return fmt.Errorf("unknown action %s", a.Type)
+}
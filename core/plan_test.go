@@ -0,0 +1,147 @@
+/*
+   Copyright (c) 2022 Cyber Home Lab authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestPlanCopyDirectory(t *testing.T) {
+	sourceDirectoryPath := filepath.Join(os.TempDir(), "TestPlanCopyDirectory_source")
+	destinationDirectoryPath := filepath.Join(os.TempDir(), "TestPlanCopyDirectory_destination")
+	planPath := filepath.Join(os.TempDir(), "TestPlanCopyDirectory_plan.json")
+	createTestTree(t, sourceDirectoryPath, testTreeOptions{})
+
+	// Dry run
+	plan, err := PlanCopy(sourceDirectoryPath, destinationDirectoryPath)
+	assert.NilError(t, err)
+	assert.Equal(t, len(plan.Actions), 1+testTreeDirectories+testTreeFiles)
+	assert.Equal(t, plan.Actions[0].Type, PlanActionCreateDirectory)
+	assert.Equal(t, plan.TotalBytes(), int64(testTreeBytes))
+	assert.Assert(t, strings.Contains(plan.String(), "copy   "+filepath.Join(sourceDirectoryPath, "a.txt")))
+	_, err = os.Stat(destinationDirectoryPath)
+	assert.Assert(t, os.IsNotExist(err))
+
+	// Review and execute
+	assert.NilError(t, SavePlan(planPath, plan))
+	loadedPlan, err := LoadPlan(planPath)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, loadedPlan.String(), plan.String())
+	assert.NilError(t, loadedPlan.Execute(CopyOptions{}))
+	assert.NilError(t, CheckIfDirectoriesMatch(sourceDirectoryPath, destinationDirectoryPath))
+
+	// Cleanup
+	for _, path := range []string{sourceDirectoryPath, destinationDirectoryPath, planPath} {
+		assert.NilError(t, Remove(path))
+	}
+}
+
+func TestPlanExecuteNegativeFlowSourceChanged(t *testing.T) {
+	sourceFilePath := filepath.Join(os.TempDir(), "TestPlanExecuteNegativeFlowSourceChanged_source")
+	destinationFilePath := filepath.Join(os.TempDir(), "TestPlanExecuteNegativeFlowSourceChanged_destination")
+	assert.NilError(t, CreateFileWithMessage(sourceFilePath, "Hello World!", DefaultMode, DefaultUserId, DefaultGroupId))
+
+	// The source changes between the plan and the execution
+	plan, err := PlanCopy(sourceFilePath, destinationFilePath)
+	assert.NilError(t, err)
+	assert.NilError(t, WriteToFile(sourceFilePath, "Hello changed World!"))
+	assert.ErrorContains(t, plan.Execute(CopyOptions{}), "changed after the plan was created")
+
+	// Cleanup
+	assert.NilError(t, Remove(sourceFilePath))
+}
+
+func TestPlanRemove(t *testing.T) {
+	directoryPath := filepath.Join(os.TempDir(), "TestPlanRemove")
+	createTestTree(t, directoryPath, testTreeOptions{})
+
+	// Dry run, the content is listed before the directories
+	plan, err := PlanRemove(directoryPath)
+	assert.NilError(t, err)
+	assert.Equal(t, len(plan.Actions), 1+testTreeDirectories+testTreeFiles)
+	assert.Equal(t, plan.Actions[len(plan.Actions)-1].Destination, directoryPath)
+	_, err = os.Stat(directoryPath)
+	assert.NilError(t, err)
+
+	// Execute
+	assert.NilError(t, plan.Execute(CopyOptions{}))
+	_, err = os.Stat(directoryPath)
+	assert.Assert(t, os.IsNotExist(err))
+}
+
+func TestPlanExecuteNegativeFlowDestinationChanged(t *testing.T) {
+	directoryPath := filepath.Join(os.TempDir(), "TestPlanExecuteNegativeFlowDestinationChanged")
+	filePath := filepath.Join(directoryPath, "file")
+	assert.NilError(t, os.MkdirAll(directoryPath, DefaultMode))
+	assert.NilError(t, WriteToFile(filePath, "reviewed"))
+
+	// A file changed after the review is kept
+	plan, err := PlanRemove(directoryPath)
+	assert.NilError(t, err)
+	assert.NilError(t, WriteToFile(filePath, "changed after the review"))
+	assert.ErrorContains(t, plan.Execute(CopyOptions{}), "changed after the plan was created")
+	content, err := ReadFile(filePath)
+	assert.NilError(t, err)
+	assert.Equal(t, content, "changed after the review")
+
+	// A file replaced by a directory as well
+	plan, err = PlanRemove(directoryPath)
+	assert.NilError(t, err)
+	assert.NilError(t, os.Remove(filePath))
+	assert.NilError(t, os.Mkdir(filePath, DefaultMode))
+	assert.ErrorContains(t, plan.Execute(CopyOptions{}), "changed after the plan was created")
+
+	// Cleanup
+	assert.NilError(t, Remove(directoryPath))
+}
+
+func TestPlanExecuteKeepMetadata(t *testing.T) {
+	sourceDirectoryPath := filepath.Join(os.TempDir(), "TestPlanExecuteKeepMetadata_source")
+	destinationDirectoryPath := filepath.Join(os.TempDir(), "TestPlanExecuteKeepMetadata_destination")
+	filePath := filepath.Join(sourceDirectoryPath, "file")
+	assert.NilError(t, os.MkdirAll(sourceDirectoryPath, DefaultMode))
+	assert.NilError(t, WriteToFile(filePath, "old file"))
+	modTime := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	assert.NilError(t, os.Chtimes(filePath, modTime, modTime))
+
+	// CopyDirectory copies like before the plans, the copy is a new file
+	assert.NilError(t, CopyDirectory(sourceDirectoryPath, destinationDirectoryPath))
+	fileStat, err := os.Stat(filepath.Join(destinationDirectoryPath, "file"))
+	assert.NilError(t, err)
+	assert.Assert(t, !fileStat.ModTime().Equal(modTime))
+	assert.NilError(t, Remove(destinationDirectoryPath))
+
+	// Sync keeps the metadata, so the next sync has nothing to do
+	_, err = Sync(sourceDirectoryPath, destinationDirectoryPath, SyncOptions{}, CopyOptions{})
+	assert.NilError(t, err)
+	fileStat, err = os.Stat(filepath.Join(destinationDirectoryPath, "file"))
+	assert.NilError(t, err)
+	assert.Assert(t, fileStat.ModTime().Equal(modTime))
+	plan, err := PlanSync(sourceDirectoryPath, destinationDirectoryPath, SyncOptions{})
+	assert.NilError(t, err)
+	assert.Equal(t, len(plan.Actions), 0)
+
+	// Cleanup
+	assert.NilError(t, Remove(sourceDirectoryPath))
+	assert.NilError(t, Remove(destinationDirectoryPath))
+}
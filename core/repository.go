@@ -0,0 +1,792 @@
+/*
+   Copyright (c) 2022 Cyber Home Lab authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package core
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	RepositoryConfigName = "config.json"
+	RepositoryVersion    = 1
+)
+
+// The layout of a repository, the chunks are named after the SHA256 of their
+// content and spread in directories by the first two characters. The chunks
+// of an encrypted repository are named after the HMAC-SHA256 of their content
+// instead, with a secret key, so the names don't tell which files are stored
+const (
+	repositoryChunksDirectory    = "chunks"
+	repositorySnapshotsDirectory = "snapshots"
+	repositoryLockName           = "lock"
+	repositoryKeyName            = "key.age"
+)
+
+type RepositoryOptions struct {
+	Chunker ChunkerOptions
+	// Compression compresses the chunks with zstd
+	Compression bool
+	// Encryption encrypts the chunks and the snapshots, the repository
+	// remembers it and needs the keys each time it is opened
+	Encryption *EncryptionOptions
+}
+
+type repositoryConfig struct {
+	Version     int            `json:"version"`
+	Chunker     ChunkerOptions `json:"chunker"`
+	Compression bool           `json:"compression"`
+	Encrypted   bool           `json:"encrypted"`
+	// Recipient is the public key of the repository, its identity is stored
+	// encrypted with the keys given to InitRepository. Deriving a key from
+	// a passphrase for every chunk would be too slow
+	Recipient string `json:"recipient,omitempty"`
+}
+
+// repositoryKey is the content of the key file of an encrypted repository
+type repositoryKey struct {
+	Identity string `json:"identity"`
+	// ChunkKey is the key of the HMAC naming the chunks
+	ChunkKey []byte `json:"chunk_key"`
+}
+
+// Repository is a local directory storing files split in chunks, each chunk
+// is stored once and the snapshots are lists of files referencing chunks
+type Repository struct {
+	path       string
+	config     repositoryConfig
+	encryption *EncryptionOptions
+	chunkKey   []byte
+	encoder    *zstd.Encoder
+	decoder    *zstd.Decoder
+}
+
+// RepositoryNode is a file of a snapshot, the content of the regular files
+// is the concatenation of the chunks
+type RepositoryNode struct {
+	ArchiveEntry
+	Xattrs map[string]string `json:"xattrs,omitempty"`
+	Chunks []string          `json:"chunks,omitempty"`
+}
+
+type RepositorySnapshot struct {
+	Id    string           `json:"id"`
+	Time  time.Time        `json:"time"`
+	Host  string           `json:"host"`
+	Tags  []string         `json:"tags,omitempty"`
+	Paths []string         `json:"paths"`
+	Tree  []RepositoryNode `json:"tree"`
+}
+
+type SnapshotOptions struct {
+	// Filter is used for the paths without an entry in PathFilters
+	Filter      *Filter
+	PathFilters map[string]*Filter
+	// Host is Hostname when empty
+	Host string
+	Tags []string
+}
+
+type SnapshotResult struct {
+	Snapshot string
+	Files    int
+	Bytes    int64
+	Chunks   int
+	// NewChunks were not in the repository, StoredBytes is their size after
+	// the compression and the encryption
+	NewChunks   int
+	StoredBytes int64
+	Duration    time.Duration
+}
+
+type GarbageCollectResult struct {
+	Chunks int
+	Bytes  int64
+}
+
+// InitRepository creates an empty repository, the chunker options and the
+// encryption can't be changed afterwards
+func InitRepository(repositoryPath string, options RepositoryOptions) (*Repository, error) {
+	configPath := filepath.Join(repositoryPath, RepositoryConfigName)
+	if _, err := os.Stat(configPath); err == nil {
+		return nil, fmt.Errorf("repository %s already exists", repositoryPath)
+	}
+	config := repositoryConfig{
+		Version:     RepositoryVersion,
+		Chunker:     options.Chunker.withDefaults(),
+		Compression: options.Compression,
+		Encrypted:   options.Encryption != nil,
+	}
+	err := config.Chunker.check()
+	if err != nil {
+		return nil, err
+	}
+	var key repositoryKey
+	if options.Encryption != nil {
+		key.Identity, config.Recipient, err = GenerateEncryptionKey()
+		if err != nil {
+			return nil, err
+		}
+		key.ChunkKey = make([]byte, sha256.Size)
+		_, err = rand.Read(key.ChunkKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, directory := range []string{repositoryChunksDirectory, repositorySnapshotsDirectory} {
+		err := os.MkdirAll(filepath.Join(repositoryPath, directory), DefaultMode)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't create repository %s -> %s", repositoryPath, err)
+		}
+	}
+	if options.Encryption != nil {
+		content, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		var encryptedKey bytes.Buffer
+		writer, err := newEncryptingWriter(&encryptedKey, options.Encryption)
+		if err != nil {
+			return nil, err
+		}
+		_, err = writer.Write(content)
+		if err == nil {
+			err = writer.Close()
+		}
+		if err == nil {
+			err = WriteFileAtomically(filepath.Join(repositoryPath, repositoryKeyName), encryptedKey.Bytes(), 0600)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("couldn't write the key of repository %s -> %s", repositoryPath, err)
+		}
+	}
+	content, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	err = WriteFileAtomically(configPath, content, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create repository %s -> %s", repositoryPath, err)
+	}
+
+	// The new key is known, the recipients are enough to use the repository
+	r := &Repository{path: repositoryPath, config: config}
+	if options.Encryption != nil {
+		r.encryption = &EncryptionOptions{Recipients: []string{config.Recipient}, Identities: []string{key.Identity}}
+		r.chunkKey = key.ChunkKey
+	}
+	return r, r.openCompression()
+}
+
+// OpenRepository opens an existing repository, the identities or the
+// passphrase given to InitRepository are needed for the encrypted ones
+func OpenRepository(repositoryPath string, encryption *EncryptionOptions) (*Repository, error) {
+	configPath := filepath.Join(repositoryPath, RepositoryConfigName)
+	content, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open repository %s -> %s", repositoryPath, err)
+	}
+	r := &Repository{path: repositoryPath}
+	err = json.Unmarshal(content, &r.config)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't decode the config of repository %s -> %s", repositoryPath, err)
+	}
+	if r.config.Version != RepositoryVersion {
+		return nil, fmt.Errorf("repository %s has version %d instead of %d", repositoryPath, r.config.Version, RepositoryVersion)
+	}
+	if r.config.Encrypted {
+		r.encryption, r.chunkKey, err = openRepositoryKey(repositoryPath, r.config.Recipient, encryption)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return r, r.openCompression()
+}
+
+func (r *Repository) openCompression() error {
+	if !r.config.Compression {
+		return nil
+	}
+	var err error
+	r.encoder, err = zstd.NewWriter(nil)
+	if err != nil {
+		return err
+	}
+	r.decoder, err = zstd.NewReader(nil)
+	return err
+}
+
+// openRepositoryKey returns the encryption options of the chunks and the key
+// naming them, they are in the key file which needs an identity or a
+// passphrase
+func openRepositoryKey(repositoryPath string, recipient string, encryption *EncryptionOptions) (*EncryptionOptions, []byte, error) {
+	if encryption == nil || (len(encryption.Identities) == 0 && encryption.Passphrase == "") {
+		return nil, nil, fmt.Errorf("repository %s is encrypted, the keys are needed", repositoryPath)
+	}
+	file, err := os.Open(filepath.Join(repositoryPath, repositoryKeyName))
+	if err != nil {
+		return nil, nil, fmt.Errorf("couldn't read the key of repository %s -> %s", repositoryPath, err)
+	}
+	defer file.Close()
+	reader, err := newDecryptingReader(file, encryption)
+	if err != nil {
+		return nil, nil, fmt.Errorf("couldn't decrypt the key of repository %s -> %s", repositoryPath, err)
+	}
+	content, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("couldn't decrypt the key of repository %s -> %s", repositoryPath, err)
+	}
+	var key repositoryKey
+	err = json.Unmarshal(content, &key)
+	if err != nil || len(key.ChunkKey) == 0 {
+		return nil, nil, fmt.Errorf("the key of repository %s is not valid", repositoryPath)
+	}
+	return &EncryptionOptions{Recipients: []string{recipient}, Identities: []string{key.Identity}}, key.ChunkKey, nil
+}
+
+func (r *Repository) Path() string {
+	return r.path
+}
+
+// Close releases the zstd encoder and decoder of a compressed repository
+func (r *Repository) Close() error {
+	if r.decoder != nil {
+		r.decoder.Close()
+	}
+	if r.encoder != nil {
+		return r.encoder.Close()
+	}
+	return nil
+}
+
+// lock makes sure a single process changes the repository, the returned
+// function releases the lock. The lock file is locked with flock() so the
+// lock is released when its owner is gone, it has the host and the pid of
+// the owner for the error message
+func (r *Repository) lock() (func(), error) {
+	lockPath := filepath.Join(r.path, repositoryLockName)
+	file, err := os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open the lock of repository %s -> %s", r.path, err)
+	}
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		file.Close()
+		owner, _ := ioutil.ReadFile(lockPath)
+		return nil, fmt.Errorf("repository %s is locked by %s", r.path, strings.TrimSpace(string(owner)))
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("couldn't lock repository %s -> %s", r.path, err)
+	}
+	err = file.Truncate(0)
+	if err == nil {
+		_, err = fmt.Fprintf(file, "%s %d\n", Hostname, os.Getpid())
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("couldn't write the lock of repository %s -> %s", r.path, err)
+	}
+	return func() {
+		file.Truncate(0)
+		file.Close()
+	}, nil
+}
+
+// encode compresses and encrypts what is stored in the repository
+func (r *Repository) encode(data []byte) ([]byte, error) {
+	if r.encoder != nil {
+		data = r.encoder.EncodeAll(data, nil)
+	}
+	if r.encryption == nil {
+		return data, nil
+	}
+	var buffer bytes.Buffer
+	writer, err := newEncryptingWriter(&buffer, r.encryption)
+	if err != nil {
+		return nil, err
+	}
+	_, err = writer.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = writer.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func (r *Repository) decode(data []byte) ([]byte, error) {
+	if r.encryption != nil {
+		reader, err := newDecryptingReader(bytes.NewReader(data), r.encryption)
+		if err != nil {
+			return nil, err
+		}
+		data, err = ioutil.ReadAll(reader)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't decrypt -> %s", err)
+		}
+	}
+	if r.decoder != nil {
+		return r.decoder.DecodeAll(data, nil)
+	}
+	return data, nil
+}
+
+// chunkId names a chunk after its content
+func (r *Repository) chunkId(data []byte) string {
+	if r.chunkKey == nil {
+		hash := sha256.Sum256(data)
+		return hex.EncodeToString(hash[:])
+	}
+	mac := hmac.New(sha256.New, r.chunkKey)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (r *Repository) chunkPath(id string) string {
+	return filepath.Join(r.path, repositoryChunksDirectory, id[:2], id)
+}
+
+// writeChunk stores a chunk unless it is already there and returns the number
+// of bytes written
+func (r *Repository) writeChunk(id string, data []byte) (int64, error) {
+	chunkPath := r.chunkPath(id)
+	if _, err := os.Stat(chunkPath); err == nil {
+		return 0, nil
+	}
+	content, err := r.encode(data)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't encode chunk %s -> %s", id, err)
+	}
+	err = os.MkdirAll(filepath.Dir(chunkPath), DefaultMode)
+	if err != nil {
+		return 0, err
+	}
+	err = WriteFileAtomically(chunkPath, content, 0600)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't write chunk %s -> %s", id, err)
+	}
+	return int64(len(content)), nil
+}
+
+// readChunk returns the content of a chunk after checking its hash
+func (r *Repository) readChunk(id string) ([]byte, error) {
+	if len(id) != sha256.Size*2 {
+		return nil, fmt.Errorf("chunk id %s is not valid", id)
+	}
+	content, err := ioutil.ReadFile(r.chunkPath(id))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read chunk %s -> %s", id, err)
+	}
+	data, err := r.decode(content)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't decode chunk %s -> %s", id, err)
+	}
+	if r.chunkId(data) != id {
+		return nil, fmt.Errorf("chunk %s is corrupted, hash missmatch", id)
+	}
+	return data, nil
+}
+
+// chunkReader reads the content of a file from its chunks
+type chunkReader struct {
+	repository *Repository
+	chunks     []string
+	current    []byte
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for len(c.current) == 0 {
+		if len(c.chunks) == 0 {
+			return 0, io.EOF
+		}
+		data, err := c.repository.readChunk(c.chunks[0])
+		if err != nil {
+			return 0, err
+		}
+		c.current = data
+		c.chunks = c.chunks[1:]
+	}
+	n := copy(p, c.current)
+	c.current = c.current[n:]
+	return n, nil
+}
+
+func newSnapshotId() (string, error) {
+	id := make([]byte, 8)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+func (r *Repository) snapshotPath(id string) string {
+	return filepath.Join(r.path, repositorySnapshotsDirectory, id+".json")
+}
+
+// storeFile splits a file in chunks and stores the new ones
+func (r *Repository) storeFile(ctx context.Context, filePath string, result *SnapshotResult) ([]string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	chunker, err := newChunker(&contextReader{ctx: ctx, reader: file}, r.config.Chunker)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for {
+		chunk, err := chunker.Next()
+		if err == io.EOF {
+			return ids, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read %s -> %s", filePath, err)
+		}
+		id := r.chunkId(chunk)
+		stored, err := r.writeChunk(id, chunk)
+		if err != nil {
+			return nil, err
+		}
+		result.Chunks++
+		result.Bytes += int64(len(chunk))
+		if stored > 0 {
+			result.NewChunks++
+			result.StoredBytes += stored
+		}
+		ids = append(ids, id)
+	}
+}
+
+// CreateSnapshot stores the files under paths, they are named like in the
+// archives after the base name of each path
+func (r *Repository) CreateSnapshot(ctx context.Context, paths []string, options SnapshotOptions) (SnapshotResult, error) {
+	startTime := time.Now()
+	result := SnapshotResult{}
+	unlock, err := r.lock()
+	if err != nil {
+		return result, err
+	}
+	defer unlock()
+	id, err := newSnapshotId()
+	if err != nil {
+		return result, err
+	}
+	snapshot := RepositorySnapshot{Id: id, Time: startTime.UTC(), Host: options.Host, Tags: options.Tags}
+	if snapshot.Host == "" {
+		snapshot.Host = Hostname
+	}
+
+	hardlinks := make(map[fileId]string)
+	for _, sourcePath := range paths {
+		sourcePath, err := filepath.Abs(sourcePath)
+		if err != nil {
+			return result, err
+		}
+		snapshot.Paths = append(snapshot.Paths, sourcePath)
+		filter, found := options.PathFilters[sourcePath]
+		if !found {
+			filter = options.Filter
+		}
+		err = filter.Walk(sourcePath, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			err = ctx.Err()
+			if err != nil {
+				return err
+			}
+			relativePath, err := filepath.Rel(sourcePath, path)
+			if err != nil {
+				return err
+			}
+			name := filepath.ToSlash(filepath.Join(filepath.Base(sourcePath), relativePath))
+			node, err := r.newNode(ctx, path, name, info, hardlinks, &result)
+			if err != nil || node == nil {
+				return err
+			}
+			snapshot.Tree = append(snapshot.Tree, *node)
+			return nil
+		})
+		if err != nil {
+			return result, fmt.Errorf("couldn't snapshot %s -> %s", sourcePath, err)
+		}
+	}
+
+	// The snapshot
+	content, err := json.Marshal(snapshot)
+	if err != nil {
+		return result, err
+	}
+	content, err = r.encode(content)
+	if err != nil {
+		return result, fmt.Errorf("couldn't encode snapshot %s -> %s", id, err)
+	}
+	err = WriteFileAtomically(r.snapshotPath(id), content, 0600)
+	if err != nil {
+		return result, fmt.Errorf("couldn't write snapshot %s -> %s", id, err)
+	}
+	result.Snapshot = id
+	result.Duration = time.Since(startTime)
+	return result, nil
+}
+
+// newNode describes a file of the snapshot and stores its content, nil is
+// returned for the files which can't be restored
+func (r *Repository) newNode(ctx context.Context, path string, name string, info os.FileInfo, hardlinks map[fileId]string, result *SnapshotResult) (*RepositoryNode, error) {
+	if !info.Mode().IsRegular() && !info.IsDir() && info.Mode()&os.ModeSymlink == 0 {
+		return nil, nil
+	}
+	var linkTarget string
+	if info.Mode()&os.ModeSymlink != 0 {
+		var err error
+		linkTarget, err = os.Readlink(path)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read symlink %s -> %s", path, err)
+		}
+	}
+	header, err := tar.FileInfoHeader(info, linkTarget)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't describe %s -> %s", path, err)
+	}
+	header.Name = name
+	node := &RepositoryNode{}
+	node.Xattrs, err = getXattrs(path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read the extended attributes of %s -> %s", path, err)
+	}
+
+	// Hardlinks are stored once
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if ok && info.Mode().IsRegular() && stat.Nlink > 1 {
+		id := fileId{device: uint64(stat.Dev), inode: uint64(stat.Ino)}
+		if firstName, found := hardlinks[id]; found {
+			header.Typeflag = tar.TypeLink
+			header.Linkname = firstName
+			header.Size = 0
+		} else {
+			hardlinks[id] = name
+		}
+	}
+	node.ArchiveEntry = newArchiveEntry(header)
+	if header.Typeflag != tar.TypeReg {
+		return node, nil
+	}
+	result.Files++
+	node.Chunks, err = r.storeFile(ctx, path, result)
+	if err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// header returns the tar header of a node, so it can be extracted like an
+// archive entry
+func (n RepositoryNode) header() *tar.Header {
+	mode := int64(n.Mode.Perm())
+	if n.Mode&os.ModeSetuid != 0 {
+		mode |= 04000
+	}
+	if n.Mode&os.ModeSetgid != 0 {
+		mode |= 02000
+	}
+	if n.Mode&os.ModeSticky != 0 {
+		mode |= 01000
+	}
+	header := &tar.Header{
+		Name:     n.Path,
+		Size:     n.Size,
+		Mode:     mode,
+		Uid:      n.UserId,
+		Gid:      n.GroupId,
+		Uname:    n.UserName,
+		Gname:    n.GroupName,
+		ModTime:  n.ModTime,
+		Linkname: n.Linkname,
+	}
+	switch n.Type {
+	case ArchiveEntryFile:
+		header.Typeflag = tar.TypeReg
+	case ArchiveEntryDirectory:
+		header.Typeflag = tar.TypeDir
+		header.Name += "/"
+	case ArchiveEntrySymlink:
+		header.Typeflag = tar.TypeSymlink
+	case ArchiveEntryHardlink:
+		header.Typeflag = tar.TypeLink
+	}
+	if len(n.Xattrs) > 0 {
+		header.PAXRecords = make(map[string]string)
+		for name, value := range n.Xattrs {
+			header.PAXRecords[paxXattrPrefix+name] = value
+		}
+	}
+	return header
+}
+
+func (r *Repository) LoadSnapshot(id string) (RepositorySnapshot, error) {
+	var snapshot RepositorySnapshot
+	content, err := ioutil.ReadFile(r.snapshotPath(filepath.Base(id)))
+	if err != nil {
+		return snapshot, fmt.Errorf("couldn't read snapshot %s -> %s", id, err)
+	}
+	content, err = r.decode(content)
+	if err != nil {
+		return snapshot, fmt.Errorf("couldn't decode snapshot %s -> %s", id, err)
+	}
+	err = json.Unmarshal(content, &snapshot)
+	if err != nil {
+		return snapshot, fmt.Errorf("couldn't decode snapshot %s -> %s", id, err)
+	}
+	return snapshot, nil
+}
+
+// Snapshots returns the snapshots of the repository from the oldest to the
+// newest
+func (r *Repository) Snapshots() ([]RepositorySnapshot, error) {
+	files, err := ioutil.ReadDir(filepath.Join(r.path, repositorySnapshotsDirectory))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't list the snapshots of repository %s -> %s", r.path, err)
+	}
+	var snapshots []RepositorySnapshot
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		snapshot, err := r.LoadSnapshot(strings.TrimSuffix(file.Name(), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Time.Before(snapshots[j].Time) })
+	return snapshots, nil
+}
+
+// RestoreSnapshot writes the files of a snapshot to the destination, the
+// options are the ones of the archive extraction and every chunk is checked
+// against its hash
+func (r *Repository) RestoreSnapshot(ctx context.Context, id string, destinationPath string, options ExtractOptions) (ExtractResult, error) {
+	snapshot, err := r.LoadSnapshot(id)
+	if err != nil {
+		return ExtractResult{}, err
+	}
+	e, err := newExtractor(destinationPath, options)
+	if err != nil {
+		return ExtractResult{}, err
+	}
+	for _, node := range snapshot.Tree {
+		err := ctx.Err()
+		if err != nil {
+			return e.result, err
+		}
+		err = e.extractEntry(node.header(), &chunkReader{repository: r, chunks: node.Chunks})
+		if err != nil {
+			return e.result, fmt.Errorf("couldn't restore %s -> %s", node.Path, err)
+		}
+	}
+	err = e.finishDirectories()
+	if err != nil {
+		return e.result, err
+	}
+	return e.result, nil
+}
+
+// ForgetSnapshots removes snapshots, their chunks are removed by
+// GarbageCollect
+func (r *Repository) ForgetSnapshots(ids ...string) error {
+	unlock, err := r.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	for _, id := range ids {
+		err := os.Remove(r.snapshotPath(filepath.Base(id)))
+		if err != nil {
+			return fmt.Errorf("couldn't forget snapshot %s -> %s", id, err)
+		}
+	}
+	return nil
+}
+
+// GarbageCollect removes the chunks which are not used by any snapshot and
+// the files left by interrupted writes
+func (r *Repository) GarbageCollect(ctx context.Context) (GarbageCollectResult, error) {
+	result := GarbageCollectResult{}
+	unlock, err := r.lock()
+	if err != nil {
+		return result, err
+	}
+	defer unlock()
+	snapshots, err := r.Snapshots()
+	if err != nil {
+		return result, err
+	}
+	used := make(map[string]bool)
+	for _, snapshot := range snapshots {
+		for _, node := range snapshot.Tree {
+			for _, id := range node.Chunks {
+				used[id] = true
+			}
+		}
+	}
+	err = filepath.Walk(filepath.Join(r.path, repositoryChunksDirectory), func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		err = ctx.Err()
+		if err != nil {
+			return err
+		}
+		if used[info.Name()] {
+			return nil
+		}
+		err = os.Remove(path)
+		if err != nil {
+			return err
+		}
+		result.Chunks++
+		result.Bytes += info.Size()
+		return nil
+	})
+	if err != nil {
+		return result, fmt.Errorf("couldn't collect the chunks of repository %s -> %s", r.path, err)
+	}
+	return result, nil
+}
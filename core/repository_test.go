@@ -0,0 +1,214 @@
+/*
+   Copyright (c) 2022 Cyber Home Lab authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package core
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestRepositoryHappyFlow(t *testing.T) {
+	sourceDirectoryPath := filepath.Join(os.TempDir(), "TestRepositoryHappyFlow_source")
+	repositoryPath := filepath.Join(os.TempDir(), "TestRepositoryHappyFlow_repository")
+	restorePath := filepath.Join(os.TempDir(), "TestRepositoryHappyFlow_restore")
+	data := createTestTree(t, sourceDirectoryPath, testTreeOptions{Links: true, Copy: true})
+	// The copy and the zeros of data reference chunks which are stored
+	// once, the small files are a chunk each and the empty file has none
+	dataChunks := splitTestData(t, data)
+	uniqueChunks := make(map[string]bool)
+	for _, chunk := range dataChunks {
+		uniqueChunks[string(chunk)] = true
+	}
+	smallFiles := testTreeFiles - 2
+
+	identity, recipient, err := GenerateEncryptionKey()
+	assert.NilError(t, err)
+	for _, options := range []RepositoryOptions{
+		{Chunker: testChunkerOptions},
+		{Chunker: testChunkerOptions, Compression: true, Encryption: &EncryptionOptions{Passphrase: "passphrase"}},
+	} {
+		repository, err := InitRepository(repositoryPath, options)
+		assert.NilError(t, err)
+		_, err = InitRepository(repositoryPath, options)
+		assert.ErrorContains(t, err, "already exists")
+
+		// The second snapshot doesn't store anything new
+		first, err := repository.CreateSnapshot(context.Background(), []string{sourceDirectoryPath}, SnapshotOptions{Tags: []string{"first"}})
+		assert.NilError(t, err)
+		assert.Equal(t, first.Files, testTreeFiles+1)
+		assert.Equal(t, first.Bytes, int64(testTreeBytes+len(data)))
+		assert.Equal(t, first.Chunks, 2*len(dataChunks)+smallFiles)
+		assert.Equal(t, first.NewChunks, len(uniqueChunks)+smallFiles)
+		second, err := repository.CreateSnapshot(context.Background(), []string{sourceDirectoryPath}, SnapshotOptions{})
+		assert.NilError(t, err)
+		assert.Equal(t, second.Chunks, first.Chunks)
+		assert.Equal(t, second.NewChunks, 0)
+
+		// Listing and restoring, from a repository opened again
+		if options.Encryption != nil {
+			_, err = OpenRepository(repositoryPath, nil)
+			assert.ErrorContains(t, err, "is encrypted, the keys are needed")
+		}
+		assert.NilError(t, repository.Close())
+		repository, err = OpenRepository(repositoryPath, options.Encryption)
+		assert.NilError(t, err)
+		snapshots, err := repository.Snapshots()
+		assert.NilError(t, err)
+		assert.Equal(t, len(snapshots), 2)
+		assert.Equal(t, snapshots[0].Id, first.Snapshot)
+		assert.DeepEqual(t, snapshots[0].Tags, []string{"first"})
+		assert.Equal(t, snapshots[0].Host, Hostname)
+		result, err := repository.RestoreSnapshot(context.Background(), second.Snapshot, restorePath, ExtractOptions{})
+		assert.NilError(t, err)
+		assert.Equal(t, result.Entries, 1+testTreeDirectories+testTreeFiles+3)
+		assert.NilError(t, CheckIfDirectoriesMatch(sourceDirectoryPath, filepath.Join(restorePath, filepath.Base(sourceDirectoryPath))))
+		link, err := os.Readlink(filepath.Join(restorePath, filepath.Base(sourceDirectoryPath), "link"))
+		assert.NilError(t, err)
+		assert.Equal(t, link, "a.txt")
+		assert.NilError(t, Remove(restorePath))
+
+		// Forgetting a snapshot keeps the chunks used by the other one
+		assert.NilError(t, repository.ForgetSnapshots(first.Snapshot))
+		collected, err := repository.GarbageCollect(context.Background())
+		assert.NilError(t, err)
+		assert.Equal(t, collected.Chunks, 0)
+		assert.NilError(t, repository.ForgetSnapshots(second.Snapshot))
+		collected, err = repository.GarbageCollect(context.Background())
+		assert.NilError(t, err)
+		assert.Equal(t, collected.Chunks, first.NewChunks)
+		assert.NilError(t, repository.Close())
+		assert.NilError(t, Remove(repositoryPath))
+	}
+
+	// The identity is needed to open a repository created for a recipient,
+	// the chunks aren't named after the SHA256 of their content
+	_, err = InitRepository(repositoryPath, RepositoryOptions{Encryption: &EncryptionOptions{Recipients: []string{recipient}}})
+	assert.NilError(t, err)
+	_, err = OpenRepository(repositoryPath, &EncryptionOptions{Recipients: []string{recipient}})
+	assert.ErrorContains(t, err, "is encrypted, the keys are needed")
+	repository, err := OpenRepository(repositoryPath, &EncryptionOptions{Identities: []string{identity}})
+	assert.NilError(t, err)
+	snapshot, err := repository.CreateSnapshot(context.Background(), []string{sourceDirectoryPath}, SnapshotOptions{})
+	assert.NilError(t, err)
+	loaded, err := repository.LoadSnapshot(snapshot.Snapshot)
+	assert.NilError(t, err)
+	for _, node := range loaded.Tree {
+		for _, id := range node.Chunks {
+			chunk, err := repository.readChunk(id)
+			assert.NilError(t, err)
+			hash := sha256.Sum256(chunk)
+			assert.Assert(t, hex.EncodeToString(hash[:]) != id)
+		}
+	}
+
+	// Cleanup
+	assert.NilError(t, Remove(sourceDirectoryPath))
+	assert.NilError(t, Remove(repositoryPath))
+}
+
+func TestRepositoryNegativeFlow(t *testing.T) {
+	sourceDirectoryPath := filepath.Join(os.TempDir(), "TestRepositoryNegativeFlow_source")
+	repositoryPath := filepath.Join(os.TempDir(), "TestRepositoryNegativeFlow_repository")
+	restorePath := filepath.Join(os.TempDir(), "TestRepositoryNegativeFlow_restore")
+	createTestTree(t, sourceDirectoryPath, testTreeOptions{Links: true, Copy: true})
+
+	_, err := OpenRepository(repositoryPath, nil)
+	assert.ErrorContains(t, err, "couldn't open repository")
+	repository, err := InitRepository(repositoryPath, RepositoryOptions{})
+	assert.NilError(t, err)
+	snapshot, err := repository.CreateSnapshot(context.Background(), []string{sourceDirectoryPath}, SnapshotOptions{})
+	assert.NilError(t, err)
+
+	// A single process changes the repository
+	unlock, err := repository.lock()
+	assert.NilError(t, err)
+	_, err = repository.CreateSnapshot(context.Background(), []string{sourceDirectoryPath}, SnapshotOptions{})
+	assert.ErrorContains(t, err, "is locked by "+Hostname)
+	unlock()
+
+	// The lock file left by a process which is gone doesn't block
+	command := exec.Command("true")
+	assert.NilError(t, command.Run())
+	lockPath := filepath.Join(repositoryPath, repositoryLockName)
+	assert.NilError(t, WriteToFile(lockPath, fmt.Sprintf("%s %d\n", Hostname, command.Process.Pid)))
+	unlock, err = repository.lock()
+	assert.NilError(t, err)
+	unlock()
+
+	// A corrupted chunk is found on restore
+	loaded, err := repository.LoadSnapshot(snapshot.Snapshot)
+	assert.NilError(t, err)
+	for _, node := range loaded.Tree {
+		if len(node.Chunks) > 0 {
+			assert.NilError(t, WriteToFile(repository.chunkPath(node.Chunks[0]), "corrupted"))
+			break
+		}
+	}
+	_, err = repository.RestoreSnapshot(context.Background(), snapshot.Snapshot, restorePath, ExtractOptions{})
+	assert.ErrorContains(t, err, "hash missmatch")
+	_, err = repository.RestoreSnapshot(context.Background(), "missing", restorePath, ExtractOptions{})
+	assert.ErrorContains(t, err, "couldn't read snapshot missing")
+
+	// Cleanup
+	assert.NilError(t, Remove(sourceDirectoryPath))
+	assert.NilError(t, Remove(repositoryPath))
+	assert.NilError(t, Remove(restorePath))
+}
+
+func TestRepositoryRestoreDirectoryReplacedBySymlink(t *testing.T) {
+	repositoryPath := filepath.Join(os.TempDir(), "TestRepositoryRestoreDirectoryReplacedBySymlink_repository")
+	outsideDirectoryPath := filepath.Join(os.TempDir(), "TestRepositoryRestoreDirectoryReplacedBySymlink_outside")
+	restorePath := filepath.Join(os.TempDir(), "TestRepositoryRestoreDirectoryReplacedBySymlink_restore")
+	assert.NilError(t, os.Mkdir(outsideDirectoryPath, 0700))
+	repository, err := InitRepository(repositoryPath, RepositoryOptions{})
+	assert.NilError(t, err)
+
+	// A corrupted snapshot with a directory replaced by a symlink
+	snapshot := RepositorySnapshot{Id: "corrupted", Tree: []RepositoryNode{
+		{ArchiveEntry: ArchiveEntry{Path: "a", Type: ArchiveEntryDirectory, Mode: os.ModeDir | 0777, ModTime: time.Unix(1000, 0)}},
+		{ArchiveEntry: ArchiveEntry{Path: "a", Type: ArchiveEntrySymlink, Linkname: outsideDirectoryPath}},
+	}}
+	content, err := json.Marshal(snapshot)
+	assert.NilError(t, err)
+	content, err = repository.encode(content)
+	assert.NilError(t, err)
+	assert.NilError(t, WriteFileAtomically(repository.snapshotPath(snapshot.Id), content, 0600))
+
+	// The metadata of the directory isn't applied through the symlink
+	result, err := repository.RestoreSnapshot(context.Background(), snapshot.Id, restorePath, ExtractOptions{IgnoreOwnership: true})
+	assert.NilError(t, err)
+	assert.Equal(t, len(result.Warnings), 1)
+	outsideStat, err := os.Stat(outsideDirectoryPath)
+	assert.NilError(t, err)
+	assert.Equal(t, outsideStat.Mode().Perm(), os.FileMode(0700))
+	assert.Assert(t, outsideStat.ModTime().Unix() != 1000)
+
+	// Cleanup
+	for _, path := range []string{repositoryPath, outsideDirectoryPath, restorePath} {
+		assert.NilError(t, Remove(path))
+	}
+}
@@ -0,0 +1,203 @@
+/*
+   Copyright (c) 2022 Cyber Home Lab authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package core
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+const (
+	DefaultResumeBlockSize = 4 * 1024 * 1024
+	PartialFileSuffix      = ".partial"
+	JournalFileSuffix      = ".journal"
+)
+
+// resumeJournal is stored next to the partial file and describes what was
+// already copied. Hash is a rolling hash, every completed block is added to
+// the hash of the previous blocks
+type resumeJournal struct {
+	SourceSize    int64  `json:"source_size"`
+	SourceModTime int64  `json:"source_mod_time"`
+	BlockSize     int64  `json:"block_size"`
+	Offset        int64  `json:"offset"`
+	Hash          string `json:"hash"`
+}
+
+func newResumeJournal(sourceFileStat os.FileInfo, blockSize int64) resumeJournal {
+	return resumeJournal{
+		SourceSize:    sourceFileStat.Size(),
+		SourceModTime: sourceFileStat.ModTime().UnixNano(),
+		BlockSize:     blockSize,
+	}
+}
+
+func rollHash(previousHash string, block []byte) string {
+	hash := sha256.New()
+	hash.Write([]byte(previousHash))
+	hash.Write(block)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func (j *resumeJournal) addBlock(block []byte) {
+	j.Hash = rollHash(j.Hash, block)
+	j.Offset += int64(len(block))
+}
+
+func (j *resumeJournal) matches(other resumeJournal) bool {
+	return j.SourceSize == other.SourceSize &&
+		j.SourceModTime == other.SourceModTime &&
+		j.BlockSize == other.BlockSize
+}
+
+func readResumeJournal(journalPath string) (resumeJournal, error) {
+	var journal resumeJournal
+	content, err := ioutil.ReadFile(journalPath)
+	if err != nil {
+		return resumeJournal{}, err
+	}
+	err = json.Unmarshal(content, &journal)
+	if err != nil {
+		return resumeJournal{}, fmt.Errorf("couldn't decode the journal %s -> %s", journalPath, err)
+	}
+	return journal, nil
+}
+
+func writeResumeJournal(journalPath string, journal resumeJournal) error {
+	content, err := json.Marshal(journal)
+	if err != nil {
+		return fmt.Errorf("couldn't encode the journal -> %s", err)
+	}
+	return WriteFileAtomically(journalPath, content, 0600)
+}
+
+// verifyPartialFile re-reads the completed prefix of the partial file and
+// returns the offset from where the copy can continue
+func verifyPartialFile(partial *os.File, journal resumeJournal) (resumeJournal, error) {
+	verified := resumeJournal{
+		SourceSize:    journal.SourceSize,
+		SourceModTime: journal.SourceModTime,
+		BlockSize:     journal.BlockSize,
+	}
+	partialStat, err := partial.Stat()
+	if err != nil {
+		return resumeJournal{}, err
+	}
+	if partialStat.Size() < journal.Offset {
+		return resumeJournal{}, fmt.Errorf("partial file is shorter (%d) than the journal offset (%d)", partialStat.Size(), journal.Offset)
+	}
+
+	buffer := make([]byte, journal.BlockSize)
+	reader := io.NewSectionReader(partial, 0, journal.Offset)
+	for verified.Offset < journal.Offset {
+		n, err := io.ReadFull(reader, buffer)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return resumeJournal{}, err
+		}
+		verified.addBlock(buffer[:n])
+	}
+	if verified.Hash != journal.Hash {
+		return resumeJournal{}, fmt.Errorf("hash missmatch for the first %d bytes of the partial file", journal.Offset)
+	}
+	return verified, nil
+}
+
+func copyFileResumable(source *os.File, sourceFileStat os.FileInfo, destinationPath string, options CopyOptions) (CopyResult, error) {
+	partialPath := destinationPath + PartialFileSuffix
+	journalPath := partialPath + JournalFileSuffix
+	blockSize := options.BlockSize
+	if blockSize <= 0 {
+		blockSize = DefaultResumeBlockSize
+	}
+
+	// Open the partial file
+	partial, err := os.OpenFile(partialPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return CopyResult{}, fmt.Errorf("couldn't open the partial file %s -> %s", partialPath, err)
+	}
+	defer partial.Close()
+
+	// Continue from the previous run only if the source didn't change and
+	// the already copied data is still valid
+	journal := newResumeJournal(sourceFileStat, blockSize)
+	previousJournal, err := readResumeJournal(journalPath)
+	if err == nil && journal.matches(previousJournal) {
+		verified, err := verifyPartialFile(partial, previousJournal)
+		if err == nil {
+			journal = verified
+		}
+	}
+	resumedBytes := journal.Offset
+	err = partial.Truncate(journal.Offset)
+	if err != nil {
+		return CopyResult{}, fmt.Errorf("couldn't truncate the partial file %s -> %s", partialPath, err)
+	}
+
+	// Copy the rest of the blocks
+	buffer := make([]byte, blockSize)
+	for journal.Offset < journal.SourceSize {
+		n, err := source.ReadAt(buffer, journal.Offset)
+		if err != nil && err != io.EOF {
+			return CopyResult{}, fmt.Errorf("couldn't read the source at offset %d -> %s", journal.Offset, err)
+		}
+		if n == 0 {
+			return CopyResult{}, fmt.Errorf("source was truncated while copying at offset %d", journal.Offset)
+		}
+		if options.Limiter != nil {
+			err = options.Limiter.WaitN(context.Background(), int64(n))
+			if err != nil {
+				return CopyResult{}, err
+			}
+		}
+		_, err = partial.WriteAt(buffer[:n], journal.Offset)
+		if err != nil {
+			return CopyResult{}, fmt.Errorf("couldn't write the partial file at offset %d -> %s", journal.Offset, err)
+		}
+
+		// The data must be on the disk before the journal points after it
+		err = partial.Sync()
+		if err != nil {
+			return CopyResult{}, fmt.Errorf("couldn't sync the partial file -> %s", err)
+		}
+		journal.addBlock(buffer[:n])
+		err = writeResumeJournal(journalPath, journal)
+		if err != nil {
+			return CopyResult{}, fmt.Errorf("couldn't update the journal -> %s", err)
+		}
+	}
+
+	// Finish
+	err = partial.Close()
+	if err != nil {
+		return CopyResult{}, fmt.Errorf("couldn't close the partial file -> %s", err)
+	}
+	err = os.Rename(partialPath, destinationPath)
+	if err != nil {
+		return CopyResult{}, fmt.Errorf("couldn't rename %s to %s -> %s", partialPath, destinationPath, err)
+	}
+	err = os.Remove(journalPath)
+	if err != nil && !os.IsNotExist(err) {
+		return CopyResult{}, fmt.Errorf("couldn't delete the journal %s -> %s", journalPath, err)
+	}
+	return CopyResult{Bytes: journal.Offset, Strategy: CopyStrategyStream, ResumedBytes: resumedBytes}, nil
+}
@@ -0,0 +1,96 @@
+/*
+   Copyright (c) 2022 Cyber Home Lab authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package core
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func createResumeTestFiles(t *testing.T, name string, blockSize int64, completedBlocks int) (string, string) {
+	sourceFilePath := filepath.Join(os.TempDir(), name+"_source")
+	destinationFilePath := filepath.Join(os.TempDir(), name+"_destination")
+	partialPath := destinationFilePath + PartialFileSuffix
+
+	// Source with 3 blocks and a half
+	content := bytes.Repeat([]byte("0123456789abcdef"), int(blockSize)*7/32)
+	assert.NilError(t, CreateFileWithMessage(sourceFilePath, string(content), DefaultMode, DefaultUserId, DefaultGroupId))
+	sourceFileStat, err := os.Stat(sourceFilePath)
+	assert.NilError(t, err)
+
+	// Simulate an interrupted copy
+	journal := newResumeJournal(sourceFileStat, blockSize)
+	for k := 0; k < completedBlocks; k++ {
+		journal.addBlock(content[int64(k)*blockSize : int64(k+1)*blockSize])
+	}
+	assert.NilError(t, CreateFileWithMessage(partialPath, string(content[:journal.Offset]), DefaultMode, DefaultUserId, DefaultGroupId))
+	assert.NilError(t, writeResumeJournal(partialPath+JournalFileSuffix, journal))
+
+	return sourceFilePath, destinationFilePath
+}
+
+func TestCopyFileResumeHappyFlow(t *testing.T) {
+	blockSize := int64(4096)
+	sourceFilePath, destinationFilePath := createResumeTestFiles(t, "TestCopyFileResumeHappyFlow", blockSize, 2)
+
+	// Copy
+	result, err := CopyFileWithOptions(sourceFilePath, destinationFilePath, CopyOptions{Resume: true, BlockSize: blockSize})
+	assert.NilError(t, err)
+	assert.Equal(t, result.ResumedBytes, 2*blockSize)
+	assert.Equal(t, result.Bytes, blockSize*7/2)
+
+	// Checks
+	filesMatch, err := CheckIfFilesMatch(sourceFilePath, destinationFilePath)
+	assert.NilError(t, err)
+	assert.Assert(t, filesMatch)
+	for _, filePath := range []string{destinationFilePath + PartialFileSuffix, destinationFilePath + PartialFileSuffix + JournalFileSuffix} {
+		_, err = os.Stat(filePath)
+		assert.Assert(t, os.IsNotExist(err), "%s wasn't deleted", filePath)
+	}
+
+	// Cleanup
+	for _, filePath := range []string{sourceFilePath, destinationFilePath} {
+		assert.NilError(t, Remove(filePath))
+	}
+}
+
+func TestCopyFileResumeNegativeFlowCorruptedPartial(t *testing.T) {
+	blockSize := int64(4096)
+	sourceFilePath, destinationFilePath := createResumeTestFiles(t, "TestCopyFileResumeNegativeFlowCorruptedPartial", blockSize, 2)
+
+	// Corrupt the already copied data
+	partial, err := os.OpenFile(destinationFilePath+PartialFileSuffix, os.O_WRONLY, 0)
+	assert.NilError(t, err)
+	_, err = partial.WriteAt([]byte("corrupted"), blockSize+10)
+	assert.NilError(t, err)
+	assert.NilError(t, partial.Close())
+
+	// The copy starts from zero
+	result, err := CopyFileWithOptions(sourceFilePath, destinationFilePath, CopyOptions{Resume: true, BlockSize: blockSize})
+	assert.NilError(t, err)
+	assert.Equal(t, result.ResumedBytes, int64(0))
+	assert.NilError(t, CheckHash(sourceFilePath, destinationFilePath))
+
+	// Cleanup
+	for _, filePath := range []string{sourceFilePath, destinationFilePath} {
+		assert.NilError(t, Remove(filePath))
+	}
+}
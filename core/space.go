@@ -0,0 +1,129 @@
+/*
+   Copyright (c) 2022 Cyber Home Lab authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package core
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+type PreflightOptions struct {
+	// SafetyMargin is added to the estimated size, 0.1 means 10% more
+	SafetyMargin float64
+	// MinimumFreeBytes have to stay available after the operation
+	MinimumFreeBytes int64
+}
+
+type FilesystemUsage struct {
+	TotalBytes      uint64
+	AvailableBytes  uint64
+	TotalInodes     uint64
+	AvailableInodes uint64
+}
+
+// GetFilesystemUsage runs statfs() for the filesystem of path, if path doesn't
+// exist yet the closest existing parent is used
+func GetFilesystemUsage(path string) (FilesystemUsage, error) {
+	path = filepath.Clean(path)
+	for {
+		_, err := os.Stat(path)
+		if err == nil {
+			break
+		}
+		if !os.IsNotExist(err) {
+			return FilesystemUsage{}, fmt.Errorf("couldn't run os.Stat() -> %s", err)
+		}
+		parentPath := filepath.Dir(path)
+		if parentPath == path {
+			return FilesystemUsage{}, fmt.Errorf("couldn't find an existing parent for %s", path)
+		}
+		path = parentPath
+	}
+
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(path, &stat)
+	if err != nil {
+		return FilesystemUsage{}, fmt.Errorf("couldn't run statfs() for %s -> %s", path, err)
+	}
+	return FilesystemUsage{
+		TotalBytes:      stat.Blocks * uint64(stat.Bsize),
+		AvailableBytes:  stat.Bavail * uint64(stat.Bsize),
+		TotalInodes:     stat.Files,
+		AvailableInodes: stat.Ffree,
+	}, nil
+}
+
+func FormatBytes(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+// CheckFreeSpace fails if the filesystem of path doesn't have enough space
+// and inodes for the estimated bytes and files
+func CheckFreeSpace(path string, requiredBytes int64, requiredInodes int64, options PreflightOptions) error {
+	usage, err := GetFilesystemUsage(path)
+	if err != nil {
+		return err
+	}
+
+	// Space
+	neededBytes := int64(float64(requiredBytes)*(1+options.SafetyMargin)) + options.MinimumFreeBytes
+	if uint64(neededBytes) > usage.AvailableBytes {
+		return fmt.Errorf(
+			"not enough free space for %s, %s are needed (%s estimated, %.0f%% safety margin, %s kept free) but only %s are available",
+			path, FormatBytes(neededBytes), FormatBytes(requiredBytes), options.SafetyMargin*100,
+			FormatBytes(options.MinimumFreeBytes), FormatBytes(int64(usage.AvailableBytes)))
+	}
+
+	// Inodes, some filesystems (btrfs for example) don't have a fixed number
+	neededInodes := int64(float64(requiredInodes) * (1 + options.SafetyMargin))
+	if usage.TotalInodes > 0 && uint64(neededInodes) > usage.AvailableInodes {
+		return fmt.Errorf(
+			"not enough free inodes for %s, %d are needed but only %d are available",
+			path, neededInodes, usage.AvailableInodes)
+	}
+	return nil
+}
+
+// CheckFreeSpace checks the filesystem of the plan's destination
+func (p Plan) CheckFreeSpace(options PreflightOptions) error {
+	var size int64
+	var nrOfFiles int64
+	for _, action := range p.Actions {
+		switch action.Type {
+		case PlanActionCopyFile:
+			size += action.Size
+			nrOfFiles++
+		case PlanActionCreateDirectory:
+			nrOfFiles++
+		}
+	}
+	if nrOfFiles == 0 {
+		return nil
+	}
+	return CheckFreeSpace(p.Actions[0].Destination, size, nrOfFiles, options)
+}
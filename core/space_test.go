@@ -0,0 +1,79 @@
+/*
+   Copyright (c) 2022 Cyber Home Lab authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestGetFilesystemUsage(t *testing.T) {
+	// A path which doesn't exist uses the closest parent
+	usage, err := GetFilesystemUsage(filepath.Join(os.TempDir(), "TestGetFilesystemUsage", "not", "created"))
+	assert.NilError(t, err)
+	assert.Assert(t, usage.TotalBytes > 0)
+	assert.Assert(t, usage.AvailableBytes <= usage.TotalBytes)
+}
+
+func TestFormatBytes(t *testing.T) {
+	assert.Equal(t, FormatBytes(10), "10 B")
+	assert.Equal(t, FormatBytes(1536), "1.5 KiB")
+	assert.Equal(t, FormatBytes(3*1024*1024*1024), "3.0 GiB")
+}
+
+func TestCheckFreeSpace(t *testing.T) {
+	assert.NilError(t, CheckFreeSpace(os.TempDir(), 1024, 1, PreflightOptions{SafetyMargin: 0.1}))
+	assert.ErrorContains(t, CheckFreeSpace(os.TempDir(), 1<<62, 1, PreflightOptions{}), "not enough free space")
+}
+
+func TestCopyDirectoryWithOptionsPreflight(t *testing.T) {
+	sourceDirectoryPath := filepath.Join(os.TempDir(), "TestCopyDirectoryWithOptionsPreflight_source")
+	destinationDirectoryPath := filepath.Join(os.TempDir(), "TestCopyDirectoryWithOptionsPreflight_destination")
+	archivePath := filepath.Join(os.TempDir(), "TestCopyDirectoryWithOptionsPreflight.tar.gz")
+	createTestTree(t, sourceDirectoryPath, testTreeOptions{})
+
+	// Nothing is written when the space is not enough
+	usage, err := GetFilesystemUsage(os.TempDir())
+	assert.NilError(t, err)
+	preflight := PreflightOptions{MinimumFreeBytes: int64(usage.AvailableBytes)}
+	err = CopyDirectoryWithOptions(sourceDirectoryPath, destinationDirectoryPath, CopyOptions{Preflight: &preflight})
+	assert.ErrorContains(t, err, "not enough free space")
+	_, err = os.Stat(destinationDirectoryPath)
+	assert.Assert(t, os.IsNotExist(err))
+	_, err = CreateArchiveWithOptions(archivePath, []string{sourceDirectoryPath}, ArchiveOptions{Preflight: &preflight})
+	assert.ErrorContains(t, err, "not enough free space")
+	_, err = os.Stat(archivePath)
+	assert.Assert(t, os.IsNotExist(err))
+	filePath := filepath.Join(destinationDirectoryPath, "data")
+	_, err = CopyFileWithOptions(filepath.Join(sourceDirectoryPath, "data"), filePath, CopyOptions{Preflight: &preflight})
+	assert.ErrorContains(t, err, "(256.0 KiB estimated")
+	_, err = os.Stat(filePath)
+	assert.Assert(t, os.IsNotExist(err))
+
+	// Enough space
+	preflight = PreflightOptions{SafetyMargin: 0.1}
+	assert.NilError(t, CopyDirectoryWithOptions(sourceDirectoryPath, destinationDirectoryPath, CopyOptions{Preflight: &preflight}))
+	assert.NilError(t, CheckIfDirectoriesMatch(sourceDirectoryPath, destinationDirectoryPath))
+
+	// Cleanup
+	for _, path := range []string{sourceDirectoryPath, destinationDirectoryPath} {
+		assert.NilError(t, Remove(path))
+	}
+}
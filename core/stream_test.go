@@ -0,0 +1,83 @@
+/*
+   Copyright (c) 2022 Cyber Home Lab authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package core
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestWriteAndReadArchive(t *testing.T) {
+	sourceDirectoryPath := filepath.Join(os.TempDir(), "TestWriteAndReadArchive_source")
+	destinationDirectoryPath := filepath.Join(os.TempDir(), "TestWriteAndReadArchive_destination")
+	createTestTree(t, sourceDirectoryPath, testTreeOptions{})
+
+	for _, format := range []ArchiveFormat{ArchiveFormatTar, ArchiveFormatTarGz, ArchiveFormatTarZst, ArchiveFormatTarXz, ArchiveFormatZip} {
+		// Stream through a pipe, the tee gets the same bytes
+		var stream bytes.Buffer
+		teeHash := sha256.New()
+		reader, writer := io.Pipe()
+		go func() {
+			_, err := WriteArchive(context.Background(), writer, []string{sourceDirectoryPath}, ArchiveOptions{Format: format, Tee: teeHash})
+			writer.CloseWithError(err)
+		}()
+		_, err := io.Copy(&stream, reader)
+		assert.NilError(t, err)
+		streamHash := sha256.Sum256(stream.Bytes())
+		assert.Equal(t, hex.EncodeToString(teeHash.Sum(nil)), hex.EncodeToString(streamHash[:]))
+
+		// The result describes the stream
+		result, err := WriteArchive(context.Background(), io.Discard, []string{sourceDirectoryPath}, ArchiveOptions{Format: format})
+		assert.NilError(t, err)
+		assert.Equal(t, result.Entries, 1+testTreeDirectories+testTreeFiles)
+		assert.Equal(t, result.ArchiveBytes, int64(stream.Len()))
+
+		// Read the stream, the format is detected
+		extractResult, err := ReadArchive(context.Background(), &stream, destinationDirectoryPath, ExtractOptions{})
+		assert.NilError(t, err, format)
+		assert.Equal(t, extractResult.Entries, 1+testTreeDirectories+testTreeFiles)
+		extractedDirectoryPath := filepath.Join(destinationDirectoryPath, filepath.Base(sourceDirectoryPath))
+		assert.NilError(t, CheckIfDirectoriesMatch(sourceDirectoryPath, extractedDirectoryPath))
+		assert.NilError(t, Remove(destinationDirectoryPath))
+	}
+
+	// Cleanup
+	assert.NilError(t, Remove(sourceDirectoryPath))
+}
+
+func TestWriteArchiveNegativeFlowCanceled(t *testing.T) {
+	sourceDirectoryPath := filepath.Join(os.TempDir(), "TestWriteArchiveNegativeFlowCanceled_source")
+	createTestTree(t, sourceDirectoryPath, testTreeOptions{})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := WriteArchive(ctx, io.Discard, []string{sourceDirectoryPath}, ArchiveOptions{})
+	assert.ErrorContains(t, err, "context canceled")
+	_, err = ReadArchive(ctx, bytes.NewReader(nil), sourceDirectoryPath, ExtractOptions{Format: ArchiveFormatTar})
+	assert.ErrorContains(t, err, "context canceled")
+
+	// Cleanup
+	assert.NilError(t, Remove(sourceDirectoryPath))
+}
@@ -0,0 +1,287 @@
+/*
+   Copyright (c) 2022 Cyber Home Lab authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package core
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+)
+
+// TreeEntry describes a single file or directory, the path is relative to
+// the root of the scanned tree
+type TreeEntry struct {
+	Path    string      `json:"path"`
+	Mode    fs.FileMode `json:"mode"`
+	Size    int64       `json:"size"`
+	ModTime time.Time   `json:"mod_time"`
+	UserId  int         `json:"uid"`
+	GroupId int         `json:"gid"`
+}
+
+type SyncOptions struct {
+	// Delete removes the files from the destination which are not in the source
+	Delete bool
+	// Checksum compares the content of the files instead of size and
+	// modification time
+	Checksum bool
+	// Filter is applied to both trees, so the excluded files of the
+	// destination are not deleted
+	Filter *Filter
+}
+
+func newTreeEntry(relativePath string, info os.FileInfo) TreeEntry {
+	entry := TreeEntry{
+		Path:    filepath.ToSlash(relativePath),
+		Mode:    info.Mode(),
+		ModTime: info.ModTime(),
+		UserId:  DefaultUserId,
+		GroupId: DefaultGroupId,
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		entry.UserId = int(stat.Uid)
+		entry.GroupId = int(stat.Gid)
+	}
+	if !info.IsDir() {
+		entry.Size = info.Size()
+	}
+	return entry
+}
+
+// ScanTree returns everything under directoryPath (without the directory
+// itself), symlinks are not followed
+func ScanTree(directoryPath string) (map[string]TreeEntry, error) {
+	return ScanTreeWithFilter(directoryPath, nil)
+}
+
+// ScanTreeWithFilter leaves out the files rejected by filter
+func ScanTreeWithFilter(directoryPath string, filter *Filter) (map[string]TreeEntry, error) {
+	return scanTree(directoryPath, directoryPath, filter)
+}
+
+func scanTree(directoryPath string, ignoreRoot string, filter *Filter) (map[string]TreeEntry, error) {
+	tree := make(map[string]TreeEntry)
+	err := filter.walk(directoryPath, ignoreRoot, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relativePath, err := filepath.Rel(directoryPath, path)
+		if err != nil {
+			return err
+		}
+		if relativePath == "." {
+			return nil
+		}
+		entry := newTreeEntry(relativePath, info)
+		tree[entry.Path] = entry
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't scan directory %s -> %s", directoryPath, err)
+	}
+	return tree, nil
+}
+
+func sortedTreePaths(tree map[string]TreeEntry) []string {
+	paths := make([]string, 0, len(tree))
+	for path := range tree {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func sameType(source TreeEntry, destination TreeEntry) bool {
+	return source.Mode.Type() == destination.Mode.Type()
+}
+
+// DiffTrees compares two trees and returns the actions needed to make the
+// destination look like the source. The content of the files is compared
+// with contentDiffers only when size and modification time are not enough
+func DiffTrees(sourceRoot string, sourceTree map[string]TreeEntry, destinationRoot string, destinationTree map[string]TreeEntry, options SyncOptions, contentDiffers func(relativePath string) (bool, error)) (Plan, error) {
+	var plan Plan
+	sourcePath := func(path string) string { return filepath.Join(sourceRoot, filepath.FromSlash(path)) }
+	destinationPath := func(path string) string { return filepath.Join(destinationRoot, filepath.FromSlash(path)) }
+
+	// Deletions, the content of a directory is removed before the directory
+	removed := make(map[string]bool)
+	destinationPaths := sortedTreePaths(destinationTree)
+	for k := len(destinationPaths) - 1; k >= 0; k-- {
+		path := destinationPaths[k]
+		destinationEntry := destinationTree[path]
+		sourceEntry, found := sourceTree[path]
+		typeChanged := found && !sameType(sourceEntry, destinationEntry)
+		if (!found && options.Delete) || typeChanged {
+			// The content of a directory which changed its type must go as well
+			if typeChanged && destinationEntry.Mode.IsDir() {
+				for _, childPath := range destinationPaths[k+1:] {
+					if isChildPath(path, childPath) && !removed[childPath] {
+						return Plan{}, fmt.Errorf("can't replace directory %s without deleting its content, use the delete option", destinationPath(path))
+					}
+				}
+			}
+			plan.Actions = append(plan.Actions, PlanAction{
+				Type:        PlanActionRemove,
+				Destination: destinationPath(path),
+				Size:        destinationEntry.Size,
+				ModTime:     destinationEntry.ModTime,
+				Mode:        destinationEntry.Mode,
+				UserId:      destinationEntry.UserId,
+				GroupId:     destinationEntry.GroupId,
+			})
+			removed[path] = true
+		}
+	}
+
+	// Creations and updates, the directories are before their content
+	for _, path := range sortedTreePaths(sourceTree) {
+		sourceEntry := sourceTree[path]
+		destinationEntry, found := destinationTree[path]
+		if removed[path] {
+			found = false
+		}
+		action := PlanAction{
+			Source:      sourcePath(path),
+			Destination: destinationPath(path),
+			Mode:        sourceEntry.Mode,
+			UserId:      sourceEntry.UserId,
+			GroupId:     sourceEntry.GroupId,
+		}
+
+		switch {
+		case sourceEntry.Mode.IsDir():
+			if !found {
+				action.Type = PlanActionCreateDirectory
+				plan.Actions = append(plan.Actions, action)
+				continue
+			}
+		case sourceEntry.Mode&os.ModeSymlink != 0:
+			// Skip symlinks, the same as CopyDirectory()
+			continue
+		case sourceEntry.Mode.IsRegular():
+			changed := !found || sourceEntry.Size != destinationEntry.Size
+			if !changed && options.Checksum && contentDiffers != nil {
+				differs, err := contentDiffers(path)
+				if err != nil {
+					return Plan{}, err
+				}
+				changed = differs
+			} else if !changed && !options.Checksum {
+				changed = !sourceEntry.ModTime.Equal(destinationEntry.ModTime)
+			}
+			if changed {
+				action.Type = PlanActionCopyFile
+				action.Size = sourceEntry.Size
+				action.ModTime = sourceEntry.ModTime
+				plan.Actions = append(plan.Actions, action)
+				continue
+			}
+		default:
+			return Plan{}, fmt.Errorf("%s is not a regular file", sourcePath(path))
+		}
+
+		// Metadata only
+		if sourceEntry.Mode != destinationEntry.Mode {
+			action.Type = PlanActionChmod
+			plan.Actions = append(plan.Actions, action)
+		}
+		if sourceEntry.UserId != destinationEntry.UserId || sourceEntry.GroupId != destinationEntry.GroupId {
+			action.Type = PlanActionChown
+			plan.Actions = append(plan.Actions, action)
+		}
+	}
+	return plan, nil
+}
+
+func isChildPath(parent string, child string) bool {
+	return len(child) > len(parent) && child[:len(parent)] == parent && child[len(parent)] == '/'
+}
+
+// PlanSync returns the actions needed to make destinationDirectoryPath a
+// mirror of sourceDirectoryPath, only the changed files are copied. The plan
+// is executed with CopyOptions.KeepMetadata, like Sync does
+func PlanSync(sourceDirectoryPath string, destinationDirectoryPath string, options SyncOptions) (Plan, error) {
+	var plan Plan
+
+	// Cleanup
+	sourceDirectoryPath = filepath.Clean(sourceDirectoryPath)
+	destinationDirectoryPath = filepath.Clean(destinationDirectoryPath)
+
+	// Checks
+	sourceStat, err := os.Stat(sourceDirectoryPath)
+	if err != nil {
+		return Plan{}, fmt.Errorf("couldn't run os.Stat() -> %s", err)
+	}
+	if !sourceStat.IsDir() {
+		return Plan{}, fmt.Errorf("%s is not a directory", sourceDirectoryPath)
+	}
+	destinationStat, err := os.Stat(destinationDirectoryPath)
+	if err != nil && !os.IsNotExist(err) {
+		return Plan{}, fmt.Errorf("couldn't run os.Stat() -> %s", err)
+	}
+	destinationExists := err == nil
+	if destinationExists && !destinationStat.IsDir() {
+		return Plan{}, fmt.Errorf("%s is not a directory", destinationDirectoryPath)
+	}
+
+	// Trees
+	sourceTree, err := ScanTreeWithFilter(sourceDirectoryPath, options.Filter)
+	if err != nil {
+		return Plan{}, err
+	}
+	destinationTree := make(map[string]TreeEntry)
+	if !destinationExists {
+		plan.Actions = append(plan.Actions, newPlanAction(PlanActionCreateDirectory, sourceDirectoryPath, destinationDirectoryPath, sourceStat))
+	} else {
+		// The ignore files of the source decide what is excluded
+		destinationTree, err = scanTree(destinationDirectoryPath, sourceDirectoryPath, options.Filter)
+		if err != nil {
+			return Plan{}, err
+		}
+	}
+
+	// Differences
+	diff, err := DiffTrees(sourceDirectoryPath, sourceTree, destinationDirectoryPath, destinationTree, options, func(relativePath string) (bool, error) {
+		sourceHash, err := GetHash(filepath.Join(sourceDirectoryPath, filepath.FromSlash(relativePath)))
+		if err != nil {
+			return false, err
+		}
+		destinationHash, err := GetHash(filepath.Join(destinationDirectoryPath, filepath.FromSlash(relativePath)))
+		if err != nil {
+			return false, err
+		}
+		return sourceHash != destinationHash, nil
+	})
+	if err != nil {
+		return Plan{}, err
+	}
+	plan.Actions = append(plan.Actions, diff.Actions...)
+	return plan, nil
+}
+
+func Sync(sourceDirectoryPath string, destinationDirectoryPath string, options SyncOptions, copyOptions CopyOptions) (Plan, error) {
+	plan, err := PlanSync(sourceDirectoryPath, destinationDirectoryPath, options)
+	if err != nil {
+		return Plan{}, err
+	}
+	copyOptions.KeepMetadata = true
+	return plan, plan.Execute(copyOptions)
+}
@@ -0,0 +1,68 @@
+/*
+   Copyright (c) 2022 Cyber Home Lab authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestSync(t *testing.T) {
+	sourceDirectoryPath := filepath.Join(os.TempDir(), "TestSync_source")
+	destinationDirectoryPath := filepath.Join(os.TempDir(), "TestSync_destination")
+	createTestTree(t, sourceDirectoryPath, testTreeOptions{})
+
+	// First run copies everything
+	plan, err := Sync(sourceDirectoryPath, destinationDirectoryPath, SyncOptions{}, CopyOptions{})
+	assert.NilError(t, err)
+	assert.Equal(t, len(plan.Actions), 1+testTreeDirectories+testTreeFiles)
+	assert.NilError(t, CheckIfDirectoriesMatch(sourceDirectoryPath, destinationDirectoryPath))
+
+	// Nothing changed
+	plan, err = PlanSync(sourceDirectoryPath, destinationDirectoryPath, SyncOptions{Checksum: true})
+	assert.NilError(t, err)
+	assert.Equal(t, len(plan.Actions), 0, plan.String())
+
+	// Changes in the source and an extra file in the destination
+	assert.NilError(t, WriteToFile(filepath.Join(sourceDirectoryPath, "a.txt"), "changed a.txt"))
+	assert.NilError(t, os.Chmod(filepath.Join(sourceDirectoryPath, "b.log"), 0600))
+	extraFilePath := filepath.Join(destinationDirectoryPath, "src", "sub", "extra")
+	assert.NilError(t, CreateFileWithMessage(extraFilePath, "Extra", DefaultMode, DefaultUserId, DefaultGroupId))
+
+	// Without delete the extra file stays
+	plan, err = PlanSync(sourceDirectoryPath, destinationDirectoryPath, SyncOptions{})
+	assert.NilError(t, err)
+	assert.Equal(t, len(plan.Actions), 2, plan.String())
+	assert.Equal(t, plan.Actions[0].Type, PlanActionCopyFile)
+	assert.Equal(t, plan.Actions[1].Type, PlanActionChmod)
+
+	// With delete
+	plan, err = Sync(sourceDirectoryPath, destinationDirectoryPath, SyncOptions{Delete: true}, CopyOptions{})
+	assert.NilError(t, err)
+	assert.Equal(t, len(plan.Actions), 3, plan.String())
+	assert.Equal(t, plan.Actions[0].Type, PlanActionRemove)
+	assert.NilError(t, CheckIfDirectoriesMatch(sourceDirectoryPath, destinationDirectoryPath))
+	assert.NilError(t, CheckPermissions(filepath.Join(sourceDirectoryPath, "b.log"), filepath.Join(destinationDirectoryPath, "b.log")))
+
+	// Cleanup
+	for _, path := range []string{sourceDirectoryPath, destinationDirectoryPath} {
+		assert.NilError(t, Remove(path))
+	}
+}
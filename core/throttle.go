@@ -0,0 +1,178 @@
+/*
+   Copyright (c) 2022 Cyber Home Lab authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket shared by all the readers and writers
+// attached to it, so several operations can use the same budget
+type RateLimiter struct {
+	mutex          sync.Mutex
+	bytesPerSecond int64
+	burst          int64
+	tokens         float64
+	last           time.Time
+}
+
+func NewRateLimiter(bytesPerSecond int64, burst int64) (*RateLimiter, error) {
+	if bytesPerSecond <= 0 {
+		return nil, fmt.Errorf("the rate limit must be greater than 0, got %d bytes/s", bytesPerSecond)
+	}
+	if burst <= 0 {
+		burst = bytesPerSecond
+	}
+	return &RateLimiter{
+		bytesPerSecond: bytesPerSecond,
+		burst:          burst,
+		tokens:         float64(burst),
+		last:           time.Now(),
+	}, nil
+}
+
+// reserve takes n tokens and returns how long the caller has to wait
+func (l *RateLimiter) reserve(n int64) time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * float64(l.bytesPerSecond)
+	if l.tokens > float64(l.burst) {
+		l.tokens = float64(l.burst)
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / float64(l.bytesPerSecond) * float64(time.Second))
+}
+
+// WaitN blocks until n bytes can be transferred, n can exceed the burst
+func (l *RateLimiter) WaitN(ctx context.Context, n int64) error {
+	for n > 0 {
+		chunk := n
+		if chunk > l.burst {
+			chunk = l.burst
+		}
+		n -= chunk
+
+		delay := l.reserve(chunk)
+		if delay == 0 {
+			continue
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+	return nil
+}
+
+func (l *RateLimiter) Reader(ctx context.Context, reader io.Reader) io.Reader {
+	if l == nil {
+		return reader
+	}
+	return &rateLimitedReader{ctx: ctx, limiter: l, reader: reader}
+}
+
+func (l *RateLimiter) Writer(ctx context.Context, writer io.Writer) io.Writer {
+	if l == nil {
+		return writer
+	}
+	return &rateLimitedWriter{ctx: ctx, limiter: l, writer: writer}
+}
+
+type rateLimitedReader struct {
+	ctx     context.Context
+	limiter *RateLimiter
+	reader  io.Reader
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > r.limiter.burst {
+		p = p[:r.limiter.burst]
+	}
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		waitErr := r.limiter.WaitN(r.ctx, int64(n))
+		if waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+type rateLimitedWriter struct {
+	ctx     context.Context
+	limiter *RateLimiter
+	writer  io.Writer
+}
+
+func (w *rateLimitedWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		chunk := p
+		if int64(len(chunk)) > w.limiter.burst {
+			chunk = chunk[:w.limiter.burst]
+		}
+		err := w.limiter.WaitN(w.ctx, int64(len(chunk)))
+		if err != nil {
+			return written, err
+		}
+		n, err := w.writer.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+type IOPriorityClass int
+
+const (
+	IOPriorityClassNone IOPriorityClass = iota
+	IOPriorityClassRealTime
+	IOPriorityClassBestEffort
+	IOPriorityClassIdle
+)
+
+// IOPriority mirrors ionice, Level goes from 0 (highest) to 7 (lowest) and
+// it is used only by the real time and best effort classes
+type IOPriority struct {
+	Class IOPriorityClass
+	Level int
+}
+
+// withIOPriority runs fn on a locked OS thread with the given IO priority,
+// the previous priority is restored before the thread is released
+func withIOPriority(priority *IOPriority, fn func() error) error {
+	if priority == nil {
+		return fn()
+	}
+	return runWithIOPriority(*priority, fn)
+}
@@ -0,0 +1,91 @@
+/*
+   Copyright (c) 2022 Cyber Home Lab authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package core
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestNewRateLimiterNegativeFlow(t *testing.T) {
+	_, err := NewRateLimiter(0, 0)
+	assert.ErrorContains(t, err, "must be greater than 0")
+}
+
+func TestRateLimiterReader(t *testing.T) {
+	limiter, err := NewRateLimiter(10*1024, 1024)
+	assert.NilError(t, err)
+
+	// 1 KiB of burst and 2 KiB throttled at 10 KiB/s
+	start := time.Now()
+	content, err := ioutil.ReadAll(limiter.Reader(context.Background(), strings.NewReader(strings.Repeat("a", 3*1024))))
+	assert.NilError(t, err)
+	elapsed := time.Since(start)
+	assert.Equal(t, len(content), 3*1024)
+	assert.Assert(t, elapsed >= 150*time.Millisecond, "the reader wasn't throttled (%s)", elapsed)
+}
+
+func TestRateLimiterWriterCancel(t *testing.T) {
+	limiter, err := NewRateLimiter(1, 1)
+	assert.NilError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var buffer bytes.Buffer
+	_, err = limiter.Writer(ctx, &buffer).Write([]byte("Hello World!"))
+	assert.ErrorContains(t, err, "context canceled")
+}
+
+func TestCopyFileWithOptionsThrottled(t *testing.T) {
+	sourceFilePath := filepath.Join(os.TempDir(), "TestCopyFileWithOptionsThrottled_source")
+	destinationFilePath := filepath.Join(os.TempDir(), "TestCopyFileWithOptionsThrottled_destination")
+	limiter, err := NewRateLimiter(1024*1024, 0)
+	assert.NilError(t, err)
+
+	// Create source
+	assert.NilError(t, CreateFileWithMessage(sourceFilePath, "Hello World!", DefaultMode, DefaultUserId, DefaultGroupId))
+
+	// Copy
+	result, err := CopyFileWithOptions(sourceFilePath, destinationFilePath, CopyOptions{
+		Limiter:    limiter,
+		IOPriority: &IOPriority{Class: IOPriorityClassIdle},
+	})
+	assert.NilError(t, err)
+	assert.Equal(t, result.Strategy, CopyStrategyStream)
+	assert.NilError(t, CheckHash(sourceFilePath, destinationFilePath))
+
+	// Hash with the same limiter
+	_, err = GetHashWithOptions(sourceFilePath, HashOptions{Limiter: limiter})
+	assert.NilError(t, err)
+
+	// Cleanup
+	for _, filePath := range []string{sourceFilePath, destinationFilePath} {
+		assert.NilError(t, Remove(filePath))
+	}
+}
+
+func TestSetIOPriorityNegativeFlow(t *testing.T) {
+	assert.ErrorContains(t, SetIOPriority(IOPriority{Class: IOPriorityClassBestEffort, Level: 8}), "is not between 0 and 7")
+}
@@ -0,0 +1,272 @@
+/*
+   Copyright (c) 2022 Cyber Home Lab authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// VolumeIndexSuffix is added to the archive path to get the index of a
+// split archive, the volumes are the archive path followed by .001, .002...
+const VolumeIndexSuffix = ".index"
+
+type Volume struct {
+	// Name is the base name of the volume, it is next to the index
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// VolumeIndex describes a split archive, Size and SHA256 are of the whole
+// archive stream
+type VolumeIndex struct {
+	VolumeSize int64    `json:"volume_size"`
+	Volumes    []Volume `json:"volumes"`
+	Size       int64    `json:"size"`
+	SHA256     string   `json:"sha256"`
+}
+
+func VolumeIndexPath(archivePath string) string {
+	return archivePath + VolumeIndexSuffix
+}
+
+func volumePath(archivePath string, number int) string {
+	return fmt.Sprintf("%s.%03d", archivePath, number)
+}
+
+func ReadVolumeIndex(indexPath string) (VolumeIndex, error) {
+	var index VolumeIndex
+	content, err := ioutil.ReadFile(indexPath)
+	if err != nil {
+		return VolumeIndex{}, fmt.Errorf("couldn't read volume index %s -> %s", indexPath, err)
+	}
+	err = json.Unmarshal(content, &index)
+	if err != nil {
+		return VolumeIndex{}, fmt.Errorf("couldn't decode volume index %s -> %s", indexPath, err)
+	}
+	if len(index.Volumes) == 0 {
+		return VolumeIndex{}, fmt.Errorf("volume index %s doesn't have any volume", indexPath)
+	}
+	for _, volume := range index.Volumes {
+		if volume.Name != filepath.Base(volume.Name) {
+			return VolumeIndex{}, fmt.Errorf("volume %s from index %s is not next to the index", volume.Name, indexPath)
+		}
+	}
+	return index, nil
+}
+
+func writeVolumeIndex(indexPath string, index VolumeIndex) error {
+	content, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return fmt.Errorf("couldn't encode the volume index -> %s", err)
+	}
+	return WriteFileAtomically(indexPath, content, 0644)
+}
+
+// volumeWriter splits everything written to it into volumes of volumeSize
+// bytes, a new volume is only created when there is something to write
+type volumeWriter struct {
+	archivePath string
+	index       VolumeIndex
+	file        *os.File
+	hash        hash.Hash
+	written     int64
+}
+
+func newVolumeWriter(archivePath string, volumeSize int64) *volumeWriter {
+	return &volumeWriter{archivePath: archivePath, index: VolumeIndex{VolumeSize: volumeSize}}
+}
+
+func (w *volumeWriter) nextVolume() error {
+	err := w.finishVolume()
+	if err != nil {
+		return err
+	}
+	filePath := volumePath(w.archivePath, len(w.index.Volumes)+1)
+	w.file, err = os.Create(filePath)
+	if err != nil {
+		return fmt.Errorf("couldn't create volume %s -> %s", filePath, err)
+	}
+	w.hash = sha256.New()
+	w.written = 0
+	return nil
+}
+
+func (w *volumeWriter) finishVolume() error {
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	if err != nil {
+		return fmt.Errorf("couldn't close volume %s -> %s", w.file.Name(), err)
+	}
+	w.index.Volumes = append(w.index.Volumes, Volume{
+		Name:   filepath.Base(w.file.Name()),
+		Size:   w.written,
+		SHA256: hex.EncodeToString(w.hash.Sum(nil)),
+	})
+	w.file = nil
+	return nil
+}
+
+func (w *volumeWriter) Write(p []byte) (int, error) {
+	total := 0
+	for len(p) > 0 {
+		if w.file == nil || w.written == w.index.VolumeSize {
+			err := w.nextVolume()
+			if err != nil {
+				return total, err
+			}
+		}
+		size := int64(len(p))
+		if size > w.index.VolumeSize-w.written {
+			size = w.index.VolumeSize - w.written
+		}
+		n, err := w.file.Write(p[:size])
+		w.hash.Write(p[:n])
+		w.written += int64(n)
+		total += n
+		if err != nil {
+			return total, err
+		}
+		p = p[n:]
+	}
+	return total, nil
+}
+
+// Close closes the last volume, writes the index and removes the volumes
+// left by a previous archive with the same name. It returns the paths of
+// the volumes and of the index
+func (w *volumeWriter) Close(size int64, sha256 string) ([]string, error) {
+	err := w.finishVolume()
+	if err != nil {
+		return nil, err
+	}
+	w.index.Size = size
+	w.index.SHA256 = sha256
+	indexPath := VolumeIndexPath(w.archivePath)
+	err = writeVolumeIndex(indexPath, w.index)
+	if err != nil {
+		return nil, err
+	}
+	for number := len(w.index.Volumes) + 1; ; number++ {
+		err := os.Remove(volumePath(w.archivePath, number))
+		if err != nil {
+			break
+		}
+	}
+
+	var filePaths []string
+	for _, volume := range w.index.Volumes {
+		filePaths = append(filePaths, filepath.Join(filepath.Dir(w.archivePath), volume.Name))
+	}
+	return append(filePaths, indexPath), nil
+}
+
+// volumeReader reads the volumes one after the other, each volume is
+// compared with the index when its end is reached
+type volumeReader struct {
+	directoryPath string
+	index         VolumeIndex
+	number        int
+	file          *os.File
+	hash          hash.Hash
+	read          int64
+}
+
+func (r *volumeReader) Read(p []byte) (int, error) {
+	for {
+		if r.file == nil {
+			if r.number >= len(r.index.Volumes) {
+				return 0, io.EOF
+			}
+			filePath := filepath.Join(r.directoryPath, r.index.Volumes[r.number].Name)
+			file, err := os.Open(filePath)
+			if err != nil {
+				return 0, fmt.Errorf("couldn't open volume %s -> %s", filePath, err)
+			}
+			r.file = file
+			r.hash = sha256.New()
+			r.read = 0
+		}
+		n, err := r.file.Read(p)
+		r.hash.Write(p[:n])
+		r.read += int64(n)
+		if err == io.EOF {
+			err = r.finishVolume()
+			if err != nil {
+				return n, err
+			}
+			if n == 0 {
+				continue
+			}
+			return n, nil
+		}
+		return n, err
+	}
+}
+
+func (r *volumeReader) finishVolume() error {
+	volume := r.index.Volumes[r.number]
+	r.file.Close()
+	r.file = nil
+	r.number++
+	if r.read != volume.Size || hex.EncodeToString(r.hash.Sum(nil)) != volume.SHA256 {
+		return fmt.Errorf("volume %s doesn't match the index", volume.Name)
+	}
+	return nil
+}
+
+func (r *volumeReader) Close() error {
+	if r.file != nil {
+		return r.file.Close()
+	}
+	return nil
+}
+
+// openArchiveFile opens a single archive or the volumes of a split archive,
+// archivePath can be the archive itself or its index
+func openArchiveFile(archivePath string) (io.ReadCloser, error) {
+	indexPath := archivePath
+	if !strings.HasSuffix(archivePath, VolumeIndexSuffix) {
+		file, err := os.Open(archivePath)
+		if err == nil {
+			return file, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		indexPath = VolumeIndexPath(archivePath)
+		if _, indexErr := os.Stat(indexPath); indexErr != nil {
+			return nil, err
+		}
+	}
+	index, err := ReadVolumeIndex(indexPath)
+	if err != nil {
+		return nil, err
+	}
+	return &volumeReader{directoryPath: filepath.Dir(indexPath), index: index}, nil
+}
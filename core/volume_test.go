@@ -0,0 +1,114 @@
+/*
+   Copyright (c) 2022 Cyber Home Lab authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestArchiveVolumesHappyFlow(t *testing.T) {
+	sourceDirectoryPath := filepath.Join(os.TempDir(), "TestArchiveVolumesHappyFlow_source")
+	destinationDirectoryPath := filepath.Join(os.TempDir(), "TestArchiveVolumesHappyFlow_destination")
+	createTestTree(t, sourceDirectoryPath, testTreeOptions{Links: true})
+
+	for _, extension := range []string{".tar", ".zip"} {
+		archivePath := filepath.Join(os.TempDir(), "TestArchiveVolumesHappyFlow"+extension)
+
+		result, err := CreateArchiveWithOptions(archivePath, []string{sourceDirectoryPath}, ArchiveOptions{VolumeSize: 64 * 1024})
+		assert.NilError(t, err)
+		index, err := ReadVolumeIndex(VolumeIndexPath(archivePath))
+		assert.NilError(t, err)
+		assert.Equal(t, len(result.Files), len(index.Volumes)+1)
+		assert.Equal(t, index.Size, result.ArchiveBytes)
+		assert.Equal(t, index.SHA256, result.SHA256)
+		assert.Assert(t, len(index.Volumes) > 2)
+		for k, volume := range index.Volumes {
+			info, err := os.Stat(result.Files[k])
+			assert.NilError(t, err)
+			assert.Equal(t, info.Size(), volume.Size)
+			assert.Assert(t, volume.Size <= 64*1024)
+		}
+		_, err = os.Stat(archivePath)
+		assert.Assert(t, os.IsNotExist(err))
+
+		// The volumes of a bigger archive with the same name are removed
+		staleVolumePath := volumePath(archivePath, len(index.Volumes)+1)
+		assert.NilError(t, WriteToFile(staleVolumePath, "stale"))
+		_, err = CreateArchiveWithOptions(archivePath, []string{sourceDirectoryPath}, ArchiveOptions{VolumeSize: 64 * 1024})
+		assert.NilError(t, err)
+		_, err = os.Stat(staleVolumePath)
+		assert.Assert(t, os.IsNotExist(err))
+
+		// The volumes are read through the archive path or the index
+		entries, err := ListArchive(archivePath)
+		assert.NilError(t, err)
+		assert.Equal(t, len(entries), 1+testTreeDirectories+testTreeFiles+2)
+		_, err = VerifyArchive(VolumeIndexPath(archivePath))
+		assert.NilError(t, err)
+		_, err = ExtractArchive(archivePath, destinationDirectoryPath, ExtractOptions{})
+		assert.NilError(t, err)
+		extractedDirectoryPath := filepath.Join(destinationDirectoryPath, filepath.Base(sourceDirectoryPath))
+		assert.NilError(t, CheckIfDirectoriesMatch(sourceDirectoryPath, extractedDirectoryPath))
+		assert.NilError(t, CheckHash(filepath.Join(sourceDirectoryPath, "data"), filepath.Join(extractedDirectoryPath, "hardlink")))
+
+		// Cleanup
+		assert.NilError(t, Remove(destinationDirectoryPath))
+		for _, filePath := range result.Files {
+			assert.NilError(t, os.RemoveAll(filePath))
+		}
+	}
+
+	// Cleanup
+	assert.NilError(t, Remove(sourceDirectoryPath))
+}
+
+func TestArchiveVolumesNegativeFlow(t *testing.T) {
+	sourceDirectoryPath := filepath.Join(os.TempDir(), "TestArchiveVolumesNegativeFlow_source")
+	archivePath := filepath.Join(os.TempDir(), "TestArchiveVolumesNegativeFlow.tar")
+	createTestTree(t, sourceDirectoryPath, testTreeOptions{Links: true})
+	result, err := CreateArchiveWithOptions(archivePath, []string{sourceDirectoryPath}, ArchiveOptions{VolumeSize: 64 * 1024})
+	assert.NilError(t, err)
+
+	// A volume which doesn't match the index
+	indexPath := VolumeIndexPath(archivePath)
+	index, err := ReadVolumeIndex(indexPath)
+	assert.NilError(t, err)
+	index.Volumes[1].SHA256 = index.Volumes[0].SHA256
+	assert.NilError(t, writeVolumeIndex(indexPath, index))
+	_, err = VerifyArchive(archivePath)
+	assert.ErrorContains(t, err, "volume TestArchiveVolumesNegativeFlow.tar.002 doesn't match the index")
+
+	// A missing volume
+	assert.NilError(t, Remove(result.Files[1]))
+	_, err = VerifyArchive(archivePath)
+	assert.ErrorContains(t, err, "couldn't open volume")
+
+	// An invalid index
+	assert.NilError(t, WriteToFile(indexPath, `{"volumes": [{"name": "../other.001"}]}`))
+	_, err = ListArchive(archivePath)
+	assert.ErrorContains(t, err, "is not next to the index")
+
+	// Cleanup
+	assert.NilError(t, Remove(sourceDirectoryPath))
+	for _, filePath := range result.Files {
+		assert.NilError(t, os.RemoveAll(filePath))
+	}
+}
@@ -3,14 +3,21 @@ module cyberhomelab.com/core
 go 1.17
 
 require (
+	filippo.io/age v1.0.0
 	github.com/joho/godotenv v1.4.0
+	github.com/klauspost/compress v1.15.9
 	github.com/pelletier/go-toml v1.9.4
+	github.com/pkg/sftp v1.13.5
 	github.com/sirupsen/logrus v1.8.1
+	github.com/ulikunitz/xz v0.5.10
+	golang.org/x/crypto v0.0.0-20211215153901-e495a2d5b3d3
+	golang.org/x/net v0.9.0
+	golang.org/x/sys v0.7.0
 	gotest.tools v2.2.0+incompatible
 )
 
 require (
 	github.com/google/go-cmp v0.5.7 // indirect
+	github.com/kr/fs v0.1.0 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
-	golang.org/x/sys v0.0.0-20191026070338-33540a1f6037 // indirect
 )
@@ -19,6 +19,7 @@ package host
 import (
 	"context"
 	"fmt"
+	"os"
 	"os/exec"
 	"strings"
 	"time"
@@ -29,12 +30,21 @@ import (
 var log = logging.NewLogger()
 
 func RunCommand(timeout int, command string, args ...string) (string, error) {
+	return RunCommandWithEnv(context.Background(), timeout, nil, command, args...)
+}
+
+// RunCommandWithEnv adds env, a list of "KEY=value", to the environment of
+// the current process for the command, the command is killed when ctx is done
+func RunCommandWithEnv(ctx context.Context, timeout int, env []string, command string, args ...string) (string, error) {
 	// Create a new context and add a timeout
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
 	defer cancel() // Cleanup
 
 	// Creating the command with the context
 	cmd := exec.CommandContext(ctx, command, args...)
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
 
 	// Get the output
 	log.Infof("Running command -> %s %s", command, strings.Join(args, " "))
@@ -44,6 +54,9 @@ func RunCommand(timeout int, command string, args ...string) (string, error) {
 	if ctx.Err() == context.DeadlineExceeded {
 		return "", fmt.Errorf("command timed out")
 	}
+	if ctx.Err() != nil {
+		return "", fmt.Errorf("command was canceled -> %s", ctx.Err())
+	}
 
 	// Error
 	if err != nil {
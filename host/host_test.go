@@ -17,6 +17,7 @@
 package host
 
 import (
+	"context"
 	"strings"
 	"testing"
 
@@ -33,3 +34,15 @@ func TestRunCommandNegativeFlow(t *testing.T) {
 	_, err := RunCommand(5, "notacommand")
 	assert.ErrorContains(t, err, "executable file not found in $PATH")
 }
+
+func TestRunCommandWithEnv(t *testing.T) {
+	output, err := RunCommandWithEnv(context.Background(), 5, []string{"HOST_TEST=value"}, "sh", "-c", "echo $HOST_TEST")
+	assert.NilError(t, err)
+	assert.Equal(t, output, "value\n")
+	_, err = RunCommandWithEnv(context.Background(), 1, nil, "sleep", "5")
+	assert.ErrorContains(t, err, "command timed out")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = RunCommandWithEnv(ctx, 5, nil, "sleep", "5")
+	assert.ErrorContains(t, err, "command was canceled")
+}
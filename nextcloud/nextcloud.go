@@ -0,0 +1,421 @@
+/*
+   Copyright (c) 2022 Cyber Home Lab authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package nextcloud
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	core "cyberhomelab.com/core/core"
+	logging "cyberhomelab.com/core/logging"
+)
+
+var log = logging.NewLogger()
+
+const (
+	// DefaultChunkSize is the size of the chunks of the uploads, the files
+	// which are not bigger are uploaded with a single request
+	DefaultChunkSize = 10 * 1024 * 1024
+	// UserEnvironmentVariable and PasswordEnvironmentVariable hold the
+	// credentials, the password is an app password of the user
+	UserEnvironmentVariable     = "NEXTCLOUD_USER"
+	PasswordEnvironmentVariable = "NEXTCLOUD_APP_PASSWORD"
+)
+
+type Client struct {
+	// BaseURL is the address of the Nextcloud server, for example
+	// https://cloud.example.com
+	BaseURL string
+	// Directory is where the files are uploaded, relative to the files of
+	// the user
+	Directory string
+	User      string
+	Password  string
+	// ChunkSize is DefaultChunkSize when it is 0
+	ChunkSize  int64
+	HTTPClient *http.Client
+}
+
+// RemoteFile is a file or a directory from the upload directory
+type RemoteFile struct {
+	Name        string
+	Size        int64
+	ModTime     time.Time
+	IsDirectory bool
+	// SHA256 is only known when the server stores the checksums
+	SHA256 string
+}
+
+// NewClient returns a client for the Nextcloud of the config, the
+// credentials are read from the environment
+func NewClient(config core.Config) (*Client, error) {
+	user, err := core.ResolveSecret("env:" + UserEnvironmentVariable)
+	if err != nil {
+		return nil, err
+	}
+	password, err := core.ResolveSecret("env:" + PasswordEnvironmentVariable)
+	if err != nil {
+		return nil, err
+	}
+	baseURL := config.Common.NextcloudHostname
+	if !strings.Contains(baseURL, "://") {
+		baseURL = "https://" + baseURL
+	}
+	return &Client{
+		BaseURL:   strings.TrimRight(baseURL, "/"),
+		Directory: config.Common.NextcloudDirectory,
+		User:      user,
+		Password:  password,
+	}, nil
+}
+
+func escapePath(filePath string) string {
+	var segments []string
+	for _, segment := range strings.Split(strings.Trim(filePath, "/"), "/") {
+		if segment != "" {
+			segments = append(segments, url.PathEscape(segment))
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// fileURL returns the address of name in the upload directory
+func (c *Client) fileURL(name string) string {
+	return fmt.Sprintf("%s/remote.php/dav/files/%s/%s", c.BaseURL, url.PathEscape(c.User), escapePath(path.Join(c.Directory, name)))
+}
+
+func (c *Client) uploadURL(transferId string) string {
+	return fmt.Sprintf("%s/remote.php/dav/uploads/%s/%s", c.BaseURL, url.PathEscape(c.User), transferId)
+}
+
+func (c *Client) do(ctx context.Context, method string, requestURL string, body io.Reader, headers map[string]string, expected ...int) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(ctx, method, requestURL, body)
+	if err != nil {
+		return nil, err
+	}
+	if section, ok := body.(*io.SectionReader); ok {
+		request.ContentLength = section.Size()
+	}
+	request.SetBasicAuth(c.User, c.Password)
+	for key, value := range headers {
+		request.Header.Set(key, value)
+	}
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s failed -> %s", method, requestURL, err)
+	}
+	for _, statusCode := range expected {
+		if response.StatusCode == statusCode {
+			return response, nil
+		}
+	}
+	response.Body.Close()
+	return nil, fmt.Errorf("%s %s returned %s", method, requestURL, response.Status)
+}
+
+// MakeDirectory creates the upload directory and its parents, the existing
+// ones are kept
+func (c *Client) MakeDirectory(ctx context.Context, name string) error {
+	directoryPath := strings.Trim(path.Join(c.Directory, name), "/")
+	currentPath := ""
+	for _, segment := range strings.Split(directoryPath, "/") {
+		if segment == "" || segment == "." {
+			continue
+		}
+		currentPath = path.Join(currentPath, segment)
+		directoryURL := fmt.Sprintf("%s/remote.php/dav/files/%s/%s", c.BaseURL, url.PathEscape(c.User), escapePath(currentPath))
+		response, err := c.do(ctx, "MKCOL", directoryURL, nil, nil, http.StatusCreated, http.StatusMethodNotAllowed)
+		if err != nil {
+			return fmt.Errorf("couldn't create directory %s -> %s", currentPath, err)
+		}
+		response.Body.Close()
+	}
+	return nil
+}
+
+type multistatus struct {
+	Responses []struct {
+		Href     string `xml:"href"`
+		Propstat []struct {
+			Prop struct {
+				ContentLength int64  `xml:"getcontentlength"`
+				LastModified  string `xml:"getlastmodified"`
+				ResourceType  struct {
+					Collection *struct{} `xml:"collection"`
+				} `xml:"resourcetype"`
+				Checksums struct {
+					Checksum string `xml:"checksum"`
+				} `xml:"checksums"`
+			} `xml:"prop"`
+			Status string `xml:"status"`
+		} `xml:"propstat"`
+	} `xml:"response"`
+}
+
+const propfindBody = `<?xml version="1.0" encoding="UTF-8"?>
+<d:propfind xmlns:d="DAV:" xmlns:oc="http://owncloud.org/ns">
+	<d:prop>
+		<d:getcontentlength/>
+		<d:getlastmodified/>
+		<d:resourcetype/>
+		<oc:checksums/>
+	</d:prop>
+</d:propfind>`
+
+func (c *Client) propfind(ctx context.Context, requestURL string, depth string) ([]RemoteFile, error) {
+	response, err := c.do(ctx, "PROPFIND", requestURL, strings.NewReader(propfindBody), map[string]string{"Depth": depth, "Content-Type": "application/xml"}, http.StatusMultiStatus)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	var status multistatus
+	err = xml.NewDecoder(response.Body).Decode(&status)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't decode the answer of PROPFIND %s -> %s", requestURL, err)
+	}
+
+	var files []RemoteFile
+	for _, response := range status.Responses {
+		href, err := url.PathUnescape(response.Href)
+		if err != nil {
+			href = response.Href
+		}
+		file := RemoteFile{Name: path.Base(strings.TrimRight(href, "/"))}
+		for _, propstat := range response.Propstat {
+			if !strings.Contains(propstat.Status, " 200 ") {
+				continue
+			}
+			prop := propstat.Prop
+			file.Size = prop.ContentLength
+			file.IsDirectory = prop.ResourceType.Collection != nil
+			if modTime, err := http.ParseTime(prop.LastModified); err == nil {
+				file.ModTime = modTime
+			}
+			for _, checksum := range strings.Fields(prop.Checksums.Checksum) {
+				if strings.HasPrefix(strings.ToUpper(checksum), "SHA256:") {
+					file.SHA256 = strings.ToLower(checksum[len("SHA256:"):])
+				}
+			}
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// Stat returns the remote file with the given name
+func (c *Client) Stat(ctx context.Context, name string) (RemoteFile, error) {
+	files, err := c.propfind(ctx, c.fileURL(name), "0")
+	if err != nil {
+		return RemoteFile{}, err
+	}
+	if len(files) != 1 {
+		return RemoteFile{}, fmt.Errorf("PROPFIND of %s returned %d files", name, len(files))
+	}
+	return files[0], nil
+}
+
+// List returns the content of a directory from the upload directory, an
+// empty name is the upload directory itself
+func (c *Client) List(ctx context.Context, name string) ([]RemoteFile, error) {
+	files, err := c.propfind(ctx, c.fileURL(name)+"/", "1")
+	if err != nil {
+		return nil, err
+	}
+	// The first answer is the directory itself
+	if len(files) > 0 {
+		files = files[1:]
+	}
+	return files, nil
+}
+
+func (c *Client) Delete(ctx context.Context, name string) error {
+	response, err := c.do(ctx, http.MethodDelete, c.fileURL(name), nil, nil, http.StatusNoContent, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	return response.Body.Close()
+}
+
+// Open returns the content of the remote file, it must be closed
+func (c *Client) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	response, err := c.do(ctx, http.MethodGet, c.fileURL(name), nil, nil, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	return response.Body, nil
+}
+
+// Download writes the remote file to writer
+func (c *Client) Download(ctx context.Context, name string, writer io.Writer) (int64, error) {
+	reader, err := c.Open(ctx, name)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+	return io.Copy(writer, reader)
+}
+
+// Put streams reader to the upload directory with a single request, the
+// parents of name are created. Unlike Upload, nothing is verified
+func (c *Client) Put(ctx context.Context, name string, reader io.Reader) error {
+	err := c.MakeDirectory(ctx, path.Dir(name))
+	if err != nil {
+		return err
+	}
+	response, err := c.do(ctx, http.MethodPut, c.fileURL(name), reader, nil, http.StatusCreated, http.StatusNoContent, http.StatusOK)
+	if err != nil {
+		return fmt.Errorf("couldn't upload %s -> %s", name, err)
+	}
+	return response.Body.Close()
+}
+
+// Upload sends a local file to the upload directory, the parents of name are
+// created. After the upload the size is checked and the SHA-256 is compared
+// with the one stored by the server or, when the server doesn't store it,
+// with the hash of the downloaded file
+func (c *Client) Upload(ctx context.Context, filePath string, name string) (RemoteFile, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return RemoteFile{}, fmt.Errorf("couldn't open %s -> %s", filePath, err)
+	}
+	defer file.Close()
+	fileStat, err := file.Stat()
+	if err != nil {
+		return RemoteFile{}, fmt.Errorf("couldn't run os.Stat() -> %s", err)
+	}
+	hash, err := core.GetHash(filePath)
+	if err != nil {
+		return RemoteFile{}, fmt.Errorf("couldn't get the hash for file %s -> %s", filePath, err)
+	}
+
+	// Directories
+	err = c.MakeDirectory(ctx, path.Dir(name))
+	if err != nil {
+		return RemoteFile{}, err
+	}
+
+	// Upload
+	log.Infof("Uploading %s to %s", filePath, c.fileURL(name))
+	chunkSize := c.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	if fileStat.Size() > chunkSize {
+		err = c.uploadChunks(ctx, file, fileStat.Size(), chunkSize, name, hash)
+	} else {
+		var response *http.Response
+		headers := map[string]string{"OC-Checksum": "SHA256:" + hash}
+		body := io.NewSectionReader(file, 0, fileStat.Size())
+		response, err = c.do(ctx, http.MethodPut, c.fileURL(name), body, headers, http.StatusCreated, http.StatusNoContent, http.StatusOK)
+		if err == nil {
+			response.Body.Close()
+		}
+	}
+	if err != nil {
+		return RemoteFile{}, fmt.Errorf("couldn't upload %s -> %s", filePath, err)
+	}
+
+	// Verify
+	remoteFile, err := c.Stat(ctx, name)
+	if err != nil {
+		return RemoteFile{}, err
+	}
+	if remoteFile.Size != fileStat.Size() {
+		return remoteFile, fmt.Errorf("size missmatch between %s (%d) and the uploaded %s (%d)", filePath, fileStat.Size(), name, remoteFile.Size)
+	}
+	if remoteFile.SHA256 == "" {
+		remoteHash := sha256.New()
+		_, err = c.Download(ctx, name, remoteHash)
+		if err != nil {
+			return remoteFile, fmt.Errorf("couldn't download %s for the verification -> %s", name, err)
+		}
+		remoteFile.SHA256 = hex.EncodeToString(remoteHash.Sum(nil))
+	}
+	if remoteFile.SHA256 != hash {
+		return remoteFile, fmt.Errorf("hash missmatch between %s (%s) and the uploaded %s (%s)", filePath, hash, name, remoteFile.SHA256)
+	}
+	return remoteFile, nil
+}
+
+// uploadChunks uses the chunked upload of Nextcloud, the chunks are stored
+// in an upload directory and are assembled by moving its .file
+func (c *Client) uploadChunks(ctx context.Context, file *os.File, size int64, chunkSize int64, name string, hash string) error {
+	transferIdBytes := make([]byte, 16)
+	_, err := rand.Read(transferIdBytes)
+	if err != nil {
+		return err
+	}
+	transferId := "core-" + hex.EncodeToString(transferIdBytes)
+	uploadURL := c.uploadURL(transferId)
+	destination := map[string]string{"Destination": c.fileURL(name)}
+
+	response, err := c.do(ctx, "MKCOL", uploadURL, nil, destination, http.StatusCreated)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+
+	// The chunks, the upload directory is removed after a failure
+	cleanup := func() {
+		response, err := c.do(context.Background(), http.MethodDelete, uploadURL, nil, nil, http.StatusNoContent, http.StatusOK)
+		if err == nil {
+			response.Body.Close()
+		}
+	}
+	for number, offset := 1, int64(0); offset < size; number, offset = number+1, offset+chunkSize {
+		chunk := io.NewSectionReader(file, offset, chunkSize)
+		if offset+chunkSize > size {
+			chunk = io.NewSectionReader(file, offset, size-offset)
+		}
+		headers := map[string]string{"Destination": c.fileURL(name), "OC-Total-Length": fmt.Sprint(size)}
+		response, err := c.do(ctx, http.MethodPut, fmt.Sprintf("%s/%05d", uploadURL, number), chunk, headers, http.StatusCreated, http.StatusNoContent)
+		if err != nil {
+			cleanup()
+			return err
+		}
+		response.Body.Close()
+	}
+
+	// Assemble
+	headers := map[string]string{
+		"Destination":     c.fileURL(name),
+		"OC-Total-Length": fmt.Sprint(size),
+		"OC-Checksum":     "SHA256:" + hash,
+		"Overwrite":       "T",
+	}
+	response, err = c.do(ctx, "MOVE", uploadURL+"/.file", nil, headers, http.StatusCreated, http.StatusNoContent)
+	if err != nil {
+		cleanup()
+		return err
+	}
+	return response.Body.Close()
+}
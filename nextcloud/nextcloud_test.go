@@ -0,0 +1,169 @@
+/*
+   Copyright (c) 2022 Cyber Home Lab authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package nextcloud
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	core "cyberhomelab.com/core/core"
+
+	"golang.org/x/net/webdav"
+	"gotest.tools/assert"
+)
+
+// newTestServer returns a WebDAV server with the layout of Nextcloud, moving
+// the .file of an upload directory assembles its chunks like Nextcloud does
+func newTestServer(t *testing.T, directoryPath string) *httptest.Server {
+	filesPath := filepath.Join(directoryPath, "files")
+	uploadsPath := filepath.Join(directoryPath, "uploads")
+	assert.NilError(t, os.MkdirAll(filesPath, core.DefaultMode))
+	assert.NilError(t, os.MkdirAll(uploadsPath, core.DefaultMode))
+	files := &webdav.Handler{Prefix: "/remote.php/dav/files/user", FileSystem: webdav.Dir(filesPath), LockSystem: webdav.NewMemLS()}
+	uploads := &webdav.Handler{Prefix: "/remote.php/dav/uploads/user", FileSystem: webdav.Dir(uploadsPath), LockSystem: webdav.NewMemLS()}
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		if !ok || user != "user" || password != "password" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case strings.HasPrefix(r.URL.Path, files.Prefix):
+			files.ServeHTTP(w, r)
+		case r.Method == "MOVE" && strings.HasSuffix(r.URL.Path, "/.file"):
+			transferPath := filepath.Join(uploadsPath, filepath.Base(filepath.Dir(r.URL.Path)))
+			chunks, err := ioutil.ReadDir(transferPath)
+			assert.NilError(t, err)
+			sort.Slice(chunks, func(i, j int) bool { return chunks[i].Name() < chunks[j].Name() })
+			var content bytes.Buffer
+			for _, chunk := range chunks {
+				chunkContent, err := ioutil.ReadFile(filepath.Join(transferPath, chunk.Name()))
+				assert.NilError(t, err)
+				content.Write(chunkContent)
+			}
+			destination, err := url.Parse(r.Header.Get("Destination"))
+			assert.NilError(t, err)
+			destinationPath := filepath.Join(filesPath, strings.TrimPrefix(destination.Path, files.Prefix))
+			assert.NilError(t, ioutil.WriteFile(destinationPath, content.Bytes(), 0600))
+			assert.NilError(t, os.RemoveAll(transferPath))
+			w.WriteHeader(http.StatusCreated)
+		case strings.HasPrefix(r.URL.Path, uploads.Prefix):
+			uploads.ServeHTTP(w, r)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func TestClientHappyFlow(t *testing.T) {
+	directoryPath := filepath.Join(os.TempDir(), "TestNextcloudClientHappyFlow")
+	server := newTestServer(t, directoryPath)
+	defer server.Close()
+	client := &Client{BaseURL: server.URL, Directory: "Backups/core", User: "user", Password: "password", ChunkSize: 1000}
+	ctx := context.Background()
+
+	// A small and a chunked upload
+	smallFilePath := filepath.Join(os.TempDir(), "TestNextcloudClientHappyFlow_small.txt")
+	bigFilePath := filepath.Join(os.TempDir(), "TestNextcloudClientHappyFlow_big.txt")
+	assert.NilError(t, core.WriteToFile(smallFilePath, "small"))
+	assert.NilError(t, core.WriteToFile(bigFilePath, strings.Repeat("big file ", 500)))
+	remoteFile, err := client.Upload(ctx, smallFilePath, "small.txt")
+	assert.NilError(t, err)
+	assert.Equal(t, remoteFile.Size, int64(5))
+	remoteFile, err = client.Upload(ctx, bigFilePath, "mars/big with spaces.txt")
+	assert.NilError(t, err)
+	assert.Equal(t, remoteFile.Size, int64(4500))
+	content, err := core.ReadFile(filepath.Join(directoryPath, "files", "Backups", "core", "mars", "big with spaces.txt"))
+	assert.NilError(t, err)
+	assert.Equal(t, content, strings.Repeat("big file ", 500))
+	uploads, err := ioutil.ReadDir(filepath.Join(directoryPath, "uploads"))
+	assert.NilError(t, err)
+	assert.Equal(t, len(uploads), 0)
+
+	// A streamed upload
+	assert.NilError(t, client.Put(ctx, "mars/streamed.txt", strings.NewReader("streamed")))
+	reader, err := client.Open(ctx, "mars/streamed.txt")
+	assert.NilError(t, err)
+	streamed, err := ioutil.ReadAll(reader)
+	assert.NilError(t, err)
+	assert.NilError(t, reader.Close())
+	assert.Equal(t, string(streamed), "streamed")
+
+	// List and delete
+	remoteFiles, err := client.List(ctx, "")
+	assert.NilError(t, err)
+	assert.Equal(t, len(remoteFiles), 2)
+	sort.Slice(remoteFiles, func(i, j int) bool { return remoteFiles[i].Name < remoteFiles[j].Name })
+	assert.Equal(t, remoteFiles[0].Name, "mars")
+	assert.Equal(t, remoteFiles[0].IsDirectory, true)
+	assert.Equal(t, remoteFiles[1].Name, "small.txt")
+	assert.Equal(t, remoteFiles[1].Size, int64(5))
+	assert.NilError(t, client.Delete(ctx, "small.txt"))
+	remoteFiles, err = client.List(ctx, "")
+	assert.NilError(t, err)
+	assert.Equal(t, len(remoteFiles), 1)
+
+	// Cleanup
+	for _, path := range []string{directoryPath, smallFilePath, bigFilePath} {
+		assert.NilError(t, core.Remove(path))
+	}
+}
+
+func TestClientNegativeFlow(t *testing.T) {
+	directoryPath := filepath.Join(os.TempDir(), "TestNextcloudClientNegativeFlow")
+	server := newTestServer(t, directoryPath)
+	defer server.Close()
+	filePath := filepath.Join(os.TempDir(), "TestNextcloudClientNegativeFlow.txt")
+	assert.NilError(t, core.WriteToFile(filePath, "content"))
+
+	client := &Client{BaseURL: server.URL, Directory: "Backups", User: "user", Password: "wrong"}
+	_, err := client.Upload(context.Background(), filePath, "file.txt")
+	assert.ErrorContains(t, err, "401 Unauthorized")
+	client.Password = "password"
+	_, err = client.Upload(context.Background(), "/tmp/notfound.txt", "file.txt")
+	assert.ErrorContains(t, err, "couldn't open")
+	err = client.Delete(context.Background(), "notfound.txt")
+	assert.ErrorContains(t, err, "404 Not Found")
+
+	// The credentials come from the environment
+	var config core.Config
+	config.Common.NextcloudHostname = "cloud.example.com"
+	os.Unsetenv(PasswordEnvironmentVariable)
+	os.Setenv(UserEnvironmentVariable, "user")
+	defer os.Unsetenv(UserEnvironmentVariable)
+	_, err = NewClient(config)
+	assert.ErrorContains(t, err, "environment variable NEXTCLOUD_APP_PASSWORD is not set")
+	os.Setenv(PasswordEnvironmentVariable, "password")
+	defer os.Unsetenv(PasswordEnvironmentVariable)
+	client, err = NewClient(config)
+	assert.NilError(t, err)
+	assert.Equal(t, client.fileURL("a b.txt"), "https://cloud.example.com/remote.php/dav/files/user/a%20b.txt")
+
+	// Cleanup
+	assert.NilError(t, core.Remove(directoryPath))
+	assert.NilError(t, core.Remove(filePath))
+}
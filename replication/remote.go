@@ -0,0 +1,292 @@
+/*
+   Copyright (c) 2022 Cyber Home Lab authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package replication
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	core "cyberhomelab.com/core/core"
+
+	sftp "github.com/pkg/sftp"
+)
+
+// actionSymlink creates the symlink Destination pointing to Source on the
+// server, core.DiffTrees leaves the symlinks out
+const actionSymlink core.PlanActionType = "symlink"
+
+// scanRemoteTree is core.ScanTree for a directory of the server, a missing
+// directory is an empty tree
+func scanRemoteTree(client *sftp.Client, directoryPath string) (map[string]core.TreeEntry, bool, error) {
+	tree := make(map[string]core.TreeEntry)
+	_, err := client.Lstat(directoryPath)
+	if os.IsNotExist(err) {
+		return tree, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("couldn't run Lstat() on %s -> %s", directoryPath, err)
+	}
+	walker := client.Walk(directoryPath)
+	for walker.Step() {
+		err := walker.Err()
+		if err != nil {
+			return nil, true, fmt.Errorf("couldn't scan directory %s -> %s", directoryPath, err)
+		}
+		if walker.Path() == directoryPath {
+			continue
+		}
+		info := walker.Stat()
+		entry := core.TreeEntry{
+			Path:    strings.TrimPrefix(walker.Path(), directoryPath+"/"),
+			Mode:    info.Mode(),
+			ModTime: info.ModTime(),
+			UserId:  core.DefaultUserId,
+			GroupId: core.DefaultGroupId,
+		}
+		if stat, ok := info.Sys().(*sftp.FileStat); ok {
+			entry.UserId = int(stat.UID)
+			entry.GroupId = int(stat.GID)
+		}
+		if !info.IsDir() {
+			entry.Size = info.Size()
+		}
+		tree[entry.Path] = entry
+	}
+	return tree, true, nil
+}
+
+// truncateModTimes drops what SFTP can't keep from the modification times
+func truncateModTimes(tree map[string]core.TreeEntry) {
+	for path, entry := range tree {
+		entry.ModTime = entry.ModTime.Truncate(time.Second)
+		tree[path] = entry
+	}
+}
+
+// planReplication is core.PlanSync with a destination on the server, the
+// owners are only compared when they are kept. The symlinks are replicated
+// as they are and the other special files of the source are skipped, they
+// are returned as warnings
+func planReplication(ctx context.Context, client *sftp.Client, sourceDirectoryPath string, destinationDirectoryPath string, options core.SyncOptions, owner bool) (core.Plan, []string, error) {
+	var plan core.Plan
+	var warnings []string
+	sourceStat, err := os.Stat(sourceDirectoryPath)
+	if err != nil {
+		return core.Plan{}, nil, fmt.Errorf("couldn't run os.Stat() -> %s", err)
+	}
+	if !sourceStat.IsDir() {
+		return core.Plan{}, nil, fmt.Errorf("%s is not a directory", sourceDirectoryPath)
+	}
+
+	// Trees, without the FIFOs, sockets and devices of the source
+	sourceTree, err := core.ScanTreeWithFilter(sourceDirectoryPath, options.Filter)
+	if err != nil {
+		return core.Plan{}, nil, err
+	}
+	var symlinkPaths []string
+	for relativePath, entry := range sourceTree {
+		switch {
+		case entry.Mode&os.ModeSymlink != 0:
+			symlinkPaths = append(symlinkPaths, relativePath)
+		case !entry.Mode.IsDir() && !entry.Mode.IsRegular():
+			warnings = append(warnings, fmt.Sprintf("skipped special file %s", filepath.Join(sourceDirectoryPath, relativePath)))
+			delete(sourceTree, relativePath)
+		}
+	}
+	sort.Strings(symlinkPaths)
+	sort.Strings(warnings)
+	destinationTree, exists, err := scanRemoteTree(client, destinationDirectoryPath)
+	if err != nil {
+		return core.Plan{}, nil, err
+	}
+	if !exists {
+		plan.Actions = append(plan.Actions, core.PlanAction{
+			Type:        core.PlanActionCreateDirectory,
+			Source:      sourceDirectoryPath,
+			Destination: destinationDirectoryPath,
+			Mode:        sourceStat.Mode(),
+		})
+	}
+	destinationTree, err = core.FilterTree(destinationTree, sourceDirectoryPath, options.Filter)
+	if err != nil {
+		return core.Plan{}, nil, err
+	}
+	truncateModTimes(sourceTree)
+	truncateModTimes(destinationTree)
+
+	// Differences
+	diff, err := core.DiffTrees(sourceDirectoryPath, sourceTree, destinationDirectoryPath, destinationTree, options, func(relativePath string) (bool, error) {
+		sourceHash, err := core.GetHash(path.Join(sourceDirectoryPath, relativePath))
+		if err != nil {
+			return false, err
+		}
+		destinationHash, err := remoteHash(ctx, client, path.Join(destinationDirectoryPath, relativePath))
+		if err != nil {
+			return false, err
+		}
+		return sourceHash != destinationHash, nil
+	})
+	if err != nil {
+		return core.Plan{}, nil, err
+	}
+	for _, action := range diff.Actions {
+		if action.Type != core.PlanActionChown || owner {
+			plan.Actions = append(plan.Actions, action)
+		}
+	}
+
+	// Symlinks, the ones of another type were removed by DiffTrees
+	for _, relativePath := range symlinkPaths {
+		linkName, err := os.Readlink(filepath.Join(sourceDirectoryPath, relativePath))
+		if err != nil {
+			return core.Plan{}, nil, fmt.Errorf("couldn't read symlink %s -> %s", relativePath, err)
+		}
+		destinationPath := path.Join(destinationDirectoryPath, filepath.ToSlash(relativePath))
+		destinationEntry, found := destinationTree[relativePath]
+		if found && destinationEntry.Mode&os.ModeSymlink != 0 {
+			destinationLinkName, err := client.ReadLink(destinationPath)
+			if err != nil {
+				return core.Plan{}, nil, fmt.Errorf("couldn't read symlink %s -> %s", destinationPath, err)
+			}
+			if destinationLinkName == linkName {
+				continue
+			}
+			plan.Actions = append(plan.Actions, core.PlanAction{Type: core.PlanActionRemove, Destination: destinationPath, Mode: destinationEntry.Mode})
+		}
+		plan.Actions = append(plan.Actions, core.PlanAction{Type: actionSymlink, Source: linkName, Destination: destinationPath, Mode: os.ModeSymlink})
+	}
+	return plan, warnings, nil
+}
+
+func remoteHash(ctx context.Context, client *sftp.Client, filePath string) (string, error) {
+	file, err := client.Open(filePath)
+	if err != nil {
+		return "", fmt.Errorf("couldn't read %s -> %s", filePath, err)
+	}
+	defer file.Close()
+	hash := sha256.New()
+	_, err = io.Copy(hash, core.NewContextReader(ctx, file))
+	if err != nil {
+		return "", fmt.Errorf("couldn't calculate the hash of %s -> %s", filePath, err)
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
+
+// executeRemote runs the actions of a plan on the server and stops at the
+// first error
+func executeRemote(ctx context.Context, client *sftp.Client, plan core.Plan, owner bool, result *Result) error {
+	for _, action := range plan.Actions {
+		err := ctx.Err()
+		if err == nil {
+			err = executeRemoteAction(ctx, client, action, owner)
+		}
+		if err != nil {
+			return fmt.Errorf("couldn't %s %s -> %s", action.Type, action.Destination, err)
+		}
+		switch action.Type {
+		case core.PlanActionCopyFile:
+			result.Copied++
+			result.Bytes += action.Size
+		case core.PlanActionRemove:
+			result.Removed++
+		}
+	}
+	return nil
+}
+
+func executeRemoteAction(ctx context.Context, client *sftp.Client, action core.PlanAction, owner bool) error {
+	switch action.Type {
+	case core.PlanActionCreateDirectory:
+		err := client.MkdirAll(action.Destination)
+		if err != nil {
+			return err
+		}
+		err = client.Chmod(action.Destination, action.Mode.Perm())
+		if err != nil || !owner {
+			return err
+		}
+		return client.Chown(action.Destination, action.UserId, action.GroupId)
+	case core.PlanActionCopyFile:
+		err := copyRemote(ctx, client, action)
+		if err != nil || !owner {
+			return err
+		}
+		return client.Chown(action.Destination, action.UserId, action.GroupId)
+	case core.PlanActionRemove:
+		if action.Mode.IsDir() {
+			return client.RemoveDirectory(action.Destination)
+		}
+		return client.Remove(action.Destination)
+	case core.PlanActionChmod:
+		return client.Chmod(action.Destination, action.Mode.Perm())
+	case core.PlanActionChown:
+		return client.Chown(action.Destination, action.UserId, action.GroupId)
+	case actionSymlink:
+		return client.Symlink(action.Source, action.Destination)
+	}
+	return fmt.Errorf("unknown action %s", action.Type)
+}
+
+// copyRemote writes the file next to the destination and renames it, so a
+// replica never has a partial file
+func copyRemote(ctx context.Context, client *sftp.Client, action core.PlanAction) error {
+	source, err := os.Open(action.Source)
+	if err != nil {
+		return fmt.Errorf("couldn't open %s -> %s", action.Source, err)
+	}
+	defer source.Close()
+	sourceStat, err := source.Stat()
+	if err != nil {
+		return fmt.Errorf("couldn't run os.Stat() -> %s", err)
+	}
+	if sourceStat.Size() != action.Size || !sourceStat.ModTime().Truncate(time.Second).Equal(action.ModTime) {
+		return fmt.Errorf("source %s changed after the plan was created", action.Source)
+	}
+
+	temporaryPath := path.Join(path.Dir(action.Destination), ".replicating-"+path.Base(action.Destination))
+	destination, err := client.Create(temporaryPath)
+	if err != nil {
+		return err
+	}
+	_, err = destination.ReadFrom(core.NewContextReader(ctx, source))
+	closeErr := destination.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = client.Chmod(temporaryPath, action.Mode.Perm())
+	}
+	if err == nil {
+		err = client.Chtimes(temporaryPath, time.Now(), action.ModTime)
+	}
+	if err == nil {
+		err = client.PosixRename(temporaryPath, action.Destination)
+	}
+	if err != nil {
+		client.Remove(temporaryPath)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,216 @@
+/*
+   Copyright (c) 2022 Cyber Home Lab authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package replication
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	core "cyberhomelab.com/core/core"
+	logging "cyberhomelab.com/core/logging"
+	storage "cyberhomelab.com/core/storage"
+)
+
+var log = logging.NewLogger()
+
+// ReplicaDirectoryName is the directory of the ServiceDirectory of a node
+// holding the replicas of the other nodes, it is never replicated itself
+const ReplicaDirectoryName = ".replica"
+
+// Notifier sends a message to the admins, like telegram.SendMessage
+type Notifier func(message string) error
+
+type Job struct {
+	// From is the node whose ServiceDirectory is replicated, it is the
+	// hostname when empty because the source has to be local. To is the
+	// node receiving the replica. Config is core.CoreConfig when it is nil
+	From   string
+	To     string
+	Config *core.Config
+	// Source is the ServiceDirectory of From when empty. Destination is
+	// ReplicaDirectoryName/<from> under the ServiceDirectory of To when
+	// empty, so the services of To are left alone
+	Source      string
+	Destination string
+	// Delete removes the files of the replica which are not in the source
+	// and Checksum compares the content instead of size and modification
+	// time, like for core.Sync
+	Delete   bool
+	Checksum bool
+	// Filter selects the files of both trees, the ignore files are read
+	// from the source
+	Filter core.FilterOptions
+	// Owner keeps the owner and the group of the files, the SSHUser of To
+	// must be root
+	Owner bool
+	// DryRun returns the plan without changing anything
+	DryRun bool
+	// KnownHostsPath checks the key of To, it is ~/.ssh/known_hosts when
+	// empty
+	KnownHostsPath string
+	// Notifier is told about the failures
+	Notifier Notifier
+}
+
+type Result struct {
+	From        string
+	To          string
+	Source      string
+	Destination string
+	// Plan has the actions which were needed, they are only planned for a
+	// dry run
+	Plan     core.Plan
+	Copied   int
+	Removed  int
+	Bytes    int64
+	Verified bool
+	// Warnings are the special files of the source which were skipped
+	Warnings  []string
+	StartTime time.Time
+	Duration  time.Duration
+}
+
+// Replicate mirrors the ServiceDirectory of a node to another one over SFTP,
+// only the changed files are copied. The replica is compared with the source
+// again afterwards, so a failed node's services can be started from it
+func Replicate(ctx context.Context, job Job) (Result, error) {
+	result := Result{StartTime: time.Now().UTC()}
+	err := replicate(ctx, job, &result)
+	result.Duration = time.Since(result.StartTime)
+	if err != nil {
+		log.Errorf("Replication of %s to %s -> %s", result.Source, result.To, err)
+		notify(job.Notifier, fmt.Sprintf("Replication of %s from %s to %s -> %s", result.Source, result.From, result.To, err))
+		return result, err
+	}
+	if !job.DryRun {
+		log.Infof("Replicated %s to %s:%s, %d files copied (%s) and %d removed in %s", result.Source, result.To, result.Destination, result.Copied, core.FormatBytes(result.Bytes), result.Removed, result.Duration)
+	}
+	return result, nil
+}
+
+func notify(notifier Notifier, message string) {
+	if notifier == nil {
+		return
+	}
+	err := notifier(message)
+	if err != nil {
+		log.Errorf("Couldn't send the notification -> %s", err)
+	}
+}
+
+func replicate(ctx context.Context, job Job, result *Result) error {
+	config := job.Config
+	if config == nil {
+		config = &core.CoreConfig
+	}
+	if job.From == "" {
+		job.From = core.Hostname
+	}
+	result.From = job.From
+	result.To = job.To
+	if strings.EqualFold(job.From, job.To) {
+		return fmt.Errorf("can't replicate node %s to itself", job.From)
+	}
+	fromHost, err := config.GetNode(job.From)
+	if err != nil {
+		return err
+	}
+	toHost, err := config.GetNode(job.To)
+	if err != nil {
+		return err
+	}
+	result.Source = job.Source
+	if result.Source == "" {
+		result.Source = fromHost.ServiceDirectory
+	}
+	result.Destination = job.Destination
+	if result.Destination == "" {
+		result.Destination = path.Join(toHost.ServiceDirectory, ReplicaDirectoryName, strings.ToLower(job.From))
+	}
+
+	// The replicas of the other nodes stay where they are
+	filterOptions := job.Filter
+	filterOptions.Exclude = append(append([]string{}, job.Filter.Exclude...), "/"+ReplicaDirectoryName)
+	filter, err := core.NewFilter(filterOptions)
+	if err != nil {
+		return err
+	}
+	options := core.SyncOptions{Delete: job.Delete, Checksum: job.Checksum, Filter: filter}
+
+	// Connection
+	sftpOptions, err := storage.NodeSFTPOptions(config, fromHost, job.To)
+	if err != nil {
+		return err
+	}
+	sftpOptions.KnownHostsPath = job.KnownHostsPath
+	remote := storage.NewSFTP(sftpOptions)
+	defer remote.Close()
+	client, err := remote.Client()
+	if err != nil {
+		return err
+	}
+
+	// Plan, execution and verification
+	plan, warnings, err := planReplication(ctx, client, result.Source, result.Destination, options, job.Owner)
+	if err != nil {
+		return err
+	}
+	result.Plan = plan
+	result.Warnings = warnings
+	for _, warning := range warnings {
+		log.Warningf("Replication of %s -> %s", result.Source, warning)
+	}
+	if job.DryRun {
+		return nil
+	}
+	log.Infof("Replicating %s to %s:%s, %d actions (%s)", result.Source, job.To, result.Destination, len(plan.Actions), core.FormatBytes(plan.TotalBytes()))
+	err = executeRemote(ctx, client, plan, job.Owner, result)
+	if err != nil {
+		return err
+	}
+	remaining, _, err := planReplication(ctx, client, result.Source, result.Destination, options, job.Owner)
+	if err != nil {
+		return fmt.Errorf("couldn't verify the replica -> %s", err)
+	}
+	if len(remaining.Actions) > 0 {
+		return fmt.Errorf("the replica differs from the source after the replication -> %s", strings.TrimSpace(remaining.Actions[0].String()))
+	}
+	result.Verified = true
+	return nil
+}
+
+// ReplicateEvery runs Replicate at each interval until ctx is done, the
+// failures are logged and notified by Replicate and the plans of a dry run
+// are logged here
+func ReplicateEvery(ctx context.Context, interval time.Duration, job Job) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		result, err := Replicate(ctx, job)
+		if err == nil && job.DryRun {
+			log.Infof("Replication of %s to %s:%s would run %d actions (%s)", result.Source, result.To, result.Destination, len(result.Plan.Actions), core.FormatBytes(result.Plan.TotalBytes()))
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
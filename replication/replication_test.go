@@ -0,0 +1,168 @@
+/*
+   Copyright (c) 2022 Cyber Home Lab authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package replication
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	core "cyberhomelab.com/core/core"
+	sftptest "cyberhomelab.com/core/storage/sftptest"
+
+	"gotest.tools/assert"
+)
+
+func TestReplicate(t *testing.T) {
+	directoryPath := filepath.Join(os.TempDir(), "TestReplicate")
+	marsPath := filepath.Join(directoryPath, "mars")
+	phobosPath := filepath.Join(directoryPath, "phobos")
+	for _, relativePath := range []string{"a.txt", "sub/b.txt", ReplicaDirectoryName + "/phobos/c.txt"} {
+		filePath := filepath.Join(marsPath, filepath.FromSlash(relativePath))
+		assert.NilError(t, os.MkdirAll(filepath.Dir(filePath), core.DefaultMode))
+		assert.NilError(t, core.WriteToFile(filePath, relativePath))
+	}
+	assert.NilError(t, os.MkdirAll(phobosPath, core.DefaultMode))
+	keyPath := filepath.Join(directoryPath, "id_ed25519")
+	knownHostsPath := filepath.Join(directoryPath, "known_hosts")
+	address := sftptest.NewServer(t, keyPath, knownHostsPath)
+
+	config := &core.Config{}
+	config.Nodes.Mars.ServiceDirectory = marsPath
+	config.Nodes.Mars.UserSSHKey = keyPath
+	config.Nodes.Phobos.ServiceDirectory = phobosPath
+	config.Nodes.Phobos.Address = address
+	var messages []string
+	job := Job{
+		From:           "Mars",
+		To:             "Phobos",
+		Config:         config,
+		Delete:         true,
+		KnownHostsPath: knownHostsPath,
+		Notifier:       func(message string) error { messages = append(messages, message); return nil },
+	}
+	replicaPath := filepath.Join(phobosPath, ReplicaDirectoryName, "mars")
+
+	// A dry run changes nothing
+	job.DryRun = true
+	result, err := Replicate(context.Background(), job)
+	assert.NilError(t, err)
+	assert.Equal(t, result.Destination, replicaPath)
+	assert.Equal(t, len(result.Plan.Actions), 4)
+	_, err = os.Stat(replicaPath)
+	assert.Assert(t, os.IsNotExist(err))
+
+	// The replicas of the other nodes are left out
+	job.DryRun = false
+	result, err = Replicate(context.Background(), job)
+	assert.NilError(t, err)
+	assert.Equal(t, result.Verified, true)
+	assert.Equal(t, result.Copied, 2)
+	assert.Equal(t, result.Bytes, int64(len("a.txt")+len("sub/b.txt")))
+	content, err := core.ReadFile(filepath.Join(replicaPath, "sub", "b.txt"))
+	assert.NilError(t, err)
+	assert.Equal(t, content, "sub/b.txt")
+	_, err = os.Stat(filepath.Join(replicaPath, ReplicaDirectoryName))
+	assert.Assert(t, os.IsNotExist(err))
+	sourceStat, err := os.Stat(filepath.Join(marsPath, "a.txt"))
+	assert.NilError(t, err)
+	replicaStat, err := os.Stat(filepath.Join(replicaPath, "a.txt"))
+	assert.NilError(t, err)
+	assert.Equal(t, replicaStat.ModTime().Unix(), sourceStat.ModTime().Unix())
+
+	// Nothing changed
+	result, err = Replicate(context.Background(), job)
+	assert.NilError(t, err)
+	assert.Equal(t, len(result.Plan.Actions), 0)
+
+	// Only the changes are replicated, the content is compared with Checksum
+	assert.NilError(t, core.WriteToFile(filepath.Join(marsPath, "a.txt"), "A.TXT"))
+	assert.NilError(t, os.Chtimes(filepath.Join(marsPath, "a.txt"), time.Now(), sourceStat.ModTime()))
+	assert.NilError(t, os.Remove(filepath.Join(marsPath, "sub", "b.txt")))
+	result, err = Replicate(context.Background(), job)
+	assert.NilError(t, err)
+	assert.Equal(t, result.Copied, 0)
+	assert.Equal(t, result.Removed, 1)
+	job.Checksum = true
+	result, err = Replicate(context.Background(), job)
+	assert.NilError(t, err)
+	assert.Equal(t, result.Copied, 1)
+	content, err = core.ReadFile(filepath.Join(replicaPath, "a.txt"))
+	assert.NilError(t, err)
+	assert.Equal(t, content, "A.TXT")
+
+	// The failures are notified
+	job.To = "Mars"
+	_, err = Replicate(context.Background(), job)
+	assert.ErrorContains(t, err, "can't replicate node Mars to itself")
+	assert.Equal(t, len(messages), 1)
+
+	// Cleanup
+	assert.NilError(t, core.Remove(directoryPath))
+}
+
+func TestReplicateSpecialFiles(t *testing.T) {
+	directoryPath := filepath.Join(os.TempDir(), "TestReplicateSpecialFiles")
+	marsPath := filepath.Join(directoryPath, "mars")
+	phobosPath := filepath.Join(directoryPath, "phobos")
+	assert.NilError(t, os.MkdirAll(marsPath, core.DefaultMode))
+	assert.NilError(t, os.MkdirAll(phobosPath, core.DefaultMode))
+	assert.NilError(t, core.WriteToFile(filepath.Join(marsPath, "a.txt"), "a"))
+	assert.NilError(t, core.WriteToFile(filepath.Join(marsPath, "b.txt"), "b"))
+	assert.NilError(t, os.Symlink("a.txt", filepath.Join(marsPath, "link")))
+	assert.NilError(t, syscall.Mkfifo(filepath.Join(marsPath, "fifo"), 0600))
+	keyPath := filepath.Join(directoryPath, "id_ed25519")
+	knownHostsPath := filepath.Join(directoryPath, "known_hosts")
+	address := sftptest.NewServer(t, keyPath, knownHostsPath)
+
+	config := &core.Config{}
+	config.Nodes.Mars.ServiceDirectory = marsPath
+	config.Nodes.Mars.UserSSHKey = keyPath
+	config.Nodes.Phobos.ServiceDirectory = phobosPath
+	config.Nodes.Phobos.Address = address
+	job := Job{From: "Mars", To: "Phobos", Config: config, Delete: true, KnownHostsPath: knownHostsPath}
+	replicaPath := filepath.Join(phobosPath, ReplicaDirectoryName, "mars")
+
+	// The symlink is replicated and the FIFO is skipped with a warning
+	result, err := Replicate(context.Background(), job)
+	assert.NilError(t, err)
+	assert.Equal(t, result.Verified, true)
+	assert.Equal(t, len(result.Warnings), 1)
+	assert.Assert(t, strings.Contains(result.Warnings[0], "fifo"))
+	linkName, err := os.Readlink(filepath.Join(replicaPath, "link"))
+	assert.NilError(t, err)
+	assert.Equal(t, linkName, "a.txt")
+	_, err = os.Lstat(filepath.Join(replicaPath, "fifo"))
+	assert.Assert(t, os.IsNotExist(err))
+
+	// A symlink pointing somewhere else is replaced
+	assert.NilError(t, os.Remove(filepath.Join(marsPath, "link")))
+	assert.NilError(t, os.Symlink("b.txt", filepath.Join(marsPath, "link")))
+	result, err = Replicate(context.Background(), job)
+	assert.NilError(t, err)
+	assert.Equal(t, result.Verified, true)
+	linkName, err = os.Readlink(filepath.Join(replicaPath, "link"))
+	assert.NilError(t, err)
+	assert.Equal(t, linkName, "b.txt")
+
+	// Cleanup
+	assert.NilError(t, core.Remove(directoryPath))
+}
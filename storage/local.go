@@ -0,0 +1,110 @@
+/*
+   Copyright (c) 2022 Cyber Home Lab authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	core "cyberhomelab.com/core/core"
+)
+
+// Local stores the files in a local directory, like a mounted USB disk
+type Local struct {
+	directoryPath string
+}
+
+func NewLocal(directoryPath string) *Local {
+	return &Local{directoryPath: directoryPath}
+}
+
+func (l *Local) path(name string) string {
+	return filepath.Join(l.directoryPath, filepath.FromSlash(cleanName(name)))
+}
+
+func (l *Local) Put(ctx context.Context, name string, reader io.Reader) error {
+	filePath := l.path(name)
+	err := os.MkdirAll(filepath.Dir(filePath), core.DefaultMode)
+	if err != nil {
+		return fmt.Errorf("couldn't create directory %s -> %s", filepath.Dir(filePath), err)
+	}
+	file, err := ioutil.TempFile(filepath.Dir(filePath), ".put-*")
+	if err != nil {
+		return fmt.Errorf("couldn't create a temporary file in %s -> %s", filepath.Dir(filePath), err)
+	}
+	_, err = io.Copy(file, core.NewContextReader(ctx, reader))
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), filePath)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return fmt.Errorf("couldn't write %s -> %s", filePath, err)
+	}
+	return nil
+}
+
+func (l *Local) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	return os.Open(l.path(name))
+}
+
+func (l *Local) Stat(ctx context.Context, name string) (FileInfo, error) {
+	info, err := os.Stat(l.path(name))
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return FileInfo{Name: info.Name(), Size: info.Size(), ModTime: info.ModTime(), IsDirectory: info.IsDir()}, nil
+}
+
+func (l *Local) List(ctx context.Context, name string) ([]FileInfo, error) {
+	infos, err := ioutil.ReadDir(l.path(name))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't list directory %s -> %s", l.path(name), err)
+	}
+	var files []FileInfo
+	for _, info := range infos {
+		files = append(files, FileInfo{Name: info.Name(), Size: info.Size(), ModTime: info.ModTime(), IsDirectory: info.IsDir()})
+	}
+	return files, nil
+}
+
+func (l *Local) Delete(ctx context.Context, name string) error {
+	return os.Remove(l.path(name))
+}
+
+func (l *Local) Type() string {
+	return LocalType
+}
+
+// Path is the absolute path of the directory
+func (l *Local) Path() string {
+	directoryPath, err := filepath.Abs(l.directoryPath)
+	if err != nil {
+		return l.directoryPath
+	}
+	return directoryPath
+}
@@ -0,0 +1,292 @@
+/*
+   Copyright (c) 2022 Cyber Home Lab authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	core "cyberhomelab.com/core/core"
+
+	sftp "github.com/pkg/sftp"
+	ssh "golang.org/x/crypto/ssh"
+	knownhosts "golang.org/x/crypto/ssh/knownhosts"
+)
+
+// DefaultSSHPort is used when the address of an SFTP storage has no port
+const DefaultSSHPort = "22"
+
+type SFTPOptions struct {
+	// Address is a host with an optional port
+	Address string
+	// User is the current user when empty
+	User string
+	// KeyPath is the private key used to log in, like the UserSSHKey of a
+	// node
+	KeyPath string
+	// KnownHostsPath checks the key of the server, it is ~/.ssh/known_hosts
+	// when empty
+	KnownHostsPath string
+	// Directory holds the files on the server, a relative one starts in the
+	// home directory of the user
+	Directory string
+	// Timeout of the connection, 30 seconds when it is 0
+	Timeout time.Duration
+}
+
+// SFTP stores the files on another host over SSH, the connection is opened
+// on the first use and is kept until Close
+type SFTP struct {
+	options   SFTPOptions
+	mutex     sync.Mutex
+	sshClient *ssh.Client
+	client    *sftp.Client
+}
+
+func NewSFTP(options SFTPOptions) *SFTP {
+	if _, _, err := net.SplitHostPort(options.Address); err != nil {
+		options.Address = net.JoinHostPort(options.Address, DefaultSSHPort)
+	}
+	if options.User == "" {
+		if currentUser, err := user.Current(); err == nil {
+			options.User = currentUser.Username
+		}
+	}
+	if options.Directory == "" {
+		options.Directory = "."
+	}
+	if options.Timeout == 0 {
+		options.Timeout = 30 * time.Second
+	}
+	return &SFTP{options: options}
+}
+
+// connect returns the SFTP client, a new connection is opened when there is
+// none
+func (s *SFTP) connect() (*sftp.Client, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.client != nil {
+		return s.client, nil
+	}
+	key, err := ioutil.ReadFile(s.options.KeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read SSH key %s -> %s", s.options.KeyPath, err)
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse SSH key %s -> %s", s.options.KeyPath, err)
+	}
+	knownHostsPath := s.options.KnownHostsPath
+	if knownHostsPath == "" {
+		homePath, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("couldn't find the home directory -> %s", err)
+		}
+		knownHostsPath = filepath.Join(homePath, ".ssh", "known_hosts")
+	}
+	hostKeyCallback, err := knownhosts.New(knownHostsPath)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read known hosts %s -> %s", knownHostsPath, err)
+	}
+	sshConfig := &ssh.ClientConfig{
+		User:            s.options.User,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         s.options.Timeout,
+	}
+	sshClient, err := ssh.Dial("tcp", s.options.Address, sshConfig)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't connect to %s -> %s", s.options.Address, err)
+	}
+	client, err := sftp.NewClient(sshClient)
+	if err != nil {
+		sshClient.Close()
+		return nil, fmt.Errorf("couldn't start SFTP on %s -> %s", s.options.Address, err)
+	}
+	s.sshClient = sshClient
+	s.client = client
+
+	// A connection closed by the server or the network isn't used again
+	go func() {
+		client.Wait()
+		s.reset(client)
+	}()
+	return client, nil
+}
+
+// reset forgets client when it is still the client of the connection
+func (s *SFTP) reset(client *sftp.Client) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.client != client {
+		return
+	}
+	s.client.Close()
+	s.sshClient.Close()
+	s.client = nil
+	s.sshClient = nil
+}
+
+// withClient runs operation with the SFTP client, when the connection is lost
+// it is opened again and operation runs once more
+func (s *SFTP) withClient(operation func(client *sftp.Client) error) error {
+	client, err := s.connect()
+	if err != nil {
+		return err
+	}
+	err = operation(client)
+	if !isConnectionLost(err) {
+		return err
+	}
+	s.reset(client)
+	client, err = s.connect()
+	if err != nil {
+		return err
+	}
+	return operation(client)
+}
+
+func isConnectionLost(err error) bool {
+	return errors.Is(err, sftp.ErrSSHFxConnectionLost) || errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed)
+}
+
+// Client returns the SFTP client of the connection, for what Storage
+// doesn't do
+func (s *SFTP) Client() (*sftp.Client, error) {
+	return s.connect()
+}
+
+// Close ends the connection, the next use opens a new one
+func (s *SFTP) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.client == nil {
+		return nil
+	}
+	s.client.Close()
+	err := s.sshClient.Close()
+	s.client = nil
+	s.sshClient = nil
+	return err
+}
+
+func (s *SFTP) path(name string) string {
+	return path.Join(s.options.Directory, cleanName(name))
+}
+
+// Put isn't run again when the connection is lost during the copy, the
+// reader was already consumed
+func (s *SFTP) Put(ctx context.Context, name string, reader io.Reader) error {
+	filePath := s.path(name)
+	temporaryPath := path.Join(path.Dir(filePath), ".put-"+path.Base(filePath))
+	var client *sftp.Client
+	var file *sftp.File
+	err := s.withClient(func(c *sftp.Client) error {
+		err := c.MkdirAll(path.Dir(filePath))
+		if err != nil {
+			return err
+		}
+		client = c
+		file, err = c.Create(temporaryPath)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't create %s on %s -> %s", temporaryPath, s.options.Address, err)
+	}
+	_, err = file.ReadFrom(core.NewContextReader(ctx, reader))
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = client.PosixRename(temporaryPath, filePath)
+	}
+	if err != nil {
+		client.Remove(temporaryPath)
+		return fmt.Errorf("couldn't write %s on %s -> %s", filePath, s.options.Address, err)
+	}
+	return nil
+}
+
+func (s *SFTP) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	var file *sftp.File
+	err := s.withClient(func(client *sftp.Client) error {
+		var err error
+		file, err = client.Open(s.path(name))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (s *SFTP) Stat(ctx context.Context, name string) (FileInfo, error) {
+	var info os.FileInfo
+	err := s.withClient(func(client *sftp.Client) error {
+		var err error
+		info, err = client.Stat(s.path(name))
+		return err
+	})
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return FileInfo{Name: info.Name(), Size: info.Size(), ModTime: info.ModTime(), IsDirectory: info.IsDir()}, nil
+}
+
+func (s *SFTP) List(ctx context.Context, name string) ([]FileInfo, error) {
+	var infos []os.FileInfo
+	err := s.withClient(func(client *sftp.Client) error {
+		var err error
+		infos, err = client.ReadDir(s.path(name))
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't list directory %s on %s -> %s", s.path(name), s.options.Address, err)
+	}
+	var files []FileInfo
+	for _, info := range infos {
+		files = append(files, FileInfo{Name: info.Name(), Size: info.Size(), ModTime: info.ModTime(), IsDirectory: info.IsDir()})
+	}
+	return files, nil
+}
+
+func (s *SFTP) Delete(ctx context.Context, name string) error {
+	return s.withClient(func(client *sftp.Client) error {
+		return client.Remove(s.path(name))
+	})
+}
+
+func (s *SFTP) Type() string {
+	return SFTPType
+}
+
+// Path is user@address:directory
+func (s *SFTP) Path() string {
+	return fmt.Sprintf("%s@%s:%s", s.options.User, s.options.Address, s.options.Directory)
+}
@@ -0,0 +1,171 @@
+/*
+   Copyright (c) 2022 Cyber Home Lab authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	core "cyberhomelab.com/core/core"
+	logging "cyberhomelab.com/core/logging"
+	nextcloud "cyberhomelab.com/core/nextcloud"
+)
+
+var log = logging.NewLogger()
+
+const (
+	LocalType     = "local"
+	SFTPType      = "sftp"
+	NextcloudType = "nextcloud"
+)
+
+// Storage is a place holding files, the names are slash separated and
+// relative to the root of the storage
+type Storage interface {
+	// Put writes what is read from reader to name, the parents are created
+	// and the file is replaced only once reader is fully read
+	Put(ctx context.Context, name string, reader io.Reader) error
+	// Get returns the content of name, it must be closed
+	Get(ctx context.Context, name string) (io.ReadCloser, error)
+	Stat(ctx context.Context, name string) (FileInfo, error)
+	// List returns the content of a directory, an empty name is the root
+	List(ctx context.Context, name string) ([]FileInfo, error)
+	Delete(ctx context.Context, name string) error
+	// Type and Path identify the storage, for example in the backup catalog
+	Type() string
+	Path() string
+}
+
+type FileInfo struct {
+	Name        string
+	Size        int64
+	ModTime     time.Time
+	IsDirectory bool
+}
+
+// String returns the type and the path of a storage for the logs
+func String(storage Storage) string {
+	return fmt.Sprintf("%s:%s", storage.Type(), storage.Path())
+}
+
+// cleanName keeps a name inside the root of the storage
+func cleanName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// PutFile copies a local file to name and checks the size of the copy
+func PutFile(ctx context.Context, storage Storage, filePath string, name string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("couldn't open %s -> %s", filePath, err)
+	}
+	defer file.Close()
+	fileStat, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("couldn't run os.Stat() -> %s", err)
+	}
+	log.Infof("Copying %s to %s", filePath, String(storage))
+	err = storage.Put(ctx, name, file)
+	if err != nil {
+		return err
+	}
+	info, err := storage.Stat(ctx, name)
+	if err != nil {
+		return err
+	}
+	if info.Size != fileStat.Size() {
+		return fmt.Errorf("size missmatch between %s (%d) and the copy in %s (%d)", filePath, fileStat.Size(), String(storage), info.Size)
+	}
+	return nil
+}
+
+// GetFile copies name to a local file
+func GetFile(ctx context.Context, storage Storage, name string, filePath string) error {
+	reader, err := storage.Get(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	file, err := os.Create(filePath)
+	if err != nil {
+		return fmt.Errorf("couldn't create file %s -> %s", filePath, err)
+	}
+	_, err = io.Copy(file, core.NewContextReader(ctx, reader))
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("couldn't copy %s from %s -> %s", name, String(storage), err)
+	}
+	return file.Close()
+}
+
+// FromConfig returns the storage of a BackupTargets entry of host: a local
+// directory, the Nextcloud of the config or sftp://node/directory where node
+// is a node of the config, an unknown node is an error. The SFTP targets log
+// in with the UserSSHKey of host
+func FromConfig(config *core.Config, host core.Host, target string) (Storage, error) {
+	switch {
+	case target == "nextcloud":
+		client, err := nextcloud.NewClient(*config)
+		if err != nil {
+			return nil, err
+		}
+		return NewWebDAV(client), nil
+	case filepath.IsAbs(target):
+		return NewLocal(target), nil
+	case strings.HasPrefix(target, "sftp://"):
+		targetURL, err := url.Parse(target)
+		if err != nil {
+			return nil, fmt.Errorf("invalid backup target %s -> %s", target, err)
+		}
+		options, err := NodeSFTPOptions(config, host, targetURL.Hostname())
+		if err != nil {
+			return nil, fmt.Errorf("invalid backup target %s -> %s", target, err)
+		}
+		if targetURL.Port() != "" {
+			options.Address = net.JoinHostPort(options.Address, targetURL.Port())
+		}
+		if targetURL.User.Username() != "" {
+			options.User = targetURL.User.Username()
+		}
+		options.Directory = targetURL.Path
+		return NewSFTP(options), nil
+	}
+	return nil, fmt.Errorf("unknown backup target %s", target)
+}
+
+// NodeSFTPOptions returns the options to reach a node of the config from
+// host, with the Address and the SSHUser of the node and the UserSSHKey of
+// host
+func NodeSFTPOptions(config *core.Config, host core.Host, node string) (SFTPOptions, error) {
+	nodeHost, err := config.GetNode(node)
+	if err != nil {
+		return SFTPOptions{}, err
+	}
+	options := SFTPOptions{Address: strings.ToLower(node), User: nodeHost.SSHUser, KeyPath: host.UserSSHKey}
+	if nodeHost.Address != "" {
+		options.Address = nodeHost.Address
+	}
+	return options, nil
+}
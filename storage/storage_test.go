@@ -0,0 +1,156 @@
+/*
+   Copyright (c) 2022 Cyber Home Lab authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package storage
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	core "cyberhomelab.com/core/core"
+	nextcloud "cyberhomelab.com/core/nextcloud"
+	sftptest "cyberhomelab.com/core/storage/sftptest"
+
+	"golang.org/x/net/webdav"
+	"gotest.tools/assert"
+)
+
+// testStorage runs the same checks against every storage
+func testStorage(t *testing.T, storage Storage) {
+	ctx := context.Background()
+	filePath := filepath.Join(os.TempDir(), "TestStorage.txt")
+	assert.NilError(t, core.WriteToFile(filePath, strings.Repeat("content ", 100)))
+	defer os.Remove(filePath)
+
+	// Put
+	assert.NilError(t, storage.Put(ctx, "streamed.txt", strings.NewReader("streamed")))
+	assert.NilError(t, PutFile(ctx, storage, filePath, "mars/file.txt"))
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	assert.Assert(t, storage.Put(cancelled, "cancelled.txt", strings.NewReader("cancelled")) != nil)
+
+	// Get and Stat
+	reader, err := storage.Get(ctx, "streamed.txt")
+	assert.NilError(t, err)
+	content, err := ioutil.ReadAll(reader)
+	assert.NilError(t, err)
+	assert.NilError(t, reader.Close())
+	assert.Equal(t, string(content), "streamed")
+	copyPath := filepath.Join(os.TempDir(), "TestStorage_copy.txt")
+	assert.NilError(t, GetFile(ctx, storage, "/mars/../mars/file.txt", copyPath))
+	defer os.Remove(copyPath)
+	copied, err := core.ReadFile(copyPath)
+	assert.NilError(t, err)
+	assert.Equal(t, copied, strings.Repeat("content ", 100))
+	info, err := storage.Stat(ctx, "mars/file.txt")
+	assert.NilError(t, err)
+	assert.Equal(t, info.Name, "file.txt")
+	assert.Equal(t, info.Size, int64(800))
+	_, err = storage.Stat(ctx, "notfound.txt")
+	assert.Assert(t, err != nil)
+
+	// List and Delete
+	files, err := storage.List(ctx, "")
+	assert.NilError(t, err)
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	assert.Equal(t, len(files), 2)
+	assert.Equal(t, files[0].Name, "mars")
+	assert.Equal(t, files[0].IsDirectory, true)
+	assert.Equal(t, files[1].Name, "streamed.txt")
+	assert.Equal(t, files[1].Size, int64(8))
+	assert.NilError(t, storage.Delete(ctx, "streamed.txt"))
+	assert.Assert(t, storage.Delete(ctx, "streamed.txt") != nil)
+	files, err = storage.List(ctx, "mars")
+	assert.NilError(t, err)
+	assert.Equal(t, len(files), 1)
+}
+
+func TestLocal(t *testing.T) {
+	directoryPath := filepath.Join(os.TempDir(), "TestLocal")
+	storage := NewLocal(directoryPath)
+	testStorage(t, storage)
+	assert.Equal(t, String(storage), "local:"+directoryPath)
+	assert.NilError(t, core.Remove(directoryPath))
+}
+
+func TestWebDAV(t *testing.T) {
+	directoryPath := filepath.Join(os.TempDir(), "TestWebDAV")
+	assert.NilError(t, os.MkdirAll(directoryPath, core.DefaultMode))
+	handler := &webdav.Handler{Prefix: "/remote.php/dav/files/user", FileSystem: webdav.Dir(directoryPath), LockSystem: webdav.NewMemLS()}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	client := &nextcloud.Client{BaseURL: server.URL, Directory: "Backups", User: "user", Password: "password", HTTPClient: http.DefaultClient}
+	storage := NewWebDAV(client)
+	testStorage(t, storage)
+	assert.Equal(t, String(storage), "nextcloud:Backups")
+	assert.NilError(t, core.Remove(directoryPath))
+}
+
+func TestSFTP(t *testing.T) {
+	directoryPath := filepath.Join(os.TempDir(), "TestSFTP")
+	assert.NilError(t, os.MkdirAll(directoryPath, core.DefaultMode))
+	keyPath := filepath.Join(directoryPath, "id_ed25519")
+	knownHostsPath := filepath.Join(directoryPath, "known_hosts")
+	address := sftptest.NewServer(t, keyPath, knownHostsPath)
+
+	storage := NewSFTP(SFTPOptions{Address: address, User: "backup", KeyPath: keyPath, KnownHostsPath: knownHostsPath, Directory: filepath.Join(directoryPath, "files")})
+	defer storage.Close()
+	testStorage(t, storage)
+	assert.Equal(t, storage.Path(), "backup@"+address+":"+filepath.Join(directoryPath, "files"))
+
+	// A lost connection is opened again
+	assert.NilError(t, storage.Put(context.Background(), "file", strings.NewReader("content")))
+	storage.sshClient.Close()
+	info, err := storage.Stat(context.Background(), "file")
+	assert.NilError(t, err)
+	assert.Equal(t, info.Size, int64(7))
+
+	// The key of the server is checked
+	assert.NilError(t, core.WriteToFile(knownHostsPath, ""))
+	other := NewSFTP(SFTPOptions{Address: address, KeyPath: keyPath, KnownHostsPath: knownHostsPath})
+	_, err = other.List(context.Background(), "")
+	assert.ErrorContains(t, err, "couldn't connect to "+address)
+	assert.NilError(t, core.Remove(directoryPath))
+}
+
+func TestFromConfig(t *testing.T) {
+	var config core.Config
+	config.Nodes.Phobos.Address = "10.0.0.2"
+	config.Nodes.Phobos.SSHUser = "backup"
+	host := core.Host{UserSSHKey: "/root/.ssh/id_ed25519"}
+
+	storage, err := FromConfig(&config, host, "/mnt/usb")
+	assert.NilError(t, err)
+	assert.Equal(t, String(storage), "local:/mnt/usb")
+	storage, err = FromConfig(&config, host, "sftp://phobos/srv/backups")
+	assert.NilError(t, err)
+	assert.Equal(t, String(storage), "sftp:backup@10.0.0.2:22:/srv/backups")
+	assert.Equal(t, storage.(*SFTP).options.KeyPath, "/root/.ssh/id_ed25519")
+	storage, err = FromConfig(&config, host, "sftp://admin@phobos:2222/backups")
+	assert.NilError(t, err)
+	assert.Equal(t, String(storage), "sftp:admin@10.0.0.2:2222:/backups")
+	_, err = FromConfig(&config, host, "sftp://nas.local/backups")
+	assert.ErrorContains(t, err, "node nas.local is not in the config")
+	_, err = FromConfig(&config, host, "backups")
+	assert.ErrorContains(t, err, "unknown backup target backups")
+}
@@ -0,0 +1,88 @@
+/*
+   Copyright (c) 2022 Cyber Home Lab authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package storage
+
+import (
+	"context"
+	"io"
+	"os"
+
+	core "cyberhomelab.com/core/core"
+	nextcloud "cyberhomelab.com/core/nextcloud"
+)
+
+// WebDAV stores the files in the upload directory of a Nextcloud client,
+// its type is NextcloudType so the catalogs written before it stay valid
+type WebDAV struct {
+	client *nextcloud.Client
+}
+
+func NewWebDAV(client *nextcloud.Client) *WebDAV {
+	return &WebDAV{client: client}
+}
+
+// Put uses the chunked and verified upload of the client for a local file
+// and a single streamed request for any other reader
+func (w *WebDAV) Put(ctx context.Context, name string, reader io.Reader) error {
+	name = cleanName(name)
+	if file, ok := reader.(*os.File); ok {
+		_, err := w.client.Upload(ctx, file.Name(), name)
+		return err
+	}
+	return w.client.Put(ctx, name, core.NewContextReader(ctx, reader))
+}
+
+func (w *WebDAV) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	return w.client.Open(ctx, cleanName(name))
+}
+
+func (w *WebDAV) Stat(ctx context.Context, name string) (FileInfo, error) {
+	remoteFile, err := w.client.Stat(ctx, cleanName(name))
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return remoteFileInfo(remoteFile), nil
+}
+
+func (w *WebDAV) List(ctx context.Context, name string) ([]FileInfo, error) {
+	remoteFiles, err := w.client.List(ctx, cleanName(name))
+	if err != nil {
+		return nil, err
+	}
+	var files []FileInfo
+	for _, remoteFile := range remoteFiles {
+		files = append(files, remoteFileInfo(remoteFile))
+	}
+	return files, nil
+}
+
+func (w *WebDAV) Delete(ctx context.Context, name string) error {
+	return w.client.Delete(ctx, cleanName(name))
+}
+
+func (w *WebDAV) Type() string {
+	return NextcloudType
+}
+
+// Path is the upload directory of the client
+func (w *WebDAV) Path() string {
+	return w.client.Directory
+}
+
+func remoteFileInfo(remoteFile nextcloud.RemoteFile) FileInfo {
+	return FileInfo{Name: remoteFile.Name, Size: remoteFile.Size, ModTime: remoteFile.ModTime, IsDirectory: remoteFile.IsDirectory}
+}
@@ -27,11 +27,14 @@ import (
 	"strings"
 
 	core "cyberhomelab.com/core/core"
-	logging "cyberhomelab.com/core/core"
+	logging "cyberhomelab.com/core/logging"
 )
 
 var (
 	Token string
+	// tokenErr is returned by the requests when there is no token, so the
+	// packages notifying with SendMessage work without it
+	tokenErr error
 	// Hostname    core.Hostname
 	// ServiceName core.ServiceName
 	Config core.Config
@@ -79,12 +82,7 @@ func getEnvVariable(env string) (string, error) {
 }
 
 func init() {
-	var err error
-	Token, err = getEnvVariable("TELEGRAM_TOKEN")
-	if err != nil {
-		fmt.Printf("%s", err)
-		os.Exit(2)
-	}
+	Token, tokenErr = getEnvVariable("TELEGRAM_TOKEN")
 }
 
 func getUrl() string {
@@ -114,6 +112,10 @@ func convertToBody(input io.ReadCloser) (Body, error) {
 } 
 
 func GetMessages() (Body, error) {
+	if tokenErr != nil {
+		return Body{}, tokenErr
+	}
+
 	// Get the messages
 	url := fmt.Sprintf("%s/getUpdates", getUrl())
 	response, err := http.Post(url, "application/json", nil)
@@ -155,6 +157,9 @@ func GetLastMessage() (string, error) {
 func SendMessage(text string) error {
 	var err error
 	var response *http.Response
+	if tokenErr != nil {
+		return tokenErr
+	}
 
 	// Send the message
 	url := fmt.Sprintf("%s/sendMessage", getUrl())